@@ -2,29 +2,69 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var (
-	cfgFile string
-	verbose bool
+	cfgFile  string
+	verbose  bool
+	output   string
+	logLevel string
 )
 
+// envPrefix is the prefix for environment variable overrides
+const envPrefix = "MYAPP"
+
+// flagBindings maps config keys to the flags bound to them
+var flagBindings = map[string]*pflag.Flag{}
+
+// bindFlag binds a flag to a config key and remembers the binding so the
+// origin of the value can be reported
+func bindFlag(key string, flag *pflag.Flag) {
+	flagBindings[key] = flag
+	viper.BindPFlag(key, flag)
+}
+
+// currentConfigVersion is the config schema version this build understands.
+// Files without a version field predate versioning and are version 1.
+const currentConfigVersion = 2
+
 // Config represents application configuration
 type Config struct {
-	Server ServerConfig `mapstructure:"server"`
-	Log    LogConfig    `mapstructure:"log"`
+	Version int          `mapstructure:"version"`
+	Server  ServerConfig `mapstructure:"server"`
+	Log     LogConfig    `mapstructure:"log"`
+	Client  ClientConfig `mapstructure:"client"`
 }
 
+// ServerConfig configures the HTTP server. Timeouts accept Go duration
+// strings such as "20s"; zero disables a timeout.
 type ServerConfig struct {
-	Host string `mapstructure:"host"`
-	Port int    `mapstructure:"port"`
+	Host         string        `mapstructure:"host"`
+	Port         int           `mapstructure:"port"`
+	ReadTimeout  time.Duration `mapstructure:"read_timeout"`
+	WriteTimeout time.Duration `mapstructure:"write_timeout"`
+	IdleTimeout  time.Duration `mapstructure:"idle_timeout"`
 }
 
 type LogConfig struct {
@@ -32,6 +72,11 @@ type LogConfig struct {
 	Format string `mapstructure:"format"`
 }
 
+type ClientConfig struct {
+	BaseURL string        `mapstructure:"base_url"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
 // rootCmd represents the base command
 var rootCmd = &cobra.Command{
 	Use:   "myapp",
@@ -65,9 +110,12 @@ var configShowCmd = &cobra.Command{
 			return err
 		}
 
-		fmt.Printf("Configuration:\n")
+		fmt.Printf("Configuration (version %d):\n", cfg.Version)
 		fmt.Printf("  Server Host: %s\n", cfg.Server.Host)
 		fmt.Printf("  Server Port: %d\n", cfg.Server.Port)
+		fmt.Printf("  Server Read Timeout:  %v\n", cfg.Server.ReadTimeout)
+		fmt.Printf("  Server Write Timeout: %v\n", cfg.Server.WriteTimeout)
+		fmt.Printf("  Server Idle Timeout:  %v\n", cfg.Server.IdleTimeout)
 		fmt.Printf("  Log Level:   %s\n", cfg.Log.Level)
 		fmt.Printf("  Log Format:  %s\n", cfg.Log.Format)
 
@@ -93,8 +141,12 @@ var configInitCmd = &cobra.Command{
 		}
 
 		// Set defaults
+		viper.Set("version", currentConfigVersion)
 		viper.SetDefault("server.host", "localhost")
 		viper.SetDefault("server.port", 8080)
+		viper.SetDefault("server.read_timeout", "15s")
+		viper.SetDefault("server.write_timeout", "15s")
+		viper.SetDefault("server.idle_timeout", "60s")
 		viper.SetDefault("log.level", "info")
 		viper.SetDefault("log.format", "json")
 
@@ -108,6 +160,198 @@ var configInitCmd = &cobra.Command{
 	},
 }
 
+// configMigrations upgrade raw config file settings from version N to N+1,
+// keyed by N
+var configMigrations = map[int]func(settings map[string]interface{}){
+	// v2 introduced the version field and renamed the "console" log format
+	// to "text", after the slog handler it selects
+	1: func(settings map[string]interface{}) {
+		logSettings, ok := settings["log"].(map[string]interface{})
+		if ok && logSettings["format"] == "console" {
+			logSettings["format"] = "text"
+		}
+	},
+}
+
+// configVersion returns the schema version recorded in raw settings
+func configVersion(settings map[string]interface{}) (int, error) {
+	switch v := settings["version"].(type) {
+	case nil:
+		return 1, nil
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	default:
+		return 0, fmt.Errorf("invalid config version %v", v)
+	}
+}
+
+// migrateConfig upgrades settings in place to currentConfigVersion and
+// returns the version they started at. Files from a newer version are
+// rejected rather than guessed at.
+func migrateConfig(settings map[string]interface{}) (int, error) {
+	from, err := configVersion(settings)
+	if err != nil {
+		return 0, err
+	}
+	if from > currentConfigVersion {
+		return from, fmt.Errorf("config version %d is newer than this build supports (%d); upgrade myapp", from, currentConfigVersion)
+	}
+
+	for version := from; version < currentConfigVersion; version++ {
+		migrate, ok := configMigrations[version]
+		if !ok {
+			return from, fmt.Errorf("no migration from config version %d", version)
+		}
+		migrate(settings)
+	}
+
+	settings["version"] = currentConfigVersion
+	return from, nil
+}
+
+// readMigratedConfig reads only the config file at path, without defaults
+// or overrides, and migrates it to the current schema
+func readMigratedConfig(path string) (map[string]interface{}, int, error) {
+	fileValues := viper.New()
+	fileValues.SetConfigFile(path)
+	if err := fileValues.ReadInConfig(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	settings := fileValues.AllSettings()
+	from, err := migrateConfig(settings)
+	if err != nil {
+		return nil, from, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, from, nil
+}
+
+// configMigrateCmd rewrites an older config file in the current schema
+var configMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the config file to the current schema version",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := viper.ConfigFileUsed()
+		if path == "" {
+			return fmt.Errorf("no config file found")
+		}
+
+		from, err := migrateConfigFile(path)
+		if err != nil {
+			return err
+		}
+		if from == currentConfigVersion {
+			fmt.Fprintf(cmd.OutOrStdout(), "%s is already at version %d\n", path, currentConfigVersion)
+			return nil
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Migrated %s from version %d to %d\n", path, from, currentConfigVersion)
+		return nil
+	},
+}
+
+// migrateConfigFile rewrites the config file at path in the current schema
+// and returns the version it started at. Files already current are left
+// untouched.
+func migrateConfigFile(path string) (int, error) {
+	settings, from, err := readMigratedConfig(path)
+	if err != nil || from == currentConfigVersion {
+		return from, err
+	}
+
+	migrated := viper.New()
+	if err := migrated.MergeConfigMap(settings); err != nil {
+		return from, err
+	}
+	if err := migrated.WriteConfigAs(path); err != nil {
+		return from, fmt.Errorf("failed to write migrated config: %w", err)
+	}
+	return from, nil
+}
+
+// applyConfigMigrations upgrades the settings v read from its config file
+// in memory. The file's own version is kept so `config show` reports what is
+// on disk until `config migrate` writes the upgrade back.
+func applyConfigMigrations(v *viper.Viper) (int, error) {
+	settings, from, err := readMigratedConfig(v.ConfigFileUsed())
+	if err != nil {
+		return from, err
+	}
+	settings["version"] = from
+	return from, v.MergeConfigMap(settings)
+}
+
+// ConfigSource describes where an effective config value came from
+type ConfigSource struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Origin string      `json:"origin"` // flag, env, file, or default
+}
+
+// envVarForKey returns the environment variable that overrides key
+func envVarForKey(key string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// configSources reports each config key's effective value and origin by
+// probing the sources in Viper's precedence order: flag, env, file, default
+func configSources() ([]ConfigSource, error) {
+	fileValues := viper.New()
+	if path := viper.ConfigFileUsed(); path != "" {
+		fileValues.SetConfigFile(path)
+		if err := fileValues.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+
+	keys := viper.AllKeys()
+	sort.Strings(keys)
+
+	sources := make([]ConfigSource, 0, len(keys))
+	for _, key := range keys {
+		origin := "default"
+		if flag, ok := flagBindings[key]; ok && flag.Changed {
+			origin = "flag"
+		} else if _, ok := os.LookupEnv(envVarForKey(key)); ok {
+			origin = "env"
+		} else if fileValues.IsSet(key) {
+			origin = "file"
+		}
+
+		sources = append(sources, ConfigSource{Key: key, Value: viper.Get(key), Origin: origin})
+	}
+	return sources, nil
+}
+
+// configSourcesCmd reports where each config value came from
+var configSourcesCmd = &cobra.Command{
+	Use:   "sources",
+	Short: "Show each config value and where it came from",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sources, err := configSources()
+		if err != nil {
+			return err
+		}
+
+		if output == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			return enc.Encode(sources)
+		}
+
+		tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "KEY\tVALUE\tORIGIN")
+		for _, src := range sources {
+			fmt.Fprintf(tw, "%s\t%v\t%s\n", src.Key, src.Value, src.Origin)
+		}
+		return tw.Flush()
+	},
+}
+
 // serverCmd represents the server command group
 var serverCmd = &cobra.Command{
 	Use:   "server",
@@ -124,16 +368,49 @@ var serverStartCmd = &cobra.Command{
 			return err
 		}
 
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("OK"))
+		})
+		srv := newHTTPServer(cfg.Server, mux)
+
 		if verbose {
-			fmt.Printf("Starting server on %s:%d\n", cfg.Server.Host, cfg.Server.Port)
+			fmt.Printf("Starting server on %s (read timeout %v, write timeout %v, idle timeout %v)\n",
+				srv.Addr, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
 		}
 
-		// Server start logic would go here
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- srv.ListenAndServe()
+		}()
 		fmt.Println("Server started successfully")
-		return nil
+
+		select {
+		case err := <-errCh:
+			return err
+		case <-ctx.Done():
+		}
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
 	},
 }
 
+// newHTTPServer builds the server `server start` runs from its config
+func newHTTPServer(cfg ServerConfig, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Handler:      handler,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+}
+
 // userCmd represents the user command group
 var userCmd = &cobra.Command{
 	Use:   "user",
@@ -200,22 +477,263 @@ var userListCmd = &cobra.Command{
 	},
 }
 
+// APIUser mirrors the user resource returned by the REST API
+type APIUser struct {
+	ID        string    `json:"id"`
+	FirstName string    `json:"first_name"`
+	LastName  string    `json:"last_name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIError is a non-2xx response from the server, carrying its error body
+type APIError struct {
+	StatusCode int
+	Title      string `json:"title"`
+	Detail     string `json:"detail"`
+	Body       string `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	switch {
+	case e.Detail != "":
+		return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Detail)
+	case e.Body != "":
+		return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Body)
+	default:
+		return fmt.Sprintf("server returned %d", e.StatusCode)
+	}
+}
+
+// APIClient calls the REST API at a configured base URL
+type APIClient struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewAPIClient creates a client from configuration
+func NewAPIClient(cfg ClientConfig) *APIClient {
+	return &APIClient{
+		baseURL: strings.TrimRight(cfg.BaseURL, "/"),
+		http:    &http.Client{Timeout: cfg.Timeout},
+	}
+}
+
+// do sends a JSON request and decodes a JSON response into out
+func (c *APIClient) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Detail == "" {
+			apiErr.Body = strings.TrimSpace(string(data))
+		}
+		return apiErr
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// GetUser fetches a single user
+func (c *APIClient) GetUser(ctx context.Context, id string) (*APIUser, error) {
+	var user APIUser
+	if err := c.do(ctx, http.MethodGet, "/api/v1/users/"+url.PathEscape(id), nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// CreateUser creates a user
+func (c *APIClient) CreateUser(ctx context.Context, user *APIUser) (*APIUser, error) {
+	var created APIUser
+	if err := c.do(ctx, http.MethodPost, "/api/v1/users", user, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// ListUsers fetches one page of users
+func (c *APIClient) ListUsers(ctx context.Context, page, pageSize int) ([]APIUser, error) {
+	var resp struct {
+		Data []APIUser `json:"data"`
+	}
+	path := fmt.Sprintf("/api/v1/users?page=%d&page_size=%d", page, pageSize)
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// printUser writes a single user to w in the format selected by --output.
+// JSON output is the user object.
+func printUser(w io.Writer, user APIUser) error {
+	return printResult(w, user, []APIUser{user})
+}
+
+// printUsers writes a list of users to w in the format selected by
+// --output. JSON output is always an array, even for one or no users.
+func printUsers(w io.Writer, users []APIUser) error {
+	if users == nil {
+		users = []APIUser{}
+	}
+	return printResult(w, users, users)
+}
+
+// printResult encodes v as JSON, or prints users as text rows
+func printResult(w io.Writer, v interface{}, users []APIUser) error {
+	switch output {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "text", "":
+		for _, u := range users {
+			fmt.Fprintf(w, "%s\t%s %s\t%s\n", u.ID, u.FirstName, u.LastName, u.Email)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported output format: %s", output)
+	}
+}
+
+// newClientFromConfig builds an API client from the loaded configuration
+func newClientFromConfig() (*APIClient, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return NewAPIClient(cfg.Client), nil
+}
+
+// clientCmd represents the API client command group
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Call a running server's API",
+}
+
+// clientUserCmd groups user API calls
+var clientUserCmd = &cobra.Command{
+	Use:   "user",
+	Short: "User API calls",
+}
+
+var clientUserGetCmd = &cobra.Command{
+	Use:   "get [id]",
+	Short: "Get a user by ID",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newClientFromConfig()
+		if err != nil {
+			return err
+		}
+
+		user, err := client.GetUser(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		return printUser(cmd.OutOrStdout(), *user)
+	},
+}
+
+var (
+	clientFirstName string
+	clientLastName  string
+	clientEmail     string
+	clientPage      int
+	clientPageSize  int
+)
+
+var clientUserCreateCmd = &cobra.Command{
+	Use:     "create",
+	Short:   "Create a user",
+	Example: `  myapp client user create --first-name Jane --last-name Doe --email jane@example.com`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newClientFromConfig()
+		if err != nil {
+			return err
+		}
+
+		user, err := client.CreateUser(cmd.Context(), &APIUser{
+			FirstName: clientFirstName,
+			LastName:  clientLastName,
+			Email:     clientEmail,
+		})
+		if err != nil {
+			return err
+		}
+		return printUser(cmd.OutOrStdout(), *user)
+	},
+}
+
+var clientUserListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List users",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := newClientFromConfig()
+		if err != nil {
+			return err
+		}
+
+		users, err := client.ListUsers(cmd.Context(), clientPage, clientPageSize)
+		if err != nil {
+			return err
+		}
+		return printUsers(cmd.OutOrStdout(), users)
+	},
+}
+
 func init() {
 	cobra.OnInitialize(initConfig)
 
 	// Global flags
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.myapp/config.yaml)")
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	rootCmd.PersistentFlags().StringVarP(&output, "output", "o", "text", "output format (text, json)")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "log level (overrides log.level)")
+	bindFlag("log.level", rootCmd.PersistentFlags().Lookup("log-level"))
 
 	// Add commands
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(configCmd)
 	rootCmd.AddCommand(serverCmd)
 	rootCmd.AddCommand(userCmd)
+	rootCmd.AddCommand(clientCmd)
 
 	// Config subcommands
 	configCmd.AddCommand(configShowCmd)
 	configCmd.AddCommand(configInitCmd)
+	configCmd.AddCommand(configSourcesCmd)
+	configCmd.AddCommand(configMigrateCmd)
 
 	// Server subcommands
 	serverCmd.AddCommand(serverStartCmd)
@@ -228,6 +746,20 @@ func init() {
 	userCreateCmd.Flags().StringVar(&userEmail, "email", "", "user email (required)")
 	userCreateCmd.Flags().StringVar(&userRole, "role", "user", "user role (user, admin)")
 	userCreateCmd.MarkFlagRequired("email")
+
+	// Client subcommands
+	clientCmd.AddCommand(clientUserCmd)
+	clientUserCmd.AddCommand(clientUserGetCmd)
+	clientUserCmd.AddCommand(clientUserCreateCmd)
+	clientUserCmd.AddCommand(clientUserListCmd)
+
+	clientUserCreateCmd.Flags().StringVar(&clientFirstName, "first-name", "", "first name")
+	clientUserCreateCmd.Flags().StringVar(&clientLastName, "last-name", "", "last name")
+	clientUserCreateCmd.Flags().StringVar(&clientEmail, "email", "", "email (required)")
+	clientUserCreateCmd.MarkFlagRequired("email")
+
+	clientUserListCmd.Flags().IntVar(&clientPage, "page", 1, "page number")
+	clientUserListCmd.Flags().IntVar(&clientPageSize, "page-size", 20, "users per page")
 }
 
 func initConfig() {
@@ -247,21 +779,37 @@ func initConfig() {
 	}
 
 	// Environment variables
-	viper.SetEnvPrefix("MYAPP")
+	viper.SetEnvPrefix(envPrefix)
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
 
 	// Set defaults
 	viper.SetDefault("server.host", "localhost")
 	viper.SetDefault("server.port", 8080)
+	viper.SetDefault("server.read_timeout", "15s")
+	viper.SetDefault("server.write_timeout", "15s")
+	viper.SetDefault("server.idle_timeout", "60s")
 	viper.SetDefault("log.level", "info")
 	viper.SetDefault("log.format", "json")
+	viper.SetDefault("client.base_url", "http://localhost:8080")
+	viper.SetDefault("client.timeout", "10s")
 
 	// Read config file (ignore if not found)
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			fmt.Fprintf(os.Stderr, "Error reading config: %v\n", err)
 		}
+		return
+	}
+
+	// Upgrade older files in memory; `config migrate` writes the result back
+	from, err := applyConfigMigrations(viper.GetViper())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if from < currentConfigVersion {
+		fmt.Fprintf(os.Stderr, "Warning: config file is version %d; run `myapp config migrate` to upgrade it to %d\n", from, currentConfigVersion)
 	}
 }
 
@@ -275,6 +823,15 @@ func loadConfig() (*Config, error) {
 	if cfg.Server.Port < 1 || cfg.Server.Port > 65535 {
 		return nil, fmt.Errorf("invalid port: %d", cfg.Server.Port)
 	}
+	for key, timeout := range map[string]time.Duration{
+		"server.read_timeout":  cfg.Server.ReadTimeout,
+		"server.write_timeout": cfg.Server.WriteTimeout,
+		"server.idle_timeout":  cfg.Server.IdleTimeout,
+	} {
+		if timeout < 0 {
+			return nil, fmt.Errorf("invalid %s: %v must not be negative", key, timeout)
+		}
+	}
 
 	return &cfg, nil
 }
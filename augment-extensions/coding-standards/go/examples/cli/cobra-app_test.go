@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// runCLI executes the root command with args against an empty home
+// directory and returns what it wrote to stdout
+func runCLI(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+
+	var out bytes.Buffer
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(io.Discard)
+	rootCmd.SetArgs(args)
+	t.Cleanup(func() { rootCmd.SetArgs(nil) })
+
+	err := rootCmd.Execute()
+	return out.String(), err
+}
+
+// newUserAPI serves the user endpoints the client commands call
+func newUserAPI(t *testing.T, users []APIUser) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/users", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": users})
+	})
+	mux.HandleFunc("GET /api/v1/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		for _, u := range users {
+			if u.ID == r.PathValue("id") {
+				json.NewEncoder(w).Encode(u)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"title": "Not Found", "detail": "user " + r.PathValue("id") + " not found"})
+	})
+	mux.HandleFunc("POST /api/v1/users", func(w http.ResponseWriter, r *http.Request) {
+		var u APIUser
+		json.NewDecoder(r.Body).Decode(&u)
+		u.ID = "user-9"
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(u)
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	t.Setenv("MYAPP_CLIENT_BASE_URL", srv.URL)
+	return srv
+}
+
+func TestClientUserListJSONIsArray(t *testing.T) {
+	for _, users := range [][]APIUser{
+		{},
+		{{ID: "user-1", Email: "jane@example.com"}},
+		{{ID: "user-1", Email: "jane@example.com"}, {ID: "user-2", Email: "john@example.com"}},
+	} {
+		newUserAPI(t, users)
+		out, err := runCLI(t, "client", "user", "list", "-o", "json")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []APIUser
+		if err := json.Unmarshal([]byte(out), &got); err != nil {
+			t.Fatalf("%d users: output isn't a JSON array: %v\n%s", len(users), err, out)
+		}
+		if len(got) != len(users) {
+			t.Errorf("got %d users, want %d", len(got), len(users))
+		}
+	}
+}
+
+func TestClientUserGetJSONIsObject(t *testing.T) {
+	newUserAPI(t, []APIUser{{ID: "user-1", Email: "jane@example.com"}})
+	out, err := runCLI(t, "client", "user", "get", "user-1", "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got APIUser
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("output isn't a JSON object: %v\n%s", err, out)
+	}
+	if got.Email != "jane@example.com" {
+		t.Errorf("email = %q, want jane@example.com", got.Email)
+	}
+}
+
+func TestClientUserGetSurfacesAPIError(t *testing.T) {
+	newUserAPI(t, nil)
+	_, err := runCLI(t, "client", "user", "get", "user-404", "-o", "text")
+	if err == nil || !strings.Contains(err.Error(), "user user-404 not found") {
+		t.Fatalf("err = %v, want the API's error detail", err)
+	}
+}
+
+func TestClientUserCreate(t *testing.T) {
+	newUserAPI(t, nil)
+	out, err := runCLI(t, "client", "user", "create", "--first-name", "Jane", "--email", "jane@example.com", "-o", "text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out, "user-9\tJane") {
+		t.Errorf("output = %q, want the created user", out)
+	}
+}
+
+// writeConfig writes a YAML config file into a temp directory
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const v1Config = `server:
+  host: example.com
+  port: 9090
+log:
+  level: debug
+  format: console
+`
+
+func TestMigrateConfigFileV1ToV2(t *testing.T) {
+	path := writeConfig(t, v1Config)
+
+	from, err := migrateConfigFile(path)
+	if err != nil {
+		t.Fatalf("migrateConfigFile() error = %v", err)
+	}
+	if from != 1 {
+		t.Errorf("migrated from version %d, want 1", from)
+	}
+
+	migrated := viper.New()
+	migrated.SetConfigFile(path)
+	if err := migrated.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := migrated.GetInt("version"); got != currentConfigVersion {
+		t.Errorf("version = %d, want %d", got, currentConfigVersion)
+	}
+	for key, want := range map[string]interface{}{
+		"server.host": "example.com",
+		"server.port": 9090,
+		"log.level":   "debug",
+		"log.format":  "text",
+	} {
+		if got := migrated.Get(key); got != want {
+			t.Errorf("%s = %v, want %v", key, got, want)
+		}
+	}
+
+	// A second run leaves the current file alone
+	if from, err := migrateConfigFile(path); err != nil || from != currentConfigVersion {
+		t.Errorf("second migrateConfigFile() = %d, %v; want %d", from, err, currentConfigVersion)
+	}
+}
+
+func TestMigrateConfigRejectsNewerVersion(t *testing.T) {
+	path := writeConfig(t, "version: 99\n"+v1Config)
+	if _, err := migrateConfigFile(path); err == nil || !strings.Contains(err.Error(), "newer than this build supports") {
+		t.Fatalf("migrateConfigFile() error = %v, want newer-version error", err)
+	}
+}
+
+func TestApplyConfigMigrationsKeepsFileVersion(t *testing.T) {
+	v := viper.New()
+	v.SetConfigFile(writeConfig(t, v1Config))
+	if err := v.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	from, err := applyConfigMigrations(v)
+	if err != nil {
+		t.Fatalf("applyConfigMigrations() error = %v", err)
+	}
+	if from != 1 || v.GetInt("version") != 1 {
+		t.Errorf("in-memory version = %d (from %d), want the file's version 1", v.GetInt("version"), from)
+	}
+	if got := v.GetString("server.host"); got != "example.com" {
+		t.Errorf("server.host = %q, want example.com", got)
+	}
+	if got := v.GetString("log.format"); got != "text" {
+		t.Errorf("log.format = %q, want the migrated text", got)
+	}
+}
+
+// resetCLIConfig undoes the global flag and Viper state a run leaves behind
+func resetCLIConfig() {
+	cfgFile, output = "", "text"
+	viper.Reset()
+	for key, flag := range flagBindings {
+		flag.Value.Set(flag.DefValue)
+		flag.Changed = false
+		viper.BindPFlag(key, flag)
+	}
+}
+
+func TestConfigSourcesReportsOrigins(t *testing.T) {
+	t.Cleanup(resetCLIConfig)
+	path := writeConfig(t, "version: 2\n"+v1Config)
+	t.Setenv("MYAPP_SERVER_PORT", "7070")
+
+	out, err := runCLI(t, "--config", path, "--log-level", "warn", "-o", "json", "config", "sources")
+	if err != nil {
+		t.Fatalf("config sources error = %v", err)
+	}
+
+	var sources []ConfigSource
+	if err := json.Unmarshal([]byte(out), &sources); err != nil {
+		t.Fatalf("output is not a JSON list: %v\n%s", err, out)
+	}
+	got := make(map[string]ConfigSource, len(sources))
+	for _, src := range sources {
+		got[src.Key] = src
+	}
+
+	for key, want := range map[string]struct {
+		value  string
+		origin string
+	}{
+		"server.port":    {"7070", "env"},
+		"server.host":    {"example.com", "file"},
+		"log.level":      {"warn", "flag"},
+		"client.timeout": {"10s", "default"},
+	} {
+		src, ok := got[key]
+		if !ok {
+			t.Errorf("%s missing from sources", key)
+			continue
+		}
+		if fmt.Sprint(src.Value) != want.value || src.Origin != want.origin {
+			t.Errorf("%s = %v from %s, want %s from %s", key, src.Value, src.Origin, want.value, want.origin)
+		}
+	}
+}
+
+func TestServerTimeoutsFromConfigFile(t *testing.T) {
+	t.Cleanup(resetCLIConfig)
+	cfgFile = writeConfig(t, `version: 2
+server:
+  host: example.com
+  port: 9090
+  read_timeout: 20s
+  idle_timeout: 2m
+`)
+	initConfig()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	srv := newHTTPServer(cfg.Server, http.NotFoundHandler())
+
+	if srv.Addr != "example.com:9090" {
+		t.Errorf("Addr = %q, want example.com:9090", srv.Addr)
+	}
+	for name, tt := range map[string]struct{ got, want time.Duration }{
+		"read":  {srv.ReadTimeout, 20 * time.Second},
+		"write": {srv.WriteTimeout, 15 * time.Second},
+		"idle":  {srv.IdleTimeout, 2 * time.Minute},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s timeout = %v, want %v", name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfigRejectsNegativeTimeouts(t *testing.T) {
+	t.Cleanup(resetCLIConfig)
+	t.Setenv("MYAPP_SERVER_WRITE_TIMEOUT", "-1s")
+	initConfig()
+
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "server.write_timeout") {
+		t.Fatalf("loadConfig() error = %v, want a negative write timeout error", err)
+	}
+}
@@ -3,14 +3,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -23,42 +30,169 @@ type Config struct {
 	Port        int    `envconfig:"PORT" default:"8080"`
 	DatabaseURL string `envconfig:"DATABASE_URL" required:"true"`
 	LogLevel    string `envconfig:"LOG_LEVEL" default:"info"`
+
+	// Header limits. ReadHeaderTimeout cuts off clients that dribble headers
+	// (slowloris).
+	ReadHeaderTimeout time.Duration `envconfig:"READ_HEADER_TIMEOUT" default:"5s"`
+	MaxHeaderBytes    int           `envconfig:"MAX_HEADER_BYTES" default:"65536"`
+
+	// Health probe settings. HealthPort 0 serves probes on the main listener.
+	HealthPath string `envconfig:"HEALTH_PATH" default:"/health"`
+	ReadyPath  string `envconfig:"READY_PATH" default:"/ready"`
+	HealthPort int    `envconfig:"HEALTH_PORT" default:"0"`
+
+	// Startup warm-up. Readiness stays down until warm-up finishes or times out.
+	StartupPath   string        `envconfig:"STARTUP_PATH" default:"/startup"`
+	WarmupEnabled bool          `envconfig:"WARMUP_ENABLED" default:"false"`
+	WarmupTimeout time.Duration `envconfig:"WARMUP_TIMEOUT" default:"30s"`
+
+	// Health transition alerts. Changes closer together than
+	// HealthNotifyInterval are held back so a flapping dependency doesn't
+	// page on every probe.
+	HealthNotifyInterval time.Duration `envconfig:"HEALTH_NOTIFY_INTERVAL" default:"30s"`
+	HealthWebhookURL     string        `envconfig:"HEALTH_WEBHOOK_URL"`
+
+	// Database startup. When many replicas start at once, each waits a
+	// random delay of up to DBStartupJitter before its first ping and opens
+	// at most DBStartupConns connections until the database has answered.
+	// Failed pings are retried with backoff up to DBPingAttempts times.
+	DBStartupJitter time.Duration `envconfig:"DB_STARTUP_JITTER" default:"1s"`
+	DBStartupConns  int           `envconfig:"DB_STARTUP_CONNS" default:"1"`
+	DBPingAttempts  int           `envconfig:"DB_PING_ATTEMPTS" default:"5"`
+	DBPingTimeout   time.Duration `envconfig:"DB_PING_TIMEOUT" default:"5s"`
+	DBPingBackoff   time.Duration `envconfig:"DB_PING_BACKOFF" default:"500ms"`
+	DBMaxOpenConns  int           `envconfig:"DB_MAX_OPEN_CONNS" default:"25"`
+	DBMaxIdleConns  int           `envconfig:"DB_MAX_IDLE_CONNS" default:"5"`
+
+	// Background workers. Workers pause while the database is unhealthy,
+	// re-checking it with backoff from WorkerGateBackoff up to
+	// WorkerGateMaxBackoff.
+	Workers              int           `envconfig:"WORKERS" default:"4"`
+	WorkerQueue          int           `envconfig:"WORKER_QUEUE" default:"100"`
+	WorkerGateBackoff    time.Duration `envconfig:"WORKER_GATE_BACKOFF" default:"250ms"`
+	WorkerGateMaxBackoff time.Duration `envconfig:"WORKER_GATE_MAX_BACKOFF" default:"10s"`
+}
+
+// Severity determines how a failing check affects overall health
+type Severity string
+
+const (
+	// SeverityCritical failures make the application unhealthy
+	SeverityCritical Severity = "critical"
+	// SeverityWarning failures only degrade the application
+	SeverityWarning Severity = "warning"
+)
+
+// Check result statuses
+const (
+	StatusOK      = "ok"
+	StatusFail    = "fail"
+	StatusSkipped = "skipped"
+)
+
+// Aggregate health statuses
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+// CheckResult is the outcome of a single health check
+type CheckResult struct {
+	Status     string        `json:"status"`
+	Severity   Severity      `json:"severity"`
+	Duration   time.Duration `json:"-"`
+	DurationMS float64       `json:"duration_ms"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// healthCheck is a registered check and its severity
+type healthCheck struct {
+	severity  Severity
+	fn        func(context.Context) error
+	dependsOn []string
 }
 
 // HealthChecker manages health check functions
 type HealthChecker struct {
-	checks map[string]func(context.Context) error
+	checks map[string]healthCheck
+
+	notifyMu       sync.Mutex
+	observers      []HealthObserver
+	notifyInterval time.Duration
+	reported       string
+	reportedAt     time.Time
 }
 
 // NewHealthChecker creates a new health checker
 func NewHealthChecker() *HealthChecker {
 	return &HealthChecker{
-		checks: make(map[string]func(context.Context) error),
+		checks: make(map[string]healthCheck),
 	}
 }
 
-// AddCheck adds a named health check function
+// AddCheck adds a named critical health check function
 func (hc *HealthChecker) AddCheck(name string, check func(context.Context) error) {
+	hc.AddCheckWithSeverity(name, SeverityCritical, check)
+}
+
+// AddCheckWithSeverity adds a named health check with the given severity
+func (hc *HealthChecker) AddCheckWithSeverity(name string, severity Severity, check func(context.Context) error) {
+	hc.checks[name] = healthCheck{severity: severity, fn: check, dependsOn: hc.checks[name].dependsOn}
+}
+
+// DependsOn makes check name run only after deps pass. If any dependency
+// fails or is skipped, name is reported as skipped instead of being run, so
+// one outage doesn't surface as a cascade of redundant failures.
+func (hc *HealthChecker) DependsOn(name string, deps ...string) {
+	check := hc.checks[name]
+	check.dependsOn = append(check.dependsOn, deps...)
 	hc.checks[name] = check
 }
 
-// Check runs all health checks and returns results
-func (hc *HealthChecker) Check(ctx context.Context) (map[string]string, error) {
-	results := make(map[string]string)
-	var hasError bool
+// AddObserver registers an observer for aggregate status transitions
+func (hc *HealthChecker) AddObserver(observer HealthObserver) {
+	hc.notifyMu.Lock()
+	defer hc.notifyMu.Unlock()
+	hc.observers = append(hc.observers, observer)
+}
 
-	for name, check := range hc.checks {
-		checkCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
-		defer cancel()
+// SetNotifyInterval sets the minimum time between transition notifications.
+// A change within the interval is held back and reported by the first check
+// after it if the status still differs from the last one reported.
+func (hc *HealthChecker) SetNotifyInterval(interval time.Duration) {
+	hc.notifyMu.Lock()
+	defer hc.notifyMu.Unlock()
+	hc.notifyInterval = interval
+}
 
-		if err := check(checkCtx); err != nil {
-			results[name] = fmt.Sprintf("FAIL: %v", err)
+// Check runs all health checks, dependencies first, and returns per-check
+// results. The error is non-nil only when a critical check fails; skipped
+// checks don't count, since their failed dependency already does. Observers
+// are notified when the aggregate status changes.
+func (hc *HealthChecker) Check(ctx context.Context) (map[string]CheckResult, error) {
+	results := make(map[string]CheckResult, len(hc.checks))
+	visiting := make(map[string]bool)
+	var hasError bool
+
+	for name := range hc.checks {
+		hc.resolve(ctx, name, results, visiting)
+	}
+	for name, result := range results {
+		if result.Status == StatusFail && hc.checks[name].severity == SeverityCritical {
 			hasError = true
-		} else {
-			results[name] = "OK"
 		}
 	}
 
+	status := HealthHealthy
+	switch {
+	case hasError:
+		status = HealthUnhealthy
+	case hasFailures(results):
+		status = HealthDegraded
+	}
+	hc.observe(ctx, status, results)
+
 	if hasError {
 		return results, fmt.Errorf("health check failed")
 	}
@@ -66,19 +200,352 @@ func (hc *HealthChecker) Check(ctx context.Context) (map[string]string, error) {
 	return results, nil
 }
 
+// CheckOnly runs the named checks and their dependencies without notifying
+// observers. The error names the first check that did not pass; unlike
+// Check, skipped checks and warnings count, since the caller asked for
+// these checks specifically.
+func (hc *HealthChecker) CheckOnly(ctx context.Context, names ...string) (map[string]CheckResult, error) {
+	results := make(map[string]CheckResult, len(names))
+	visiting := make(map[string]bool)
+
+	for _, name := range names {
+		if _, ok := hc.checks[name]; !ok {
+			return results, fmt.Errorf("unknown health check %q", name)
+		}
+		if result := hc.resolve(ctx, name, results, visiting); result.Status != StatusOK {
+			return results, fmt.Errorf("%s %s: %s", name, result.Status, result.Error)
+		}
+	}
+	return results, nil
+}
+
+// criticalChecks returns the names of all critical checks, sorted
+func (hc *HealthChecker) criticalChecks() []string {
+	var names []string
+	for name, check := range hc.checks {
+		if check.severity == SeverityCritical {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// observe notifies observers if status differs from the last reported
+// status and the notify interval has passed. The first observed status is
+// the baseline and isn't reported.
+func (hc *HealthChecker) observe(ctx context.Context, status string, results map[string]CheckResult) {
+	hc.notifyMu.Lock()
+	now := time.Now()
+	if hc.reported == "" {
+		hc.reported, hc.reportedAt = status, now
+	}
+	if status == hc.reported || now.Sub(hc.reportedAt) < hc.notifyInterval {
+		hc.notifyMu.Unlock()
+		return
+	}
+	transition := HealthTransition{From: hc.reported, To: status, At: now, Components: results}
+	hc.reported, hc.reportedAt = status, now
+	observers := append([]HealthObserver(nil), hc.observers...)
+	hc.notifyMu.Unlock()
+
+	for _, observer := range observers {
+		observer.HealthChanged(ctx, transition)
+	}
+}
+
+// resolve runs name after its dependencies, memoizing results. Unknown
+// dependencies and cycles are reported as failures of the dependent check.
+func (hc *HealthChecker) resolve(ctx context.Context, name string, results map[string]CheckResult, visiting map[string]bool) CheckResult {
+	if result, ok := results[name]; ok {
+		return result
+	}
+
+	check := hc.checks[name]
+	fail := func(msg string) CheckResult {
+		result := CheckResult{Status: StatusFail, Severity: check.severity, Error: msg}
+		results[name] = result
+		return result
+	}
+
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	for _, dep := range check.dependsOn {
+		if _, ok := hc.checks[dep]; !ok {
+			return fail(fmt.Sprintf("unknown dependency %q", dep))
+		}
+		if visiting[dep] {
+			return fail(fmt.Sprintf("dependency cycle through %q", dep))
+		}
+		if depResult := hc.resolve(ctx, dep, results, visiting); depResult.Status != StatusOK {
+			result := CheckResult{
+				Status:   StatusSkipped,
+				Severity: check.severity,
+				Error:    fmt.Sprintf("dependency %q did not pass (%s)", dep, depResult.Status),
+			}
+			results[name] = result
+			return result
+		}
+	}
+
+	result := runCheck(ctx, check)
+	results[name] = result
+	return result
+}
+
+// runCheck executes a single check with its own timeout and records timing
+func runCheck(ctx context.Context, check healthCheck) CheckResult {
+	checkCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := check.fn(checkCtx)
+	elapsed := time.Since(start)
+
+	result := CheckResult{
+		Status:     StatusOK,
+		Severity:   check.severity,
+		Duration:   elapsed,
+		DurationMS: float64(elapsed.Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// HealthTransition describes a change in aggregate health status
+type HealthTransition struct {
+	From       string                 `json:"from"`
+	To         string                 `json:"to"`
+	At         time.Time              `json:"at"`
+	Components map[string]CheckResult `json:"components,omitempty"`
+}
+
+// HealthObserver is notified when aggregate health changes. HealthChanged
+// runs on the checking goroutine, so slow observers should hand off work.
+type HealthObserver interface {
+	HealthChanged(ctx context.Context, transition HealthTransition)
+}
+
+// LogHealthObserver logs health transitions
+type LogHealthObserver struct{}
+
+// HealthChanged logs the transition and the checks that are failing
+func (LogHealthObserver) HealthChanged(ctx context.Context, t HealthTransition) {
+	var failing []string
+	for name, result := range t.Components {
+		if result.Status == StatusFail {
+			failing = append(failing, name)
+		}
+	}
+	if len(failing) == 0 {
+		log.Printf("Health changed from %s to %s", t.From, t.To)
+		return
+	}
+	sort.Strings(failing)
+	log.Printf("Health changed from %s to %s (failing: %s)", t.From, t.To, strings.Join(failing, ", "))
+}
+
+// WebhookHealthObserver POSTs each transition as JSON to URL
+type WebhookHealthObserver struct {
+	URL    string
+	Client *http.Client
+}
+
+// HealthChanged delivers the transition in the background so a slow
+// endpoint can't hold up the readiness probe. Failures are logged.
+func (o WebhookHealthObserver) HealthChanged(ctx context.Context, t HealthTransition) {
+	client := o.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	body, err := json.Marshal(t)
+	if err != nil {
+		log.Printf("Failed to encode health transition: %v", err)
+		return
+	}
+
+	go func() {
+		resp, err := client.Post(o.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Health webhook failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Health webhook returned %s", resp.Status)
+		}
+	}()
+}
+
+// Health metrics are published once per process: expvar panics when a name
+// is registered twice, as it would be by a second NewApplication
+var (
+	healthStatusVar      = expvar.NewString("health_status")
+	healthTransitionsVar = expvar.NewMap("health_transitions_total")
+)
+
+// MetricHealthObserver publishes the current status and transition counts
+// through expvar, served at /debug/vars on the dedicated health listener
+type MetricHealthObserver struct {
+	status      *expvar.String
+	transitions *expvar.Map
+}
+
+// NewMetricHealthObserver reports to the health_status and
+// health_transitions_total variables
+func NewMetricHealthObserver() *MetricHealthObserver {
+	return &MetricHealthObserver{
+		status:      healthStatusVar,
+		transitions: healthTransitionsVar,
+	}
+}
+
+// HealthChanged records the new status and counts the transition by target
+func (o *MetricHealthObserver) HealthChanged(ctx context.Context, t HealthTransition) {
+	o.status.Set(t.To)
+	o.transitions.Add(t.To, 1)
+}
+
+// TimingSegment is one timed sub-operation of a request
+type TimingSegment struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Timings accumulates timed sub-operations for a single request
+type Timings struct {
+	mu       sync.Mutex
+	segments []TimingSegment
+}
+
+type timingsContextKey struct{}
+
+// NewTimingContext returns a context that collects WithTiming segments
+func NewTimingContext(ctx context.Context) (context.Context, *Timings) {
+	t := &Timings{}
+	return context.WithValue(ctx, timingsContextKey{}, t), t
+}
+
+// WithTiming starts timing the named sub-operation and returns a function
+// that stops it. It is a no-op when ctx isn't collecting timings.
+func WithTiming(ctx context.Context, name string) (stop func()) {
+	t, ok := ctx.Value(timingsContextKey{}).(*Timings)
+	if !ok {
+		return func() {}
+	}
+
+	start := time.Now()
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.segments = append(t.segments, TimingSegment{Name: name, Duration: time.Since(start)})
+	}
+}
+
+// Segments returns the recorded segments in completion order
+func (t *Timings) Segments() []TimingSegment {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TimingSegment(nil), t.segments...)
+}
+
+// Header formats the segments as a Server-Timing header value, e.g.
+// "db;dur=1.25, cache;dur=0.31"
+func (t *Timings) Header() string {
+	segments := t.Segments()
+	parts := make([]string, len(segments))
+	for i, s := range segments {
+		parts[i] = fmt.Sprintf("%s;dur=%.2f", s.Name, float64(s.Duration.Microseconds())/1000)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// serverTimingWriter adds the Server-Timing header just before the response
+// header is sent, once the handler's segments are known
+type serverTimingWriter struct {
+	http.ResponseWriter
+	timings     *Timings
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if header := w.timings.Header(); header != "" {
+			w.Header().Set("Server-Timing", header)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *serverTimingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// serverTiming collects WithTiming segments recorded while handling a
+// request and reports them in a Server-Timing response header. Segments
+// that finish after the header is written are not included.
+func serverTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, timings := NewTimingContext(r.Context())
+		next.ServeHTTP(&serverTimingWriter{ResponseWriter: w, timings: timings}, r.WithContext(ctx))
+	})
+}
+
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status     string            `json:"status"`
-	Timestamp  time.Time         `json:"timestamp"`
-	Components map[string]string `json:"components,omitempty"`
+	Status     string                 `json:"status"`
+	Reason     string                 `json:"reason,omitempty"`
+	Timestamp  time.Time              `json:"timestamp"`
+	Components map[string]CheckResult `json:"components,omitempty"`
+}
+
+// Warm-up states reported by the startup probe
+const (
+	WarmupPending  = "pending"
+	WarmupRunning  = "running"
+	WarmupComplete = "complete"
+	WarmupFailed   = "failed"
+	WarmupTimedOut = "timed_out"
+	WarmupSkipped  = "skipped"
+)
+
+// Warmer preloads data before the application reports ready
+type Warmer struct {
+	Name string
+	Run  func(context.Context) error
+}
+
+// Closer releases one resource during shutdown. Close should honor ctx;
+// Shutdown stops waiting for it once Timeout elapses either way.
+type Closer struct {
+	Name    string
+	Timeout time.Duration
+	Close   func(context.Context) error
 }
 
 // Application holds the application state
 type Application struct {
-	config  *Config
-	db      *sql.DB
-	server  *http.Server
-	checker *HealthChecker
+	config       *Config
+	db           *sql.DB
+	server       *http.Server
+	healthServer *http.Server
+	checker      *HealthChecker
+	workers      *WorkerPool
+	warmers      []Warmer
+
+	closersMu sync.Mutex
+	closers   []Closer
+
+	warmupMu     sync.RWMutex
+	warmupStatus string
 }
 
 // NewApplication creates a new application instance
@@ -89,32 +556,397 @@ func NewApplication(cfg *Config) (*Application, error) {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
-	// Configure connection pool
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
+	// Configure connection pool. Until the database has answered, hold the
+	// pool to a trickle so a herd of starting replicas doesn't swamp it.
+	db.SetMaxOpenConns(cfg.DBStartupConns)
+	db.SetMaxIdleConns(cfg.DBStartupConns)
 	db.SetConnMaxLifetime(5 * time.Minute)
 
 	// Verify connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := db.PingContext(ctx); err != nil {
-		return nil, fmt.Errorf("failed to ping database: %w", err)
+	if err := waitForDatabase(context.Background(), db, cfg); err != nil {
+		db.Close()
+		return nil, err
 	}
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
 
 	app := &Application{
-		config:  cfg,
-		db:      db,
-		checker: NewHealthChecker(),
+		config:       cfg,
+		db:           db,
+		checker:      NewHealthChecker(),
+		warmupStatus: WarmupPending,
+	}
+
+	// Registered first so it closes after everything that might still use it
+	app.AddCloser("database", 5*time.Second, func(context.Context) error {
+		return db.Close()
+	})
+
+	// Prime the connection pool so the first requests don't pay for dialing
+	app.AddWarmer("db_pool", func(ctx context.Context) error {
+		conns := make([]*sql.Conn, 0, 5)
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for i := 0; i < cap(conns); i++ {
+			conn, err := db.Conn(ctx)
+			if err != nil {
+				return err
+			}
+			conns = append(conns, conn)
+		}
+		return nil
+	})
+
+	// Alert on readiness transitions
+	app.checker.SetNotifyInterval(cfg.HealthNotifyInterval)
+	app.checker.AddObserver(LogHealthObserver{})
+	app.checker.AddObserver(NewMetricHealthObserver())
+	if cfg.HealthWebhookURL != "" {
+		app.checker.AddObserver(WebhookHealthObserver{URL: cfg.HealthWebhookURL})
 	}
 
 	// Add health checks
 	app.checker.AddCheck("database", func(ctx context.Context) error {
+		defer WithTiming(ctx, "db")()
 		return db.PingContext(ctx)
 	})
 
+	// Background workers pause while the database is down. Registered after
+	// the database so they finish before it closes.
+	gate := app.checker.Gate("database")
+	gate.SetBackoff(cfg.WorkerGateBackoff, cfg.WorkerGateMaxBackoff)
+	app.workers = NewWorkerPool(cfg.Workers, cfg.WorkerQueue, gate)
+	app.AddCloser("workers", 10*time.Second, app.workers.Close)
+
 	return app, nil
 }
 
+// Workers returns the pool for background jobs that need the database
+func (app *Application) Workers() *WorkerPool {
+	return app.workers
+}
+
+// pinger is the part of *sql.DB that waitForDatabase uses
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// maxDBPingBackoff caps the delay between startup pings
+const maxDBPingBackoff = 10 * time.Second
+
+// waitForDatabase pings db until it answers or cfg.DBPingAttempts pings
+// have failed. It first sleeps a random delay of up to cfg.DBStartupJitter,
+// then retries failed pings after an exponential backoff that is itself
+// jittered, so replicas that failed together don't retry together.
+func waitForDatabase(ctx context.Context, db pinger, cfg *Config) error {
+	if cfg.DBStartupJitter > 0 {
+		if err := sleepContext(ctx, time.Duration(rand.Int63n(int64(cfg.DBStartupJitter)+1))); err != nil {
+			return err
+		}
+	}
+
+	attempts := cfg.DBPingAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := cfg.DBPingBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, cfg.DBPingTimeout)
+		err = db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if attempt >= attempts {
+			break
+		}
+
+		// Wait between half and all of the backoff
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("Database ping %d/%d failed, retrying in %v: %v", attempt, attempts, wait.Round(time.Millisecond), err)
+		if err := sleepContext(ctx, wait); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, maxDBPingBackoff)
+	}
+	return fmt.Errorf("failed to ping database after %d attempts: %w", attempts, err)
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Default polling backoff for a ReadinessGate
+const (
+	defaultGateBackoff    = 250 * time.Millisecond
+	defaultGateMaxBackoff = 10 * time.Second
+)
+
+// ReadinessGate lets background goroutines wait for the dependencies they
+// need instead of spinning on errors while those dependencies are down.
+type ReadinessGate struct {
+	checker    *HealthChecker
+	checks     []string
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// Gate returns a ReadinessGate on the named checks. With no names it waits
+// for every critical check registered when Wait is called.
+func (hc *HealthChecker) Gate(checks ...string) *ReadinessGate {
+	return &ReadinessGate{
+		checker:    hc,
+		checks:     checks,
+		backoff:    defaultGateBackoff,
+		maxBackoff: defaultGateMaxBackoff,
+	}
+}
+
+// SetBackoff sets the delay before the first re-check and the cap it
+// doubles up to. Non-positive values keep the current setting.
+func (g *ReadinessGate) SetBackoff(backoff, maxBackoff time.Duration) {
+	if backoff > 0 {
+		g.backoff = backoff
+	}
+	if maxBackoff > 0 {
+		g.maxBackoff = maxBackoff
+	}
+}
+
+// Wait returns once the gate's checks pass, polling with exponential
+// backoff while they fail. It returns ctx.Err() if ctx ends first.
+func (g *ReadinessGate) Wait(ctx context.Context) error {
+	checks := g.checks
+	if len(checks) == 0 {
+		checks = g.checker.criticalChecks()
+	}
+
+	backoff := g.backoff
+	var blockedAt time.Time
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		_, err := g.checker.CheckOnly(checkCtx, checks...)
+		cancel()
+		if err == nil {
+			if !blockedAt.IsZero() {
+				log.Printf("Dependencies %v recovered after %v", checks, time.Since(blockedAt).Round(time.Millisecond))
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if blockedAt.IsZero() {
+			blockedAt = time.Now()
+			log.Printf("Pausing until dependencies %v recover: %v", checks, err)
+		}
+		if err := sleepContext(ctx, backoff); err != nil {
+			return err
+		}
+		backoff = min(backoff*2, g.maxBackoff)
+	}
+}
+
+// ErrPoolClosed is returned by Submit after the pool has been closed
+var ErrPoolClosed = errors.New("worker pool closed")
+
+// Job is a unit of background work
+type Job func(context.Context) error
+
+// WorkerPool runs jobs on a fixed number of goroutines. Before each job a
+// worker waits on the pool's gate, so work pauses while a dependency is
+// down rather than failing job after job.
+type WorkerPool struct {
+	gate *ReadinessGate
+	jobs chan Job
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.RWMutex
+	closed    bool
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWorkerPool starts workers goroutines that take jobs from a queue of
+// the given size. A nil gate runs jobs without waiting.
+func NewWorkerPool(workers, queue int, gate *ReadinessGate) *WorkerPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &WorkerPool{
+		gate:   gate,
+		jobs:   make(chan Job, max(queue, 0)),
+		ctx:    ctx,
+		cancel: cancel,
+		quit:   make(chan struct{}),
+	}
+	for i := 0; i < max(workers, 1); i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues job, blocking while the queue is full. It fails if ctx
+// ends first or the pool is closed.
+func (p *WorkerPool) Submit(ctx context.Context, job Job) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.quit:
+		return ErrPoolClosed
+	}
+}
+
+// Close stops accepting jobs and waits for the queued ones to finish. If ctx
+// ends first, running jobs and gate waits are cancelled and the remaining
+// jobs are dropped.
+func (p *WorkerPool) Close(ctx context.Context) error {
+	p.closeOnce.Do(func() {
+		// Release blocked Submits before taking the lock they hold
+		close(p.quit)
+		p.mu.Lock()
+		p.closed = true
+		close(p.jobs)
+		p.mu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
+
+// work runs queued jobs until the queue is closed and drained
+func (p *WorkerPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		if p.gate != nil {
+			if err := p.gate.Wait(p.ctx); err != nil {
+				log.Printf("Dropping job: %v", err)
+				continue
+			}
+		}
+		if err := job(p.ctx); err != nil {
+			log.Printf("Job failed: %v", err)
+		}
+	}
+}
+
+// AddCloser registers a resource to release during Shutdown. Closers run in
+// reverse registration order, so register dependencies before the things
+// that use them: a database before the workers that write to it, and the
+// workers before the server that feeds them. A timeout of zero leaves the
+// closer bounded only by the overall shutdown deadline.
+func (app *Application) AddCloser(name string, timeout time.Duration, fn func(context.Context) error) {
+	app.closersMu.Lock()
+	defer app.closersMu.Unlock()
+	app.closers = append(app.closers, Closer{Name: name, Timeout: timeout, Close: fn})
+}
+
+// AddWarmer registers a warm-up task to run during startup
+func (app *Application) AddWarmer(name string, run func(context.Context) error) {
+	app.warmers = append(app.warmers, Warmer{Name: name, Run: run})
+}
+
+// WarmupStatus returns the current warm-up state
+func (app *Application) WarmupStatus() string {
+	app.warmupMu.RLock()
+	defer app.warmupMu.RUnlock()
+	return app.warmupStatus
+}
+
+func (app *Application) setWarmupStatus(status string) {
+	app.warmupMu.Lock()
+	app.warmupStatus = status
+	app.warmupMu.Unlock()
+}
+
+// warmedUp reports whether warm-up has reached a terminal state
+func (app *Application) warmedUp() bool {
+	switch app.WarmupStatus() {
+	case WarmupPending, WarmupRunning:
+		return false
+	}
+	return true
+}
+
+// warmUp runs the registered warmers within the configured timeout. Warm-up
+// is an optimization, so failures and timeouts are logged and the
+// application still becomes ready afterwards.
+func (app *Application) warmUp(ctx context.Context) {
+	if !app.config.WarmupEnabled || len(app.warmers) == 0 {
+		app.setWarmupStatus(WarmupSkipped)
+		return
+	}
+
+	app.setWarmupStatus(WarmupRunning)
+	ctx, cancel := context.WithTimeout(ctx, app.config.WarmupTimeout)
+	defer cancel()
+
+	start := time.Now()
+	for _, warmer := range app.warmers {
+		if err := warmer.Run(ctx); err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				log.Printf("Warm-up timed out after %v during %s", app.config.WarmupTimeout, warmer.Name)
+				app.setWarmupStatus(WarmupTimedOut)
+				return
+			}
+			log.Printf("Warm-up %s failed: %v", warmer.Name, err)
+			app.setWarmupStatus(WarmupFailed)
+			return
+		}
+	}
+
+	log.Printf("Warm-up complete in %v", time.Since(start))
+	app.setWarmupStatus(WarmupComplete)
+}
+
+// startupHandler handles startup probe requests, succeeding once warm-up
+// has finished
+func (app *Application) startupHandler(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	if !app.warmedUp() {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"warmup": app.WarmupStatus()})
+}
+
 // healthHandler handles liveness probe requests
 func (app *Application) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
@@ -123,64 +955,192 @@ func (app *Application) healthHandler(w http.ResponseWriter, r *http.Request) {
 
 // readinessHandler handles readiness probe requests
 func (app *Application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if !app.warmedUp() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(HealthResponse{
+			Status:    "warming_up",
+			Reason:    "warmup: " + app.WarmupStatus(),
+			Timestamp: time.Now(),
+		})
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 	defer cancel()
 
 	components, err := app.checker.Check(ctx)
 
 	response := HealthResponse{
+		Reason:     failureReason(components),
 		Timestamp:  time.Now(),
 		Components: components,
 	}
 
-	if err != nil {
-		response.Status = "unhealthy"
-		w.WriteHeader(http.StatusServiceUnavailable)
-	} else {
-		response.Status = "healthy"
-		w.WriteHeader(http.StatusOK)
+	status := http.StatusOK
+	switch {
+	case err != nil:
+		response.Status = HealthUnhealthy
+		status = http.StatusServiceUnavailable
+	case hasFailures(components):
+		response.Status = HealthDegraded
+	default:
+		response.Status = HealthHealthy
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(response)
 }
 
-// Start starts the HTTP server
+// registerHealthRoutes mounts the liveness, readiness, and startup probes
+// on mux
+func (app *Application) registerHealthRoutes(mux *http.ServeMux) {
+	mux.HandleFunc(app.config.HealthPath, app.healthHandler)
+	mux.HandleFunc(app.config.ReadyPath, app.readinessHandler)
+	mux.HandleFunc(app.config.StartupPath, app.startupHandler)
+}
+
+// failureReason summarizes the most severe failing check as "name: error",
+// or returns "" if nothing failed. Critical checks win over warnings and
+// ties go to the first name alphabetically, so the reason stays stable for
+// alerting while the failure persists. Skipped checks are never the reason,
+// since the dependency they wait on is failing itself.
+func failureReason(results map[string]CheckResult) string {
+	var name string
+	var worst CheckResult
+	for n, result := range results {
+		if result.Status != StatusFail {
+			continue
+		}
+		switch {
+		case name == "",
+			result.Severity == SeverityCritical && worst.Severity != SeverityCritical,
+			result.Severity == worst.Severity && n < name:
+			name, worst = n, result
+		}
+	}
+	if name == "" {
+		return ""
+	}
+	return name + ": " + worst.Error
+}
+
+// hasFailures reports whether any check failed, regardless of severity
+func hasFailures(results map[string]CheckResult) bool {
+	for _, result := range results {
+		if result.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Start starts the HTTP server. When a dedicated health port is configured,
+// probes are served on a separate listener so they don't share the main
+// listener's limits or count toward request metrics. The expvar metrics at
+// /debug/vars are only served there, never on the public port.
 func (app *Application) Start() error {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/health", app.healthHandler)
-	mux.HandleFunc("/ready", app.readinessHandler)
+
+	if app.config.HealthPort != 0 && app.config.HealthPort != app.config.Port {
+		healthMux := http.NewServeMux()
+		app.registerHealthRoutes(healthMux)
+		healthMux.Handle("/debug/vars", expvar.Handler())
+
+		app.healthServer = &http.Server{
+			Addr:              fmt.Sprintf(":%d", app.config.HealthPort),
+			Handler:           serverTiming(healthMux),
+			ReadHeaderTimeout: app.config.ReadHeaderTimeout,
+			ReadTimeout:       5 * time.Second,
+			WriteTimeout:      10 * time.Second,
+			IdleTimeout:       60 * time.Second,
+			MaxHeaderBytes:    app.config.MaxHeaderBytes,
+		}
+		// Registered before the main server so probes keep answering while
+		// it drains
+		app.AddCloser("health_server", 0, app.healthServer.Shutdown)
+
+		go func() {
+			log.Printf("Starting health server on port %d", app.config.HealthPort)
+			if err := app.healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("Health server failed: %v", err)
+			}
+		}()
+	} else {
+		app.registerHealthRoutes(mux)
+	}
 
 	app.server = &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.Port),
-		Handler:      mux,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:              fmt.Sprintf(":%d", app.config.Port),
+		Handler:           serverTiming(mux),
+		ReadHeaderTimeout: app.config.ReadHeaderTimeout,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    app.config.MaxHeaderBytes,
 	}
+	app.AddCloser("http_server", 0, app.server.Shutdown)
+
+	// Warm up in the background so probes can report progress meanwhile
+	go app.warmUp(context.Background())
 
 	log.Printf("Starting server on port %d", app.config.Port)
 	return app.server.ListenAndServe()
 }
 
-// Shutdown gracefully shuts down the application
+// Shutdown gracefully shuts down the application by running its closers in
+// reverse registration order. A failing or timed-out closer doesn't stop the
+// rest; all errors are returned together.
 func (app *Application) Shutdown(ctx context.Context) error {
 	log.Println("Shutting down gracefully...")
 
-	// Shutdown HTTP server
-	if err := app.server.Shutdown(ctx); err != nil {
-		return fmt.Errorf("server shutdown failed: %w", err)
+	app.closersMu.Lock()
+	closers := append([]Closer(nil), app.closers...)
+	app.closersMu.Unlock()
+
+	var errs []error
+	for i := len(closers) - 1; i >= 0; i-- {
+		closer := closers[i]
+		start := time.Now()
+		if err := runCloser(ctx, closer); err != nil {
+			log.Printf("Closing %s failed after %v: %v", closer.Name, time.Since(start), err)
+			errs = append(errs, fmt.Errorf("%s: %w", closer.Name, err))
+			continue
+		}
+		log.Printf("Closed %s in %v", closer.Name, time.Since(start))
 	}
 
-	// Close database connection
-	if err := app.db.Close(); err != nil {
-		return fmt.Errorf("database close failed: %w", err)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
 	}
 
 	log.Println("Shutdown complete")
 	return nil
 }
 
+// runCloser runs one closer under its own timeout. Closers that ignore their
+// context are abandoned when it expires so they can't hold up the others.
+func runCloser(ctx context.Context, closer Closer) error {
+	if closer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, closer.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- closer.Close(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func main() {
 	// Load configuration
 	var cfg Config
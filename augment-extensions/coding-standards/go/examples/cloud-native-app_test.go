@@ -0,0 +1,747 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerTimingListsSegments(t *testing.T) {
+	handler := serverTiming(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WithTiming(r.Context(), "cache")()
+		WithTiming(r.Context(), "db")()
+		w.Write([]byte("ok"))
+		// Too late to make the header
+		WithTiming(r.Context(), "after")()
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	header := rec.Header().Get("Server-Timing")
+	segments := strings.Split(header, ", ")
+	if len(segments) != 2 {
+		t.Fatalf("Server-Timing = %q, want 2 segments", header)
+	}
+	for i, name := range []string{"cache", "db"} {
+		if !strings.HasPrefix(segments[i], name+";dur=") {
+			t.Errorf("segment %d = %q, want %s;dur=...", i, segments[i], name)
+		}
+	}
+}
+
+func TestWithTimingWithoutCollector(t *testing.T) {
+	// Timing outside a request must be a harmless no-op
+	WithTiming(httptest.NewRequest("GET", "/", nil).Context(), "db")()
+}
+
+func TestMetricHealthObserverSharedAcrossApplications(t *testing.T) {
+	// Each NewApplication creates an observer; a second must not panic
+	first := NewMetricHealthObserver()
+	second := NewMetricHealthObserver()
+
+	before := expvarInt(t, "unhealthy")
+	first.HealthChanged(context.Background(), HealthTransition{From: HealthHealthy, To: HealthUnhealthy})
+	second.HealthChanged(context.Background(), HealthTransition{From: HealthHealthy, To: HealthUnhealthy})
+
+	if got := expvarInt(t, "unhealthy") - before; got != 2 {
+		t.Errorf("unhealthy transitions grew by %d, want 2", got)
+	}
+	if got := healthStatusVar.Value(); got != HealthUnhealthy {
+		t.Errorf("health_status = %q, want %q", got, HealthUnhealthy)
+	}
+}
+
+// expvarInt returns the health transition count for status
+func expvarInt(t *testing.T, status string) int64 {
+	t.Helper()
+	v, ok := healthTransitionsVar.Get(status).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+// recordingObserver records the transitions it is notified of
+type recordingObserver struct {
+	mu          sync.Mutex
+	transitions []string
+}
+
+func (o *recordingObserver) HealthChanged(ctx context.Context, t HealthTransition) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.transitions = append(o.transitions, t.From+"->"+t.To)
+}
+
+func (o *recordingObserver) seen() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append([]string(nil), o.transitions...)
+}
+
+func TestHealthObserverNotifiedOncePerTransition(t *testing.T) {
+	db := &switchableDB{}
+	checker := NewHealthChecker()
+	checker.AddCheck("database", db.check)
+	observer := &recordingObserver{}
+	checker.AddObserver(observer)
+	checker.SetNotifyInterval(0)
+
+	for _, down := range []bool{false, true, true, false, false} {
+		db.down.Store(down)
+		checker.Check(context.Background())
+	}
+
+	want := []string{"healthy->unhealthy", "unhealthy->healthy"}
+	if got := observer.seen(); !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+}
+
+func TestHealthObserverDebouncesFlaps(t *testing.T) {
+	db := &switchableDB{}
+	checker := NewHealthChecker()
+	checker.AddCheck("database", db.check)
+	observer := &recordingObserver{}
+	checker.AddObserver(observer)
+	checker.SetNotifyInterval(100 * time.Millisecond)
+
+	// Baseline, then flaps inside the interval
+	for _, down := range []bool{false, true, false, true} {
+		db.down.Store(down)
+		checker.Check(context.Background())
+	}
+	if got := observer.seen(); len(got) != 0 {
+		t.Fatalf("transitions = %v within the notify interval, want none", got)
+	}
+
+	// A change that outlasts the interval is reported once
+	time.Sleep(150 * time.Millisecond)
+	checker.Check(context.Background())
+	checker.Check(context.Background())
+	if got, want := observer.seen(), []string{"healthy->unhealthy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("transitions = %v, want %v", got, want)
+	}
+}
+
+func TestHealthRoutesOmitDebugVars(t *testing.T) {
+	app := &Application{
+		config:  &Config{HealthPath: "/health", ReadyPath: "/ready", StartupPath: "/startup"},
+		checker: NewHealthChecker(),
+	}
+	mux := http.NewServeMux()
+	app.registerHealthRoutes(mux)
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/vars on the shared mux = %d, want 404", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("GET /health = %d, want 200", rec.Code)
+	}
+}
+
+// freePort returns a TCP port that was free a moment ago
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startTestApp starts app's listeners and shuts them down when the test ends
+func startTestApp(t *testing.T, cfg *Config) *Application {
+	t.Helper()
+	app := &Application{config: cfg, checker: NewHealthChecker(), warmupStatus: WarmupPending}
+	go app.Start()
+	t.Cleanup(func() { app.Shutdown(context.Background()) })
+	return app
+}
+
+// getStatus polls url until its listener is up and returns the status code
+func getStatus(t *testing.T, url string) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHealthOnDedicatedPort(t *testing.T) {
+	cfg := &Config{
+		Port:        freePort(t),
+		HealthPort:  freePort(t),
+		HealthPath:  "/healthz",
+		ReadyPath:   "/readyz",
+		StartupPath: "/startupz",
+	}
+	startTestApp(t, cfg)
+
+	health := fmt.Sprintf("http://127.0.0.1:%d", cfg.HealthPort)
+	main := fmt.Sprintf("http://127.0.0.1:%d", cfg.Port)
+	if got := getStatus(t, health+"/healthz"); got != http.StatusOK {
+		t.Errorf("health port /healthz = %d, want 200", got)
+	}
+	if got := getStatus(t, health+"/debug/vars"); got != http.StatusOK {
+		t.Errorf("health port /debug/vars = %d, want 200", got)
+	}
+	for _, path := range []string{"/healthz", "/readyz", "/startupz", "/health", "/debug/vars"} {
+		if got := getStatus(t, main+path); got != http.StatusNotFound {
+			t.Errorf("main port %s = %d, want 404", path, got)
+		}
+	}
+}
+
+func TestHealthOnMainPortAtConfiguredPath(t *testing.T) {
+	cfg := &Config{
+		Port:        freePort(t),
+		HealthPath:  "/healthz",
+		ReadyPath:   "/readyz",
+		StartupPath: "/startupz",
+	}
+	startTestApp(t, cfg)
+
+	main := fmt.Sprintf("http://127.0.0.1:%d", cfg.Port)
+	if got := getStatus(t, main+"/healthz"); got != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", got)
+	}
+	if got := getStatus(t, main+"/health"); got != http.StatusNotFound {
+		t.Errorf("default /health = %d, want 404", got)
+	}
+}
+
+func TestReadinessReportsCheckDurations(t *testing.T) {
+	checker := NewHealthChecker()
+	checker.AddCheck("database", func(context.Context) error { return nil })
+	checker.AddCheckWithSeverity("cache", SeverityWarning, func(context.Context) error {
+		time.Sleep(50 * time.Millisecond)
+		return errors.New("slow and failing")
+	})
+	app := &Application{config: &Config{}, checker: checker, warmupStatus: WarmupComplete}
+
+	rec := httptest.NewRecorder()
+	app.readinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 for a degraded app: %s", rec.Code, rec.Body)
+	}
+
+	var response HealthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Status != HealthDegraded {
+		t.Errorf("status = %q, want %q", response.Status, HealthDegraded)
+	}
+
+	db, cache := response.Components["database"], response.Components["cache"]
+	if db.Status != StatusOK || db.Severity != SeverityCritical || db.DurationMS < 0 {
+		t.Errorf("database = %+v, want ok critical with a duration", db)
+	}
+	if cache.Status != StatusFail || cache.Severity != SeverityWarning || cache.Error == "" {
+		t.Errorf("cache = %+v, want failing warning with an error", cache)
+	}
+	if cache.DurationMS < 50 {
+		t.Errorf("cache duration_ms = %v, want the slow check visible (>= 50)", cache.DurationMS)
+	}
+}
+
+// probe runs handler and returns its status code
+func probe(handler http.HandlerFunc) int {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/", nil))
+	return rec.Code
+}
+
+func TestReadinessWaitsForWarmup(t *testing.T) {
+	release := make(chan struct{})
+	app := &Application{
+		config:       &Config{WarmupEnabled: true, WarmupTimeout: time.Minute},
+		checker:      NewHealthChecker(),
+		warmupStatus: WarmupPending,
+	}
+	app.AddWarmer("cache", func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+
+	if got := probe(app.readinessHandler); got != http.StatusServiceUnavailable {
+		t.Errorf("readiness before warm-up = %d, want 503", got)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		app.warmUp(context.Background())
+		close(done)
+	}()
+	for app.WarmupStatus() != WarmupRunning {
+		time.Sleep(time.Millisecond)
+	}
+	if got := probe(app.readinessHandler); got != http.StatusServiceUnavailable {
+		t.Errorf("readiness during warm-up = %d, want 503", got)
+	}
+	if got := probe(app.startupHandler); got != http.StatusServiceUnavailable {
+		t.Errorf("startup during warm-up = %d, want 503", got)
+	}
+
+	close(release)
+	<-done
+	if got := app.WarmupStatus(); got != WarmupComplete {
+		t.Errorf("warm-up status = %q, want %q", got, WarmupComplete)
+	}
+	if got := probe(app.readinessHandler); got != http.StatusOK {
+		t.Errorf("readiness after warm-up = %d, want 200", got)
+	}
+	if got := probe(app.startupHandler); got != http.StatusOK {
+		t.Errorf("startup after warm-up = %d, want 200", got)
+	}
+}
+
+func TestWarmupTimeoutStillBecomesReady(t *testing.T) {
+	app := &Application{
+		config:       &Config{WarmupEnabled: true, WarmupTimeout: 10 * time.Millisecond},
+		checker:      NewHealthChecker(),
+		warmupStatus: WarmupPending,
+	}
+	app.AddWarmer("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	app.warmUp(context.Background())
+	if got := app.WarmupStatus(); got != WarmupTimedOut {
+		t.Errorf("warm-up status = %q, want %q", got, WarmupTimedOut)
+	}
+	if got := probe(app.readinessHandler); got != http.StatusOK {
+		t.Errorf("readiness after timed-out warm-up = %d, want 200", got)
+	}
+}
+
+func TestSlowHeadersCutOff(t *testing.T) {
+	cfg := &Config{
+		Port:              freePort(t),
+		HealthPath:        "/health",
+		ReadyPath:         "/ready",
+		StartupPath:       "/startup",
+		ReadHeaderTimeout: 100 * time.Millisecond,
+		MaxHeaderBytes:    1024,
+	}
+	startTestApp(t, cfg)
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.Port)
+	getStatus(t, "http://"+addr+"/health")
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Start a request but never finish the headers
+	fmt.Fprint(conn, "GET /health HTTP/1.1\r\nHost: example.com\r\nX-Slow: ")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	start := time.Now()
+	_, err = io.ReadAll(conn)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server kept the dribbling connection open past the header timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %v, want about the 100ms header timeout", elapsed)
+	}
+}
+
+func TestOversizedHeadersRejected(t *testing.T) {
+	cfg := &Config{
+		Port:              freePort(t),
+		HealthPath:        "/health",
+		ReadyPath:         "/ready",
+		StartupPath:       "/startup",
+		ReadHeaderTimeout: time.Second,
+		MaxHeaderBytes:    1024,
+	}
+	startTestApp(t, cfg)
+	url := fmt.Sprintf("http://127.0.0.1:%d/health", cfg.Port)
+	getStatus(t, url)
+
+	req, _ := http.NewRequest("GET", url, nil)
+	// net/http allows 4 KB of slack over MaxHeaderBytes
+	req.Header.Set("X-Large", strings.Repeat("a", 8<<10))
+	// A fresh connection, since a reused one may already have buffered
+	// past the limit
+	client := &http.Client{Transport: &http.Transport{}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status = %d, want 431", resp.StatusCode)
+	}
+}
+
+func TestFailedDependencySkipsDependents(t *testing.T) {
+	checker := NewHealthChecker()
+	var queried bool
+	checker.AddCheck("database", func(context.Context) error { return errors.New("connection refused") })
+	checker.AddCheck("user_table", func(context.Context) error {
+		queried = true
+		return errors.New("query failed")
+	})
+	checker.AddCheckWithSeverity("report_cache", SeverityWarning, func(context.Context) error { return nil })
+	checker.DependsOn("user_table", "database")
+	checker.DependsOn("report_cache", "user_table")
+
+	results, err := checker.Check(context.Background())
+	if err == nil {
+		t.Error("Check() error = nil, want the critical database failure")
+	}
+	if queried {
+		t.Error("dependent check ran although its dependency failed")
+	}
+
+	want := map[string]string{
+		"database":     StatusFail,
+		"user_table":   StatusSkipped,
+		"report_cache": StatusSkipped,
+	}
+	for name, status := range want {
+		if got := results[name].Status; got != status {
+			t.Errorf("%s status = %q, want %q", name, got, status)
+		}
+	}
+	if reason := failureReason(results); !strings.HasPrefix(reason, "database:") {
+		t.Errorf("failureReason() = %q, want the database failure", reason)
+	}
+}
+
+func TestDependencyCycleFails(t *testing.T) {
+	checker := NewHealthChecker()
+	ok := func(context.Context) error { return nil }
+	checker.AddCheck("a", ok)
+	checker.AddCheck("b", ok)
+	checker.DependsOn("a", "b")
+	checker.DependsOn("b", "a")
+	checker.AddCheck("c", ok)
+	checker.DependsOn("c", "missing")
+
+	results, _ := checker.Check(context.Background())
+	for _, name := range []string{"a", "c"} {
+		if results[name].Status == StatusOK {
+			t.Errorf("%s = %+v, want a cycle or unknown-dependency failure", name, results[name])
+		}
+	}
+}
+
+func TestShutdownClosesInReverseOrder(t *testing.T) {
+	app := &Application{config: &Config{}, checker: NewHealthChecker()}
+	var order []string
+	closer := func(name string, err error) func(context.Context) error {
+		return func(context.Context) error {
+			order = append(order, name)
+			return err
+		}
+	}
+	app.AddCloser("database", time.Second, closer("database", nil))
+	app.AddCloser("workers", time.Second, closer("workers", errors.New("worker stuck")))
+	app.AddCloser("http_server", time.Second, closer("http_server", nil))
+
+	err := app.Shutdown(context.Background())
+	if want := []string{"http_server", "workers", "database"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("close order = %v, want %v", order, want)
+	}
+	if err == nil || !strings.Contains(err.Error(), "workers: worker stuck") {
+		t.Errorf("Shutdown() error = %v, want the workers failure", err)
+	}
+}
+
+func TestShutdownAbandonsHungCloser(t *testing.T) {
+	app := &Application{config: &Config{}, checker: NewHealthChecker()}
+	var closedDB bool
+	app.AddCloser("database", time.Second, func(context.Context) error {
+		closedDB = true
+		return nil
+	})
+	release := make(chan struct{})
+	defer close(release)
+	app.AddCloser("cache", 20*time.Millisecond, func(context.Context) error {
+		<-release // ignores its context
+		return nil
+	})
+
+	err := app.Shutdown(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() error = %v, want the cache timeout", err)
+	}
+	if !closedDB {
+		t.Error("database not closed after the cache closer hung")
+	}
+}
+
+func TestFailureReason(t *testing.T) {
+	ok := CheckResult{Status: StatusOK, Severity: SeverityCritical}
+	fail := func(severity Severity, msg string) CheckResult {
+		return CheckResult{Status: StatusFail, Severity: severity, Error: msg}
+	}
+
+	tests := []struct {
+		name    string
+		results map[string]CheckResult
+		want    string
+	}{
+		{"healthy", map[string]CheckResult{"database": ok, "cache": ok}, ""},
+		{"one failure", map[string]CheckResult{"database": fail(SeverityCritical, "connection refused"), "cache": ok}, "database: connection refused"},
+		{"critical beats warning", map[string]CheckResult{
+			"analytics": fail(SeverityWarning, "timeout"),
+			"queue":     fail(SeverityCritical, "no brokers"),
+		}, "queue: no brokers"},
+		{"ties go to the first name", map[string]CheckResult{
+			"search":   fail(SeverityCritical, "red cluster"),
+			"database": fail(SeverityCritical, "connection refused"),
+		}, "database: connection refused"},
+		{"skipped never the reason", map[string]CheckResult{
+			"api":   {Status: StatusSkipped, Severity: SeverityCritical, Error: "dependency failed"},
+			"cache": fail(SeverityWarning, "evicting"),
+		}, "cache: evicting"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Map order is random, so repeat to catch unstable picks
+			for i := 0; i < 20; i++ {
+				if got := failureReason(tt.results); got != tt.want {
+					t.Fatalf("failureReason() = %q, want %q", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReadinessReasonNamesFailingCheck(t *testing.T) {
+	checker := NewHealthChecker()
+	checker.AddCheck("database", func(context.Context) error { return errors.New("connection refused") })
+	app := &Application{config: &Config{}, checker: checker, warmupStatus: WarmupComplete}
+
+	rec := httptest.NewRecorder()
+	app.readinessHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	var response HealthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Reason != "database: connection refused" {
+		t.Errorf("reason = %q, want the database failure", response.Reason)
+	}
+}
+
+// flakyPinger fails its first failures pings, as a database swamped by a
+// startup herd would, then answers
+type flakyPinger struct {
+	mu       sync.Mutex
+	failures int
+	pings    []time.Time
+}
+
+func (p *flakyPinger) PingContext(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pings = append(p.pings, time.Now())
+	if len(p.pings) <= p.failures {
+		return errors.New("too many clients already")
+	}
+	return nil
+}
+
+func TestWaitForDatabaseRidesOutHerd(t *testing.T) {
+	db := &flakyPinger{failures: 2}
+	cfg := &Config{
+		DBStartupJitter: 20 * time.Millisecond,
+		DBPingAttempts:  5,
+		DBPingTimeout:   time.Second,
+		DBPingBackoff:   10 * time.Millisecond,
+	}
+
+	start := time.Now()
+	if err := waitForDatabase(context.Background(), db, cfg); err != nil {
+		t.Fatalf("waitForDatabase() = %v, want success once the herd passes", err)
+	}
+	if len(db.pings) != 3 {
+		t.Fatalf("pinged %d times, want 3", len(db.pings))
+	}
+	// Retries back off: at least half of 10ms, then half of 20ms
+	if gap := db.pings[1].Sub(db.pings[0]); gap < 5*time.Millisecond {
+		t.Errorf("first retry after %v, want at least 5ms", gap)
+	}
+	if gap := db.pings[2].Sub(db.pings[1]); gap < 10*time.Millisecond {
+		t.Errorf("second retry after %v, want at least 10ms", gap)
+	}
+	if first := db.pings[0].Sub(start); first > 20*time.Millisecond+50*time.Millisecond {
+		t.Errorf("first ping after %v, want within the 20ms jitter", first)
+	}
+}
+
+func TestWaitForDatabaseGivesUp(t *testing.T) {
+	db := &flakyPinger{failures: 10}
+	cfg := &Config{DBPingAttempts: 3, DBPingTimeout: time.Second, DBPingBackoff: time.Millisecond}
+
+	err := waitForDatabase(context.Background(), db, cfg)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("waitForDatabase() = %v, want failure after 3 attempts", err)
+	}
+	if len(db.pings) != 3 {
+		t.Errorf("pinged %d times, want 3", len(db.pings))
+	}
+}
+
+func TestWaitForDatabaseStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	db := &flakyPinger{}
+	cfg := &Config{DBStartupJitter: time.Hour, DBPingAttempts: 1, DBPingTimeout: time.Second}
+
+	if err := waitForDatabase(ctx, db, cfg); !errors.Is(err, context.Canceled) {
+		t.Errorf("waitForDatabase() = %v, want context.Canceled", err)
+	}
+	if len(db.pings) != 0 {
+		t.Errorf("pinged %d times during the jitter, want 0", len(db.pings))
+	}
+}
+
+// switchableDB is a database check that can be taken down and brought back
+type switchableDB struct {
+	down  atomic.Bool
+	pings atomic.Int32
+}
+
+func (db *switchableDB) check(context.Context) error {
+	db.pings.Add(1)
+	if db.down.Load() {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func TestWorkerBlocksWhileDatabaseDown(t *testing.T) {
+	db := &switchableDB{}
+	db.down.Store(true)
+	checker := NewHealthChecker()
+	checker.AddCheck("database", db.check)
+	gate := checker.Gate("database")
+	gate.SetBackoff(time.Millisecond, 10*time.Millisecond)
+
+	pool := NewWorkerPool(1, 1, gate)
+	defer pool.Close(context.Background())
+
+	ran := make(chan struct{})
+	if err := pool.Submit(context.Background(), func(context.Context) error {
+		close(ran)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ran:
+		t.Fatal("job ran while the database was down")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if pings := db.pings.Load(); pings < 3 || pings > 20 {
+		t.Errorf("database checked %d times in 100ms, want a few backed-off checks", pings)
+	}
+
+	db.down.Store(false)
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("job did not run after the database recovered")
+	}
+}
+
+func TestGateWaitStopsOnCancel(t *testing.T) {
+	checker := NewHealthChecker()
+	checker.AddCheck("database", func(context.Context) error { return errors.New("connection refused") })
+	gate := checker.Gate()
+	gate.SetBackoff(time.Millisecond, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := gate.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestCheckOnlyRunsNamedChecks(t *testing.T) {
+	checker := NewHealthChecker()
+	var cacheChecked bool
+	checker.AddCheck("database", func(context.Context) error { return errors.New("connection refused") })
+	checker.AddCheck("user_table", func(context.Context) error { return nil })
+	checker.DependsOn("user_table", "database")
+	checker.AddCheckWithSeverity("cache", SeverityWarning, func(context.Context) error {
+		cacheChecked = true
+		return nil
+	})
+
+	results, err := checker.CheckOnly(context.Background(), "user_table")
+	if err == nil || !strings.Contains(err.Error(), "user_table skipped") {
+		t.Errorf("CheckOnly() = %v, want user_table skipped", err)
+	}
+	if results["database"].Status != StatusFail {
+		t.Errorf("database = %+v, want it run as a dependency", results["database"])
+	}
+	if cacheChecked {
+		t.Error("unrelated check ran")
+	}
+	if _, err := checker.CheckOnly(context.Background(), "missing"); err == nil {
+		t.Error("CheckOnly(missing) = nil, want an unknown check error")
+	}
+}
+
+func TestWorkerPoolDrainsOnClose(t *testing.T) {
+	pool := NewWorkerPool(2, 10, nil)
+	var done atomic.Int32
+	for i := 0; i < 10; i++ {
+		if err := pool.Submit(context.Background(), func(context.Context) error {
+			time.Sleep(time.Millisecond)
+			done.Add(1)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pool.Close(context.Background()); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if n := done.Load(); n != 10 {
+		t.Errorf("%d jobs finished before Close returned, want 10", n)
+	}
+	if err := pool.Submit(context.Background(), func(context.Context) error { return nil }); !errors.Is(err, ErrPoolClosed) {
+		t.Errorf("Submit after Close = %v, want ErrPoolClosed", err)
+	}
+}
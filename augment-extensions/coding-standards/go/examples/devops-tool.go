@@ -4,9 +4,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -18,8 +24,13 @@ type DeploymentConfig struct {
 	Environment string
 	Version     string
 	Replicas    int
+	MaxReplicas int // upper bound on Replicas; 0 means defaultMaxReplicas
+	BatchSize   int // replicas rolled out per batch; 0 rolls out all at once
 }
 
+// defaultMaxReplicas caps replica counts when no limit is configured
+const defaultMaxReplicas = 50
+
 // DeploymentStep represents a single deployment step
 type DeploymentStep struct {
 	Name        string
@@ -27,29 +38,365 @@ type DeploymentStep struct {
 	Execute     func(context.Context) error
 }
 
+// StepStatus is the machine-readable outcome of a deployment step
+type StepStatus string
+
+const (
+	StepSucceeded             StepStatus = "succeeded"
+	StepSucceededWithWarnings StepStatus = "succeeded_with_warnings"
+	StepSkipped               StepStatus = "skipped"
+	StepFailed                StepStatus = "failed"
+	StepNotRun                StepStatus = "not_run" // an earlier step failed
+)
+
+// StepWarning can be returned by a step's Execute to report a problem that
+// shouldn't fail the deployment
+type StepWarning struct {
+	Message string
+}
+
+func (w *StepWarning) Error() string { return w.Message }
+
+// StepResult records how a single deployment step went
+type StepResult struct {
+	Name       string        `json:"name"`
+	Status     StepStatus    `json:"status"`
+	Attempts   int           `json:"attempts"`
+	Duration   time.Duration `json:"-"`
+	DurationMS int64         `json:"duration_ms"`
+	Err        error         `json:"-"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// DeployResult collects the step results of a deployment
+type DeployResult struct {
+	Name        string        `json:"name"`
+	Environment string        `json:"environment"`
+	Version     string        `json:"version"`
+	DryRun      bool          `json:"dry_run"`
+	Succeeded   bool          `json:"succeeded"`
+	Steps       []StepResult  `json:"steps"`
+	Batches     []BatchResult `json:"batches,omitempty"`
+}
+
+// RolloutBatch is a contiguous range of replicas rolled out together
+type RolloutBatch struct {
+	Index int // zero-based
+	Total int // number of batches in the rollout
+	First int // zero-based index of the first replica
+	Count int
+}
+
+// BatchResult records how a rollout batch went
+type BatchResult struct {
+	Batch    int    `json:"batch"` // one-based
+	Replicas int    `json:"replicas"`
+	Verified bool   `json:"verified"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Rollout deploys and health-checks batches of replicas
+type Rollout interface {
+	DeployBatch(ctx context.Context, batch RolloutBatch) error
+	VerifyBatch(ctx context.Context, batch RolloutBatch) error
+}
+
+// planBatches splits replicas into batches of at most size, or a single
+// batch when size is zero
+func planBatches(replicas, size int) []RolloutBatch {
+	if size <= 0 || size > replicas {
+		size = replicas
+	}
+	total := (replicas + size - 1) / size
+	batches := make([]RolloutBatch, 0, total)
+	for first := 0; first < replicas; first += size {
+		count := size
+		if first+count > replicas {
+			count = replicas - first
+		}
+		batches = append(batches, RolloutBatch{Index: len(batches), Total: total, First: first, Count: count})
+	}
+	return batches
+}
+
+// simulatedRollout stands in for a real orchestrator
+type simulatedRollout struct {
+	clock Clock
+}
+
+func (r simulatedRollout) DeployBatch(ctx context.Context, batch RolloutBatch) error {
+	r.clock.Sleep(100 * time.Millisecond)
+	return nil
+}
+
+func (r simulatedRollout) VerifyBatch(ctx context.Context, batch RolloutBatch) error {
+	r.clock.Sleep(50 * time.Millisecond)
+	return nil
+}
+
 // DeploymentOptions holds deployment options
 type DeploymentOptions struct {
-	DryRun  bool
-	Verbose bool
-	Timeout time.Duration
+	DryRun   bool
+	Verbose  bool
+	Timeout  time.Duration
+	Clock    Clock        // defaults to RealClock
+	History  HistoryStore // optional; enables automatic rollback targets
+	Observer StepObserver // optional; notified as steps run
+	Rollout  Rollout      // defaults to a simulated rollout
+
+	// RollbackOnFailure rolls back to the last good version when a batch
+	// fails, instead of leaving the earlier batches on the new version
+	RollbackOnFailure bool
+}
+
+// StepObserver is notified as each deployment step starts and finishes,
+// including steps that are skipped or not run
+type StepObserver interface {
+	StepStarted(step DeploymentStep, index, total int)
+	StepFinished(step DeploymentStep, result StepResult)
 }
 
+// CIStepObserver writes steps as GitHub Actions workflow commands: each
+// step is a collapsible ::group:: and failures and warnings become
+// ::error:: and ::warning:: annotations
+type CIStepObserver struct {
+	w io.Writer
+}
+
+// NewCIStepObserver creates a CIStepObserver writing to w
+func NewCIStepObserver(w io.Writer) *CIStepObserver {
+	return &CIStepObserver{w: w}
+}
+
+// StepStarted opens the step's group
+func (o *CIStepObserver) StepStarted(step DeploymentStep, index, total int) {
+	fmt.Fprintf(o.w, "::group::[%d/%d] %s\n", index+1, total, escapeCIData(step.Description))
+}
+
+// StepFinished annotates a failure or warning and closes the step's group
+func (o *CIStepObserver) StepFinished(step DeploymentStep, result StepResult) {
+	title := escapeCIProperty("Step " + step.Name)
+	switch result.Status {
+	case StepFailed:
+		fmt.Fprintf(o.w, "::error title=%s::%s\n", title, escapeCIData(result.Error))
+	case StepSucceededWithWarnings:
+		fmt.Fprintf(o.w, "::warning title=%s::%s\n", title, escapeCIData(result.Error))
+	default:
+		fmt.Fprintf(o.w, "%s: %s\n", step.Name, result.Status)
+	}
+	fmt.Fprintln(o.w, "::endgroup::")
+}
+
+// escapeCIData escapes a workflow command message so newlines and percent
+// signs can't end the command early or be misread as escapes
+func escapeCIData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeCIProperty escapes a workflow command property value, which
+// additionally can't contain the ':' and ',' separators
+func escapeCIProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
+
+// DeploymentRecord is one entry in the deployment history
+type DeploymentRecord struct {
+	Name        string    `json:"name"`
+	Environment string    `json:"environment"`
+	Version     string    `json:"version"`
+	Action      string    `json:"action"` // "deploy" or "rollback"
+	Success     bool      `json:"success"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// HistoryStore persists deployment history
+type HistoryStore interface {
+	Record(ctx context.Context, record DeploymentRecord) error
+	// List returns records for name and environment, oldest first
+	List(ctx context.Context, name, environment string) ([]DeploymentRecord, error)
+}
+
+// FileHistoryStore keeps deployment history in a JSON file
+type FileHistoryStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileHistoryStore creates a history store backed by path
+func NewFileHistoryStore(path string) *FileHistoryStore {
+	return &FileHistoryStore{path: path}
+}
+
+// Record appends a record to the history file
+func (s *FileHistoryStore) Record(ctx context.Context, record DeploymentRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	records = append(records, record)
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	// Write to a temp file and rename so a crash never truncates history
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// List returns the records for name and environment, oldest first
+func (s *FileHistoryStore) List(ctx context.Context, name, environment string) ([]DeploymentRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []DeploymentRecord
+	for _, r := range records {
+		if r.Name == name && r.Environment == environment {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+func (s *FileHistoryStore) load() ([]DeploymentRecord, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	var records []DeploymentRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse history %s: %w", s.path, err)
+	}
+	return records, nil
+}
+
+// ErrNoRollbackTarget is returned when history has no earlier good version
+var ErrNoRollbackTarget = errors.New("no previous successful deployment to roll back to")
+
+// Clock abstracts time so time-dependent behavior can be driven
+// deterministically in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// RealClock is a Clock backed by the time package
+type RealClock struct{}
+
+// Now returns the current time
+func (RealClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep pauses the current goroutine for at least the duration d
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
 // Deployer handles deployment operations
 type Deployer struct {
 	config  *DeploymentConfig
 	options *DeploymentOptions
+	clock   Clock
+	rollout Rollout
+	batches []BatchResult
 }
 
 // NewDeployer creates a new deployer
 func NewDeployer(config *DeploymentConfig, options *DeploymentOptions) *Deployer {
+	clock := options.Clock
+	if clock == nil {
+		clock = RealClock{}
+	}
+
+	rollout := options.Rollout
+	if rollout == nil {
+		rollout = simulatedRollout{clock: clock}
+	}
+
 	return &Deployer{
 		config:  config,
 		options: options,
+		clock:   clock,
+		rollout: rollout,
+	}
+}
+
+// Deploy executes the deployment and records the outcome in the history.
+// The result is returned even when a step fails, so callers can report
+// which step it was.
+func (d *Deployer) Deploy(ctx context.Context) (*DeployResult, error) {
+	result := &DeployResult{
+		Name:        d.config.Name,
+		Environment: d.config.Environment,
+		Version:     d.config.Version,
+		DryRun:      d.options.DryRun,
+	}
+
+	err := d.runSteps(ctx, result)
+	result.Batches = d.batches
+	result.Succeeded = err == nil
+	if !d.options.DryRun {
+		d.recordHistory(ctx, "deploy", d.config.Version, err == nil)
+	}
+	return result, err
+}
+
+// PromotionResult collects the per-environment results of a promotion.
+// Environments after a failed one are listed in NotAttempted.
+type PromotionResult struct {
+	Name         string          `json:"name"`
+	Version      string          `json:"version"`
+	Succeeded    bool            `json:"succeeded"`
+	Environments []*DeployResult `json:"environments"`
+	NotAttempted []string        `json:"not_attempted,omitempty"`
+}
+
+// Promote deploys config to each environment in order, running the full
+// step sequence in each, and stops at the first environment that fails.
+// RollbackOnFailure applies to the failing environment only; environments
+// already promoted keep the new version. The result is returned even on
+// failure.
+func Promote(ctx context.Context, config *DeploymentConfig, options *DeploymentOptions, environments []string) (*PromotionResult, error) {
+	result := &PromotionResult{Name: config.Name, Version: config.Version}
+	for i, env := range environments {
+		envConfig := *config
+		envConfig.Environment = env
+		log.Printf("Promoting %s %s to %s (%d/%d)", config.Name, config.Version, env, i+1, len(environments))
+
+		envResult, err := NewDeployer(&envConfig, options).Deploy(ctx)
+		result.Environments = append(result.Environments, envResult)
+		if err != nil {
+			result.NotAttempted = environments[i+1:]
+			return result, fmt.Errorf("environment %s: %w", env, err)
+		}
 	}
+	result.Succeeded = true
+	return result, nil
 }
 
-// Deploy executes the deployment
-func (d *Deployer) Deploy(ctx context.Context) error {
+// runSteps executes the deployment steps in order, appending a result for
+// each to result. Steps after a failure are reported as not run.
+func (d *Deployer) runSteps(ctx context.Context, result *DeployResult) error {
 	steps := []DeploymentStep{
 		{
 			Name:        "validate",
@@ -78,22 +425,56 @@ func (d *Deployer) Deploy(ctx context.Context) error {
 		},
 	}
 
+	var failure error
 	for i, step := range steps {
-		if d.options.Verbose {
+		stepResult := StepResult{Name: step.Name}
+		if d.options.Observer != nil {
+			d.options.Observer.StepStarted(step, i, len(steps))
+		}
+		if d.options.Verbose && failure == nil {
 			log.Printf("[%d/%d] %s", i+1, len(steps), step.Description)
 		}
 
-		if d.options.DryRun {
+		switch {
+		case failure != nil:
+			stepResult.Status = StepNotRun
+		case d.options.DryRun:
 			log.Printf("[DRY RUN] Would execute: %s", step.Name)
-			continue
+			stepResult.Status = StepSkipped
+		default:
+			start := d.clock.Now()
+			err := step.Execute(ctx)
+			stepResult.Attempts = 1
+			stepResult.Duration = d.clock.Now().Sub(start)
+			stepResult.DurationMS = stepResult.Duration.Milliseconds()
+
+			var warning *StepWarning
+			switch {
+			case errors.As(err, &warning):
+				log.Printf("Step '%s' warning: %s", step.Name, warning.Message)
+				stepResult.Status = StepSucceededWithWarnings
+				stepResult.Error = err.Error()
+			case err != nil:
+				stepResult.Status = StepFailed
+				stepResult.Err = err
+				stepResult.Error = err.Error()
+				failure = fmt.Errorf("step '%s' failed: %w", step.Name, err)
+			default:
+				stepResult.Status = StepSucceeded
+			}
+
+			if d.options.Verbose && err == nil {
+				log.Printf("Step '%s' completed in %v", step.Name, stepResult.Duration)
+			}
 		}
 
-		if err := step.Execute(ctx); err != nil {
-			return fmt.Errorf("step '%s' failed: %w", step.Name, err)
+		if d.options.Observer != nil {
+			d.options.Observer.StepFinished(step, stepResult)
 		}
+		result.Steps = append(result.Steps, stepResult)
 	}
 
-	return nil
+	return failure
 }
 
 func (d *Deployer) validateConfig(ctx context.Context) error {
@@ -103,36 +484,173 @@ func (d *Deployer) validateConfig(ctx context.Context) error {
 	if d.config.Environment == "" {
 		return fmt.Errorf("environment is required")
 	}
+
+	maxReplicas := d.config.MaxReplicas
+	if maxReplicas <= 0 {
+		maxReplicas = defaultMaxReplicas
+	}
+	if d.config.Replicas < 1 || d.config.Replicas > maxReplicas {
+		return fmt.Errorf("replicas must be between 1 and %d, got %d", maxReplicas, d.config.Replicas)
+	}
+	if d.config.BatchSize < 0 {
+		return fmt.Errorf("batch size must not be negative, got %d", d.config.BatchSize)
+	}
+
 	log.Println("Configuration validated")
 	return nil
 }
 
 func (d *Deployer) buildApplication(ctx context.Context) error {
 	log.Printf("Building application version %s", d.config.Version)
-	time.Sleep(100 * time.Millisecond) // Simulate build
+	d.clock.Sleep(100 * time.Millisecond) // Simulate build
 	return nil
 }
 
 func (d *Deployer) runTests(ctx context.Context) error {
 	log.Println("Running tests")
-	time.Sleep(100 * time.Millisecond) // Simulate tests
+	d.clock.Sleep(100 * time.Millisecond) // Simulate tests
 	return nil
 }
 
+// deployToEnvironment rolls replicas out in batches, verifying each batch
+// before starting the next. The rollout halts at the first failed batch,
+// rolling back first if RollbackOnFailure is set.
 func (d *Deployer) deployToEnvironment(ctx context.Context) error {
 	log.Printf("Deploying to %s environment", d.config.Environment)
-	time.Sleep(100 * time.Millisecond) // Simulate deployment
+
+	d.batches = nil
+	for _, batch := range planBatches(d.config.Replicas, d.config.BatchSize) {
+		log.Printf("Batch %d/%d: deploying replicas %d-%d of %d",
+			batch.Index+1, batch.Total, batch.First+1, batch.First+batch.Count, d.config.Replicas)
+
+		result := BatchResult{Batch: batch.Index + 1, Replicas: batch.Count}
+		err := d.rollout.DeployBatch(ctx, batch)
+		if err == nil {
+			err = d.rollout.VerifyBatch(ctx, batch)
+			result.Verified = err == nil
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		d.batches = append(d.batches, result)
+
+		if err != nil {
+			err = fmt.Errorf("batch %d/%d failed with %d of %d replicas rolled out: %w",
+				batch.Index+1, batch.Total, batch.First, d.config.Replicas, err)
+			if d.options.RollbackOnFailure {
+				if rbErr := d.rollbackFailedRollout(ctx); rbErr != nil {
+					err = errors.Join(err, fmt.Errorf("rollback failed: %w", rbErr))
+				}
+			}
+			return err
+		}
+		log.Printf("Batch %d/%d: verified", batch.Index+1, batch.Total)
+	}
 	return nil
 }
 
 func (d *Deployer) verifyDeployment(ctx context.Context) error {
 	log.Println("Verifying deployment health")
-	time.Sleep(100 * time.Millisecond) // Simulate verification
+	d.clock.Sleep(100 * time.Millisecond) // Simulate verification
 	return nil
 }
 
-// Rollback performs deployment rollback
+// recordHistory stores the outcome of a deploy or rollback. History is best
+// effort: a failure to record is logged rather than failing the operation.
+func (d *Deployer) recordHistory(ctx context.Context, action, version string, success bool) {
+	if d.options.History == nil {
+		return
+	}
+
+	record := DeploymentRecord{
+		Name:        d.config.Name,
+		Environment: d.config.Environment,
+		Version:     version,
+		Action:      action,
+		Success:     success,
+		Timestamp:   d.clock.Now().UTC(),
+	}
+	if err := d.options.History.Record(ctx, record); err != nil {
+		log.Printf("Warning: failed to record deployment history: %v", err)
+	}
+}
+
+// rollbackFailedRollout returns the batches already rolled out to the
+// version that was running before this deployment started
+func (d *Deployer) rollbackFailedRollout(ctx context.Context) error {
+	if d.options.History == nil {
+		return fmt.Errorf("deployment history is not configured")
+	}
+	records, err := d.options.History.List(ctx, d.config.Name, d.config.Environment)
+	if err != nil {
+		return err
+	}
+	if stack := versionStack(records); len(stack) > 0 {
+		return d.Rollback(ctx, stack[len(stack)-1])
+	}
+	return fmt.Errorf("%w for %s in %s", ErrNoRollbackTarget, d.config.Name, d.config.Environment)
+}
+
+// versionStack replays successful history records into the stack of
+// versions that were live, with the running version on top. A deploy pushes
+// its version; a rollback pops back down to the version it restored, so a
+// version that was rolled away from is never offered as a target again.
+func versionStack(records []DeploymentRecord) []string {
+	var stack []string
+	for _, r := range records {
+		if !r.Success {
+			continue
+		}
+		switch r.Action {
+		case "rollback":
+			i := len(stack) - 1
+			for i >= 0 && stack[i] != r.Version {
+				i--
+			}
+			if i < 0 {
+				// Rolled back to a version older than the recorded history
+				stack = []string{r.Version}
+				continue
+			}
+			stack = stack[:i+1]
+		default:
+			if len(stack) == 0 || stack[len(stack)-1] != r.Version {
+				stack = append(stack, r.Version)
+			}
+		}
+	}
+	return stack
+}
+
+// LastGoodVersion returns the version that was live before the one currently
+// running, which is what a rollback targets
+func (d *Deployer) LastGoodVersion(ctx context.Context) (string, error) {
+	if d.options.History == nil {
+		return "", fmt.Errorf("deployment history is not configured")
+	}
+
+	records, err := d.options.History.List(ctx, d.config.Name, d.config.Environment)
+	if err != nil {
+		return "", err
+	}
+
+	if stack := versionStack(records); len(stack) > 1 {
+		return stack[len(stack)-2], nil
+	}
+	return "", fmt.Errorf("%w for %s in %s", ErrNoRollbackTarget, d.config.Name, d.config.Environment)
+}
+
+// Rollback performs deployment rollback. An empty version rolls back to the
+// last good version recorded in the deployment history.
 func (d *Deployer) Rollback(ctx context.Context, version string) error {
+	if version == "" {
+		target, err := d.LastGoodVersion(ctx)
+		if err != nil {
+			return err
+		}
+		version = target
+	}
+
 	log.Printf("Rolling back to version %s", version)
 	
 	if d.options.DryRun {
@@ -141,17 +659,33 @@ func (d *Deployer) Rollback(ctx context.Context, version string) error {
 	}
 
 	// Simulate rollback
-	time.Sleep(100 * time.Millisecond)
+	d.clock.Sleep(100 * time.Millisecond)
+	d.recordHistory(ctx, "rollback", version, true)
 	log.Println("Rollback completed")
 	return nil
 }
 
+// defaultHistoryPath returns the default location of the history file
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".devops-tool-history.json"
+	}
+	return filepath.Join(home, ".devops-tool", "history.json")
+}
+
 var (
-	dryRun      bool
-	verbose     bool
-	version     string
-	environment string
-	replicas    int
+	dryRun       bool
+	verbose      bool
+	version      string
+	environment  string
+	environments []string
+	replicas     int
+	maxReplicas  int
+	batchSize    int
+	rollback     bool
+	output       string
+	historyFile  string
 )
 
 var rootCmd = &cobra.Command{
@@ -163,21 +697,37 @@ var rootCmd = &cobra.Command{
 var deployCmd = &cobra.Command{
 	Use:   "deploy [name]",
 	Short: "Deploy application",
-	Args:  cobra.ExactArgs(1),
+	Long: `Deploy an application to one environment, or with --environments promote it
+through several in order, stopping at the first that fails.`,
+	Args: cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		name := args[0]
+		if len(environments) > 0 && cmd.Flags().Changed("environment") {
+			return fmt.Errorf("--environment and --environments are mutually exclusive")
+		}
 
 		config := &DeploymentConfig{
 			Name:        name,
 			Environment: environment,
 			Version:     version,
 			Replicas:    replicas,
+			MaxReplicas: maxReplicas,
+			BatchSize:   batchSize,
 		}
 
 		options := &DeploymentOptions{
-			DryRun:  dryRun,
-			Verbose: verbose,
-			Timeout: 5 * time.Minute,
+			DryRun:            dryRun,
+			Verbose:           verbose,
+			Timeout:           5 * time.Minute,
+			History:           NewFileHistoryStore(historyFile),
+			RollbackOnFailure: rollback,
+		}
+		if output == "ci" {
+			options.Observer = NewCIStepObserver(cmd.OutOrStdout())
+		}
+
+		if len(environments) > 0 {
+			return runPromotion(cmd, config, options)
 		}
 
 		deployer := NewDeployer(config, options)
@@ -185,7 +735,15 @@ var deployCmd = &cobra.Command{
 		ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
 		defer cancel()
 
-		if err := deployer.Deploy(ctx); err != nil {
+		result, err := deployer.Deploy(ctx)
+		if output == "json" {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			if encErr := enc.Encode(result); encErr != nil {
+				return encErr
+			}
+		}
+		if err != nil {
 			return err
 		}
 
@@ -194,13 +752,51 @@ var deployCmd = &cobra.Command{
 	},
 }
 
+// runPromotion deploys to each of the --environments in order and reports
+// how each went. The timeout applies per environment.
+func runPromotion(cmd *cobra.Command, config *DeploymentConfig, options *DeploymentOptions) error {
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout*time.Duration(len(environments)))
+	defer cancel()
+
+	result, err := Promote(ctx, config, options, environments)
+	if output == "json" {
+		enc := json.NewEncoder(cmd.OutOrStdout())
+		enc.SetIndent("", "  ")
+		if encErr := enc.Encode(result); encErr != nil {
+			return encErr
+		}
+	} else {
+		for _, env := range result.Environments {
+			status := "succeeded"
+			if !env.Succeeded {
+				status = "failed"
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: %s\n", env.Environment, status)
+		}
+		for _, env := range result.NotAttempted {
+			fmt.Fprintf(cmd.OutOrStdout(), "%s: not attempted\n", env)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Promotion of '%s' through %s completed successfully", config.Name, strings.Join(environments, ", "))
+	return nil
+}
+
 var rollbackCmd = &cobra.Command{
 	Use:   "rollback [name] [version]",
 	Short: "Rollback deployment",
-	Args:  cobra.ExactArgs(2),
+	Long: `Rollback a deployment to the given version. If no version is given, the
+last successfully deployed version before the current one is used.`,
+	Args: cobra.RangeArgs(1, 2),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		name := args[0]
-		targetVersion := args[1]
+		targetVersion := ""
+		if len(args) == 2 {
+			targetVersion = args[1]
+		}
 
 		config := &DeploymentConfig{
 			Name:        name,
@@ -210,6 +806,7 @@ var rollbackCmd = &cobra.Command{
 		options := &DeploymentOptions{
 			DryRun:  dryRun,
 			Verbose: verbose,
+			History: NewFileHistoryStore(historyFile),
 		}
 
 		deployer := NewDeployer(config, options)
@@ -219,7 +816,7 @@ var rollbackCmd = &cobra.Command{
 			return err
 		}
 
-		log.Printf("Rollback to version %s completed", targetVersion)
+		log.Printf("Rollback of '%s' completed", name)
 		return nil
 	},
 }
@@ -228,15 +825,22 @@ func init() {
 	// Deploy command flags
 	deployCmd.Flags().StringVarP(&version, "version", "v", "latest", "Version to deploy")
 	deployCmd.Flags().StringVarP(&environment, "environment", "e", "production", "Target environment")
+	deployCmd.Flags().StringSliceVar(&environments, "environments", nil, "Environments to promote through in order, e.g. dev,staging,prod")
 	deployCmd.Flags().IntVarP(&replicas, "replicas", "r", 3, "Number of replicas")
+	deployCmd.Flags().IntVar(&maxReplicas, "max-replicas", defaultMaxReplicas, "Maximum allowed replicas")
+	deployCmd.Flags().IntVar(&batchSize, "batch-size", 0, "Replicas to roll out per batch (0 for all at once)")
+	deployCmd.Flags().BoolVar(&rollback, "rollback-on-failure", false, "Roll back to the last good version if a batch fails")
 	deployCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Perform dry run")
 	deployCmd.Flags().BoolVar(&verbose, "verbose", false, "Verbose output")
+	deployCmd.Flags().StringVarP(&output, "output", "o", "text", "Output format (text, json, ci)")
 
 	// Rollback command flags
 	rollbackCmd.Flags().StringVarP(&environment, "environment", "e", "production", "Target environment")
 	rollbackCmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Perform dry run")
 	rollbackCmd.Flags().BoolVar(&verbose, "verbose", false, "Verbose output")
 
+	rootCmd.PersistentFlags().StringVar(&historyFile, "history-file", defaultHistoryPath(), "Deployment history file")
+
 	rootCmd.AddCommand(deployCmd)
 	rootCmd.AddCommand(rollbackCmd)
 }
@@ -247,4 +851,3 @@ func main() {
 		os.Exit(1)
 	}
 }
-
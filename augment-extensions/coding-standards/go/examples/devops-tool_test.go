@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// steppingClock is a Clock whose Sleep and After advance time immediately,
+// so deployer tests run without waiting
+type steppingClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newSteppingClock() *steppingClock {
+	return &steppingClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *steppingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *steppingClock) After(d time.Duration) <-chan time.Time {
+	c.Sleep(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func (c *steppingClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func testDeployConfig() *DeploymentConfig {
+	return &DeploymentConfig{Name: "api", Environment: "staging", Version: "v2", Replicas: 3}
+}
+
+// failingRollout records the batches it deploys and fails verification of
+// one batch
+type failingRollout struct {
+	failBatch int
+	deployed  []RolloutBatch
+}
+
+func (r *failingRollout) DeployBatch(ctx context.Context, batch RolloutBatch) error {
+	r.deployed = append(r.deployed, batch)
+	return nil
+}
+
+func (r *failingRollout) VerifyBatch(ctx context.Context, batch RolloutBatch) error {
+	if batch.Index == r.failBatch {
+		return errors.New("readiness probe failed")
+	}
+	return nil
+}
+
+func TestPlanBatches(t *testing.T) {
+	tests := []struct {
+		replicas, size int
+		want           []int
+	}{
+		{10, 4, []int{4, 4, 2}},
+		{3, 0, []int{3}},
+		{3, 5, []int{3}},
+		{6, 3, []int{3, 3}},
+	}
+	for _, tt := range tests {
+		batches := planBatches(tt.replicas, tt.size)
+		var counts []int
+		for _, b := range batches {
+			counts = append(counts, b.Count)
+			if b.Total != len(tt.want) {
+				t.Errorf("planBatches(%d, %d) batch total = %d, want %d", tt.replicas, tt.size, b.Total, len(tt.want))
+			}
+		}
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("planBatches(%d, %d) counts = %v, want %v", tt.replicas, tt.size, counts, tt.want)
+		}
+	}
+}
+
+func TestDeployHaltsAtFailedBatch(t *testing.T) {
+	config := testDeployConfig()
+	config.Replicas = 10
+	config.BatchSize = 4
+	rollout := &failingRollout{failBatch: 1}
+
+	deployer := NewDeployer(config, &DeploymentOptions{Clock: newSteppingClock(), Rollout: rollout})
+	result, err := deployer.Deploy(context.Background())
+	if err == nil {
+		t.Fatal("Deploy succeeded, want batch failure")
+	}
+	if !strings.Contains(err.Error(), "batch 2/3") {
+		t.Errorf("error = %q, want it to name batch 2/3", err)
+	}
+
+	if len(rollout.deployed) != 2 {
+		t.Fatalf("deployed %d batches, want rollout to halt after 2", len(rollout.deployed))
+	}
+	want := []BatchResult{
+		{Batch: 1, Replicas: 4, Verified: true},
+		{Batch: 2, Replicas: 4, Error: "readiness probe failed"},
+	}
+	if !reflect.DeepEqual(result.Batches, want) {
+		t.Errorf("batches = %+v, want %+v", result.Batches, want)
+	}
+}
+
+func TestDeployRollsBackFailedBatch(t *testing.T) {
+	history := &memoryHistory{}
+	history.Record(context.Background(), DeploymentRecord{Name: "api", Environment: "staging", Version: "v1", Action: "deploy", Success: true})
+
+	config := testDeployConfig()
+	config.BatchSize = 1
+	deployer := NewDeployer(config, &DeploymentOptions{
+		Clock:             newSteppingClock(),
+		Rollout:           &failingRollout{failBatch: 0},
+		History:           history,
+		RollbackOnFailure: true,
+	})
+	if _, err := deployer.Deploy(context.Background()); err == nil {
+		t.Fatal("Deploy succeeded, want batch failure")
+	}
+
+	var rollbacks []string
+	for _, r := range history.records {
+		if r.Action == "rollback" {
+			rollbacks = append(rollbacks, r.Version)
+		}
+	}
+	if !reflect.DeepEqual(rollbacks, []string{"v1"}) {
+		t.Errorf("rollbacks = %v, want [v1]", rollbacks)
+	}
+}
+
+// memoryHistory is an in-memory HistoryStore
+type memoryHistory struct {
+	records []DeploymentRecord
+}
+
+func (h *memoryHistory) Record(ctx context.Context, record DeploymentRecord) error {
+	h.records = append(h.records, record)
+	return nil
+}
+
+func (h *memoryHistory) List(ctx context.Context, name, environment string) ([]DeploymentRecord, error) {
+	var matched []DeploymentRecord
+	for _, r := range h.records {
+		if r.Name == name && r.Environment == environment {
+			matched = append(matched, r)
+		}
+	}
+	return matched, nil
+}
+
+func historyDeployer(history *memoryHistory, records ...DeploymentRecord) *Deployer {
+	for _, r := range records {
+		r.Name, r.Environment, r.Success = "api", "staging", true
+		history.Record(context.Background(), r)
+	}
+	return NewDeployer(testDeployConfig(), &DeploymentOptions{
+		Clock:   newSteppingClock(),
+		History: history,
+	})
+}
+
+func TestLastGoodVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []DeploymentRecord
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "empty history",
+			wantErr: true,
+		},
+		{
+			name:    "single deploy",
+			records: []DeploymentRecord{{Action: "deploy", Version: "v1"}},
+			wantErr: true,
+		},
+		{
+			name: "previous deploy",
+			records: []DeploymentRecord{
+				{Action: "deploy", Version: "v1"},
+				{Action: "deploy", Version: "v2"},
+			},
+			want: "v1",
+		},
+		{
+			name: "rolled back to the first deploy",
+			records: []DeploymentRecord{
+				{Action: "deploy", Version: "v1"},
+				{Action: "deploy", Version: "v2"},
+				{Action: "rollback", Version: "v1"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "rolled back one of three",
+			records: []DeploymentRecord{
+				{Action: "deploy", Version: "v1"},
+				{Action: "deploy", Version: "v2"},
+				{Action: "deploy", Version: "v3"},
+				{Action: "rollback", Version: "v2"},
+			},
+			want: "v1",
+		},
+		{
+			name: "redeploy after rollback",
+			records: []DeploymentRecord{
+				{Action: "deploy", Version: "v1"},
+				{Action: "deploy", Version: "v2"},
+				{Action: "rollback", Version: "v1"},
+				{Action: "deploy", Version: "v3"},
+			},
+			want: "v1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployer := historyDeployer(&memoryHistory{}, tt.records...)
+			got, err := deployer.LastGoodVersion(context.Background())
+			if tt.wantErr {
+				if !errors.Is(err, ErrNoRollbackTarget) {
+					t.Fatalf("LastGoodVersion() = %q, %v; want ErrNoRollbackTarget", got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("LastGoodVersion() = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollbackTwiceDoesNotReturnToRolledBackVersion(t *testing.T) {
+	history := &memoryHistory{}
+	deployer := historyDeployer(history,
+		DeploymentRecord{Action: "deploy", Version: "v1"},
+		DeploymentRecord{Action: "deploy", Version: "v2"},
+	)
+
+	if err := deployer.Rollback(context.Background(), ""); err != nil {
+		t.Fatalf("first Rollback() error = %v", err)
+	}
+	last := history.records[len(history.records)-1]
+	if last.Action != "rollback" || last.Version != "v1" {
+		t.Fatalf("first rollback recorded %+v, want rollback to v1", last)
+	}
+
+	if err := deployer.Rollback(context.Background(), ""); !errors.Is(err, ErrNoRollbackTarget) {
+		t.Fatalf("second Rollback() error = %v, want ErrNoRollbackTarget", err)
+	}
+}
+
+func TestValidateReplicas(t *testing.T) {
+	tests := []struct {
+		name        string
+		replicas    int
+		maxReplicas int
+		wantErr     bool
+	}{
+		{"negative", -1, 0, true},
+		{"zero", 0, 0, true},
+		{"one", 1, 0, false},
+		{"default max", defaultMaxReplicas, 0, false},
+		{"over default max", defaultMaxReplicas + 1, 0, true},
+		{"within configured max", 80, 100, false},
+		{"over configured max", 11, 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testDeployConfig()
+			config.Replicas = tt.replicas
+			config.MaxReplicas = tt.maxReplicas
+			deployer := NewDeployer(config, &DeploymentOptions{Clock: newSteppingClock()})
+
+			err := deployer.validateConfig(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "replicas must be between 1 and") {
+				t.Errorf("error = %q, want the replica range", err)
+			}
+		})
+	}
+}
+
+// stepStatuses maps each step name in result to its status
+func stepStatuses(result *DeployResult) map[string]StepStatus {
+	statuses := make(map[string]StepStatus, len(result.Steps))
+	for _, step := range result.Steps {
+		statuses[step.Name] = step.Status
+	}
+	return statuses
+}
+
+func TestDeployStepStatuses(t *testing.T) {
+	all := func(status StepStatus) map[string]StepStatus {
+		return map[string]StepStatus{
+			"validate": status, "build": status, "test": status, "deploy": status, "verify": status,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		options DeploymentOptions
+		want    map[string]StepStatus
+		wantErr bool
+	}{
+		{"dry run", DeploymentOptions{DryRun: true}, all(StepSkipped), false},
+		{"success", DeploymentOptions{}, all(StepSucceeded), false},
+		{
+			"failed rollout",
+			DeploymentOptions{Rollout: &failingRollout{failBatch: 0}},
+			map[string]StepStatus{
+				"validate": StepSucceeded, "build": StepSucceeded, "test": StepSucceeded,
+				"deploy": StepFailed, "verify": StepNotRun,
+			},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := tt.options
+			options.Clock = newSteppingClock()
+			result, err := NewDeployer(testDeployConfig(), &options).Deploy(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Deploy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if result.Succeeded == tt.wantErr {
+				t.Errorf("Succeeded = %v, want %v", result.Succeeded, !tt.wantErr)
+			}
+			if got := stepStatuses(result); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("step statuses = %v, want %v", got, tt.want)
+			}
+			for _, step := range result.Steps {
+				if step.Status == StepFailed && (step.Err == nil || step.Error == "") {
+					t.Errorf("failed step %s = %+v, want its error", step.Name, step)
+				}
+			}
+		})
+	}
+}
+
+func TestCIStepObserverAnnotatesSteps(t *testing.T) {
+	var out bytes.Buffer
+	options := &DeploymentOptions{
+		Clock:    newSteppingClock(),
+		Rollout:  &failingRollout{failBatch: 0},
+		Observer: NewCIStepObserver(&out),
+	}
+	if _, err := NewDeployer(testDeployConfig(), options).Deploy(context.Background()); err == nil {
+		t.Fatal("Deploy() succeeded, want the rollout failure")
+	}
+
+	// Every step is wrapped in its own group, closed before the next opens
+	var groups, errorLines int
+	open := false
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		switch {
+		case strings.HasPrefix(line, "::group::"):
+			if open {
+				t.Fatalf("group opened inside another:\n%s", out.String())
+			}
+			open = true
+			groups++
+		case line == "::endgroup::":
+			if !open {
+				t.Fatalf("endgroup without group:\n%s", out.String())
+			}
+			open = false
+		case strings.HasPrefix(line, "::error "):
+			errorLines++
+			if !open || !strings.HasPrefix(line, "::error title=Step deploy::") {
+				t.Errorf("error line = %q, want the deploy step's annotation inside its group", line)
+			}
+		}
+	}
+	if open {
+		t.Error("last group never closed")
+	}
+	if groups != 5 || errorLines != 1 {
+		t.Errorf("got %d groups and %d errors, want 5 and 1:\n%s", groups, errorLines, out.String())
+	}
+}
+
+func TestEscapeCI(t *testing.T) {
+	if got, want := escapeCIData("50% done\nnext"), "50%25 done%0Anext"; got != want {
+		t.Errorf("escapeCIData() = %q, want %q", got, want)
+	}
+	if got, want := escapeCIProperty("a:b,c"), "a%3Ab%2Cc"; got != want {
+		t.Errorf("escapeCIProperty() = %q, want %q", got, want)
+	}
+}
+
+// nthCallRollout fails verification on its failOn-th deployed batch,
+// counting from one across every environment it rolls out to
+type nthCallRollout struct {
+	failOn int
+	calls  int
+}
+
+func (r *nthCallRollout) DeployBatch(ctx context.Context, batch RolloutBatch) error {
+	r.calls++
+	return nil
+}
+
+func (r *nthCallRollout) VerifyBatch(ctx context.Context, batch RolloutBatch) error {
+	if r.calls == r.failOn {
+		return errors.New("readiness probe failed")
+	}
+	return nil
+}
+
+func TestPromoteStopsAtFailedEnvironment(t *testing.T) {
+	history := &memoryHistory{}
+	history.Record(context.Background(), DeploymentRecord{Name: "api", Environment: "staging", Version: "v1", Action: "deploy", Success: true})
+	rollout := &nthCallRollout{failOn: 2}
+
+	result, err := Promote(context.Background(), testDeployConfig(), &DeploymentOptions{
+		Clock:             newSteppingClock(),
+		Rollout:           rollout,
+		History:           history,
+		RollbackOnFailure: true,
+	}, []string{"dev", "staging", "prod"})
+	if err == nil || !strings.Contains(err.Error(), "environment staging") {
+		t.Fatalf("Promote() error = %v, want a staging failure", err)
+	}
+
+	if rollout.calls != 2 {
+		t.Errorf("rolled out %d times, want prod not attempted", rollout.calls)
+	}
+	if result.Succeeded {
+		t.Error("promotion reported success")
+	}
+	var attempted []string
+	for _, env := range result.Environments {
+		attempted = append(attempted, fmt.Sprintf("%s=%v", env.Environment, env.Succeeded))
+	}
+	if want := []string{"dev=true", "staging=false"}; !reflect.DeepEqual(attempted, want) {
+		t.Errorf("environments = %v, want %v", attempted, want)
+	}
+	if !reflect.DeepEqual(result.NotAttempted, []string{"prod"}) {
+		t.Errorf("not attempted = %v, want [prod]", result.NotAttempted)
+	}
+
+	// Only the failed environment is rolled back
+	for _, r := range history.records {
+		if r.Action == "rollback" && r.Environment != "staging" {
+			t.Errorf("rolled back %s, want only staging", r.Environment)
+		}
+		if r.Environment == "prod" {
+			t.Errorf("prod has history %+v, want it untouched", r)
+		}
+	}
+	var rolledBack bool
+	for _, r := range history.records {
+		rolledBack = rolledBack || (r.Action == "rollback" && r.Environment == "staging" && r.Version == "v1")
+	}
+	if !rolledBack {
+		t.Errorf("history = %+v, want staging rolled back to v1", history.records)
+	}
+}
+
+func TestPromoteSucceedsThroughEveryEnvironment(t *testing.T) {
+	result, err := Promote(context.Background(), testDeployConfig(), &DeploymentOptions{
+		Clock:   newSteppingClock(),
+		Rollout: &nthCallRollout{},
+	}, []string{"dev", "staging", "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Succeeded || len(result.Environments) != 3 || len(result.NotAttempted) != 0 {
+		t.Errorf("result = %+v, want all three environments deployed", result)
+	}
+}
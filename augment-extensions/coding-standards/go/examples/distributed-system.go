@@ -3,25 +3,99 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/time/rate"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
 )
 
 // Event represents an immutable event in the system
 type Event struct {
-	ID          string            `json:"id"`
-	AggregateID string            `json:"aggregate_id"`
-	Type        string            `json:"type"`
-	Data        json.RawMessage   `json:"data"`
-	Metadata    map[string]string `json:"metadata"`
-	Timestamp   time.Time         `json:"timestamp"`
-	Version     int               `json:"version"`
+	ID            string            `json:"id"`
+	AggregateID   string            `json:"aggregate_id"`
+	AggregateType string            `json:"aggregate_type,omitempty"`
+	Type          string            `json:"type"`
+	Data          json.RawMessage   `json:"data"`
+	Metadata      map[string]string `json:"metadata"`
+	Timestamp     time.Time         `json:"timestamp"`
+	Version       int               `json:"version"`
+}
+
+// ErrUserNotFound is returned when an aggregate has no events
+var ErrUserNotFound = errors.New("user not found")
+
+// ErrEventSequence matches every SequenceError
+var ErrEventSequence = errors.New("event out of sequence")
+
+// SequenceError reports an event whose version doesn't directly follow the
+// version before it
+type SequenceError struct {
+	AggregateID string
+	Expected    int
+	Got         int
+}
+
+func (e *SequenceError) Error() string {
+	var kind string
+	switch {
+	case e.Got == e.Expected-1:
+		kind = "duplicate event"
+	case e.Got < e.Expected:
+		kind = "out-of-order event"
+	default:
+		kind = "gap in event stream"
+	}
+	return fmt.Sprintf("%s for aggregate %s: expected version %d, got %d",
+		kind, e.AggregateID, e.Expected, e.Got)
+}
+
+// Is lets errors.Is match ErrEventSequence
+func (e *SequenceError) Is(target error) bool {
+	return target == ErrEventSequence
+}
+
+// Duplicate reports whether the event repeats the last applied version
+func (e *SequenceError) Duplicate() bool { return e.Got == e.Expected-1 }
+
+// Gap reports whether versions between the last applied one and the event
+// are missing
+func (e *SequenceError) Gap() bool { return e.Got > e.Expected }
+
+// OutOfOrder reports whether the event is older than the last applied one
+func (e *SequenceError) OutOfOrder() bool { return e.Got < e.Expected-1 }
+
+// checkContiguous verifies that each event's version is one more than the
+// one before it. The first version isn't checked, so a tier holding only
+// the newer part of a stream passes.
+func checkContiguous(events []Event) error {
+	for i := 1; i < len(events); i++ {
+		if want := events[i-1].Version + 1; events[i].Version != want {
+			return &SequenceError{AggregateID: events[i].AggregateID, Expected: want, Got: events[i].Version}
+		}
+	}
+	return nil
 }
 
 // EventStore interface for event persistence
@@ -30,39 +104,1477 @@ type EventStore interface {
 	Load(ctx context.Context, aggregateID string) ([]Event, error)
 }
 
+// EventStreamer is implemented by event stores that can replay their whole
+// log in append order. Positions are zero-based offsets into that log and
+// never shift, even when events are archived. ReadAll reads up to limit
+// positions starting at from and returns the events there along with the
+// position to continue from; it returns from itself at the end of the log.
+type EventStreamer interface {
+	ReadAll(ctx context.Context, from, limit int) ([]Event, int, error)
+}
+
+// InMemoryEventStore is an append-only EventStore for demos and tests
+type InMemoryEventStore struct {
+	mu     sync.RWMutex
+	events []Event
+	ids    map[eventKey]bool
+
+	// archived marks positions whose events were moved to an archive. Their
+	// slots keep a tombstone with just the event's identity, so positions
+	// after them don't shift under a resumed replay.
+	archived map[int]bool
+}
+
+// eventKey identifies an event within its aggregate for deduplication
+type eventKey struct {
+	aggregateID string
+	eventID     string
+}
+
+// NewInMemoryEventStore creates an empty in-memory event store
+func NewInMemoryEventStore() *InMemoryEventStore {
+	return &InMemoryEventStore{
+		ids:      make(map[eventKey]bool),
+		archived: make(map[int]bool),
+	}
+}
+
+// Save appends events to the log, skipping any already stored
+func (s *InMemoryEventStore) Save(ctx context.Context, events []Event) error {
+	_, err := s.Append(ctx, events)
+	return err
+}
+
+// Append idempotently appends events and returns the ones that were new.
+// Events whose ID already exists for the aggregate are skipped, so retried
+// commands under at-least-once delivery don't double-apply.
+func (s *InMemoryEventStore) Append(ctx context.Context, events []Event) ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var added []Event
+	for _, event := range events {
+		key := eventKey{aggregateID: event.AggregateID, eventID: event.ID}
+		if s.ids[key] {
+			continue
+		}
+		s.ids[key] = true
+		s.events = append(s.events, event)
+		added = append(added, event)
+	}
+	return added, nil
+}
+
+// Load returns all events for an aggregate in append order. It fails with a
+// SequenceError if their versions aren't contiguous.
+func (s *InMemoryEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []Event
+	for i, event := range s.events {
+		if event.AggregateID == aggregateID && !s.archived[i] {
+			events = append(events, event)
+		}
+	}
+	if err := checkContiguous(events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ReadAll returns the hot events in up to limit positions starting at
+// from. Archived positions are skipped; TieredEventStore.ReadAll fills them
+// in from the archive.
+func (s *InMemoryEventStore) ReadAll(ctx context.Context, from, limit int) ([]Event, int, error) {
+	slots, archived, next := s.readSlots(from, limit)
+
+	events := slots[:0]
+	for i, event := range slots {
+		if !archived[i] {
+			events = append(events, event)
+		}
+	}
+	return events, next, nil
+}
+
+// readSlots copies up to limit log slots starting at from, reporting which
+// of them are archive tombstones
+func (s *InMemoryEventStore) readSlots(from, limit int) ([]Event, []bool, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if from >= len(s.events) {
+		return nil, nil, from
+	}
+	end := from + limit
+	if end > len(s.events) {
+		end = len(s.events)
+	}
+
+	slots := make([]Event, end-from)
+	copy(slots, s.events[from:end])
+	archived := make([]bool, len(slots))
+	for i := range slots {
+		archived[i] = s.archived[from+i]
+	}
+	return slots, archived, end
+}
+
+// olderThan returns hot events of aggregateType recorded before cutoff
+func (s *InMemoryEventStore) olderThan(aggregateType string, cutoff time.Time) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []Event
+	for i, event := range s.events {
+		if s.archived[i] {
+			continue
+		}
+		if event.AggregateType == aggregateType && event.Timestamp.Before(cutoff) {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// remove replaces the events with the given IDs by tombstones once they
+// have been archived. Their IDs stay in the dedup index, so Append keeps
+// rejecting them under the same lock.
+func (s *InMemoryEventStore) remove(ids map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, event := range s.events {
+		if s.archived[i] || !ids[event.ID] {
+			continue
+		}
+		s.events[i] = Event{ID: event.ID, AggregateID: event.AggregateID}
+		s.archived[i] = true
+	}
+}
+
+// Serializer encodes values for storage. Its ID is stored alongside the
+// encoded bytes so data written with one serializer stays readable after
+// the default changes.
+type Serializer interface {
+	ID() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONSerializer encodes values as JSON. It is the default.
+type JSONSerializer struct{}
+
+func (JSONSerializer) ID() string                                 { return "json" }
+func (JSONSerializer) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (JSONSerializer) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// MsgpackSerializer encodes values as MessagePack, which is more compact
+// and faster than JSON
+type MsgpackSerializer struct{}
+
+func (MsgpackSerializer) ID() string                            { return "msgpack" }
+func (MsgpackSerializer) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+func (MsgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// ErrNotProtoMessage is returned when ProtobufSerializer is given a value
+// it can't encode
+var ErrNotProtoMessage = errors.New("value is not a protobuf message")
+
+// protoMarshaler is implemented by types that encode themselves in
+// protobuf wire format without generated code, such as User and Event
+type protoMarshaler interface {
+	MarshalProto() ([]byte, error)
+}
+
+// protoUnmarshaler decodes what a protoMarshaler encoded
+type protoUnmarshaler interface {
+	UnmarshalProto(data []byte) error
+}
+
+// ProtobufSerializer encodes generated protobuf messages, and User and
+// Event through their hand-written wire conversions
+type ProtobufSerializer struct{}
+
+func (ProtobufSerializer) ID() string { return "proto" }
+
+func (ProtobufSerializer) Marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.Marshal(v)
+	case protoMarshaler:
+		return v.MarshalProto()
+	}
+	return nil, fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+}
+
+func (ProtobufSerializer) Unmarshal(data []byte, v interface{}) error {
+	switch v := v.(type) {
+	case proto.Message:
+		return proto.Unmarshal(data, v)
+	case protoUnmarshaler:
+		return v.UnmarshalProto(data)
+	}
+	return fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+}
+
+// appendProtoString appends a string field, omitting it when empty as
+// proto3 does
+func appendProtoString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendProtoBytes appends a bytes or embedded message field, omitting it
+// when empty
+func appendProtoBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendProtoVarint appends an integer field, omitting it when zero
+func appendProtoVarint(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
+
+// consumeProtoFields calls field for each field of a protobuf message.
+// field returns how many bytes of the value it consumed, or 0 to skip an
+// unknown field.
+func consumeProtoFields(data []byte, field func(num protowire.Number, typ protowire.Type, value []byte) int) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+
+		n = field(num, typ, data)
+		if n == 0 {
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// consumeProtoString decodes a string field value into dst
+func consumeProtoString(value []byte, dst *string) int {
+	v, n := protowire.ConsumeString(value)
+	*dst = v
+	return n
+}
+
+// consumeProtoInt decodes an integer field value into dst
+func consumeProtoInt(value []byte, dst *int) int {
+	v, n := protowire.ConsumeVarint(value)
+	*dst = int(int64(v))
+	return n
+}
+
+// MarshalProto encodes the event as the message
+//
+//	message Event {
+//	  string id = 1;
+//	  string aggregate_id = 2;
+//	  string aggregate_type = 3;
+//	  string type = 4;
+//	  bytes data = 5;
+//	  map<string, string> metadata = 6;
+//	  google.protobuf.Timestamp timestamp = 7;
+//	  int64 version = 8;
+//	}
+func (e Event) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendProtoString(b, 1, e.ID)
+	b = appendProtoString(b, 2, e.AggregateID)
+	b = appendProtoString(b, 3, e.AggregateType)
+	b = appendProtoString(b, 4, e.Type)
+	b = appendProtoBytes(b, 5, e.Data)
+
+	keys := make([]string, 0, len(e.Metadata))
+	for k := range e.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		entry := appendProtoString(nil, 1, k)
+		entry = appendProtoString(entry, 2, e.Metadata[k])
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+
+	if !e.Timestamp.IsZero() {
+		ts := appendProtoVarint(nil, 1, e.Timestamp.Unix())
+		ts = appendProtoVarint(ts, 2, int64(e.Timestamp.Nanosecond()))
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts)
+	}
+
+	b = appendProtoVarint(b, 8, int64(e.Version))
+	return b, nil
+}
+
+// UnmarshalProto decodes an event encoded by MarshalProto
+func (e *Event) UnmarshalProto(data []byte) error {
+	*e = Event{}
+	return consumeProtoFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		if typ == protowire.VarintType && num == 8 {
+			return consumeProtoInt(value, &e.Version)
+		}
+		if typ != protowire.BytesType {
+			return 0
+		}
+
+		switch num {
+		case 1:
+			return consumeProtoString(value, &e.ID)
+		case 2:
+			return consumeProtoString(value, &e.AggregateID)
+		case 3:
+			return consumeProtoString(value, &e.AggregateType)
+		case 4:
+			return consumeProtoString(value, &e.Type)
+		case 5:
+			v, n := protowire.ConsumeBytes(value)
+			e.Data = append(json.RawMessage(nil), v...)
+			return n
+		case 6:
+			entry, n := protowire.ConsumeBytes(value)
+			if n < 0 {
+				return n
+			}
+			var k, v string
+			if err := consumeProtoFields(entry, func(num protowire.Number, typ protowire.Type, value []byte) int {
+				switch {
+				case typ != protowire.BytesType:
+					return 0
+				case num == 1:
+					return consumeProtoString(value, &k)
+				case num == 2:
+					return consumeProtoString(value, &v)
+				}
+				return 0
+			}); err != nil {
+				return -1
+			}
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]string)
+			}
+			e.Metadata[k] = v
+			return n
+		case 7:
+			ts, n := protowire.ConsumeBytes(value)
+			if n < 0 {
+				return n
+			}
+			var seconds, nanos int
+			if err := consumeProtoFields(ts, func(num protowire.Number, typ protowire.Type, value []byte) int {
+				switch {
+				case typ != protowire.VarintType:
+					return 0
+				case num == 1:
+					return consumeProtoInt(value, &seconds)
+				case num == 2:
+					return consumeProtoInt(value, &nanos)
+				}
+				return 0
+			}); err != nil {
+				return -1
+			}
+			e.Timestamp = time.Unix(int64(seconds), int64(nanos)).UTC()
+			return n
+		}
+		return 0
+	})
+}
+
+// serializers resolves the serializer ID recorded with stored data
+var serializers = map[string]Serializer{
+	JSONSerializer{}.ID():     JSONSerializer{},
+	MsgpackSerializer{}.ID():  MsgpackSerializer{},
+	ProtobufSerializer{}.ID(): ProtobufSerializer{},
+}
+
+// encodeTagged encodes v with s, prefixed by the serializer ID
+func encodeTagged(s Serializer, v interface{}) ([]byte, error) {
+	data, err := s.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(s.ID()+":"), data...), nil
+}
+
+// decodeTagged decodes data written by encodeTagged using the serializer
+// it records. Untagged data predates serializers and is read as JSON.
+func decodeTagged(data []byte, v interface{}) error {
+	if id, payload, found := bytes.Cut(data, []byte(":")); found {
+		if s, ok := serializers[string(id)]; ok {
+			return s.Unmarshal(payload, v)
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ArchiveStore is cold storage for events moved out of the hot store
+type ArchiveStore interface {
+	Archive(ctx context.Context, events []Event) error
+	Load(ctx context.Context, aggregateID string) ([]Event, error)
+}
+
+// InMemoryArchiveStore is an ArchiveStore for demos and tests. Events are
+// kept encoded, as a real cold store would, so serializers can be compared.
+type InMemoryArchiveStore struct {
+	mu         sync.RWMutex
+	events     map[string][][]byte
+	serializer Serializer
+}
+
+// ArchiveOption configures an InMemoryArchiveStore
+type ArchiveOption func(*InMemoryArchiveStore)
+
+// WithArchiveSerializer sets how archived events are encoded. Defaults to
+// JSON.
+func WithArchiveSerializer(s Serializer) ArchiveOption {
+	return func(a *InMemoryArchiveStore) {
+		a.serializer = s
+	}
+}
+
+// NewInMemoryArchiveStore creates an empty in-memory archive
+func NewInMemoryArchiveStore(opts ...ArchiveOption) *InMemoryArchiveStore {
+	a := &InMemoryArchiveStore{
+		events:     make(map[string][][]byte),
+		serializer: JSONSerializer{},
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// Archive stores events in cold storage. Nothing is stored if any event
+// fails to encode.
+func (a *InMemoryArchiveStore) Archive(ctx context.Context, events []Event) error {
+	encoded := make([][]byte, len(events))
+	for i, event := range events {
+		data, err := encodeTagged(a.serializer, event)
+		if err != nil {
+			return fmt.Errorf("failed to encode event %s: %w", event.ID, err)
+		}
+		encoded[i] = data
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i, event := range events {
+		a.events[event.AggregateID] = append(a.events[event.AggregateID], encoded[i])
+	}
+	return nil
+}
+
+// Load returns the archived events for an aggregate
+func (a *InMemoryArchiveStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	events := make([]Event, len(a.events[aggregateID]))
+	for i, data := range a.events[aggregateID] {
+		if err := decodeTagged(data, &events[i]); err != nil {
+			return nil, fmt.Errorf("failed to decode archived event: %w", err)
+		}
+	}
+	return events, nil
+}
+
+// TieredEventStore keeps recent events hot and moves events older than a
+// per-aggregate-type retention to an ArchiveStore. Load transparently merges
+// both tiers so aggregates stay replayable after archiving.
+type TieredEventStore struct {
+	hot     *InMemoryEventStore
+	archive ArchiveStore
+	clock   Clock
+
+	mu        sync.RWMutex
+	retention map[string]time.Duration
+}
+
+// NewTieredEventStore creates a tiered store over hot and archive storage
+func NewTieredEventStore(hot *InMemoryEventStore, archive ArchiveStore, clock Clock) *TieredEventStore {
+	if clock == nil {
+		clock = RealClock{}
+	}
+	return &TieredEventStore{
+		hot:       hot,
+		archive:   archive,
+		clock:     clock,
+		retention: make(map[string]time.Duration),
+	}
+}
+
+// SetRetention archives events of aggregateType once they are older than maxAge
+func (s *TieredEventStore) SetRetention(aggregateType string, maxAge time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention[aggregateType] = maxAge
+}
+
+// Save appends events to the hot tier, skipping any already stored in
+// either tier
+func (s *TieredEventStore) Save(ctx context.Context, events []Event) error {
+	_, err := s.Append(ctx, events)
+	return err
+}
+
+// Append idempotently appends events and returns the ones that were new.
+// Events archived through this store are still in the hot tier's dedup
+// index; the archive check covers events archived before it was created.
+func (s *TieredEventStore) Append(ctx context.Context, events []Event) ([]Event, error) {
+	archivedIDs := make(map[string]map[string]bool)
+	fresh := make([]Event, 0, len(events))
+
+	for _, event := range events {
+		ids, ok := archivedIDs[event.AggregateID]
+		if !ok {
+			archived, err := s.archive.Load(ctx, event.AggregateID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load archived events: %w", err)
+			}
+			ids = make(map[string]bool, len(archived))
+			for _, a := range archived {
+				ids[a.ID] = true
+			}
+			archivedIDs[event.AggregateID] = ids
+		}
+
+		if !ids[event.ID] {
+			fresh = append(fresh, event)
+		}
+	}
+
+	return s.hot.Append(ctx, fresh)
+}
+
+// Load returns archived and hot events for an aggregate ordered by version
+func (s *TieredEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	archived, err := s.archive.Load(ctx, aggregateID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load archived events: %w", err)
+	}
+
+	hot, err := s.hot.Load(ctx, aggregateID)
+	if err != nil {
+		return nil, err
+	}
+
+	// An event can briefly exist in both tiers if archiving was interrupted
+	seen := make(map[string]bool, len(archived)+len(hot))
+	events := make([]Event, 0, len(archived)+len(hot))
+	for _, event := range append(archived, hot...) {
+		if seen[event.ID] {
+			continue
+		}
+		seen[event.ID] = true
+		events = append(events, event)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Version < events[j].Version
+	})
+	if err := checkContiguous(events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// ReadAll reads the log like InMemoryEventStore.ReadAll but returns archived
+// events in their original positions, so a full replay sees the whole
+// history and resumed replays land on the same events
+func (s *TieredEventStore) ReadAll(ctx context.Context, from, limit int) ([]Event, int, error) {
+	slots, archived, next := s.hot.readSlots(from, limit)
+
+	cold := make(map[string]map[string]Event)
+	for i, event := range slots {
+		if !archived[i] {
+			continue
+		}
+
+		byID, ok := cold[event.AggregateID]
+		if !ok {
+			events, err := s.archive.Load(ctx, event.AggregateID)
+			if err != nil {
+				return nil, from, fmt.Errorf("failed to load archived events: %w", err)
+			}
+			byID = make(map[string]Event, len(events))
+			for _, e := range events {
+				byID[e.ID] = e
+			}
+			cold[event.AggregateID] = byID
+		}
+
+		full, ok := byID[event.ID]
+		if !ok {
+			return nil, from, fmt.Errorf("archived event %s missing from archive", event.ID)
+		}
+		slots[i] = full
+	}
+	return slots, next, nil
+}
+
+// ArchiveExpired moves events past their type's retention to the archive and
+// returns how many were moved. Events are copied to the archive before being
+// removed from the hot tier so a failure never loses data.
+func (s *TieredEventStore) ArchiveExpired(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	retention := make(map[string]time.Duration, len(s.retention))
+	for aggregateType, maxAge := range s.retention {
+		retention[aggregateType] = maxAge
+	}
+	s.mu.RUnlock()
+
+	now := s.clock.Now()
+	archived := 0
+
+	for aggregateType, maxAge := range retention {
+		expired := s.hot.olderThan(aggregateType, now.Add(-maxAge))
+		if len(expired) == 0 {
+			continue
+		}
+
+		if err := s.archive.Archive(ctx, expired); err != nil {
+			return archived, fmt.Errorf("failed to archive %s events: %w", aggregateType, err)
+		}
+
+		ids := make(map[string]bool, len(expired))
+		for _, event := range expired {
+			ids[event.ID] = true
+		}
+		s.hot.remove(ids)
+		archived += len(expired)
+	}
+
+	return archived, nil
+}
+
+// aggregateTypeSeparator splits a type prefix from the rest of an aggregate
+// ID, as in "user:42"
+const aggregateTypeSeparator = ":"
+
+// RoutingEventStore partitions events across backends by aggregate type so
+// each store can be scaled independently. Both Save and Load take the type
+// from the aggregate ID's prefix, as in "user:42", so an aggregate is always
+// read from the backend it was written to. Unprefixed IDs and types without
+// a route use the fallback store.
+type RoutingEventStore struct {
+	mu       sync.RWMutex
+	routes   map[string]EventStore
+	fallback EventStore
+}
+
+// NewRoutingEventStore creates a routing store that sends unrouted aggregate
+// types to fallback
+func NewRoutingEventStore(fallback EventStore) *RoutingEventStore {
+	return &RoutingEventStore{
+		routes:   make(map[string]EventStore),
+		fallback: fallback,
+	}
+}
+
+// Route sends events for aggregateType to store
+func (s *RoutingEventStore) Route(aggregateType string, store EventStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes[aggregateType] = store
+}
+
+// storeFor picks the backend for an aggregate type
+func (s *RoutingEventStore) storeFor(aggregateType string) EventStore {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if store, ok := s.routes[aggregateType]; ok {
+		return store
+	}
+	return s.fallback
+}
+
+// typeFromID extracts the type prefix of an aggregate ID, or "" if it has none
+func typeFromID(aggregateID string) string {
+	prefix, _, found := strings.Cut(aggregateID, aggregateTypeSeparator)
+	if !found {
+		return ""
+	}
+	return prefix
+}
+
+// Save groups events by backend and saves each group. Saves to different
+// backends are not atomic: if one fails, earlier groups stay saved.
+func (s *RoutingEventStore) Save(ctx context.Context, events []Event) error {
+	var order []EventStore
+	groups := make(map[EventStore][]Event)
+
+	for _, event := range events {
+		aggregateType := typeFromID(event.AggregateID)
+		store := s.storeFor(aggregateType)
+		if store == nil {
+			return fmt.Errorf("no event store for aggregate type %q", aggregateType)
+		}
+		if _, ok := groups[store]; !ok {
+			order = append(order, store)
+		}
+		groups[store] = append(groups[store], event)
+	}
+
+	for _, store := range order {
+		if err := store.Save(ctx, groups[store]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load loads an aggregate from the backend its ID prefix routes to
+func (s *RoutingEventStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	aggregateType := typeFromID(aggregateID)
+	store := s.storeFor(aggregateType)
+	if store == nil {
+		return nil, fmt.Errorf("no event store for aggregate type %q", aggregateType)
+	}
+	return store.Load(ctx, aggregateID)
+}
+
+// Projection builds a read model by folding events
+type Projection interface {
+	Apply(event Event) error
+}
+
+// ReplayProgress reports how far a projection rebuild has advanced
+type ReplayProgress struct {
+	Position int
+	Elapsed  time.Duration
+}
+
+// ReplayResult summarizes a completed projection rebuild
+type ReplayResult struct {
+	EventsReplayed int
+	Projections    int
+	Duration       time.Duration
+}
+
+// ProjectionRebuilder owns the live projections and can rebuild them from
+// scratch by replaying the event log. Rebuilt projections are built on fresh
+// instances and only swapped in once the replay has caught up, so readers
+// never observe a half-built model.
+type ProjectionRebuilder struct {
+	source    EventStreamer
+	batchSize int
+
+	mu        sync.RWMutex
+	factories map[string]func() Projection
+	live      map[string]Projection
+
+	// In-progress rebuild state, kept so a cancelled or failed replay can
+	// resume. consumed counts, per projection, the events of the batch at
+	// position already applied, so a batch that failed partway isn't
+	// applied twice to the projections that got through it.
+	pending  map[string]Projection
+	position int
+	consumed map[string]int
+	replayed int
+}
+
+// NewProjectionRebuilder creates a rebuilder reading from source in batches
+func NewProjectionRebuilder(source EventStreamer, batchSize int) *ProjectionRebuilder {
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	return &ProjectionRebuilder{
+		source:    source,
+		batchSize: batchSize,
+		factories: make(map[string]func() Projection),
+		live:      make(map[string]Projection),
+	}
+}
+
+// Register adds a named projection built by factory
+func (pr *ProjectionRebuilder) Register(name string, factory func() Projection) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pr.factories[name] = factory
+	pr.live[name] = factory()
+}
+
+// Projection returns the live projection registered under name
+func (pr *ProjectionRebuilder) Projection(name string) Projection {
+	pr.mu.RLock()
+	defer pr.mu.RUnlock()
+	return pr.live[name]
+}
+
+// Apply feeds a newly committed event to the live projections
+func (pr *ProjectionRebuilder) Apply(event Event) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for name, projection := range pr.live {
+		if err := projection.Apply(event); err != nil {
+			return fmt.Errorf("projection %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Rebuild replays the full event log through fresh projection instances and
+// swaps them in on completion. If ctx is cancelled the partial state is kept
+// and the next call to Rebuild resumes from the last processed position.
+// Rebuild must not be called concurrently with itself.
+func (pr *ProjectionRebuilder) Rebuild(ctx context.Context, progress func(ReplayProgress)) (*ReplayResult, error) {
+	start := time.Now()
+
+	pr.mu.Lock()
+	if pr.pending == nil {
+		pr.pending = make(map[string]Projection, len(pr.factories))
+		for name, factory := range pr.factories {
+			pr.pending[name] = factory()
+		}
+		pr.position = 0
+		pr.consumed = make(map[string]int)
+		pr.replayed = 0
+	} else {
+		log.Printf("Resuming projection rebuild at position %d", pr.position)
+	}
+	pr.mu.Unlock()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("rebuild interrupted at position %d: %w", pr.position, err)
+		}
+
+		batch, next, err := pr.source.ReadAll(ctx, pr.position, pr.batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read events at position %d: %w", pr.position, err)
+		}
+		if next == pr.position {
+			break
+		}
+
+		if err := pr.applyPending(batch, next); err != nil {
+			return nil, err
+		}
+
+		if progress != nil {
+			progress(ReplayProgress{Position: pr.position, Elapsed: time.Since(start)})
+		}
+	}
+
+	// Drain anything appended since the last batch under the write lock so
+	// no live update slips in between the final read and the swap
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for {
+		batch, next, err := pr.source.ReadAll(ctx, pr.position, pr.batchSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read events at position %d: %w", pr.position, err)
+		}
+		if next == pr.position {
+			break
+		}
+		if err := pr.applyLocked(batch, next); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ReplayResult{
+		EventsReplayed: pr.replayed,
+		Projections:    len(pr.pending),
+		Duration:       time.Since(start),
+	}
+
+	pr.live = pr.pending
+	pr.pending = nil
+	pr.position = 0
+	pr.consumed = nil
+	pr.replayed = 0
+
+	return result, nil
+}
+
+func (pr *ProjectionRebuilder) applyPending(batch []Event, next int) error {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.applyLocked(batch, next)
+}
+
+// applyLocked applies a batch read from pr.position up to next to every
+// pending projection. Each projection skips the events it already consumed
+// before an earlier attempt at the batch failed.
+func (pr *ProjectionRebuilder) applyLocked(batch []Event, next int) error {
+	for name, projection := range pr.pending {
+		for i := pr.consumed[name]; i < len(batch); i++ {
+			if err := projection.Apply(batch[i]); err != nil {
+				return fmt.Errorf("projection %s at event %s: %w", name, batch[i].ID, err)
+			}
+			pr.consumed[name] = i + 1
+		}
+	}
+	pr.position = next
+	pr.replayed += len(batch)
+	pr.consumed = make(map[string]int)
+	return nil
+}
+
+// UserEmailProjection is a read model mapping user IDs to current emails
+type UserEmailProjection struct {
+	mu     sync.RWMutex
+	emails map[string]string
+}
+
+// NewUserEmailProjection creates an empty user email projection
+func NewUserEmailProjection() *UserEmailProjection {
+	return &UserEmailProjection{emails: make(map[string]string)}
+}
+
+// Apply updates the read model from a user event
+func (p *UserEmailProjection) Apply(event Event) error {
+	var data struct {
+		Email    string `json:"email"`
+		NewEmail string `json:"new_email"`
+	}
+
+	switch event.Type {
+	case "UserCreated", "UserEmailChanged":
+		if err := json.Unmarshal(event.Data, &data); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	email := data.Email
+	if event.Type == "UserEmailChanged" {
+		email = data.NewEmail
+	}
+
+	p.mu.Lock()
+	p.emails[event.AggregateID] = email
+	p.mu.Unlock()
+	return nil
+}
+
+// Email returns the projected email for a user
+func (p *UserEmailProjection) Email(userID string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	email, ok := p.emails[userID]
+	return email, ok
+}
+
+// Clock abstracts time so time-dependent behavior can be driven
+// deterministically in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// RealClock is a Clock backed by the time package
+type RealClock struct{}
+
+// Now returns the current time
+func (RealClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep pauses the current goroutine for at least the duration d
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
 // CacheManager handles distributed caching operations
 type CacheManager struct {
-	client *redis.Client
+	client     *redis.Client
+	clock      Clock
+	serializer Serializer
+
+	healthy        atomic.Bool
+	healthInterval time.Duration
+	backoffMin     time.Duration
+	backoffMax     time.Duration
+}
+
+// CacheOption configures a CacheManager
+type CacheOption func(*CacheManager)
+
+// WithCacheClock sets the clock used for time-dependent cache behavior
+func WithCacheClock(clock Clock) CacheOption {
+	return func(cm *CacheManager) {
+		cm.clock = clock
+	}
+}
+
+// WithCacheSerializer sets how SetObject encodes values. Defaults to JSON.
+func WithCacheSerializer(s Serializer) CacheOption {
+	return func(cm *CacheManager) {
+		cm.serializer = s
+	}
+}
+
+// WithHealthInterval sets how often Supervise pings Redis while it is
+// reachable. Defaults to 5s.
+func WithHealthInterval(d time.Duration) CacheOption {
+	return func(cm *CacheManager) {
+		cm.healthInterval = d
+	}
+}
+
+// WithReconnectBackoff sets the delay bounds between pings while Redis is
+// unreachable. The delay starts at min and doubles after each failed ping up
+// to max. Defaults to 100ms and 10s.
+func WithReconnectBackoff(min, max time.Duration) CacheOption {
+	return func(cm *CacheManager) {
+		cm.backoffMin = min
+		cm.backoffMax = max
+	}
+}
+
+// NewCacheManager creates a new cache manager
+func NewCacheManager(addr string, opts ...CacheOption) *CacheManager {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: "",
+		DB:       0,
+	})
+
+	cm := &CacheManager{
+		client:         client,
+		clock:          RealClock{},
+		serializer:     JSONSerializer{},
+		healthInterval: 5 * time.Second,
+		backoffMin:     100 * time.Millisecond,
+		backoffMax:     10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(cm)
+	}
+	return cm
+}
+
+// Healthy reports whether Redis answered the most recent ping by Supervise.
+// It is false until the first ping succeeds, so it can back a readiness
+// check directly.
+func (cm *CacheManager) Healthy() bool {
+	return cm.healthy.Load()
+}
+
+// Supervise pings Redis until ctx is canceled, keeping Healthy up to date.
+// While Redis is unreachable it retries with jittered exponential backoff
+// instead of the regular interval, so a recovering server isn't hit in
+// lockstep by every client. Run it in its own goroutine.
+func (cm *CacheManager) Supervise(ctx context.Context) {
+	backoff := cm.backoffMin
+	for first := true; ; first = false {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := cm.client.Ping(pingCtx).Err()
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		wait := cm.healthInterval
+		if err != nil {
+			if cm.healthy.Swap(false) || first {
+				log.Printf("Redis unreachable, reconnecting: %v", err)
+			}
+			wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			if backoff *= 2; backoff > cm.backoffMax {
+				backoff = cm.backoffMax
+			}
+		} else {
+			if !cm.healthy.Swap(true) {
+				log.Println("Redis connection healthy")
+			}
+			backoff = cm.backoffMin
+		}
+
+		select {
+		case <-cm.clock.After(wait):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Get retrieves a value from cache
+func (cm *CacheManager) Get(ctx context.Context, key string) (string, error) {
+	return cm.client.Get(ctx, key).Result()
+}
+
+// Set stores a value in cache with TTL
+func (cm *CacheManager) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return cm.client.Set(ctx, key, value, ttl).Err()
+}
+
+// SetObject encodes value with the cache's serializer and stores it with TTL
+func (cm *CacheManager) SetObject(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	data, err := encodeTagged(cm.serializer, value)
+	if err != nil {
+		return err
+	}
+	return cm.Set(ctx, key, data, ttl)
+}
+
+// DecodeObject decodes a cached value written by SetObject into v, whichever
+// serializer wrote it
+func (cm *CacheManager) DecodeObject(value string, v interface{}) error {
+	return decodeTagged([]byte(value), v)
+}
+
+// Delete removes a value from cache
+func (cm *CacheManager) Delete(ctx context.Context, key string) error {
+	return cm.client.Del(ctx, key).Err()
+}
+
+// maxTransactionRetries bounds how often Transaction retries after a
+// watched key changes
+const maxTransactionRetries = 5
+
+// ErrTransactionConflict is returned when watched keys kept changing through
+// every retry
+var ErrTransactionConflict = errors.New("cache transaction conflict")
+
+// Transaction runs fn with keys WATCHed. fn should read through tx and queue
+// its writes with tx.TxPipelined, which executes them in MULTI/EXEC. If a
+// watched key changes before EXEC, the transaction is discarded and fn runs
+// again with fresh reads, up to maxTransactionRetries times.
+func (cm *CacheManager) Transaction(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 0; attempt < maxTransactionRetries; attempt++ {
+		err := cm.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+
+		// Back off briefly so competing writers don't keep colliding
+		select {
+		case <-cm.clock.After(time.Duration(attempt+1) * 10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return ErrTransactionConflict
+}
+
+// Job is a unit of work carried through a JobQueue
+type Job struct {
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error,omitempty"`
+	EnqueuedAt time.Time       `json:"enqueued_at"`
+}
+
+// JobHandler processes one job. Returning an error schedules a retry until
+// the queue's attempt limit is reached.
+type JobHandler func(ctx context.Context, job Job) error
+
+// JobQueue is a reliable work queue backed by Redis lists. Workers move a
+// job atomically from the pending list to a processing list while they work
+// on it, so a crashed consumer leaves the job recoverable rather than lost.
+// Jobs that fail every attempt are moved to a dead-letter list.
+type JobQueue struct {
+	client       *redis.Client
+	name         string
+	clock        Clock
+	workers      int
+	maxAttempts  int
+	retryBackoff time.Duration
+	pollInterval time.Duration
+}
+
+// JobQueueOption configures a JobQueue
+type JobQueueOption func(*JobQueue)
+
+// WithJobWorkers sets how many jobs are processed concurrently. Defaults to 4.
+func WithJobWorkers(n int) JobQueueOption {
+	return func(q *JobQueue) {
+		q.workers = n
+	}
+}
+
+// WithJobMaxAttempts sets how many times a job is tried before it is
+// dead-lettered. Defaults to 3.
+func WithJobMaxAttempts(n int) JobQueueOption {
+	return func(q *JobQueue) {
+		q.maxAttempts = n
+	}
+}
+
+// WithJobRetryBackoff sets the delay before the first retry; each later
+// retry waits twice as long as the one before. Defaults to 100ms.
+func WithJobRetryBackoff(d time.Duration) JobQueueOption {
+	return func(q *JobQueue) {
+		q.retryBackoff = d
+	}
+}
+
+// WithJobClock sets the clock used for retry backoff
+func WithJobClock(clock Clock) JobQueueOption {
+	return func(q *JobQueue) {
+		q.clock = clock
+	}
+}
+
+// NewJobQueue creates a queue whose lists are stored under "jobs:<name>:"
+func NewJobQueue(client *redis.Client, name string, opts ...JobQueueOption) *JobQueue {
+	q := &JobQueue{
+		client:       client,
+		name:         name,
+		clock:        RealClock{},
+		workers:      4,
+		maxAttempts:  3,
+		retryBackoff: 100 * time.Millisecond,
+		pollInterval: time.Second,
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	if q.workers < 1 {
+		q.workers = 1
+	}
+	if q.maxAttempts < 1 {
+		q.maxAttempts = 1
+	}
+	return q
+}
+
+func (q *JobQueue) pendingKey() string    { return "jobs:" + q.name + ":pending" }
+func (q *JobQueue) processingKey() string { return "jobs:" + q.name + ":processing" }
+func (q *JobQueue) deadKey() string       { return "jobs:" + q.name + ":dead" }
+
+// Enqueue adds a job with the given type and JSON-encoded payload
+func (q *JobQueue) Enqueue(ctx context.Context, jobType string, payload interface{}) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to encode job payload: %w", err)
+	}
+
+	job := Job{
+		ID:         uuid.New().String(),
+		Type:       jobType,
+		Payload:    data,
+		EnqueuedAt: q.clock.Now().UTC(),
+	}
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to encode job: %w", err)
+	}
+	if err := q.client.LPush(ctx, q.pendingKey(), raw).Err(); err != nil {
+		return Job{}, fmt.Errorf("failed to enqueue job: %w", err)
+	}
+	return job, nil
+}
+
+// Run processes jobs with handler on the configured number of workers until
+// ctx is canceled. Cancellation stops workers from taking new jobs; jobs
+// already taken run to completion, including their retries, before Run
+// returns.
+func (q *JobQueue) Run(ctx context.Context, handler JobHandler) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx, handler)
+		}()
+	}
+	wg.Wait()
+}
+
+// work takes jobs one at a time until ctx is canceled
+func (q *JobQueue) work(ctx context.Context, handler JobHandler) {
+	for ctx.Err() == nil {
+		raw, err := q.client.BRPopLPush(ctx, q.pendingKey(), q.processingKey(), q.pollInterval).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Job queue %s: failed to take job: %v", q.name, err)
+			select {
+			case <-q.clock.After(q.pollInterval):
+			case <-ctx.Done():
+			}
+			continue
+		}
+
+		// Finish the job even if shutdown starts while it runs
+		q.process(context.WithoutCancel(ctx), ctx, raw, handler)
+	}
+}
+
+// process runs a taken job until it succeeds or runs out of attempts, then
+// removes it from the processing list. Backoff between attempts is cut short
+// when stop is canceled, sending the job back to pending for the next run.
+func (q *JobQueue) process(ctx, stop context.Context, raw string, handler JobHandler) {
+	var job Job
+	if err := json.Unmarshal([]byte(raw), &job); err != nil {
+		// Keep the original bytes so the job can be inspected
+		original, _ := json.Marshal(raw)
+		job = Job{Payload: original, LastError: fmt.Sprintf("malformed job: %v", err)}
+		q.finish(ctx, raw, q.deadKey(), job)
+		return
+	}
+
+	backoff := q.retryBackoff
+	for {
+		job.Attempts++
+		err := runJob(ctx, handler, job)
+		if err == nil {
+			q.finish(ctx, raw, "", job)
+			return
+		}
+		job.LastError = err.Error()
+
+		if job.Attempts >= q.maxAttempts {
+			log.Printf("Job %s (%s) failed %d times, moving to dead letters: %v", job.ID, job.Type, job.Attempts, err)
+			q.finish(ctx, raw, q.deadKey(), job)
+			return
+		}
+
+		select {
+		case <-q.clock.After(backoff):
+			backoff *= 2
+		case <-stop.Done():
+			q.finish(ctx, raw, q.pendingKey(), job)
+			return
+		}
+	}
+}
+
+// runJob calls handler, turning a panic into an error so one bad job can't
+// take down its worker
+func runJob(ctx context.Context, handler JobHandler, job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
 }
 
-// NewCacheManager creates a new cache manager
-func NewCacheManager(addr string) *CacheManager {
-	client := redis.NewClient(&redis.Options{
-		Addr:     addr,
-		Password: "",
-		DB:       0,
+// finish removes raw from the processing list and, when dest is set, pushes
+// job there in the same transaction
+func (q *JobQueue) finish(ctx context.Context, raw, dest string, job Job) {
+	var encoded []byte
+	if dest != "" {
+		var err error
+		if encoded, err = json.Marshal(job); err != nil {
+			log.Printf("Job queue %s: failed to encode job %s: %v", q.name, job.ID, err)
+			return
+		}
+	}
+
+	_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(ctx, q.processingKey(), 1, raw)
+		if dest != "" {
+			pipe.LPush(ctx, dest, encoded)
+		}
+		return nil
 	})
+	if err != nil {
+		log.Printf("Job queue %s: failed to complete job %s: %v", q.name, job.ID, err)
+	}
+}
 
-	return &CacheManager{client: client}
+// Recover moves jobs left in the processing list by a consumer that died
+// mid-job back to pending. Call it before Run, when no other consumer of the
+// queue is running.
+func (q *JobQueue) Recover(ctx context.Context) (int, error) {
+	moved := 0
+	for {
+		err := q.client.RPopLPush(ctx, q.processingKey(), q.pendingKey()).Err()
+		if err == redis.Nil {
+			return moved, nil
+		}
+		if err != nil {
+			return moved, fmt.Errorf("failed to recover jobs: %w", err)
+		}
+		moved++
+	}
 }
 
-// Get retrieves a value from cache
-func (cm *CacheManager) Get(ctx context.Context, key string) (string, error) {
-	return cm.client.Get(ctx, key).Result()
+// DeadLetters returns up to limit dead-lettered jobs, most recent first
+func (q *JobQueue) DeadLetters(ctx context.Context, limit int64) ([]Job, error) {
+	raws, err := q.client.LRange(ctx, q.deadKey(), 0, limit-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	jobs := make([]Job, 0, len(raws))
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil {
+			return nil, fmt.Errorf("failed to decode dead letter: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
 }
 
-// Set stores a value in cache with TTL
-func (cm *CacheManager) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
-	return cm.client.Set(ctx, key, value, ttl).Err()
+// CacheLookupStatus describes the outcome of a single key in a batch lookup
+type CacheLookupStatus int
+
+const (
+	CacheHit CacheLookupStatus = iota
+	CacheMiss
+	CacheError
+)
+
+// CacheLookup is the per-key result of GetMultiple
+type CacheLookup struct {
+	Status CacheLookupStatus
+	Value  string
+	Err    error
 }
 
-// Delete removes a value from cache
-func (cm *CacheManager) Delete(ctx context.Context, key string) error {
-	return cm.client.Del(ctx, key).Err()
+// CacheLookups maps each requested key to its lookup result
+type CacheLookups map[string]CacheLookup
+
+// Unresolved returns the keys that missed or errored, which callers should
+// load from the source of truth
+func (l CacheLookups) Unresolved() []string {
+	var keys []string
+	for key, lookup := range l {
+		if lookup.Status != CacheHit {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
 }
 
-// GetMultiple retrieves multiple values using pipelining
-func (cm *CacheManager) GetMultiple(ctx context.Context, keys []string) (map[string]string, error) {
+// GetMultiple retrieves multiple values using pipelining. A failure on one
+// key is reported in that key's result rather than failing the whole batch;
+// the returned error is only set when the batch couldn't run at all.
+func (cm *CacheManager) GetMultiple(ctx context.Context, keys []string) (CacheLookups, error) {
 	pipe := cm.client.Pipeline()
 
 	cmds := make(map[string]*redis.StringCmd)
@@ -70,20 +1582,22 @@ func (cm *CacheManager) GetMultiple(ctx context.Context, keys []string) (map[str
 		cmds[key] = pipe.Get(ctx, key)
 	}
 
-	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
-		return nil, err
+	// Exec reports the first failed command; per-key errors are read below
+	if _, err := pipe.Exec(ctx); err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
 	}
 
-	results := make(map[string]string)
+	results := make(CacheLookups, len(cmds))
 	for key, cmd := range cmds {
 		val, err := cmd.Result()
-		if err == redis.Nil {
-			continue
+		switch {
+		case err == redis.Nil:
+			results[key] = CacheLookup{Status: CacheMiss}
+		case err != nil:
+			results[key] = CacheLookup{Status: CacheError, Err: err}
+		default:
+			results[key] = CacheLookup{Status: CacheHit, Value: val}
 		}
-		if err != nil {
-			return nil, err
-		}
-		results[key] = val
 	}
 
 	return results, nil
@@ -109,8 +1623,14 @@ func NewUser(id, email, name string) *User {
 	}
 }
 
-// ApplyEvent applies an event to the user aggregate
+// ApplyEvent applies an event to the user aggregate. The event's version
+// must be exactly one more than the user's; anything else returns a
+// SequenceError and leaves the user unchanged.
 func (u *User) ApplyEvent(event Event) error {
+	if event.Version != u.Version+1 {
+		return &SequenceError{AggregateID: u.ID, Expected: u.Version + 1, Got: event.Version}
+	}
+
 	switch event.Type {
 	case "UserCreated":
 		var data struct {
@@ -152,12 +1672,13 @@ func (u *User) ChangeEmail(newEmail string) error {
 	}
 
 	event := Event{
-		ID:          uuid.New().String(),
-		AggregateID: u.ID,
-		Type:        "UserEmailChanged",
-		Data:        data,
-		Timestamp:   time.Now(),
-		Version:     u.Version + 1,
+		ID:            uuid.New().String(),
+		AggregateID:   u.ID,
+		AggregateType: "user",
+		Type:          "UserEmailChanged",
+		Data:          data,
+		Timestamp:     time.Now(),
+		Version:       u.Version + 1,
 	}
 
 	u.changes = append(u.changes, event)
@@ -174,6 +1695,44 @@ func (u *User) MarkChangesAsCommitted() {
 	u.changes = nil
 }
 
+// MarshalProto encodes the user's state, without uncommitted changes, as
+// the message
+//
+//	message User {
+//	  string id = 1;
+//	  string email = 2;
+//	  string name = 3;
+//	  int64 version = 4;
+//	}
+func (u *User) MarshalProto() ([]byte, error) {
+	var b []byte
+	b = appendProtoString(b, 1, u.ID)
+	b = appendProtoString(b, 2, u.Email)
+	b = appendProtoString(b, 3, u.Name)
+	b = appendProtoVarint(b, 4, int64(u.Version))
+	return b, nil
+}
+
+// UnmarshalProto decodes a user encoded by MarshalProto
+func (u *User) UnmarshalProto(data []byte) error {
+	*u = User{}
+	return consumeProtoFields(data, func(num protowire.Number, typ protowire.Type, value []byte) int {
+		switch {
+		case typ == protowire.VarintType && num == 4:
+			return consumeProtoInt(value, &u.Version)
+		case typ != protowire.BytesType:
+			return 0
+		case num == 1:
+			return consumeProtoString(value, &u.ID)
+		case num == 2:
+			return consumeProtoString(value, &u.Email)
+		case num == 3:
+			return consumeProtoString(value, &u.Name)
+		}
+		return 0
+	})
+}
+
 // DistributedService demonstrates distributed system patterns
 type DistributedService struct {
 	cache      *CacheManager
@@ -188,14 +1747,38 @@ func NewDistributedService(cache *CacheManager, eventStore EventStore) *Distribu
 	}
 }
 
+// cacheCorruptTotal counts cached users that failed to decode. A rising
+// count usually means a writer and reader disagree on the serializer.
+var cacheCorruptTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cache_corrupt_total",
+	Help: "Cached values that failed to decode and were deleted.",
+})
+
+// dropCorrupt records a cached value that failed to decode and deletes it,
+// so the next read repopulates it from the event store
+func (ds *DistributedService) dropCorrupt(ctx context.Context, key string, err error) {
+	cacheCorruptTotal.Inc()
+	log.Printf("Warning: corrupt cache entry %s, falling back to event store: %v", key, err)
+	if err := ds.cache.Delete(ctx, key); err != nil {
+		log.Printf("Failed to delete corrupt cache entry %s: %v", key, err)
+	}
+}
+
+// userCacheKey returns the cache key for a user aggregate
+func userCacheKey(userID string) string {
+	return fmt.Sprintf("user:%s", userID)
+}
+
 // GetUserWithCache retrieves user with cache-aside pattern
 func (ds *DistributedService) GetUserWithCache(ctx context.Context, userID string) (*User, error) {
 	// Try cache first
-	cacheKey := fmt.Sprintf("user:%s", userID)
+	cacheKey := userCacheKey(userID)
 	cached, err := ds.cache.Get(ctx, cacheKey)
 	if err == nil {
 		var user User
-		if err := json.Unmarshal([]byte(cached), &user); err == nil {
+		if err := ds.cache.DecodeObject(cached, &user); err != nil {
+			ds.dropCorrupt(ctx, cacheKey, err)
+		} else {
 			log.Printf("Cache hit for user %s", userID)
 			return &user, nil
 		}
@@ -207,26 +1790,608 @@ func (ds *DistributedService) GetUserWithCache(ctx context.Context, userID strin
 	if err != nil {
 		return nil, err
 	}
+	if len(events) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	user, err := replayUser(userID, events)
+	if err != nil {
+		return nil, err
+	}
+
+	// Store in cache
+	if err := ds.cache.SetObject(ctx, cacheKey, user, userCacheTTL); err != nil {
+		log.Printf("Failed to cache user %s: %v", userID, err)
+	}
+
+	return user, nil
+}
+
+// SaveUser persists the user's uncommitted events and writes the new state
+// through to the cache. The cache write is a WATCHed transaction that only
+// replaces an older cached version, so a slow writer can't overwrite a
+// newer user saved concurrently.
+func (ds *DistributedService) SaveUser(ctx context.Context, user *User) error {
+	changes := user.GetUncommittedChanges()
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if err := ds.eventStore.Save(ctx, changes); err != nil {
+		return fmt.Errorf("failed to save events: %w", err)
+	}
+	user.MarkChangesAsCommitted()
+
+	key := userCacheKey(user.ID)
+	err := ds.cache.Transaction(ctx, func(tx *redis.Tx) error {
+		cached, err := tx.Get(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if err == nil {
+			var current User
+			if ds.cache.DecodeObject(cached, &current) == nil && current.Version >= user.Version {
+				return nil
+			}
+		}
+
+		data, err := encodeTagged(ds.cache.serializer, user)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, data, userCacheTTL)
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		// The events are durable; a stale cache entry just expires. Drop
+		// it so readers fall back to the event store.
+		log.Printf("Failed to update cached user %s: %v", user.ID, err)
+		if err := ds.cache.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete stale cached user %s: %v", user.ID, err)
+		}
+	}
+	return nil
+}
 
+// replayUser rebuilds a user aggregate from its events
+func replayUser(userID string, events []Event) (*User, error) {
 	user := &User{ID: userID}
 	for _, event := range events {
 		if err := user.ApplyEvent(event); err != nil {
 			return nil, err
 		}
 	}
+	return user, nil
+}
+
+// GetUsers loads a batch of users, serving what it can from the cache and
+// falling back to the event store for the rest. Users that fail to load are
+// reported in the error map instead of failing the batch, so list views can
+// render whatever is available. Found users are returned in request order.
+func (ds *DistributedService) GetUsers(ctx context.Context, userIDs []string) ([]*User, map[string]error) {
+	failed := make(map[string]error)
+
+	keys := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		keys[i] = userCacheKey(id)
+	}
 
-	// Store in cache
-	data, _ := json.Marshal(user)
-	ds.cache.Set(ctx, cacheKey, data, 1*time.Hour)
+	lookups, err := ds.cache.GetMultiple(ctx, keys)
+	if err != nil {
+		log.Printf("Batch cache lookup failed, loading all users from event store: %v", err)
+		lookups = nil
+	}
 
-	return user, nil
+	found := make(map[string]*User, len(userIDs))
+	for _, id := range userIDs {
+		if _, done := found[id]; done {
+			continue
+		}
+
+		if lookup, ok := lookups[userCacheKey(id)]; ok && lookup.Status == CacheHit {
+			var user User
+			if err := ds.cache.DecodeObject(lookup.Value, &user); err != nil {
+				ds.dropCorrupt(ctx, userCacheKey(id), err)
+			} else {
+				found[id] = &user
+				continue
+			}
+		}
+
+		events, err := ds.eventStore.Load(ctx, id)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		if len(events) == 0 {
+			failed[id] = ErrUserNotFound
+			continue
+		}
+
+		user, err := replayUser(id, events)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		found[id] = user
+
+		if err := ds.cache.SetObject(ctx, userCacheKey(id), user, userCacheTTL); err != nil {
+			log.Printf("Failed to cache user %s: %v", id, err)
+		}
+	}
+
+	users := make([]*User, 0, len(found))
+	for _, id := range userIDs {
+		if user, ok := found[id]; ok {
+			users = append(users, user)
+			delete(found, id)
+		}
+	}
+
+	return users, failed
+}
+
+// warmConcurrency bounds how many users WarmCache loads at once
+const warmConcurrency = 8
+
+// userCacheTTL is how long cached users live before jitter
+const userCacheTTL = 1 * time.Hour
+
+// jitteredTTL spreads ttl by up to 10% either way, so entries written
+// together, as in a cache warm, don't all expire together and stampede the
+// event store
+func jitteredTTL(ttl time.Duration) time.Duration {
+	spread := int64(ttl) / 10
+	if spread <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// WarmCacheError reports the users WarmCache couldn't cache
+type WarmCacheError struct {
+	Failed map[string]error
+}
+
+func (e *WarmCacheError) Error() string {
+	ids := make([]string, 0, len(e.Failed))
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return fmt.Sprintf("failed to warm %d users: %s", len(ids), strings.Join(ids, ", "))
+}
+
+// WarmCache loads each user from the event store and caches it, e.g. to
+// pre-populate a cold cache after a deploy. Users are loaded concurrently,
+// at most warmConcurrency at a time. A user that fails doesn't stop the
+// rest; failures are returned together as a *WarmCacheError.
+func (ds *DistributedService) WarmCache(ctx context.Context, userIDs []string) error {
+	var (
+		mu     sync.Mutex
+		failed = make(map[string]error)
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, warmConcurrency)
+	)
+
+	for _, id := range userIDs {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			failed[id] = ctx.Err()
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := ds.warmUser(ctx, id); err != nil {
+				mu.Lock()
+				failed[id] = err
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &WarmCacheError{Failed: failed}
+	}
+	return nil
+}
+
+// warmUser replays one user from the event store into the cache
+func (ds *DistributedService) warmUser(ctx context.Context, userID string) error {
+	events, err := ds.eventStore.Load(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		return ErrUserNotFound
+	}
+
+	user, err := replayUser(userID, events)
+	if err != nil {
+		return err
+	}
+	return ds.cache.SetObject(ctx, userCacheKey(userID), user, jitteredTTL(userCacheTTL))
+}
+
+// CheckpointStore persists how far a long-running job has got, so it can
+// resume after an interruption. LoadCheckpoint returns "" when no
+// checkpoint is saved under key.
+type CheckpointStore interface {
+	LoadCheckpoint(ctx context.Context, key string) (string, error)
+	SaveCheckpoint(ctx context.Context, key, value string) error
+	ClearCheckpoint(ctx context.Context, key string) error
+}
+
+// LoadCheckpoint reads a checkpoint saved in Redis
+func (cm *CacheManager) LoadCheckpoint(ctx context.Context, key string) (string, error) {
+	value, err := cm.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return value, err
+}
+
+// SaveCheckpoint stores a checkpoint in Redis without expiry
+func (cm *CacheManager) SaveCheckpoint(ctx context.Context, key, value string) error {
+	return cm.client.Set(ctx, key, value, 0).Err()
+}
+
+// ClearCheckpoint removes a checkpoint once its job has finished
+func (cm *CacheManager) ClearCheckpoint(ctx context.Context, key string) error {
+	return cm.client.Del(ctx, key).Err()
+}
+
+// cacheRebuildCheckpointKey is where RebuildCache keeps its progress
+const cacheRebuildCheckpointKey = "rebuild:user-cache:checkpoint"
+
+// cacheRebuildCheckpointEvery is how many users RebuildCache rebuilds
+// between checkpoint writes
+const cacheRebuildCheckpointEvery = 100
+
+// CacheRebuildOptions tunes RebuildCache
+type CacheRebuildOptions struct {
+	// Rate caps how many users are rebuilt per second, with bursts of up to
+	// Burst. A zero Rate means no limit.
+	Rate  rate.Limit
+	Burst int
+
+	// Concurrency bounds how many users are loaded at once; it defaults to
+	// warmConcurrency
+	Concurrency int
+
+	// Checkpoints stores progress; it defaults to the service's cache
+	Checkpoints CheckpointStore
+
+	// Progress, if set, is called after each user is rebuilt
+	Progress func(CacheRebuildProgress)
+}
+
+// CacheRebuildProgress reports how far a cache rebuild has advanced
+type CacheRebuildProgress struct {
+	Rebuilt int
+	Total   int
+	Elapsed time.Duration
+}
+
+// Throughput returns the users rebuilt per second so far
+func (p CacheRebuildProgress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Rebuilt) / p.Elapsed.Seconds()
+}
+
+// CacheRebuildResult summarizes a cache rebuild. Total counts every known
+// user; Resumed counts those skipped because an earlier, interrupted run
+// had already rebuilt them.
+type CacheRebuildResult struct {
+	CacheRebuildProgress
+	Resumed int
+}
+
+// RebuildCache re-caches every user in the event store, e.g. after a change
+// to the cached format. Users are rebuilt in ID order at no more than
+// opts.Rate per second and opts.Concurrency at a time, so the rebuild
+// doesn't starve live traffic to the event store or Redis.
+//
+// Progress is checkpointed as the highest user ID below which every user
+// is done. If ctx is cancelled the checkpoint is kept and the next call
+// resumes from it; a completed rebuild clears it. Users that fail don't
+// hold the checkpoint back: they're returned together as a
+// *WarmCacheError, to be retried with WarmCache. An interrupted rebuild
+// joins them to its interruption error, since the resumed run won't
+// revisit them.
+func (ds *DistributedService) RebuildCache(ctx context.Context, opts CacheRebuildOptions) (*CacheRebuildResult, error) {
+	start := time.Now()
+
+	streamer, ok := ds.eventStore.(EventStreamer)
+	if !ok {
+		return nil, errors.New("event store can't list aggregates for a cache rebuild")
+	}
+	checkpoints := opts.Checkpoints
+	if checkpoints == nil {
+		checkpoints = ds.cache
+	}
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = warmConcurrency
+	}
+	limit, burst := opts.Rate, opts.Burst
+	if limit == 0 {
+		limit = rate.Inf
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	limiter := rate.NewLimiter(limit, burst)
+
+	ids, err := userAggregateIDs(ctx, streamer)
+	if err != nil {
+		return nil, err
+	}
+	checkpoint, err := checkpoints.LoadCheckpoint(ctx, cacheRebuildCheckpointKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load rebuild checkpoint: %w", err)
+	}
+	resumed := sort.Search(len(ids), func(i int) bool { return ids[i] > checkpoint })
+	if resumed > 0 {
+		log.Printf("Resuming cache rebuild after %s (%d of %d users done)", checkpoint, resumed, len(ids))
+	}
+	pending := ids[resumed:]
+
+	var (
+		mu      sync.Mutex
+		failed  = make(map[string]error)
+		done    = make([]bool, len(pending))
+		next    int // pending[:next] are all done
+		saved   int
+		rebuilt int
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, concurrency)
+	)
+
+	// finish marks pending[i] done and returns the checkpoint to save, if
+	// the contiguous run of finished users has grown enough to write one.
+	// Called with mu held.
+	finish := func(i int) (string, bool) {
+		done[i] = true
+		rebuilt++
+		for next < len(done) && done[next] {
+			next++
+		}
+		if next-saved < cacheRebuildCheckpointEvery {
+			return "", false
+		}
+		saved = next
+		return pending[next-1], true
+	}
+
+	for i, id := range pending {
+		if err := limiter.Wait(ctx); err != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := ds.warmUser(ctx, id)
+			if err != nil && ctx.Err() != nil {
+				// Interrupted, not failed: leave it for the resumed run
+				return
+			}
+
+			mu.Lock()
+			if err != nil {
+				failed[id] = err
+			}
+			value, save := finish(i)
+			progress := CacheRebuildProgress{Rebuilt: resumed + rebuilt, Total: len(ids), Elapsed: time.Since(start)}
+			mu.Unlock()
+
+			if save {
+				if err := checkpoints.SaveCheckpoint(ctx, cacheRebuildCheckpointKey, value); err != nil {
+					log.Printf("Failed to save rebuild checkpoint at %s: %v", value, err)
+				}
+			}
+			if opts.Progress != nil {
+				opts.Progress(progress)
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	result := &CacheRebuildResult{
+		CacheRebuildProgress: CacheRebuildProgress{Rebuilt: resumed + rebuilt, Total: len(ids), Elapsed: time.Since(start)},
+		Resumed:              resumed,
+	}
+
+	if err := ctx.Err(); err != nil {
+		// Save the final watermark with a fresh context, since ctx is done
+		if next > 0 {
+			saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+			defer cancel()
+			if err := checkpoints.SaveCheckpoint(saveCtx, cacheRebuildCheckpointKey, pending[next-1]); err != nil {
+				log.Printf("Failed to save rebuild checkpoint at %s: %v", pending[next-1], err)
+			}
+		}
+		err = fmt.Errorf("cache rebuild interrupted after %d of %d users: %w", result.Rebuilt, result.Total, err)
+		if len(failed) > 0 {
+			err = errors.Join(err, &WarmCacheError{Failed: failed})
+		}
+		return result, err
+	}
+
+	if err := checkpoints.ClearCheckpoint(ctx, cacheRebuildCheckpointKey); err != nil {
+		log.Printf("Failed to clear rebuild checkpoint: %v", err)
+	}
+	if len(failed) > 0 {
+		return result, &WarmCacheError{Failed: failed}
+	}
+	return result, nil
+}
+
+// userAggregateIDs lists the distinct user aggregate IDs in the event log,
+// sorted
+func userAggregateIDs(ctx context.Context, streamer EventStreamer) ([]string, error) {
+	seen := make(map[string]bool)
+	position := 0
+	for {
+		batch, next, err := streamer.ReadAll(ctx, position, 500)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read events at position %d: %w", position, err)
+		}
+		if next == position {
+			break
+		}
+		for _, event := range batch {
+			if event.AggregateType == "user" {
+				seen[event.AggregateID] = true
+			}
+		}
+		position = next
+	}
+
+	ids := make([]string, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// loadEventLog appends the events in an NDJSON file, one event per line,
+// to store. Replaying an exported log rebuilds projections from the real
+// history instead of an empty store.
+func loadEventLog(ctx context.Context, path string, store EventStore) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var events []Event
+	dec := json.NewDecoder(f)
+	for {
+		var event Event
+		if err := dec.Decode(&event); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("failed to decode event %d: %w", len(events)+1, err)
+		}
+		events = append(events, event)
+	}
+
+	if err := store.Save(ctx, events); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// runReplay is the admin entry point that rebuilds all registered projections
+func runReplay(ctx context.Context, rebuilder *ProjectionRebuilder) error {
+	result, err := rebuilder.Rebuild(ctx, func(p ReplayProgress) {
+		log.Printf("Replay progress: %d events (%v)", p.Position, p.Elapsed.Round(time.Millisecond))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Replay complete: %d events through %d projections in %v",
+		result.EventsReplayed, result.Projections, result.Duration.Round(time.Millisecond))
+	return nil
+}
+
+// runCacheRebuild is the admin entry point that re-caches every user
+func runCacheRebuild(ctx context.Context, ds *DistributedService, opts CacheRebuildOptions) error {
+	var reported int64
+	opts.Progress = func(p CacheRebuildProgress) {
+		// Log roughly every 5% rather than on every user
+		step := int64(p.Total/20 + 1)
+		if n := int64(p.Rebuilt) / step; n > atomic.LoadInt64(&reported) {
+			atomic.StoreInt64(&reported, n)
+			log.Printf("Cache rebuild progress: %d/%d users (%.1f/s)", p.Rebuilt, p.Total, p.Throughput())
+		}
+	}
+
+	result, err := ds.RebuildCache(ctx, opts)
+	if result != nil {
+		log.Printf("Cache rebuild: %d/%d users (%d resumed) in %v, %.1f/s",
+			result.Rebuilt, result.Total, result.Resumed, result.Elapsed.Round(time.Millisecond), result.Throughput())
+	}
+	return err
 }
 
 func main() {
-	ctx := context.Background()
+	replay := flag.Bool("replay", false, "rebuild projections by replaying the event store, then exit")
+	eventLog := flag.String("events", "", "NDJSON event log to load into the event store at startup")
+	rebuildCache := flag.Bool("rebuild-cache", false, "re-cache every user from the event store, resuming any interrupted rebuild, then exit")
+	rebuildRate := flag.Float64("rebuild-rate", 200, "users per second to rebuild with -rebuild-cache; 0 means unlimited")
+	rebuildConcurrency := flag.Int("rebuild-concurrency", warmConcurrency, "users to load at once with -rebuild-cache")
+	flag.Parse()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	eventStore := NewInMemoryEventStore()
+	rebuilder := NewProjectionRebuilder(eventStore, 500)
+	rebuilder.Register("user_emails", func() Projection { return NewUserEmailProjection() })
+
+	if *eventLog != "" {
+		n, err := loadEventLog(ctx, *eventLog, eventStore)
+		if err != nil {
+			log.Fatalf("Failed to load event log: %v", err)
+		}
+		log.Printf("Loaded %d events from %s", n, *eventLog)
+	}
+
+	if *replay {
+		if *eventLog == "" {
+			log.Fatal("-replay needs an event log to replay; pass -events")
+		}
+		if err := runReplay(ctx, rebuilder); err != nil {
+			log.Fatalf("Replay failed: %v", err)
+		}
+		return
+	}
 
 	// Initialize cache manager
 	cache := NewCacheManager("localhost:6379")
+	go cache.Supervise(ctx)
+
+	if *rebuildCache {
+		if *eventLog == "" {
+			log.Fatal("-rebuild-cache needs an event log to rebuild from; pass -events")
+		}
+		ds := NewDistributedService(cache, eventStore)
+		if err := runCacheRebuild(ctx, ds, CacheRebuildOptions{
+			Rate:        rate.Limit(*rebuildRate),
+			Burst:       *rebuildConcurrency,
+			Concurrency: *rebuildConcurrency,
+		}); err != nil {
+			log.Fatalf("Cache rebuild failed: %v", err)
+		}
+		return
+	}
 
 	log.Println("Distributed system example started")
 
@@ -0,0 +1,1027 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// userEvent builds a user event with JSON data
+func userEvent(t *testing.T, id, aggregateID, eventType string, version int, data interface{}) Event {
+	t.Helper()
+	raw, err := json.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Event{
+		ID:            id,
+		AggregateID:   aggregateID,
+		AggregateType: "user",
+		Type:          eventType,
+		Data:          raw,
+		Timestamp:     time.Date(2024, 1, 1, 0, 0, version, 0, time.UTC),
+		Version:       version,
+	}
+}
+
+// userHistory returns created and email-changed events for a few users
+func userHistory(t *testing.T) []Event {
+	t.Helper()
+	var events []Event
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("user:%d", i)
+		events = append(events,
+			userEvent(t, id+"-1", id, "UserCreated", 1, map[string]string{"email": id + "@old.example", "name": id}),
+			userEvent(t, id+"-2", id, "UserEmailChanged", 2, map[string]string{"new_email": id + "@new.example"}),
+		)
+	}
+	return events
+}
+
+// countingProjection counts applied events and can fail once at a given
+// count
+type countingProjection struct {
+	applied int
+	failAt  int
+}
+
+func (p *countingProjection) Apply(event Event) error {
+	if p.failAt > 0 && p.applied == p.failAt {
+		p.failAt = 0
+		return errors.New("projection bug")
+	}
+	p.applied++
+	return nil
+}
+
+func TestRebuildMatchesIncrementalProjection(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	rebuilder := NewProjectionRebuilder(store, 2)
+	rebuilder.Register("user_emails", func() Projection { return NewUserEmailProjection() })
+
+	for _, event := range userHistory(t) {
+		if err := store.Save(ctx, []Event{event}); err != nil {
+			t.Fatal(err)
+		}
+		if err := rebuilder.Apply(event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	incremental := rebuilder.Projection("user_emails").(*UserEmailProjection)
+
+	result, err := rebuilder.Rebuild(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := rebuilder.Projection("user_emails").(*UserEmailProjection)
+
+	if rebuilt == incremental {
+		t.Fatal("Rebuild did not swap in a fresh projection")
+	}
+	if !reflect.DeepEqual(rebuilt.emails, incremental.emails) {
+		t.Errorf("rebuilt = %v, incremental = %v", rebuilt.emails, incremental.emails)
+	}
+	if result.EventsReplayed != 6 {
+		t.Errorf("EventsReplayed = %d, want 6", result.EventsReplayed)
+	}
+}
+
+func TestRebuildResumesWithoutReapplying(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	if err := store.Save(ctx, userHistory(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch holds every event, so the flaky projection fails partway
+	// through the same batch the steady one has already applied
+	rebuilder := NewProjectionRebuilder(store, 10)
+	rebuilder.Register("steady", func() Projection { return &countingProjection{} })
+	rebuilder.Register("flaky", func() Projection { return &countingProjection{failAt: 3} })
+
+	if _, err := rebuilder.Rebuild(ctx, nil); err == nil {
+		t.Fatal("expected the first rebuild to fail")
+	}
+	if _, err := rebuilder.Rebuild(ctx, nil); err != nil {
+		t.Fatalf("resumed rebuild: %v", err)
+	}
+
+	for _, name := range []string{"steady", "flaky"} {
+		if got := rebuilder.Projection(name).(*countingProjection).applied; got != 6 {
+			t.Errorf("%s applied %d events, want 6", name, got)
+		}
+	}
+}
+
+func TestRebuildCancelledResumes(t *testing.T) {
+	store := NewInMemoryEventStore()
+	if err := store.Save(context.Background(), userHistory(t)); err != nil {
+		t.Fatal(err)
+	}
+	rebuilder := NewProjectionRebuilder(store, 2)
+	rebuilder.Register("count", func() Projection { return &countingProjection{} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := rebuilder.Rebuild(ctx, func(p ReplayProgress) {
+		if p.Position == 2 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+
+	result, err := rebuilder.Rebuild(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.EventsReplayed != 6 {
+		t.Errorf("EventsReplayed = %d, want 6", result.EventsReplayed)
+	}
+	if got := rebuilder.Projection("count").(*countingProjection).applied; got != 6 {
+		t.Errorf("applied %d events, want 6", got)
+	}
+}
+
+// fixedClock is a Clock stopped at one instant
+type fixedClock struct{ now time.Time }
+
+func (c fixedClock) Now() time.Time                         { return c.now }
+func (c fixedClock) After(d time.Duration) <-chan time.Time { return time.After(0) }
+func (c fixedClock) Sleep(d time.Duration)                  {}
+
+// newArchivingStore returns a tiered store whose clock is a day after the
+// user history, with user events retained for an hour
+func newArchivingStore() *TieredEventStore {
+	clock := fixedClock{now: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}
+	store := NewTieredEventStore(NewInMemoryEventStore(), NewInMemoryArchiveStore(), clock)
+	store.SetRetention("user", time.Hour)
+	return store
+}
+
+func TestArchiveThenLoadReconstructsAggregate(t *testing.T) {
+	ctx := context.Background()
+	store := newArchivingStore()
+	history := userHistory(t)
+	if err := store.Save(ctx, history[:1]); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := store.Load(ctx, "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := store.ArchiveExpired(ctx); err != nil || n != 1 {
+		t.Fatalf("ArchiveExpired = %d, %v; want 1 event", n, err)
+	}
+
+	// A newer event stays hot alongside the archived one
+	recent := history[1]
+	recent.Timestamp = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	if err := store.Save(ctx, []Event{recent}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := store.Load(ctx, "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after[:1], before) {
+		t.Errorf("archived events = %+v, want %+v", after[:1], before)
+	}
+
+	user, err := replayUser("user:1", after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "user:1@new.example" || user.Version != 2 {
+		t.Errorf("user = %+v, want new email at version 2", user)
+	}
+}
+
+func TestReplayAfterArchivalSeesWholeHistory(t *testing.T) {
+	ctx := context.Background()
+	store := newArchivingStore()
+	if err := store.Save(ctx, userHistory(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	rebuilder := NewProjectionRebuilder(store, 2)
+	rebuilder.Register("user_emails", func() Projection { return NewUserEmailProjection() })
+	rebuilder.Register("count", func() Projection { return &countingProjection{} })
+
+	// Interrupt the rebuild after the first batch, then archive everything
+	// before resuming
+	cancelled, cancel := context.WithCancel(ctx)
+	if _, err := rebuilder.Rebuild(cancelled, func(ReplayProgress) { cancel() }); err == nil {
+		t.Fatal("expected the rebuild to be interrupted")
+	}
+	if n, err := store.ArchiveExpired(ctx); err != nil || n != 6 {
+		t.Fatalf("ArchiveExpired = %d, %v; want 6 events", n, err)
+	}
+
+	if _, err := rebuilder.Rebuild(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := rebuilder.Projection("count").(*countingProjection).applied; got != 6 {
+		t.Errorf("replayed %d events, want 6", got)
+	}
+	emails := rebuilder.Projection("user_emails").(*UserEmailProjection)
+	for i := 1; i <= 3; i++ {
+		id := fmt.Sprintf("user:%d", i)
+		if email, _ := emails.Email(id); email != id+"@new.example" {
+			t.Errorf("%s email = %q, want %q", id, email, id+"@new.example")
+		}
+	}
+}
+
+func TestAppendSkipsDuplicateEventID(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	event := userHistory(t)[0]
+
+	added, err := store.Append(ctx, []Event{event})
+	if err != nil || len(added) != 1 {
+		t.Fatalf("first Append = %v, %v; want 1 event", added, err)
+	}
+	added, err = store.Append(ctx, []Event{event})
+	if err != nil || len(added) != 0 {
+		t.Fatalf("second Append = %v, %v; want none", added, err)
+	}
+
+	events, err := store.Load(ctx, event.AggregateID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("stored %d events, want 1", len(events))
+	}
+}
+
+func TestAppendSkipsArchivedEventID(t *testing.T) {
+	ctx := context.Background()
+	store := newArchivingStore()
+	event := userHistory(t)[0]
+
+	if err := store.Save(ctx, []Event{event}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ArchiveExpired(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The hot tier alone must still reject the archived ID
+	if added, err := store.hot.Append(ctx, []Event{event}); err != nil || len(added) != 0 {
+		t.Fatalf("hot Append = %v, %v; want none", added, err)
+	}
+	if added, err := store.Append(ctx, []Event{event}); err != nil || len(added) != 0 {
+		t.Fatalf("Append = %v, %v; want none", added, err)
+	}
+
+	events, err := store.Load(ctx, event.AggregateID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("stored %d events, want 1", len(events))
+	}
+}
+
+func TestRoutingEventStoreRoutesByIDPrefix(t *testing.T) {
+	ctx := context.Background()
+	users := NewInMemoryEventStore()
+	orders := NewInMemoryEventStore()
+	fallback := NewInMemoryEventStore()
+
+	store := NewRoutingEventStore(fallback)
+	store.Route("user", users)
+	store.Route("order", orders)
+
+	order := userEvent(t, "order:7-1", "order:7", "OrderPlaced", 1, map[string]string{})
+	order.AggregateType = "order"
+	// The type field disagrees with the ID; the prefix decides
+	mislabeled := userEvent(t, "user:9-1", "user:9", "UserCreated", 1, map[string]string{})
+	mislabeled.AggregateType = "order"
+	unprefixed := userEvent(t, "42-1", "42", "UserCreated", 1, map[string]string{})
+
+	events := append(userHistory(t), order, mislabeled, unprefixed)
+	if err := store.Save(ctx, events); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	tests := []struct {
+		aggregateID string
+		backend     *InMemoryEventStore
+		want        int
+	}{
+		{"user:1", users, 2},
+		{"user:9", users, 1},
+		{"order:7", orders, 1},
+		{"42", fallback, 1},
+	}
+	for _, tt := range tests {
+		direct, err := tt.backend.Load(ctx, tt.aggregateID)
+		if err != nil || len(direct) != tt.want {
+			t.Errorf("backend Load(%q) = %d events, %v; want %d", tt.aggregateID, len(direct), err, tt.want)
+		}
+		routed, err := store.Load(ctx, tt.aggregateID)
+		if err != nil || !reflect.DeepEqual(routed, direct) {
+			t.Errorf("routed Load(%q) = %v, %v; want %v", tt.aggregateID, routed, err, direct)
+		}
+	}
+
+	if leaked, _ := orders.Load(ctx, "user:9"); len(leaked) != 0 {
+		t.Errorf("order backend holds user:9 events: %v", leaked)
+	}
+}
+
+func TestSerializersRoundTripUserAndEvent(t *testing.T) {
+	event := userEvent(t, "user:1-1", "user:1", "UserCreated", 1, map[string]string{"email": "jane@example.com"})
+	event.Timestamp = time.Date(2024, 1, 1, 12, 30, 0, 123456789, time.UTC)
+	event.Metadata = map[string]string{"actor": "alice", "request_id": "req-1"}
+	user := &User{ID: "user:1", Email: "jane@example.com", Name: "Jane", Version: 3}
+
+	for _, s := range []Serializer{JSONSerializer{}, MsgpackSerializer{}, ProtobufSerializer{}} {
+		t.Run(s.ID(), func(t *testing.T) {
+			data, err := encodeTagged(s, event)
+			if err != nil {
+				t.Fatalf("encode event: %v", err)
+			}
+			var gotEvent Event
+			if err := decodeTagged(data, &gotEvent); err != nil {
+				t.Fatalf("decode event: %v", err)
+			}
+			if !gotEvent.Timestamp.Equal(event.Timestamp) {
+				t.Errorf("timestamp = %v, want %v", gotEvent.Timestamp, event.Timestamp)
+			}
+			gotEvent.Timestamp = event.Timestamp
+			if !reflect.DeepEqual(gotEvent, event) {
+				t.Errorf("event = %+v, want %+v", gotEvent, event)
+			}
+
+			data, err = encodeTagged(s, user)
+			if err != nil {
+				t.Fatalf("encode user: %v", err)
+			}
+			var gotUser User
+			if err := decodeTagged(data, &gotUser); err != nil {
+				t.Fatalf("decode user: %v", err)
+			}
+			if !reflect.DeepEqual(&gotUser, user) {
+				t.Errorf("user = %+v, want %+v", gotUser, *user)
+			}
+		})
+	}
+}
+
+func TestProtobufSerializerRejectsUnknownTypes(t *testing.T) {
+	if _, err := (ProtobufSerializer{}).Marshal(map[string]string{}); !errors.Is(err, ErrNotProtoMessage) {
+		t.Fatalf("Marshal() error = %v, want ErrNotProtoMessage", err)
+	}
+}
+
+func TestArchiveRoundTripsThroughProtobuf(t *testing.T) {
+	ctx := context.Background()
+	archive := NewInMemoryArchiveStore(WithArchiveSerializer(ProtobufSerializer{}))
+	events := userHistory(t)[:2]
+	if err := archive.Archive(ctx, events); err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+
+	got, err := archive.Load(ctx, "user:1")
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, events) {
+		t.Errorf("Load() = %+v, want %+v", got, events)
+	}
+}
+
+func TestGetMultipleReportsPerKeyResults(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cm := NewCacheManager(mr.Addr())
+	mr.Set("user:1", "alice")
+	// A list under a string key makes that GET fail with WRONGTYPE
+	mr.Lpush("user:3", "not-a-string")
+
+	results, err := cm.GetMultiple(context.Background(), []string{"user:1", "user:2", "user:3"})
+	if err != nil {
+		t.Fatalf("GetMultiple() error = %v", err)
+	}
+
+	if got := results["user:1"]; got.Status != CacheHit || got.Value != "alice" {
+		t.Errorf("user:1 = %+v, want hit alice", got)
+	}
+	if got := results["user:2"]; got.Status != CacheMiss {
+		t.Errorf("user:2 = %+v, want miss", got)
+	}
+	if got := results["user:3"]; got.Status != CacheError || got.Err == nil {
+		t.Errorf("user:3 = %+v, want error", got)
+	}
+	if got, want := results.Unresolved(), []string{"user:2", "user:3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unresolved() = %v, want %v", got, want)
+	}
+}
+
+func TestGetMultipleCancelledFailsBatch(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cm := NewCacheManager(mr.Addr())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := cm.GetMultiple(ctx, []string{"user:1"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetMultiple() error = %v, want context.Canceled", err)
+	}
+}
+
+// failingLoadStore fails Load for the listed aggregates
+type failingLoadStore struct {
+	EventStore
+	fail map[string]bool
+}
+
+func (s failingLoadStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	if s.fail[aggregateID] {
+		return nil, errors.New("shard unavailable")
+	}
+	return s.EventStore.Load(ctx, aggregateID)
+}
+
+func TestGetUsersReturnsPartialResults(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	if err := store.Save(ctx, userHistory(t)); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCacheManager(miniredis.RunT(t).Addr())
+	ds := NewDistributedService(cache, failingLoadStore{
+		EventStore: store,
+		fail:       map[string]bool{"user:2": true, "user:3": true},
+	})
+
+	// user:3 is cached, so its failing shard isn't consulted
+	cached := &User{ID: "user:3", Email: "user:3@new.example", Name: "user:3", Version: 2}
+	if err := cache.SetObject(ctx, userCacheKey("user:3"), cached, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	users, failed := ds.GetUsers(ctx, []string{"user:3", "user:1", "user:2", "user:4"})
+
+	var ids []string
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+	if want := []string{"user:3", "user:1"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("users = %v, want %v in request order", ids, want)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("failed = %v, want user:2 and user:4", failed)
+	}
+	if failed["user:2"] == nil {
+		t.Error("user:2 store error not reported")
+	}
+	if !errors.Is(failed["user:4"], ErrUserNotFound) {
+		t.Errorf("user:4 error = %v, want ErrUserNotFound", failed["user:4"])
+	}
+}
+
+// incrementIn returns a transaction body that increments key, calling
+// interfere after each read to simulate a concurrent writer
+func incrementIn(ctx context.Context, key string, interfere func(attempt int)) (func(tx *redis.Tx) error, *int) {
+	attempts := 0
+	return func(tx *redis.Tx) error {
+		attempts++
+		n, err := tx.Get(ctx, key).Int()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		interfere(attempts)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, n+1, 0)
+			return nil
+		})
+		return err
+	}, &attempts
+}
+
+func TestTransactionRetriesAfterWatchedKeyChanges(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	cm := NewCacheManager(mr.Addr())
+	mr.Set("counter", "1")
+
+	fn, attempts := incrementIn(ctx, "counter", func(attempt int) {
+		if attempt == 1 {
+			mr.Set("counter", "10")
+		}
+	})
+	if err := cm.Transaction(ctx, fn, "counter"); err != nil {
+		t.Fatalf("Transaction() error = %v", err)
+	}
+
+	if *attempts != 2 {
+		t.Errorf("ran %d attempts, want 2", *attempts)
+	}
+	if got, _ := mr.Get("counter"); got != "11" {
+		t.Errorf("counter = %s, want 11 (the retry must see the concurrent write)", got)
+	}
+}
+
+func TestTransactionGivesUpOnPersistentConflict(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	cm := NewCacheManager(mr.Addr())
+
+	fn, attempts := incrementIn(ctx, "counter", func(attempt int) {
+		mr.Set("counter", fmt.Sprint(attempt*100))
+	})
+	if err := cm.Transaction(ctx, fn, "counter"); !errors.Is(err, ErrTransactionConflict) {
+		t.Fatalf("Transaction() error = %v, want ErrTransactionConflict", err)
+	}
+	if *attempts != maxTransactionRetries {
+		t.Errorf("ran %d attempts, want %d", *attempts, maxTransactionRetries)
+	}
+}
+
+func TestSaveUserKeepsNewerCachedVersion(t *testing.T) {
+	ctx := context.Background()
+	cache := NewCacheManager(miniredis.RunT(t).Addr())
+	ds := NewDistributedService(cache, NewInMemoryEventStore())
+
+	newer := &User{ID: "user:1", Email: "newer@example.com", Version: 5}
+	if err := cache.SetObject(ctx, userCacheKey("user:1"), newer, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	stale := NewUser("user:1", "stale@example.com", "stale")
+	stale.changes = []Event{userEvent(t, "user:1-1", "user:1", "UserCreated", 1,
+		map[string]string{"email": "stale@example.com", "name": "stale"})}
+	stale.Version = 1
+	if err := ds.SaveUser(ctx, stale); err != nil {
+		t.Fatalf("SaveUser() error = %v", err)
+	}
+
+	raw, err := cache.Get(ctx, userCacheKey("user:1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cached User
+	if err := cache.DecodeObject(raw, &cached); err != nil {
+		t.Fatal(err)
+	}
+	if cached.Version != 5 || cached.Email != "newer@example.com" {
+		t.Errorf("cached user = %+v, want the newer version 5 kept", cached)
+	}
+}
+
+func TestJobQueueRetriesAndDeadLetters(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	queue := NewJobQueue(client, "test", WithJobWorkers(2), WithJobMaxAttempts(3), WithJobRetryBackoff(time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, jobType := range []string{"ok", "flaky", "broken"} {
+		if _, err := queue.Enqueue(ctx, jobType, map[string]string{"type": jobType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	attempts := make(map[string]int)
+	finished := make(chan string, 3)
+	handler := func(ctx context.Context, job Job) error {
+		mu.Lock()
+		attempts[job.Type]++
+		n := attempts[job.Type]
+		mu.Unlock()
+
+		switch {
+		case job.Type == "flaky" && n == 1:
+			return errors.New("transient")
+		case job.Type == "broken":
+			if n == 3 {
+				finished <- job.Type
+			}
+			return errors.New("permanent")
+		}
+		finished <- job.Type
+		return nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		queue.Run(ctx, handler)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-finished:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("jobs did not finish; attempts so far %v", attempts)
+		}
+	}
+	cancel()
+	<-done
+
+	if want := map[string]int{"ok": 1, "flaky": 2, "broken": 3}; !reflect.DeepEqual(attempts, want) {
+		t.Errorf("attempts = %v, want %v", attempts, want)
+	}
+
+	dead, err := queue.DeadLetters(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || dead[0].Type != "broken" || dead[0].Attempts != 3 || dead[0].LastError != "permanent" {
+		t.Errorf("dead letters = %+v, want only the broken job after 3 attempts", dead)
+	}
+	for _, key := range []string{queue.pendingKey(), queue.processingKey()} {
+		if n, _ := client.LLen(context.Background(), key).Result(); n != 0 {
+			t.Errorf("%s holds %d jobs, want 0", key, n)
+		}
+	}
+}
+
+func TestJobQueueRecoverRequeuesAbandonedJobs(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	queue := NewJobQueue(client, "test")
+	ctx := context.Background()
+
+	// A consumer took two jobs and died before finishing them
+	for i := 0; i < 2; i++ {
+		if _, err := queue.Enqueue(ctx, "work", i); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.RPopLPush(ctx, queue.pendingKey(), queue.processingKey()).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := queue.Recover(ctx)
+	if err != nil || moved != 2 {
+		t.Fatalf("Recover() = %d, %v; want 2, nil", moved, err)
+	}
+	if n, _ := client.LLen(ctx, queue.pendingKey()).Result(); n != 2 {
+		t.Errorf("pending = %d, want 2", n)
+	}
+}
+
+func TestWarmCachePopulatesUsers(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := NewInMemoryEventStore()
+	if err := store.Save(ctx, userHistory(t)); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCacheManager(mr.Addr())
+	ds := NewDistributedService(cache, failingLoadStore{
+		EventStore: store,
+		fail:       map[string]bool{"user:3": true},
+	})
+
+	err := ds.WarmCache(ctx, []string{"user:1", "user:2", "user:3", "user:4"})
+
+	var warmErr *WarmCacheError
+	if !errors.As(err, &warmErr) {
+		t.Fatalf("WarmCache() error = %v, want *WarmCacheError", err)
+	}
+	if len(warmErr.Failed) != 2 || warmErr.Failed["user:3"] == nil || !errors.Is(warmErr.Failed["user:4"], ErrUserNotFound) {
+		t.Errorf("failed = %v, want user:3 store error and user:4 not found", warmErr.Failed)
+	}
+
+	for _, id := range []string{"user:1", "user:2"} {
+		raw, err := cache.Get(ctx, userCacheKey(id))
+		if err != nil {
+			t.Fatalf("%s not cached: %v", id, err)
+		}
+		var cached User
+		if err := cache.DecodeObject(raw, &cached); err != nil {
+			t.Fatal(err)
+		}
+		if cached.Email != id+"@new.example" || cached.Version != 2 {
+			t.Errorf("cached %s = %+v, want the replayed version 2", id, cached)
+		}
+		if ttl := mr.TTL(userCacheKey(id)); ttl < 54*time.Minute || ttl > 66*time.Minute {
+			t.Errorf("%s TTL = %v, want within 10%% of %v", id, ttl, userCacheTTL)
+		}
+	}
+	if mr.Exists(userCacheKey("user:3")) {
+		t.Error("user:3 cached despite its failed load")
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds pass
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSuperviseTracksRedisHealth(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cm := NewCacheManager(mr.Addr(),
+		WithHealthInterval(5*time.Millisecond),
+		WithReconnectBackoff(5*time.Millisecond, 20*time.Millisecond))
+	if cm.Healthy() {
+		t.Fatal("Healthy() before the first ping, want false")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		cm.Supervise(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, cm.Healthy)
+
+	mr.Close()
+	waitFor(t, func() bool { return !cm.Healthy() })
+
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, cm.Healthy)
+}
+
+func TestApplyEventSequencing(t *testing.T) {
+	created := func(version int) Event {
+		return userEvent(t, fmt.Sprintf("e%d", version), "user:1", "UserCreated", version,
+			map[string]string{"email": "a@example.com", "name": "a"})
+	}
+	changed := func(version int) Event {
+		return userEvent(t, fmt.Sprintf("e%d", version), "user:1", "UserEmailChanged", version,
+			map[string]string{"new_email": fmt.Sprintf("v%d@example.com", version)})
+	}
+
+	tests := []struct {
+		name   string
+		events []Event
+		check  func(*SequenceError) bool
+	}{
+		{"in sequence", []Event{created(1), changed(2), changed(3)}, nil},
+		{"duplicate", []Event{created(1), changed(2), changed(2)}, (*SequenceError).Duplicate},
+		{"gap", []Event{created(1), changed(3)}, (*SequenceError).Gap},
+		{"out of order", []Event{created(1), changed(2), changed(3), changed(1)}, (*SequenceError).OutOfOrder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := NewUser("user:1", "", "")
+			var err error
+			for _, event := range tt.events {
+				if err = user.ApplyEvent(event); err != nil {
+					break
+				}
+			}
+
+			if tt.check == nil {
+				if err != nil || user.Version != 3 || user.Email != "v3@example.com" {
+					t.Fatalf("user = %+v, err = %v; want version 3", user, err)
+				}
+				return
+			}
+			var seqErr *SequenceError
+			if !errors.As(err, &seqErr) || !errors.Is(err, ErrEventSequence) || !tt.check(seqErr) {
+				t.Fatalf("ApplyEvent() error = %v, want a %s SequenceError", err, tt.name)
+			}
+			if want := tt.events[len(tt.events)-2].Version; user.Version != want {
+				t.Errorf("version = %d after the rejected event, want %d unchanged", user.Version, want)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsGappedStream(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	events := []Event{
+		userEvent(t, "e1", "user:1", "UserCreated", 1, map[string]string{"email": "a@example.com", "name": "a"}),
+		userEvent(t, "e3", "user:1", "UserEmailChanged", 3, map[string]string{"new_email": "b@example.com"}),
+	}
+	if err := store.Save(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := store.Load(ctx, "user:1")
+	var seqErr *SequenceError
+	if !errors.As(err, &seqErr) || !seqErr.Gap() || seqErr.Expected != 2 || seqErr.Got != 3 {
+		t.Errorf("Load() error = %v, want a gap expecting version 2", err)
+	}
+}
+
+func TestCorruptCacheEntryFallsBackToStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := NewInMemoryEventStore()
+	if err := store.Save(ctx, userHistory(t)); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCacheManager(mr.Addr())
+	ds := NewDistributedService(cache, store)
+
+	before := testutil.ToFloat64(cacheCorruptTotal)
+	mr.Set(userCacheKey("user:1"), "{not json")
+
+	user, err := ds.GetUserWithCache(ctx, "user:1")
+	if err != nil {
+		t.Fatalf("GetUserWithCache() error = %v", err)
+	}
+	if user.Email != "user:1@new.example" {
+		t.Errorf("user = %+v, want the store's version", user)
+	}
+	if got := testutil.ToFloat64(cacheCorruptTotal) - before; got != 1 {
+		t.Errorf("cache_corrupt_total rose by %v, want 1", got)
+	}
+
+	// The corrupt value is gone; anything cached now decodes
+	if raw, err := cache.Get(ctx, userCacheKey("user:1")); err == nil {
+		var cached User
+		if err := cache.DecodeObject(raw, &cached); err != nil {
+			t.Errorf("cache still holds an undecodable value %q", raw)
+		}
+	}
+}
+
+func TestGetUserWithCacheMissingUser(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	ds := NewDistributedService(NewCacheManager(mr.Addr()), NewInMemoryEventStore())
+
+	if _, err := ds.GetUserWithCache(ctx, "user:9"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("GetUserWithCache() error = %v, want ErrUserNotFound", err)
+	}
+	if mr.Exists(userCacheKey("user:9")) {
+		t.Error("missing user was cached")
+	}
+}
+
+// manyUsers returns a created event for each of n users
+func manyUsers(t *testing.T, n int) []Event {
+	t.Helper()
+	var events []Event
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("user:%02d", i)
+		events = append(events, userEvent(t, id+"-1", id, "UserCreated", 1, map[string]string{"email": id + "@example.com", "name": id}))
+	}
+	return events
+}
+
+// countingLoadStore counts Loads against an in-memory store
+type countingLoadStore struct {
+	*InMemoryEventStore
+	loads int64
+}
+
+func (s *countingLoadStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	atomic.AddInt64(&s.loads, 1)
+	return s.InMemoryEventStore.Load(ctx, aggregateID)
+}
+
+func TestRebuildCacheRespectsRate(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemoryEventStore()
+	if err := store.Save(ctx, manyUsers(t, 20)); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCacheManager(miniredis.RunT(t).Addr())
+	ds := NewDistributedService(cache, store)
+
+	start := time.Now()
+	result, err := ds.RebuildCache(ctx, CacheRebuildOptions{Rate: 100, Burst: 1, Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	// 20 users at 100/s with no burst take at least 19 intervals of 10ms
+	if elapsed < 180*time.Millisecond {
+		t.Errorf("rebuild took %v, want at least 190ms at 100 users/s", elapsed)
+	}
+	if result.Rebuilt != 20 || result.Total != 20 {
+		t.Errorf("result = %+v, want 20 of 20 rebuilt", result)
+	}
+	if got := result.Throughput(); got > 110 {
+		t.Errorf("throughput = %.1f/s, want no more than the 100/s limit", got)
+	}
+	if _, err := cache.Get(ctx, userCacheKey("user:20")); err != nil {
+		t.Errorf("user:20 not cached: %v", err)
+	}
+}
+
+func TestRebuildCacheResumesFromCheckpoint(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := &countingLoadStore{InMemoryEventStore: NewInMemoryEventStore()}
+	if err := store.Save(ctx, manyUsers(t, 10)); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewCacheManager(mr.Addr())
+	ds := NewDistributedService(cache, store)
+
+	interrupted, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, err := ds.RebuildCache(interrupted, CacheRebuildOptions{
+		Concurrency: 1,
+		Progress: func(p CacheRebuildProgress) {
+			if p.Rebuilt == 4 {
+				cancel()
+			}
+		},
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("interrupted rebuild error = %v, want context.Canceled", err)
+	}
+	if checkpoint, _ := mr.Get(cacheRebuildCheckpointKey); checkpoint != "user:04" {
+		t.Errorf("checkpoint = %q, want user:04", checkpoint)
+	}
+
+	atomic.StoreInt64(&store.loads, 0)
+	result, err := ds.RebuildCache(ctx, CacheRebuildOptions{Concurrency: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Resumed != 4 || result.Rebuilt != 10 {
+		t.Errorf("result = %+v, want 4 resumed and 10 rebuilt", result)
+	}
+	if loads := atomic.LoadInt64(&store.loads); loads != 6 {
+		t.Errorf("resumed rebuild loaded %d users, want only the 6 left", loads)
+	}
+	if mr.Exists(cacheRebuildCheckpointKey) {
+		t.Error("checkpoint kept after a completed rebuild")
+	}
+	for i := 1; i <= 10; i++ {
+		if id := fmt.Sprintf("user:%02d", i); !mr.Exists(userCacheKey(id)) {
+			t.Errorf("%s not cached", id)
+		}
+	}
+}
+
+// failingStreamStore fails Load for the listed aggregates but can still list
+// every aggregate for a rebuild
+type failingStreamStore struct {
+	*InMemoryEventStore
+	fail map[string]bool
+}
+
+func (s failingStreamStore) Load(ctx context.Context, aggregateID string) ([]Event, error) {
+	if s.fail[aggregateID] {
+		return nil, errors.New("shard unavailable")
+	}
+	return s.InMemoryEventStore.Load(ctx, aggregateID)
+}
+
+func TestInterruptedRebuildReportsFailures(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := failingStreamStore{InMemoryEventStore: NewInMemoryEventStore(), fail: map[string]bool{"user:02": true}}
+	if err := store.Save(ctx, manyUsers(t, 10)); err != nil {
+		t.Fatal(err)
+	}
+	ds := NewDistributedService(NewCacheManager(mr.Addr()), store)
+
+	interrupted, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, err := ds.RebuildCache(interrupted, CacheRebuildOptions{
+		Concurrency: 1,
+		Progress: func(p CacheRebuildProgress) {
+			if p.Rebuilt == 4 {
+				cancel()
+			}
+		},
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, want context.Canceled", err)
+	}
+	var warmErr *WarmCacheError
+	if !errors.As(err, &warmErr) || warmErr.Failed["user:02"] == nil {
+		t.Fatalf("error = %v, want a *WarmCacheError naming user:02", err)
+	}
+	// The checkpoint moved past user:02, so only the error reports it
+	if checkpoint, _ := mr.Get(cacheRebuildCheckpointKey); checkpoint != "user:04" {
+		t.Errorf("checkpoint = %q, want user:04", checkpoint)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// defaultGatewayTimeout bounds each gRPC call the gateway makes
+const defaultGatewayTimeout = 5 * time.Second
+
+// maxGatewayBodyBytes caps the size of a create request body
+const maxGatewayBodyBytes = 1 << 20
+
+// Gateway serves UserService over HTTP by translating each request into a
+// call on a gRPC client. It's a thin, hand-written alternative to
+// grpc-gateway covering GET /users/{id} and POST /users, which also
+// accepts ?validate_only=true as a dry run.
+type Gateway struct {
+	client  UserServiceClient
+	logger  *slog.Logger
+	timeout time.Duration
+}
+
+// GatewayOption configures a Gateway
+type GatewayOption func(*Gateway)
+
+// WithGatewayTimeout sets the deadline for each gRPC call. The caller's own
+// deadline still applies if it's sooner.
+func WithGatewayTimeout(d time.Duration) GatewayOption {
+	return func(g *Gateway) {
+		g.timeout = d
+	}
+}
+
+// NewGateway creates a gateway calling client
+func NewGateway(client UserServiceClient, logger *slog.Logger, opts ...GatewayOption) *Gateway {
+	g := &Gateway{
+		client:  client,
+		logger:  logger,
+		timeout: defaultGatewayTimeout,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// Handler returns the gateway's routes
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{id}", g.getUser)
+	mux.HandleFunc("POST /users", g.createUser)
+	return mux
+}
+
+// gatewayUser is a user as the gateway renders it
+type gatewayUser struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func fromUserProto(user *UserProto) gatewayUser {
+	return gatewayUser{
+		ID:        user.Id,
+		Name:      user.Name,
+		Email:     user.Email,
+		CreatedAt: time.Unix(user.CreatedAt, 0).UTC(),
+	}
+}
+
+// gatewayProblem is an RFC 7807 problem document carrying the gRPC code it
+// was translated from
+type gatewayProblem struct {
+	Title  string                `json:"title"`
+	Status int                   `json:"status"`
+	Detail string                `json:"detail,omitempty"`
+	Code   string                `json:"code"`
+	Errors []gatewayFieldProblem `json:"errors,omitempty"`
+}
+
+type gatewayFieldProblem struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// callContext derives the context for one gRPC call from r: it carries the
+// gateway's deadline and forwards the caller's bearer token and request ID
+// as metadata
+func (g *Gateway) callContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), g.timeout)
+
+	var pairs []string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		pairs = append(pairs, authorizationKey, auth)
+	}
+	if id := r.Header.Get(requestIDHeader); validRequestID(id) {
+		pairs = append(pairs, requestIDMetadataKey, id)
+	}
+	if len(pairs) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, pairs...)
+	}
+	return ctx, cancel
+}
+
+func (g *Gateway) getUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil || id <= 0 {
+		writeGatewayProblem(w, http.StatusBadRequest, codes.InvalidArgument, "user id must be a positive integer")
+		return
+	}
+
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+
+	resp, err := g.client.GetUser(ctx, &GetUserRequest{Id: id})
+	if err != nil {
+		g.writeCallError(w, r, err)
+		return
+	}
+	writeGatewayJSON(w, http.StatusOK, fromUserProto(resp.User))
+}
+
+func (g *Gateway) createUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGatewayBodyBytes))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeGatewayProblem(w, http.StatusRequestEntityTooLarge, codes.InvalidArgument, "request body too large")
+			return
+		}
+		writeGatewayProblem(w, http.StatusBadRequest, codes.InvalidArgument, "invalid JSON body: "+err.Error())
+		return
+	}
+
+	ctx, cancel := g.callContext(r)
+	defer cancel()
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("validate_only"))
+	resp, err := g.client.CreateUser(ctx, &CreateUserRequest{Name: body.Name, Email: body.Email, DryRun: dryRun})
+	if err != nil {
+		g.writeCallError(w, r, err)
+		return
+	}
+	if dryRun {
+		writeGatewayJSON(w, http.StatusOK, map[string]bool{"valid": true})
+		return
+	}
+	w.Header().Set("Location", "/users/"+strconv.FormatInt(resp.User.Id, 10))
+	writeGatewayJSON(w, http.StatusCreated, fromUserProto(resp.User))
+}
+
+// writeCallError translates a failed gRPC call into a problem. Field
+// violations in a BadRequest detail are listed individually.
+func (g *Gateway) writeCallError(w http.ResponseWriter, r *http.Request, err error) {
+	st := status.Convert(err)
+	code := st.Code()
+	// The client went away or our deadline passed before the server replied;
+	// the error is local and carries no server status
+	if ctxErr := r.Context().Err(); ctxErr != nil && (code == codes.Canceled || code == codes.DeadlineExceeded) {
+		code = status.FromContextError(ctxErr).Code()
+	}
+
+	httpStatus := httpStatusFromCode(code)
+	if httpStatus >= http.StatusInternalServerError {
+		g.logger.Error("gateway call failed", "path", r.URL.Path, "code", code.String(), "error", st.Message())
+	}
+
+	problem := gatewayProblem{
+		Title:  http.StatusText(httpStatus),
+		Status: httpStatus,
+		Detail: st.Message(),
+		Code:   code.String(),
+	}
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range badRequest.FieldViolations {
+				problem.Errors = append(problem.Errors, gatewayFieldProblem{
+					Field:   v.Field,
+					Message: strings.TrimPrefix(v.Description, v.Field+" "),
+				})
+			}
+		}
+	}
+	writeGatewayJSONAs(w, httpStatus, "application/problem+json", problem)
+}
+
+// httpStatusFromCode maps a gRPC code to the HTTP status grpc-gateway uses
+// for it
+func httpStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // client closed request
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeGatewayProblem(w http.ResponseWriter, httpStatus int, code codes.Code, detail string) {
+	writeGatewayJSONAs(w, httpStatus, "application/problem+json", gatewayProblem{
+		Title:  http.StatusText(httpStatus),
+		Status: httpStatus,
+		Detail: detail,
+		Code:   code.String(),
+	})
+}
+
+func writeGatewayJSON(w http.ResponseWriter, httpStatus int, v interface{}) {
+	writeGatewayJSONAs(w, httpStatus, "application/json", v)
+}
+
+func writeGatewayJSONAs(w http.ResponseWriter, httpStatus int, contentType string, v interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(httpStatus)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestGateway serves a UserServiceServer over bufconn and returns a
+// gateway whose client calls it
+func newTestGateway(t *testing.T, service *UserServiceServer, serverOpts []grpc.ServerOption, opts ...GatewayOption) *Gateway {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(serverOpts...)
+	RegisterUserServiceServer(server, service)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return NewGateway(NewUserServiceClient(conn), discardLogger(), opts...)
+}
+
+// serveGateway sends one request through the gateway's handler
+func serveGateway(g *Gateway, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	g.Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGatewayCreatesAndGetsUsers(t *testing.T) {
+	g := newTestGateway(t, NewUserServiceServer(discardLogger()), nil)
+
+	req := httptest.NewRequest("POST", "/users", strings.NewReader(`{"name":"Jane","email":"jane@example.com"}`))
+	rec := serveGateway(g, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	var created gatewayUser
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	location := rec.Header().Get("Location")
+	if created.Name != "Jane" || created.Email != "jane@example.com" || location == "" {
+		t.Fatalf("created = %+v at %q, want Jane with a Location", created, location)
+	}
+
+	rec = serveGateway(g, httptest.NewRequest("GET", location, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var got gatewayUser
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != created {
+		t.Errorf("got %+v, want %+v", got, created)
+	}
+}
+
+func TestGatewayMapsStatusCodes(t *testing.T) {
+	service := NewUserServiceServer(discardLogger(),
+		WithAuthorizer(&RoleAuthorizer{Roles: map[string]string{"alice": "admin"}, Grants: DefaultGrants}))
+	g := newTestGateway(t, service, []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(authUnaryInterceptor(map[string]string{"admin-token": "alice", "viewer-token": "carol"})),
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		token      string
+		wantStatus int
+		wantCode   string
+		wantFields []string
+	}{
+		{"not found", "GET", "/users/999", "", "", http.StatusNotFound, "NotFound", nil},
+		{"bad id", "GET", "/users/abc", "", "", http.StatusBadRequest, "InvalidArgument", nil},
+		{"bad json", "POST", "/users", `{"name":`, "admin-token", http.StatusBadRequest, "InvalidArgument", nil},
+		{"invalid fields", "POST", "/users", `{}`, "admin-token", http.StatusBadRequest, "InvalidArgument", []string{"name", "email"}},
+		{"forbidden", "POST", "/users", `{"name":"Jane","email":"jane@example.com"}`, "viewer-token", http.StatusForbidden, "PermissionDenied", nil},
+		{"bad token", "POST", "/users", `{"name":"Jane","email":"jane@example.com"}`, "nope", http.StatusUnauthorized, "Unauthenticated", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := serveGateway(g, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+			var problem gatewayProblem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Code != tt.wantCode || problem.Status != tt.wantStatus {
+				t.Errorf("problem = %+v, want code %s and status %d", problem, tt.wantCode, tt.wantStatus)
+			}
+			var fields []string
+			for _, f := range problem.Errors {
+				fields = append(fields, f.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.wantFields, ",") {
+				t.Errorf("fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+// blockingUnaryInterceptor holds every call until its context ends
+func blockingUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGatewayTimesOutSlowCalls(t *testing.T) {
+	g := newTestGateway(t, NewUserServiceServer(discardLogger()),
+		[]grpc.ServerOption{grpc.UnaryInterceptor(blockingUnaryInterceptor)},
+		WithGatewayTimeout(50*time.Millisecond))
+
+	start := time.Now()
+	rec := serveGateway(g, httptest.NewRequest("GET", "/users/1", nil))
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504: %s", rec.Code, rec.Body)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timed out after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestGatewayReportsCancelledCaller(t *testing.T) {
+	g := newTestGateway(t, NewUserServiceServer(discardLogger()),
+		[]grpc.ServerOption{grpc.UnaryInterceptor(blockingUnaryInterceptor)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	rec := serveGateway(g, httptest.NewRequest("GET", "/users/1", nil).WithContext(ctx))
+
+	if rec.Code != 499 {
+		t.Errorf("status = %d, want 499 for a caller that went away: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestGatewayForwardsRequestID(t *testing.T) {
+	var got []string
+	capture := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		got = md.Get(requestIDMetadataKey)
+		return handler(ctx, req)
+	}
+	g := newTestGateway(t, NewUserServiceServer(discardLogger()), []grpc.ServerOption{grpc.UnaryInterceptor(capture)})
+
+	req := httptest.NewRequest("GET", "/users/1", nil)
+	req.Header.Set(requestIDHeader, "req-123")
+	serveGateway(g, req)
+
+	if len(got) != 1 || got[0] != "req-123" {
+		t.Errorf("request id metadata = %v, want [req-123]", got)
+	}
+}
+
+func TestGatewayValidateOnly(t *testing.T) {
+	service := NewUserServiceServer(discardLogger())
+	g := newTestGateway(t, service, nil)
+
+	rec := serveGateway(g, httptest.NewRequest("POST", "/users?validate_only=true", strings.NewReader(`{"name":"Jane","email":"jane@example.com"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid dry run = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	rec = serveGateway(g, httptest.NewRequest("POST", "/users?validate_only=true", strings.NewReader(`{"name":"Jane"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid dry run = %d, want 400: %s", rec.Code, rec.Body)
+	}
+
+	if page, err := service.ListUsersPage(context.Background(), &ListUsersPageRequest{PageSize: 10}); err != nil || page.TotalSize != 0 {
+		t.Errorf("users after dry runs = %v (%v), want none", page, err)
+	}
+}
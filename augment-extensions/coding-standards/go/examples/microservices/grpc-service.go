@@ -3,18 +3,43 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/stats"
 	"google.golang.org/grpc/status"
 )
 
@@ -26,102 +51,1319 @@ type User struct {
 	CreatedAt time.Time
 }
 
-var ErrNotFound = errors.New("user not found")
+// Error kinds shared by the service layer. Handlers map them to status codes
+// with errors.Is and errors.As instead of matching messages.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("validation failed")
+	ErrForbidden  = errors.New("forbidden")
+)
+
+// kindError carries a client-facing message for one of the error kinds
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// newError returns an error with the formatted message that matches kind
+// with errors.Is
+func newError(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// ValidationError lists the invalid fields of a request. It matches
+// ErrValidation with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrValidation }
+
+// FieldError describes a validation failure on a single field
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// IDGenerator allocates candidate user IDs. User IDs are int64 on the wire,
+// so the default is a sequence rather than UUIDs. Generators that aren't
+// strictly sequential may hand out an ID that is already taken; the
+// repository rejects those with errIDTaken.
+type IDGenerator interface {
+	NewID() int64
+}
+
+// IDGeneratorFunc adapts a function to an IDGenerator
+type IDGeneratorFunc func() int64
+
+// NewID calls f
+func (f IDGeneratorFunc) NewID() int64 { return f() }
+
+// SequentialIDGenerator issues 1, 2, 3, ... in order. It is the default.
+type SequentialIDGenerator struct {
+	last atomic.Int64
+}
+
+// NewID returns the next ID in the sequence
+func (g *SequentialIDGenerator) NewID() int64 {
+	return g.last.Add(1)
+}
+
+// DeterministicIDGenerator issues positive IDs derived from a seed and a
+// counter, so a test or replay with the same seed sees the same IDs in the
+// same order
+type DeterministicIDGenerator struct {
+	seed string
+	last atomic.Int64
+}
+
+// NewDeterministicIDGenerator creates a replayable generator for seed
+func NewDeterministicIDGenerator(seed string) *DeterministicIDGenerator {
+	return &DeterministicIDGenerator{seed: seed}
+}
+
+// NewID returns the next ID for the generator's seed
+func (g *DeterministicIDGenerator) NewID() int64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", g.seed, g.last.Add(1))
+	return int64(h.Sum64() >> 1)
+}
+
+// Reset restarts the sequence so the same IDs are issued again
+func (g *DeterministicIDGenerator) Reset() {
+	g.last.Store(0)
+}
+
+// errIDTaken is returned by CreateUser when the generated ID is in use
+var errIDTaken = errors.New("user id already taken")
 
 // UserRepository handles user data operations
 type UserRepository struct {
+	mu    sync.RWMutex
 	users map[int64]*User
+	ids   IDGenerator
+}
+
+func NewUserRepository() *UserRepository {
+	return &UserRepository{
+		users: make(map[int64]*User),
+		ids:   &SequentialIDGenerator{},
+	}
+}
+
+func (r *UserRepository) GetUser(ctx context.Context, id int64) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	user, ok := r.users[id]
+	if !ok {
+		return nil, newError(ErrNotFound, "user %d not found", id)
+	}
+	return user, nil
+}
+
+func (r *UserRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, newError(ErrNotFound, "no user with email %s", email)
+}
+
+// ListUsers returns up to limit users with IDs greater than afterID in ID
+// order, plus the total number of users
+func (r *UserRepository) ListUsers(ctx context.Context, afterID int64, limit int) ([]*User, int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]int64, 0, len(r.users))
+	for id := range r.users {
+		if id > afterID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+
+	users := make([]*User, len(ids))
+	for i, id := range ids {
+		users[i] = r.users[id]
+	}
+	return users, len(r.users), nil
+}
+
+// CreateUser stores a user under the next generated ID. It fails with
+// ErrConflict if the email is already registered and with errIDTaken if the
+// ID is already in use. Both are checked under the write lock, so concurrent
+// creates can't register the same email twice.
+func (r *UserRepository) CreateUser(ctx context.Context, name, email string) (*User, error) {
+	id := r.ids.NewID()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.users {
+		if existing.Email == email {
+			return nil, newError(ErrConflict, "email already registered")
+		}
+	}
+	if _, taken := r.users[id]; taken {
+		return nil, fmt.Errorf("%w: %d", errIDTaken, id)
+	}
+
+	user := &User{
+		ID:        id,
+		Name:      name,
+		Email:     email,
+		CreatedAt: time.Now(),
+	}
+	r.users[id] = user
+	return user, nil
+}
+
+// AuditRecord describes a single mutating operation for the audit trail
+type AuditRecord struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Actor     string      `json:"actor"`
+	Action    string      `json:"action"`
+	TargetID  string      `json:"target_id"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+}
+
+// AuditLogger records who changed what
+type AuditLogger interface {
+	Log(ctx context.Context, record AuditRecord) error
+}
+
+// JSONLAuditLogger appends audit records to a file as JSON lines. With
+// rotation configured, the file is renamed to a timestamped backup once it
+// grows past a size or age, and a fresh one is started.
+type JSONLAuditLogger struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	opened   time.Time
+	rotation AuditRotation
+	now      func() time.Time
+}
+
+// AuditRotation configures when JSONLAuditLogger rotates its file. A zero
+// field disables that limit.
+type AuditRotation struct {
+	// MaxSize is the size in bytes a file may reach before rotating
+	MaxSize int64
+	// MaxAge is how long a file is written to before rotating
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files to keep; older ones are deleted
+	MaxBackups int
+}
+
+// AuditLoggerOption configures a JSONLAuditLogger
+type AuditLoggerOption func(*JSONLAuditLogger)
+
+// WithAuditRotation rotates the audit log by size and age
+func WithAuditRotation(rotation AuditRotation) AuditLoggerOption {
+	return func(l *JSONLAuditLogger) {
+		l.rotation = rotation
+	}
+}
+
+// AuditRotationFromEnv reads AUDIT_LOG_MAX_SIZE_MB, AUDIT_LOG_MAX_AGE (a
+// duration) and AUDIT_LOG_MAX_BACKUPS
+func AuditRotationFromEnv() (AuditRotation, error) {
+	var rotation AuditRotation
+	if v := os.Getenv("AUDIT_LOG_MAX_SIZE_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_SIZE_MB %q", v)
+		}
+		rotation.MaxSize = mb << 20
+	}
+	if v := os.Getenv("AUDIT_LOG_MAX_AGE"); v != "" {
+		age, err := time.ParseDuration(v)
+		if err != nil || age < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_AGE %q", v)
+		}
+		rotation.MaxAge = age
+	}
+	if v := os.Getenv("AUDIT_LOG_MAX_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_BACKUPS %q", v)
+		}
+		rotation.MaxBackups = n
+	}
+	return rotation, nil
+}
+
+// NewJSONLAuditLogger opens (or creates) path for appending audit records
+func NewJSONLAuditLogger(path string, opts ...AuditLoggerOption) (*JSONLAuditLogger, error) {
+	l := &JSONLAuditLogger{path: path, now: time.Now}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return l, nil
+}
+
+// open opens l.path for appending and notes its current size
+func (l *JSONLAuditLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	l.opened = l.now()
+	return nil
+}
+
+// Log writes record as a single JSON line, rotating first if the line
+// would take the file past its limits
+func (l *JSONLAuditLogger) Log(ctx context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if l.shouldRotate(int64(len(data))) {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// shouldRotate reports whether writing n more bytes needs a fresh file. A
+// record larger than MaxSize still goes to a file of its own.
+func (l *JSONLAuditLogger) shouldRotate(n int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if max := l.rotation.MaxSize; max > 0 && l.size+n > max {
+		return true
+	}
+	return l.rotation.MaxAge > 0 && l.now().Sub(l.opened) >= l.rotation.MaxAge
+}
+
+// rotate renames the current file to a timestamped backup, opens a fresh
+// one, and prunes backups beyond MaxBackups
+func (l *JSONLAuditLogger) rotate() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	// Keep appending to the current file if it can't be moved aside
+	renameErr := os.Rename(l.path, l.backupName())
+	if err := l.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	return l.prune()
+}
+
+// auditBackupTime formats backup timestamps so names sort by age
+const auditBackupTime = "20060102T150405.000000000"
+
+// backupName returns an unused backup path such as audit-<time>.jsonl
+func (l *JSONLAuditLogger) backupName() string {
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext)
+	at := l.now().UTC()
+	for {
+		name := base + "-" + at.Format(auditBackupTime) + ext
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		at = at.Add(time.Nanosecond)
+	}
+}
+
+// backups lists the rotated files for l.path, oldest first
+func (l *JSONLAuditLogger) backups() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	pattern := strings.TrimSuffix(l.path, ext) + "-*" + ext
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// prune deletes the oldest backups beyond MaxBackups
+func (l *JSONLAuditLogger) prune() error {
+	if l.rotation.MaxBackups <= 0 {
+		return nil
+	}
+	names, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for len(names) > l.rotation.MaxBackups {
+		if err := os.Remove(names[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Close flushes and closes the current file. Logging after Close fails with
+// os.ErrClosed; closing again is a no-op.
+func (l *JSONLAuditLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	syncErr := l.file.Sync()
+	closeErr := l.file.Close()
+	l.file = nil
+	if syncErr != nil {
+		return syncErr
+	}
+	return closeErr
+}
+
+// actorContextKey carries the authenticated identity in a request context
+type actorContextKey struct{}
+
+// WithActor returns a context carrying the authenticated actor identity
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the authenticated actor, or "anonymous"
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorContextKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// Actions checked by an Authorizer. They match the audit record actions.
+const (
+	ActionCreateUser = "user.create"
+	ActionUpdateUser = "user.update"
+	ActionDeleteUser = "user.delete"
+)
+
+// Authorizer decides whether the actor in ctx may perform action on
+// resource, returning an ErrForbidden error if not
+type Authorizer interface {
+	Authorize(ctx context.Context, action, resource string) error
+}
+
+// RoleAuthorizer grants actions by the role of the actor in the context.
+// Actors without a role, including anonymous callers, may do nothing.
+type RoleAuthorizer struct {
+	Roles  map[string]string   // actor -> role
+	Grants map[string][]string // role -> permitted actions; "*" permits all
+}
+
+// DefaultGrants lets admins do anything and editors create and update users
+// but not delete them
+var DefaultGrants = map[string][]string{
+	"admin":  {"*"},
+	"editor": {ActionCreateUser, ActionUpdateUser},
+}
+
+// Authorize implements Authorizer
+func (a *RoleAuthorizer) Authorize(ctx context.Context, action, resource string) error {
+	actor := ActorFromContext(ctx)
+	for _, granted := range a.Grants[a.Roles[actor]] {
+		if granted == "*" || granted == action {
+			return nil
+		}
+	}
+	return newError(ErrForbidden, "%s is not allowed to %s %s", actor, action, resource)
+}
+
+// loggerContextKey carries the call-scoped logger in a request context
+type loggerContextKey struct{}
+
+// ContextWithLogger returns a context carrying logger for FromContext
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// WithFields returns a context whose logger adds args, as slog key-value
+// pairs, to every record
+func WithFields(ctx context.Context, args ...interface{}) context.Context {
+	return ContextWithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// FromContext returns the call-scoped logger, or slog.Default() outside a
+// call
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// UserServiceServer implements the gRPC UserService
+type UserServiceServer struct {
+	repo       *UserRepository
+	logger     *slog.Logger
+	audit      AuditLogger
+	authorizer Authorizer
+	tracer     Tracer
+	metrics    MetricsRecorder
+
+	// authTokens maps bearer tokens to actor identities; see WithAuthTokens
+	authTokens map[string]string
+
+	// createAttempts bounds how many IDs a create tries before giving up
+	createAttempts int
+}
+
+// UserServiceOption configures a UserServiceServer
+type UserServiceOption func(*UserServiceServer)
+
+// WithAuditLogger records create, update, and delete operations to audit
+func WithAuditLogger(audit AuditLogger) UserServiceOption {
+	return func(s *UserServiceServer) {
+		s.audit = audit
+	}
+}
+
+// WithAuthorizer consults authorizer before every write, rejecting denied
+// calls with PermissionDenied
+func WithAuthorizer(authorizer Authorizer) UserServiceOption {
+	return func(s *UserServiceServer) {
+		s.authorizer = authorizer
+	}
+}
+
+// authorize consults the Authorizer, if any, before a write
+func (s *UserServiceServer) authorize(ctx context.Context, action, resource string) error {
+	if s.authorizer == nil {
+		return nil
+	}
+	return s.authorizer.Authorize(ctx, action, resource)
+}
+
+// WithMetrics records the count, latency, and errors of every call with
+// recorder
+func WithMetrics(recorder MetricsRecorder) UserServiceOption {
+	return func(s *UserServiceServer) {
+		s.metrics = recorder
+	}
+}
+
+// WithTracer enables tracing, continuing inbound traceparent metadata
+func WithTracer(tracer Tracer) UserServiceOption {
+	return func(s *UserServiceServer) {
+		s.tracer = tracer
+	}
+}
+
+// WithAuthTokens maps bearer tokens in authorization metadata to the actor
+// recorded for their calls. Calls without a token run as anonymous; calls
+// with an unknown one fail with Unauthenticated.
+func WithAuthTokens(tokens map[string]string) UserServiceOption {
+	return func(s *UserServiceServer) {
+		s.authTokens = tokens
+	}
+}
+
+// WithIDGenerator replaces the repository's sequential ID allocation
+func WithIDGenerator(ids IDGenerator) UserServiceOption {
+	return func(s *UserServiceServer) {
+		s.repo.ids = ids
+	}
+}
+
+// WithCreateAttempts sets how many generated IDs a create tries when they
+// collide with existing users. Defaults to 3.
+func WithCreateAttempts(n int) UserServiceOption {
+	return func(s *UserServiceServer) {
+		s.createAttempts = n
+	}
+}
+
+func NewUserServiceServer(logger *slog.Logger, opts ...UserServiceOption) *UserServiceServer {
+	s := &UserServiceServer{
+		repo:           NewUserRepository(),
+		logger:         logger,
+		createAttempts: 3,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// recordAudit writes an audit record if an AuditLogger is configured.
+// Audit failures are logged but never fail the RPC.
+func (s *UserServiceServer) recordAudit(ctx context.Context, action string, targetID int64, before, after interface{}) {
+	if s.audit == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Actor:     ActorFromContext(ctx),
+		Action:    action,
+		TargetID:  strconv.FormatInt(targetID, 10),
+		Before:    before,
+		After:     after,
+	}
+	if err := s.audit.Log(ctx, record); err != nil {
+		FromContext(ctx).Error("failed to write audit record", "action", action, "target_id", targetID, "error", err)
+	}
+}
+
+// GetUser retrieves a user by ID
+func (s *UserServiceServer) GetUser(ctx context.Context, req *GetUserRequest) (*GetUserResponse, error) {
+	if req.Id <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "user ID must be positive")
+	}
+
+	user, err := s.repo.GetUser(ctx, req.Id)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	return &GetUserResponse{User: toUserProto(user)}, nil
+}
+
+// Page size bounds for ListUsersPage
+const (
+	defaultPageSize = 50
+	maxPageSize     = 1000
+)
+
+// ListUsersPage returns one page of users ordered by ID. The next page token
+// is opaque to clients and empty on the last page.
+func (s *UserServiceServer) ListUsersPage(ctx context.Context, req *ListUsersPageRequest) (*ListUsersPageResponse, error) {
+	pageSize := int(req.PageSize)
+	switch {
+	case pageSize < 0:
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	case pageSize == 0:
+		pageSize = defaultPageSize
+	case pageSize > maxPageSize:
+		pageSize = maxPageSize
+	}
+
+	afterID, err := decodePageToken(req.PageToken)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid page_token")
+	}
+
+	// Fetch one extra to learn whether another page exists
+	users, total, err := s.repo.ListUsers(ctx, afterID, pageSize+1)
+	if err != nil {
+		FromContext(ctx).Error("failed to list users", "error", err)
+		return nil, status.Error(codes.Internal, "internal error")
+	}
+
+	resp := &ListUsersPageResponse{TotalSize: int32(total)}
+	if len(users) > pageSize {
+		users = users[:pageSize]
+		resp.NextPageToken = encodePageToken(users[len(users)-1].ID)
+	}
+
+	resp.Users = make([]*UserProto, len(users))
+	for i, user := range users {
+		resp.Users[i] = toUserProto(user)
+	}
+	return resp, nil
+}
+
+// encodePageToken encodes the last ID of a page as an opaque token
+func encodePageToken(lastID int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(lastID, 10)))
+}
+
+// decodePageToken returns the last ID encoded in token, or 0 for the first page
+func decodePageToken(token string) (int64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+// toUserProto converts a domain user to its wire representation
+func toUserProto(user *User) *UserProto {
+	return &UserProto{
+		Id:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt.Unix(),
+	}
+}
+
+// validateCreateUserRequest checks the required fields of a create request,
+// reporting every violation together in a *ValidationError so clients can
+// fix every field in one go
+func validateCreateUserRequest(req *CreateUserRequest) error {
+	var violations []FieldError
+	if req.Name == "" {
+		violations = append(violations, FieldError{Field: "name", Message: "is required"})
+	}
+	if req.Email == "" {
+		violations = append(violations, FieldError{Field: "email", Message: "is required"})
+	}
+	if len(violations) > 0 {
+		return &ValidationError{Fields: violations}
+	}
+	return nil
+}
+
+// toStatus maps a service error to a gRPC status. Validation errors become
+// InvalidArgument with a BadRequest detail listing each field; unexpected
+// errors are logged and hidden from the client. Errors that already carry a
+// status pass through.
+func (s *UserServiceServer) toStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	var validation *ValidationError
+	switch {
+	case errors.As(err, &validation):
+		violations := make([]*errdetails.BadRequest_FieldViolation, len(validation.Fields))
+		for i, f := range validation.Fields {
+			violations[i] = &errdetails.BadRequest_FieldViolation{
+				Field:       f.Field,
+				Description: f.Field + " " + f.Message,
+			}
+		}
+		st := status.New(codes.InvalidArgument, validation.Error())
+		detailed, detailErr := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+		if detailErr != nil {
+			// Details only fail to attach if they can't be marshaled; the
+			// plain status still carries the messages
+			return st.Err()
+		}
+		return detailed.Err()
+	case errors.Is(err, ErrValidation):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, ErrConflict):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		s.logger.Error("unexpected error", "error", err)
+		return status.Error(codes.Internal, "internal error")
+	}
+}
+
+// createUser stores a user, retrying with a fresh ID when the generated one
+// collides. Collisions are transient, so they are logged rather than
+// reported until the attempts run out.
+func (s *UserServiceServer) createUser(ctx context.Context, name, email string) (*User, error) {
+	for attempt := 1; ; attempt++ {
+		user, err := s.repo.CreateUser(ctx, name, email)
+		if !errors.Is(err, errIDTaken) {
+			return user, err
+		}
+		if attempt >= s.createAttempts {
+			return nil, fmt.Errorf("no free user id after %d attempts: %w", attempt, err)
+		}
+		FromContext(ctx).Warn("user id collision, retrying", "attempt", attempt, "error", err)
+	}
+}
+
+// CreateUser creates a new user. With DryRun set it only validates the
+// request, and the response has no user.
+func (s *UserServiceServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error) {
+	if err := s.authorize(ctx, ActionCreateUser, "users"); err != nil {
+		return nil, s.toStatus(err)
+	}
+	if err := validateCreateUserRequest(req); err != nil {
+		return nil, s.toStatus(err)
+	}
+	// A dry run stops here, replying without a user
+	if req.DryRun {
+		return &CreateUserResponse{}, nil
+	}
+
+	user, err := s.createUser(ctx, req.Name, req.Email)
+	if err != nil {
+		return nil, s.toStatus(err)
+	}
+
+	FromContext(ctx).Info("user created", "id", user.ID, "name", user.Name)
+	s.recordAudit(ctx, "user.create", user.ID, nil, user)
+
+	return &CreateUserResponse{User: toUserProto(user)}, nil
+}
+
+// CreateUsers imports a client stream of create requests and replies with a
+// single summary. Invalid or duplicate entries are reported per index and
+// don't abort the rest of the batch.
+func (s *UserServiceServer) CreateUsers(stream UserService_CreateUsersServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, ActionCreateUser, "users"); err != nil {
+		return s.toStatus(err)
+	}
+	resp := &CreateUsersResponse{}
+	seen := make(map[string]bool)
+
+	for index := int32(0); ; index++ {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// Client went away mid-stream; nothing to reply to
+			FromContext(ctx).Warn("create users stream aborted",
+				"received", index, "created", resp.Created, "error", err)
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return status.FromContextError(ctxErr).Err()
+			}
+			return err
+		}
+
+		if err := s.createUserFromStream(ctx, req, seen); err != nil {
+			err = s.toStatus(err)
+			resp.Failed++
+			resp.Errors = append(resp.Errors, &CreateUsersError{
+				Index:   index,
+				Code:    status.Code(err).String(),
+				Message: status.Convert(err).Message(),
+			})
+			continue
+		}
+		resp.Created++
+	}
+
+	FromContext(ctx).Info("users imported", "created", resp.Created, "failed", resp.Failed)
+	return stream.SendAndClose(resp)
+}
+
+// createUserFromStream validates and stores one streamed create request,
+// rejecting emails already used in the store or earlier in the stream.
+// Dry runs are rejected rather than stored: the import has no way to report
+// an item that was only validated.
+func (s *UserServiceServer) createUserFromStream(ctx context.Context, req *CreateUserRequest, seen map[string]bool) error {
+	if err := validateCreateUserRequest(req); err != nil {
+		return err
+	}
+	if req.DryRun {
+		return &ValidationError{Fields: []FieldError{{Field: "dry_run", Message: "is not supported in a streamed import"}}}
+	}
+
+	if seen[req.Email] {
+		return newError(ErrConflict, "duplicate email in request stream")
+	}
+
+	user, err := s.createUser(ctx, req.Name, req.Email)
+	if err != nil {
+		return err
+	}
+	s.recordAudit(ctx, "user.create", user.ID, nil, user)
+
+	seen[req.Email] = true
+	return nil
+}
+
+// SpanContext identifies a span within a W3C trace
+type SpanContext struct {
+	TraceID string // 32 lowercase hex digits
+	SpanID  string // 16 lowercase hex digits
+	Sampled bool
+}
+
+// IsValid reports whether sc carries usable trace and span IDs
+func (sc SpanContext) IsValid() bool {
+	return isLowerHex(sc.TraceID, 32) && isLowerHex(sc.SpanID, 16) &&
+		strings.Trim(sc.TraceID, "0") != "" && strings.Trim(sc.SpanID, "0") != ""
+}
+
+// Traceparent formats sc as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || !isLowerHex(parts[0], 2) || parts[0] == "ff" || !isLowerHex(parts[3], 2) {
+		return SpanContext{}, false
+	}
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	sc := SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags&0x01 == 1}
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	Name    string
+	Context SpanContext
+	Parent  SpanContext // zero for root spans
+	Start   time.Time
+	EndTime time.Time
+
+	export func(*Span)
+}
+
+// End finishes the span and hands it to the tracer's exporter
+func (s *Span) End() {
+	s.EndTime = time.Now()
+	if s.export != nil {
+		s.export(s)
+	}
+}
+
+// Tracer starts spans. Inject a custom Tracer to capture spans in tests.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, *Span)
+}
+
+// spanContextKey carries the current SpanContext, whether it belongs to a
+// local span or a remote parent read from an inbound request
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns ctx carrying sc as the current span
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the current span context, if any
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// simpleTracer creates spans with random IDs and passes finished spans to
+// export
+type simpleTracer struct {
+	export func(*Span)
+}
+
+// NewTracer creates a Tracer that calls export with every finished span
+func NewTracer(export func(*Span)) Tracer {
+	return &simpleTracer{export: export}
+}
+
+// Start begins a span that is a child of the span in ctx, or a new root
+func (t *simpleTracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{Name: name, Start: time.Now(), export: t.export}
+	if parent, ok := SpanContextFromContext(ctx); ok {
+		span.Parent = parent
+		span.Context = SpanContext{TraceID: parent.TraceID, SpanID: randomHex(8), Sampled: parent.Sampled}
+	} else {
+		span.Context = SpanContext{TraceID: randomHex(16), SpanID: randomHex(8), Sampled: true}
+	}
+	return ContextWithSpanContext(ctx, span.Context), span
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// traceparentKey is the gRPC metadata key carrying W3C trace context
+const traceparentKey = "traceparent"
+
+// MetricsRecorder records call metrics to a monitoring backend, such as
+// Prometheus or an OpenTelemetry collector
+type MetricsRecorder interface {
+	// RecordCall records a finished call to the full method name
+	RecordCall(ctx context.Context, method string, code codes.Code, duration time.Duration)
+}
+
+// isServerError reports whether code blames the server rather than the
+// caller. Only these count toward error rates.
+func isServerError(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.Internal, codes.Unavailable, codes.DataLoss,
+		codes.DeadlineExceeded, codes.Unimplemented:
+		return true
+	}
+	return false
+}
+
+// PrometheusMetricsRecorder records grpc_server_handled_total,
+// grpc_server_errors_total, and grpc_server_handling_seconds
+type PrometheusMetricsRecorder struct {
+	handled  *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewPrometheusMetricsRecorder creates the call metrics and registers them
+// with reg
+func NewPrometheusMetricsRecorder(reg prometheus.Registerer) (*PrometheusMetricsRecorder, error) {
+	m := &PrometheusMetricsRecorder{
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "gRPC calls completed, by method and status code.",
+		}, []string{"method", "code"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_errors_total",
+			Help: "gRPC calls that failed with a server-side status code, by method.",
+		}, []string{"method"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "gRPC call latency, by method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method"}),
+	}
+	for _, c := range []prometheus.Collector{m.handled, m.errors, m.duration} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// RecordCall implements MetricsRecorder
+func (m *PrometheusMetricsRecorder) RecordCall(ctx context.Context, method string, code codes.Code, duration time.Duration) {
+	m.handled.WithLabelValues(method, code.String()).Inc()
+	if isServerError(code) {
+		m.errors.WithLabelValues(method).Inc()
+	}
+	m.duration.WithLabelValues(method).Observe(duration.Seconds())
+}
+
+// OTelMetricsRecorder records the OpenTelemetry RPC server metrics
+// rpc.server.request.count, rpc.server.request.errors, and
+// rpc.server.duration in seconds
+type OTelMetricsRecorder struct {
+	requests otelmetric.Int64Counter
+	errors   otelmetric.Int64Counter
+	duration otelmetric.Float64Histogram
+}
+
+// NewOTelMetricsRecorder creates the call instruments from meter
+func NewOTelMetricsRecorder(meter otelmetric.Meter) (*OTelMetricsRecorder, error) {
+	requests, err := meter.Int64Counter("rpc.server.request.count",
+		otelmetric.WithDescription("gRPC calls completed."))
+	if err != nil {
+		return nil, err
+	}
+	errs, err := meter.Int64Counter("rpc.server.request.errors",
+		otelmetric.WithDescription("gRPC calls that failed with a server-side status code."))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram("rpc.server.duration",
+		otelmetric.WithDescription("gRPC call latency."),
+		otelmetric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	return &OTelMetricsRecorder{requests: requests, errors: errs, duration: duration}, nil
+}
+
+// RecordCall implements MetricsRecorder
+func (m *OTelMetricsRecorder) RecordCall(ctx context.Context, method string, code codes.Code, duration time.Duration) {
+	attrs := otelmetric.WithAttributes(
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.method", method),
+	)
+	m.requests.Add(ctx, 1, attrs, otelmetric.WithAttributes(attribute.Int("rpc.grpc.status_code", int(code))))
+	if isServerError(code) {
+		m.errors.Add(ctx, 1, attrs)
+	}
+	m.duration.Record(ctx, duration.Seconds(), attrs)
+}
+
+// newOTLPMeterProvider exports metrics over OTLP/gRPC to the collector named
+// by the standard OTEL_EXPORTER_OTLP_* environment variables
+func newOTLPMeterProvider(ctx context.Context) (*sdkmetric.MeterProvider, error) {
+	exporter, err := otlpmetricgrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter))), nil
 }
 
-func NewUserRepository() *UserRepository {
-	return &UserRepository{
-		users: make(map[int64]*User),
+// metricsUnaryInterceptor records every unary call with recorder
+func metricsUnaryInterceptor(recorder MetricsRecorder) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		recorder.RecordCall(ctx, info.FullMethod, status.Code(err), time.Since(start))
+		return resp, err
 	}
 }
 
-func (r *UserRepository) GetUser(ctx context.Context, id int64) (*User, error) {
-	user, ok := r.users[id]
-	if !ok {
-		return nil, ErrNotFound
+// metricsStreamInterceptor records every streaming call with recorder once
+// the stream ends
+func metricsStreamInterceptor(recorder MetricsRecorder) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		recorder.RecordCall(ss.Context(), info.FullMethod, status.Code(err), time.Since(start))
+		return err
 	}
-	return user, nil
 }
 
-func (r *UserRepository) CreateUser(ctx context.Context, name, email string) (*User, error) {
-	id := int64(len(r.users) + 1)
-	user := &User{
-		ID:        id,
-		Name:      name,
-		Email:     email,
-		CreatedAt: time.Now(),
+// tracingUnaryInterceptor starts a server span per call, continuing the
+// caller's trace when traceparent metadata is present
+func tracingUnaryInterceptor(tracer Tracer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(traceparentKey); len(values) > 0 {
+				if remote, ok := ParseTraceparent(values[0]); ok {
+					ctx = ContextWithSpanContext(ctx, remote)
+				}
+			}
+		}
+
+		ctx, span := tracer.Start(ctx, info.FullMethod)
+		defer span.End()
+		return handler(ctx, req)
 	}
-	r.users[id] = user
-	return user, nil
 }
 
-// UserServiceServer implements the gRPC UserService
-type UserServiceServer struct {
-	repo   *UserRepository
-	logger *slog.Logger
+// TracingClientInterceptor propagates the current span to outbound calls
+// as traceparent metadata
+func TracingClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if sc, ok := SpanContextFromContext(ctx); ok {
+			ctx = metadata.AppendToOutgoingContext(ctx, traceparentKey, sc.Traceparent())
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
 }
 
-func NewUserServiceServer(logger *slog.Logger) *UserServiceServer {
-	return &UserServiceServer{
-		repo:   NewUserRepository(),
-		logger: logger,
+// requestIDHeader carries the request ID on HTTP requests and responses.
+// gRPC metadata uses the same name, lowercased.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds caller-supplied request IDs
+const maxRequestIDLength = 128
+
+// validRequestID reports whether a caller-supplied ID is safe to adopt: non
+// empty, bounded, and printable ASCII without spaces, so it can't forge
+// extra fields or lines in logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
 	}
+	return true
 }
 
-// GetUser retrieves a user by ID
-func (s *UserServiceServer) GetUser(ctx context.Context, req *GetUserRequest) (*GetUserResponse, error) {
-	if req.Id <= 0 {
-		return nil, status.Error(codes.InvalidArgument, "user ID must be positive")
+// newRequestID generates a random request ID
+func newRequestID() string {
+	return randomHex(16)
+}
+
+// requestIDMetadataKey is requestIDHeader as gRPC metadata, which is
+// always lowercase
+const requestIDMetadataKey = "x-request-id"
+
+type requestIDContextKey struct{}
+
+// ContextWithRequestID returns a copy of ctx carrying the request ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID in ctx, if any
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// requestIDUnaryInterceptor adopts the caller's x-request-id metadata or
+// generates an ID, stores it in the context, and returns it in the response
+// header
+func requestIDUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var id string
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(requestIDMetadataKey); len(values) > 0 {
+				id = values[0]
+			}
+		}
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadataKey, id))
+
+		return handler(ContextWithRequestID(ctx, id), req)
 	}
+}
 
-	user, err := s.repo.GetUser(ctx, req.Id)
-	if err != nil {
-		if errors.Is(err, ErrNotFound) {
-			return nil, status.Error(codes.NotFound, "user not found")
+// RequestIDClientInterceptor propagates the request ID in ctx to outbound
+// calls as x-request-id metadata. Callers of this service install it with
+// grpc.WithChainUnaryInterceptor so requestIDUnaryInterceptor adopts their
+// ID and the backend's logs correlate with theirs.
+func RequestIDClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if id := RequestIDFromContext(ctx); id != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, requestIDMetadataKey, id)
 		}
-		s.logger.Error("failed to get user", "error", err)
-		return nil, status.Error(codes.Internal, "internal error")
+		return invoker(ctx, method, req, reply, cc, opts...)
 	}
+}
 
-	return &GetUserResponse{
-		User: &UserProto{
-			Id:        user.ID,
-			Name:      user.Name,
-			Email:     user.Email,
-			CreatedAt: user.CreatedAt.Unix(),
-		},
-	}, nil
+// authorizationKey is the metadata key carrying a bearer token
+const authorizationKey = "authorization"
+
+// authenticate returns ctx carrying the actor for its bearer token, if it
+// has one
+func authenticate(ctx context.Context, tokens map[string]string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(authorizationKey)
+	if len(values) == 0 {
+		return ctx, nil
+	}
+
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	actor, known := actorForToken(tokens, token)
+	if !ok || !known {
+		return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+	}
+	return WithActor(ctx, actor), nil
 }
 
-// CreateUser creates a new user
-func (s *UserServiceServer) CreateUser(ctx context.Context, req *CreateUserRequest) (*CreateUserResponse, error) {
-	if req.Name == "" {
-		return nil, status.Error(codes.InvalidArgument, "name is required")
+// actorForToken looks up the actor for a bearer token. Every token is
+// compared in constant time so response timing doesn't leak a prefix match.
+func actorForToken(tokens map[string]string, token string) (string, bool) {
+	var actor string
+	for candidate, a := range tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			actor = a
+		}
 	}
-	if req.Email == "" {
-		return nil, status.Error(codes.InvalidArgument, "email is required")
+	return actor, actor != "" && token != ""
+}
+
+// authUnaryInterceptor records the caller's actor in the context
+func authUnaryInterceptor(tokens map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, tokens)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
 	}
+}
 
-	user, err := s.repo.CreateUser(ctx, req.Name, req.Email)
-	if err != nil {
-		s.logger.Error("failed to create user", "error", err)
-		return nil, status.Error(codes.Internal, "internal error")
+// contextStream overrides the context of a server stream
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+// authStreamInterceptor records the caller's actor in the stream's context
+func authStreamInterceptor(tokens map[string]string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), tokens)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
 	}
+}
 
-	s.logger.Info("user created", "id", user.ID, "name", user.Name)
+// callLogger tags logger with the call's method, request ID, and actor
+func callLogger(ctx context.Context, logger *slog.Logger, method string) *slog.Logger {
+	args := []interface{}{"method", method, "actor", ActorFromContext(ctx)}
+	if id := RequestIDFromContext(ctx); id != "" {
+		args = append(args, "request_id", id)
+	}
+	return logger.With(args...)
+}
 
-	return &CreateUserResponse{
-		User: &UserProto{
-			Id:        user.ID,
-			Name:      user.Name,
-			Email:     user.Email,
-			CreatedAt: user.CreatedAt.Unix(),
-		},
-	}, nil
+// contextLoggerUnaryInterceptor stores a call-scoped logger in the context
+// so handlers log through FromContext and get correlated records. It runs
+// after authentication so the actor is known.
+func contextLoggerUnaryInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(ContextWithLogger(ctx, callLogger(ctx, logger, info.FullMethod)), req)
+	}
+}
+
+// contextLoggerStreamInterceptor is contextLoggerUnaryInterceptor for
+// streaming calls
+func contextLoggerStreamInterceptor(logger *slog.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx := ContextWithLogger(ss.Context(), callLogger(ss.Context(), logger, info.FullMethod))
+		return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	}
 }
 
 // Logging interceptor
@@ -133,6 +1375,7 @@ func loggingUnaryInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
 
 		logger.Info("gRPC call",
 			"method", info.FullMethod,
+			"request_id", RequestIDFromContext(ctx),
 			"duration_ms", time.Since(start).Milliseconds(),
 			"error", err,
 		)
@@ -141,12 +1384,54 @@ func loggingUnaryInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
 	}
 }
 
+// PanicHandler is notified of recovered panics, e.g. to report to an error tracker
+type PanicHandler func(ctx context.Context, method string, recovered interface{}, stack []byte)
+
+// RecoveryConfig configures the recovery interceptor
+type RecoveryConfig struct {
+	Panics  *prometheus.CounterVec // grpc_panics_total by method; optional
+	Handler PanicHandler           // optional
+}
+
+// NewPanicCounter creates and registers the grpc_panics_total counter. If
+// reg already has one, e.g. from an earlier server in the same process, that
+// counter is returned instead.
+func NewPanicCounter(reg prometheus.Registerer) (*prometheus.CounterVec, error) {
+	panics := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_panics_total",
+		Help: "Total number of panics recovered in gRPC handlers.",
+	}, []string{"method"})
+	if err := reg.Register(panics); err != nil {
+		var already prometheus.AlreadyRegisteredError
+		if errors.As(err, &already) {
+			if existing, ok := already.ExistingCollector.(*prometheus.CounterVec); ok {
+				return existing, nil
+			}
+		}
+		return nil, err
+	}
+	return panics, nil
+}
+
 // Recovery interceptor
-func recoveryUnaryInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
+func recoveryUnaryInterceptor(logger *slog.Logger, cfg RecoveryConfig) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 		defer func() {
 			if r := recover(); r != nil {
-				logger.Error("panic recovered", "panic", r, "method", info.FullMethod)
+				stack := debug.Stack()
+				logger.Error("panic recovered",
+					"panic", r,
+					"method", info.FullMethod,
+					"stack", string(stack),
+				)
+
+				if cfg.Panics != nil {
+					cfg.Panics.WithLabelValues(info.FullMethod).Inc()
+				}
+				if cfg.Handler != nil {
+					cfg.Handler(ctx, info.FullMethod, r, stack)
+				}
+
 				err = status.Error(codes.Internal, "internal error")
 			}
 		}()
@@ -154,34 +1439,178 @@ func recoveryUnaryInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
 	}
 }
 
+// FieldLimits maps a request field name to its maximum length in bytes
+type FieldLimits map[string]int
+
+// limitedFields is implemented by requests whose string fields can be
+// checked against FieldLimits
+type limitedFields interface {
+	LimitedFields() map[string]string
+}
+
+// fieldLimitUnaryInterceptor rejects requests whose fields exceed the limits
+// configured for their full method name before the handler runs
+func fieldLimitUnaryInterceptor(limits map[string]FieldLimits) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		methodLimits, ok := limits[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		fields, ok := req.(limitedFields)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		values := fields.LimitedFields()
+		names := make([]string, 0, len(methodLimits))
+		for name := range methodLimits {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if max := methodLimits[name]; len(values[name]) > max {
+				return nil, status.Errorf(codes.InvalidArgument, "%s must be at most %d bytes", name, max)
+			}
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// timeoutUnaryInterceptor caps each method's deadline at the timeout
+// configured for its full method name. Callers may ask for a shorter
+// deadline but not a longer one. The handler runs on the calling goroutine
+// and must honor ctx cancellation; an error returned after the deadline
+// passed is reported as DeadlineExceeded.
+func timeoutUnaryInterceptor(timeouts map[string]time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		timeout, ok := timeouts[info.FullMethod]
+		if !ok || timeout <= 0 {
+			return handler(ctx, req)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= timeout {
+			return handler(ctx, req)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		resp, err := handler(ctx, req)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, status.Errorf(codes.DeadlineExceeded, "%s exceeded its %v timeout", info.FullMethod, timeout)
+		}
+		return resp, err
+	}
+}
+
+// connTracker counts open connections and in-flight RPCs so a forced stop
+// can report what it cut off
+type connTracker struct {
+	conns atomic.Int64
+	rpcs  atomic.Int64
+}
+
+func (t *connTracker) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context   { return ctx }
+func (t *connTracker) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context { return ctx }
+
+func (t *connTracker) HandleRPC(_ context.Context, s stats.RPCStats) {
+	switch s.(type) {
+	case *stats.Begin:
+		t.rpcs.Add(1)
+	case *stats.End:
+		t.rpcs.Add(-1)
+	}
+}
+
+func (t *connTracker) HandleConn(_ context.Context, s stats.ConnStats) {
+	switch s.(type) {
+	case *stats.ConnBegin:
+		t.conns.Add(1)
+	case *stats.ConnEnd:
+		t.conns.Add(-1)
+	}
+}
+
+// defaultShutdownGrace bounds how long Stop waits for in-flight RPCs
+const defaultShutdownGrace = 30 * time.Second
+
 // Server manages the gRPC server lifecycle
 type Server struct {
 	grpcServer *grpc.Server
 	listener   net.Listener
 	logger     *slog.Logger
+	tracker    *connTracker
+
+	// ShutdownGrace is how long Stop lets in-flight RPCs finish before
+	// force-closing their connections. Zero waits indefinitely.
+	ShutdownGrace time.Duration
 }
 
-func NewServer(port int, logger *slog.Logger) (*Server, error) {
+func NewServer(port int, logger *slog.Logger, opts ...UserServiceOption) (*Server, error) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
 	if err != nil {
 		return nil, err
 	}
 
+	userService := NewUserServiceServer(logger, opts...)
+
+	panics, err := NewPanicCounter(prometheus.DefaultRegisterer)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	// Metrics wrap everything else so rejected calls are counted too
+	var interceptors []grpc.UnaryServerInterceptor
+	streamInterceptors := []grpc.StreamServerInterceptor{}
+	if userService.metrics != nil {
+		interceptors = append(interceptors, metricsUnaryInterceptor(userService.metrics))
+		streamInterceptors = append(streamInterceptors, metricsStreamInterceptor(userService.metrics))
+	}
+	interceptors = append(interceptors,
+		requestIDUnaryInterceptor(),
+		authUnaryInterceptor(userService.authTokens),
+		contextLoggerUnaryInterceptor(logger),
+	)
+	streamInterceptors = append(streamInterceptors,
+		authStreamInterceptor(userService.authTokens),
+		contextLoggerStreamInterceptor(logger),
+	)
+	if userService.tracer != nil {
+		interceptors = append(interceptors, tracingUnaryInterceptor(userService.tracer))
+	}
+	interceptors = append(interceptors,
+		recoveryUnaryInterceptor(logger, RecoveryConfig{
+			Panics: panics,
+		}),
+		loggingUnaryInterceptor(logger),
+		timeoutUnaryInterceptor(map[string]time.Duration{
+			methodGetUser:    2 * time.Second,
+			methodCreateUser: 5 * time.Second,
+		}),
+		fieldLimitUnaryInterceptor(map[string]FieldLimits{
+			methodCreateUser: {"name": 256, "email": 320},
+		}),
+	)
+
+	tracker := &connTracker{}
 	grpcServer := grpc.NewServer(
-		grpc.ChainUnaryInterceptor(
-			recoveryUnaryInterceptor(logger),
-			loggingUnaryInterceptor(logger),
-		),
+		grpc.ChainUnaryInterceptor(interceptors...),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		grpc.StatsHandler(tracker),
 	)
 
 	// Register service
-	userService := NewUserServiceServer(logger)
 	RegisterUserServiceServer(grpcServer, userService)
 
 	return &Server{
-		grpcServer: grpcServer,
-		listener:   listener,
-		logger:     logger,
+		grpcServer:    grpcServer,
+		listener:      listener,
+		logger:        logger,
+		tracker:       tracker,
+		ShutdownGrace: defaultShutdownGrace,
 	}, nil
 }
 
@@ -190,18 +1619,125 @@ func (s *Server) Start() error {
 	return s.grpcServer.Serve(s.listener)
 }
 
+// Stop stops accepting RPCs and waits for in-flight ones to finish. If they
+// outlast ShutdownGrace, typically a stream that never ends, the remaining
+// connections are force-closed.
 func (s *Server) Stop() {
-	s.logger.Info("gRPC server stopping")
-	s.grpcServer.GracefulStop()
+	s.logger.Info("gRPC server stopping", "grace_period", s.ShutdownGrace)
+
+	drained := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(drained)
+	}()
+
+	if s.ShutdownGrace <= 0 {
+		<-drained
+		return
+	}
+
+	timer := time.NewTimer(s.ShutdownGrace)
+	defer timer.Stop()
+	select {
+	case <-drained:
+	case <-timer.C:
+		s.logger.Warn("grace period expired, forcing stop",
+			"connections", s.tracker.conns.Load(),
+			"inflight_rpcs", s.tracker.rpcs.Load(),
+		)
+		s.grpcServer.Stop()
+		<-drained
+	}
 }
 
 func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	// FromContext falls back to the default outside calls
+	slog.SetDefault(logger)
+
+	var opts []UserServiceOption
+	if path := os.Getenv("AUDIT_LOG_PATH"); path != "" {
+		rotation, err := AuditRotationFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		auditLogger, err := NewJSONLAuditLogger(path, WithAuditRotation(rotation))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer auditLogger.Close()
+		opts = append(opts, WithAuditLogger(auditLogger))
+	}
+
+	if v := os.Getenv("API_TOKENS"); v != "" {
+		tokens := make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			token, actor, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || token == "" || actor == "" {
+				log.Fatalf("invalid API_TOKENS entry %q: want token=actor", pair)
+			}
+			tokens[token] = actor
+		}
+		opts = append(opts, WithAuthTokens(tokens))
+	}
+
+	if v := os.Getenv("API_ROLES"); v != "" {
+		roles := make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			actor, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || actor == "" || role == "" {
+				log.Fatalf("invalid API_ROLES entry %q: want actor=role", pair)
+			}
+			roles[actor] = role
+		}
+		opts = append(opts, WithAuthorizer(&RoleAuthorizer{Roles: roles, Grants: DefaultGrants}))
+	}
+
+	opts = append(opts, WithTracer(NewTracer(func(span *Span) {
+		logger.Debug("span finished",
+			"name", span.Name,
+			"trace_id", span.Context.TraceID,
+			"span_id", span.Context.SpanID,
+			"parent_span_id", span.Parent.SpanID,
+			"duration", span.EndTime.Sub(span.Start),
+		)
+	})))
 
-	srv, err := NewServer(50051, logger)
+	// METRICS_BACKEND=otlp pushes call metrics to an OpenTelemetry
+	// collector instead of registering them with Prometheus
+	switch backend := os.Getenv("METRICS_BACKEND"); backend {
+	case "", "prometheus":
+		metrics, err := NewPrometheusMetricsRecorder(prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithMetrics(metrics))
+	case "otlp":
+		provider, err := newOTLPMeterProvider(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer provider.Shutdown(context.Background())
+		metrics, err := NewOTelMetricsRecorder(provider.Meter("grpc-service"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, WithMetrics(metrics))
+	default:
+		log.Fatalf("invalid METRICS_BACKEND %q: want prometheus or otlp", backend)
+	}
+
+	srv, err := NewServer(50051, logger, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if v := os.Getenv("SHUTDOWN_GRACE"); v != "" {
+		grace, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("invalid SHUTDOWN_GRACE: %v", err)
+		}
+		srv.ShutdownGrace = grace
+	}
 
 	// Start server in goroutine
 	go func() {
@@ -211,12 +1747,48 @@ func main() {
 		}
 	}()
 
+	// GATEWAY_ADDR also serves the service over HTTP, through a gateway
+	// calling this server
+	var gateway *http.Server
+	if addr := os.Getenv("GATEWAY_ADDR"); addr != "" {
+		conn, err := grpc.NewClient("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer conn.Close()
+
+		gateway = &http.Server{
+			Addr:              addr,
+			Handler:           NewGateway(NewUserServiceClient(conn), logger).Handler(),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			logger.Info("gateway starting", "addr", addr)
+			if err := gateway.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("gateway failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
 	// Wait for interrupt signal
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	logger.Info("shutdown signal received")
+	if gateway != nil {
+		// Drain HTTP callers first so their in-flight calls reach the
+		// gRPC server before it stops accepting them
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if srv.ShutdownGrace > 0 {
+			ctx, cancel = context.WithTimeout(ctx, srv.ShutdownGrace)
+		}
+		if err := gateway.Shutdown(ctx); err != nil {
+			logger.Warn("gateway shutdown incomplete", "error", err)
+		}
+		cancel()
+	}
 	srv.Stop()
 	logger.Info("server stopped")
 }
@@ -233,12 +1805,50 @@ type GetUserResponse struct {
 type CreateUserRequest struct {
 	Name  string
 	Email string
+	// DryRun validates the request without creating the user
+	DryRun bool
+}
+
+// LimitedFields exposes size-limited fields to fieldLimitUnaryInterceptor
+func (r *CreateUserRequest) LimitedFields() map[string]string {
+	return map[string]string{"name": r.Name, "email": r.Email}
 }
 
 type CreateUserResponse struct {
 	User *UserProto
 }
 
+type ListUsersPageRequest struct {
+	PageSize  int32
+	PageToken string
+}
+
+type ListUsersPageResponse struct {
+	Users         []*UserProto
+	TotalSize     int32
+	NextPageToken string
+}
+
+type CreateUsersResponse struct {
+	Created int32
+	Failed  int32
+	Errors  []*CreateUsersError
+}
+
+type CreateUsersError struct {
+	Index   int32
+	Code    string
+	Message string
+}
+
+// UserService_CreateUsersServer is the server side of the client-streaming
+// CreateUsers RPC (normally generated)
+type UserService_CreateUsersServer interface {
+	SendAndClose(*CreateUsersResponse) error
+	Recv() (*CreateUserRequest, error)
+	grpc.ServerStream
+}
+
 type UserProto struct {
 	Id        int64
 	Name      string
@@ -246,8 +1856,164 @@ type UserProto struct {
 	CreatedAt int64
 }
 
+// Full method names (normally generated)
+const (
+	methodGetUser       = "/user.v1.UserService/GetUser"
+	methodCreateUser    = "/user.v1.UserService/CreateUser"
+	methodListUsersPage = "/user.v1.UserService/ListUsersPage"
+)
+
+// jsonCodecName is the content subtype the hand-written messages above are
+// sent with. They aren't real protobufs, so the default proto codec can't
+// marshal them.
+const jsonCodecName = "json"
+
+// jsonCodec encodes messages as JSON (normally unnecessary with generated
+// messages)
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return jsonCodecName }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// userServiceHandler is the server API for UserService (normally generated)
+type userServiceHandler interface {
+	GetUser(context.Context, *GetUserRequest) (*GetUserResponse, error)
+	CreateUser(context.Context, *CreateUserRequest) (*CreateUserResponse, error)
+	ListUsersPage(context.Context, *ListUsersPageRequest) (*ListUsersPageResponse, error)
+	CreateUsers(UserService_CreateUsersServer) error
+}
+
 // Service registration (normally generated)
 func RegisterUserServiceServer(s *grpc.Server, srv *UserServiceServer) {
-	// Registration logic would be generated by protoc
+	s.RegisterService(&userServiceDesc, srv)
+}
+
+var userServiceDesc = grpc.ServiceDesc{
+	ServiceName: "user.v1.UserService",
+	HandlerType: (*userServiceHandler)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "GetUser", Handler: userServiceGetUserHandler},
+		{MethodName: "CreateUser", Handler: userServiceCreateUserHandler},
+		{MethodName: "ListUsersPage", Handler: userServiceListUsersPageHandler},
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "CreateUsers", Handler: userServiceCreateUsersHandler, ClientStreams: true},
+	},
+}
+
+func userServiceGetUserHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(userServiceHandler).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: methodGetUser}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(userServiceHandler).GetUser(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func userServiceCreateUserHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(userServiceHandler).CreateUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: methodCreateUser}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(userServiceHandler).CreateUser(ctx, req.(*CreateUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func userServiceListUsersPageHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUsersPageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(userServiceHandler).ListUsersPage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{Server: srv, FullMethod: methodListUsersPage}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(userServiceHandler).ListUsersPage(ctx, req.(*ListUsersPageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func userServiceCreateUsersHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(userServiceHandler).CreateUsers(&userServiceCreateUsersServer{stream})
+}
+
+type userServiceCreateUsersServer struct {
+	grpc.ServerStream
+}
+
+func (x *userServiceCreateUsersServer) SendAndClose(m *CreateUsersResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *userServiceCreateUsersServer) Recv() (*CreateUserRequest, error) {
+	m := new(CreateUserRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UserServiceClient is the client API for UserService's unary methods
+// (normally generated)
+type UserServiceClient interface {
+	GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*GetUserResponse, error)
+	CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*CreateUserResponse, error)
+	ListUsersPage(ctx context.Context, in *ListUsersPageRequest, opts ...grpc.CallOption) (*ListUsersPageResponse, error)
+}
+
+type userServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+// NewUserServiceClient creates a client for UserService on cc
+func NewUserServiceClient(cc grpc.ClientConnInterface) UserServiceClient {
+	return &userServiceClient{cc}
+}
+
+func (c *userServiceClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*GetUserResponse, error) {
+	out := new(GetUserResponse)
+	if err := c.cc.Invoke(ctx, methodGetUser, in, out, c.callOptions(opts)...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userServiceClient) CreateUser(ctx context.Context, in *CreateUserRequest, opts ...grpc.CallOption) (*CreateUserResponse, error) {
+	out := new(CreateUserResponse)
+	if err := c.cc.Invoke(ctx, methodCreateUser, in, out, c.callOptions(opts)...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userServiceClient) ListUsersPage(ctx context.Context, in *ListUsersPageRequest, opts ...grpc.CallOption) (*ListUsersPageResponse, error) {
+	out := new(ListUsersPageResponse)
+	if err := c.cc.Invoke(ctx, methodListUsersPage, in, out, c.callOptions(opts)...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// callOptions selects jsonCodec ahead of the caller's options
+func (c *userServiceClient) callOptions(opts []grpc.CallOption) []grpc.CallOption {
+	return append([]grpc.CallOption{grpc.CallContentSubtype(jsonCodecName)}, opts...)
 }
 
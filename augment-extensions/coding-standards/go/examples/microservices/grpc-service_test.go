@@ -0,0 +1,1149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// discardLogger returns a logger that drops everything
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// unaryInfo returns server info for a full method name
+func unaryInfo(method string) *grpc.UnaryServerInfo {
+	return &grpc.UnaryServerInfo{FullMethod: method}
+}
+
+func TestNewServerTwice(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		srv, err := NewServer(0, discardLogger())
+		if err != nil {
+			t.Fatalf("NewServer #%d: %v", i+1, err)
+		}
+		srv.listener.Close()
+	}
+}
+
+func TestNewPanicCounterReusesRegistered(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	first, err := NewPanicCounter(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewPanicCounter(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("second NewPanicCounter returned a different counter")
+	}
+}
+
+func TestRecoveryCountsPanics(t *testing.T) {
+	panics, err := NewPanicCounter(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled interface{}
+	interceptor := recoveryUnaryInterceptor(discardLogger(), RecoveryConfig{
+		Panics: panics,
+		Handler: func(ctx context.Context, method string, recovered interface{}, stack []byte) {
+			handled = recovered
+		},
+	})
+
+	_, err = interceptor(context.Background(), nil, unaryInfo(methodGetUser),
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("boom")
+		})
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("err = %v, want Internal", err)
+	}
+	if got := testutil.ToFloat64(panics.WithLabelValues(methodGetUser)); got != 1 {
+		t.Errorf("grpc_panics_total = %v, want 1", got)
+	}
+	if handled != "boom" {
+		t.Errorf("handler saw %v, want boom", handled)
+	}
+}
+
+// memoryAuditLogger keeps audit records in memory
+type memoryAuditLogger struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (l *memoryAuditLogger) Log(ctx context.Context, record AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record)
+	return nil
+}
+
+// withBearer returns an incoming context carrying token as authorization
+// metadata
+func withBearer(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(authorizationKey, "Bearer "+token))
+}
+
+func TestAuditRecordsCreateActor(t *testing.T) {
+	audit := &memoryAuditLogger{}
+	tokens := map[string]string{"secret-a": "alice"}
+	svc := NewUserServiceServer(discardLogger(), WithAuditLogger(audit), WithAuthTokens(tokens))
+
+	resp, err := authUnaryInterceptor(tokens)(withBearer("secret-a"),
+		&CreateUserRequest{Name: "Jane", Email: "jane@example.com"}, unaryInfo(methodCreateUser),
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return svc.CreateUser(ctx, req.(*CreateUserRequest))
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(audit.records) != 1 {
+		t.Fatalf("got %d audit records, want 1", len(audit.records))
+	}
+	got := audit.records[0]
+	id := strconv.FormatInt(resp.(*CreateUserResponse).User.Id, 10)
+	if got.Action != "user.create" || got.Actor != "alice" || got.TargetID != id {
+		t.Errorf("record = %+v, want user.create of %s by alice", got, id)
+	}
+}
+
+func TestAuthRejectsUnknownToken(t *testing.T) {
+	interceptor := authUnaryInterceptor(map[string]string{"secret-a": "alice"})
+	called := false
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		called = true
+		return ActorFromContext(ctx), nil
+	}
+
+	_, err := interceptor(withBearer("guess"), nil, unaryInfo(methodGetUser), handler)
+	if status.Code(err) != codes.Unauthenticated || called {
+		t.Fatalf("err = %v, handler called = %v; want Unauthenticated before the handler", err, called)
+	}
+
+	actor, err := interceptor(context.Background(), nil, unaryInfo(methodGetUser), handler)
+	if err != nil || actor != "anonymous" {
+		t.Errorf("no token = %v, %v; want anonymous", actor, err)
+	}
+}
+
+func TestDeterministicIDGeneratorOrder(t *testing.T) {
+	want := []int64{5075978916318951774, 5075977267051509458, 5075977816807323563}
+	ids := NewDeterministicIDGenerator("test")
+	server := NewUserServiceServer(discardLogger(), WithIDGenerator(ids))
+
+	for i, id := range want {
+		resp, err := server.CreateUser(context.Background(), &CreateUserRequest{
+			Name:  fmt.Sprintf("user%d", i),
+			Email: fmt.Sprintf("user%d@example.com", i),
+		})
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		if resp.User.Id != id {
+			t.Errorf("user %d ID = %d, want %d", i, resp.User.Id, id)
+		}
+	}
+
+	ids.Reset()
+	if got := ids.NewID(); got != want[0] {
+		t.Errorf("after Reset NewID() = %d, want %d", got, want[0])
+	}
+}
+
+func TestCreateUserRetriesTakenID(t *testing.T) {
+	var calls int
+	ids := IDGeneratorFunc(func() int64 {
+		calls++
+		if calls <= 2 {
+			return 7
+		}
+		return 8
+	})
+	server := NewUserServiceServer(discardLogger(), WithIDGenerator(ids))
+
+	var got []int64
+	for i := 0; i < 2; i++ {
+		resp, err := server.CreateUser(context.Background(), &CreateUserRequest{
+			Name:  fmt.Sprintf("user%d", i),
+			Email: fmt.Sprintf("user%d@example.com", i),
+		})
+		if err != nil {
+			t.Fatalf("CreateUser() error = %v", err)
+		}
+		got = append(got, resp.User.Id)
+	}
+	if want := []int64{7, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IDs = %v, want %v", got, want)
+	}
+}
+
+func TestConcurrentCreatesRegisterEmailOnce(t *testing.T) {
+	repo := NewUserRepository()
+
+	const workers = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := repo.CreateUser(context.Background(), fmt.Sprintf("alice%d", i), "alice@example.com")
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	var created, conflicts int
+	for err := range errs {
+		switch {
+		case err == nil:
+			created++
+		case errors.Is(err, ErrConflict):
+			conflicts++
+		default:
+			t.Errorf("CreateUser() error = %v", err)
+		}
+	}
+	if created != 1 || conflicts != workers-1 {
+		t.Errorf("created/conflicts = %d/%d, want 1/%d", created, conflicts, workers-1)
+	}
+}
+
+func TestTimeoutInterceptorWaitsForHandler(t *testing.T) {
+	const method = "/user.v1.UserService/GetUser"
+	interceptor := timeoutUnaryInterceptor(map[string]time.Duration{method: 10 * time.Millisecond})
+
+	var returned atomic.Bool
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		defer returned.Store(true)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	_, err := interceptor(context.Background(), nil, unaryInfo(method), handler)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("error = %v, want DeadlineExceeded", err)
+	}
+	if !returned.Load() {
+		t.Error("interceptor returned while the handler was still running")
+	}
+}
+
+func TestTimeoutInterceptorPassesThrough(t *testing.T) {
+	const method = "/user.v1.UserService/GetUser"
+	interceptor := timeoutUnaryInterceptor(map[string]time.Duration{method: time.Minute})
+
+	tests := []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		handler grpc.UnaryHandler
+		want    time.Duration
+		wantErr codes.Code
+	}{
+		{
+			name: "fast handler",
+			ctx:  func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return "ok", nil
+			},
+			want: time.Minute,
+		},
+		{
+			name: "caller deadline is shorter",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), time.Second)
+			},
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return "ok", nil
+			},
+			want: time.Second,
+		},
+		{
+			name: "handler error before the deadline",
+			ctx:  func() (context.Context, context.CancelFunc) { return context.WithCancel(context.Background()) },
+			handler: func(ctx context.Context, req interface{}) (interface{}, error) {
+				return nil, status.Error(codes.NotFound, "missing")
+			},
+			wantErr: codes.NotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+
+			var remaining time.Duration
+			resp, err := interceptor(ctx, nil, unaryInfo(method), func(ctx context.Context, req interface{}) (interface{}, error) {
+				if deadline, ok := ctx.Deadline(); ok {
+					remaining = time.Until(deadline)
+				}
+				return tt.handler(ctx, req)
+			})
+			if tt.wantErr != codes.OK {
+				if status.Code(err) != tt.wantErr {
+					t.Fatalf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || resp != "ok" {
+				t.Fatalf("interceptor = %v, %v; want ok", resp, err)
+			}
+			if remaining > tt.want || remaining < tt.want-time.Second/2 {
+				t.Errorf("handler deadline in %v, want about %v", remaining, tt.want)
+			}
+		})
+	}
+}
+
+// loopbackInvoker hands a client call's outgoing metadata to the server
+// interceptors as incoming metadata, as the transport would
+func loopbackInvoker(server grpc.UnaryServerInterceptor, handler grpc.UnaryHandler) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		_, err := server(metadata.NewIncomingContext(context.Background(), md), req, unaryInfo(method), handler)
+		return err
+	}
+}
+
+// chainServer runs interceptors in order around a handler
+func chainServer(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], handler
+			handler = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+func TestRequestIDPropagatesToBackendLogs(t *testing.T) {
+	const method = "/user.v1.UserService/GetUser"
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	var handled string
+	server := chainServer(requestIDUnaryInterceptor(), loggingUnaryInterceptor(logger))
+	invoker := loopbackInvoker(server, func(ctx context.Context, req interface{}) (interface{}, error) {
+		handled = RequestIDFromContext(ctx)
+		return nil, nil
+	})
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		wantID string
+	}{
+		{"inbound ID propagated", ContextWithRequestID(context.Background(), "edge-req-42"), "edge-req-42"},
+		{"generated when absent", context.Background(), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs.Reset()
+			client := RequestIDClientInterceptor()
+			if err := client(tt.ctx, method, nil, nil, nil, invoker); err != nil {
+				t.Fatal(err)
+			}
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("log entry isn't JSON: %v\n%s", err, logs.String())
+			}
+			logged, _ := entry["request_id"].(string)
+			if tt.wantID != "" && logged != tt.wantID {
+				t.Errorf("logged request_id = %q, want %q", logged, tt.wantID)
+			}
+			if logged == "" || logged != handled {
+				t.Errorf("logged request_id = %q, handler saw %q; want the same non-empty ID", logged, handled)
+			}
+		})
+	}
+}
+
+// fakeCreateUsersStream replays reqs to CreateUsers, then returns end (io.EOF
+// for a clean close) and records the summary
+type fakeCreateUsersStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	reqs []*CreateUserRequest
+	end  error
+	resp *CreateUsersResponse
+}
+
+func (s *fakeCreateUsersStream) Context() context.Context { return s.ctx }
+
+func (s *fakeCreateUsersStream) Recv() (*CreateUserRequest, error) {
+	if len(s.reqs) == 0 {
+		return nil, s.end
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+func (s *fakeCreateUsersStream) SendAndClose(resp *CreateUsersResponse) error {
+	s.resp = resp
+	return nil
+}
+
+func TestCreateUsersReportsPerIndexErrors(t *testing.T) {
+	server := NewUserServiceServer(discardLogger())
+	if _, err := server.CreateUser(context.Background(), &CreateUserRequest{Name: "existing", Email: "taken@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &fakeCreateUsersStream{
+		ctx: context.Background(),
+		end: io.EOF,
+		reqs: []*CreateUserRequest{
+			{Name: "alice", Email: "alice@example.com"},
+			{Name: "", Email: "noname@example.com"},
+			{Name: "bob", Email: "taken@example.com"},
+			{Name: "carol", Email: "carol@example.com"},
+			{Name: "alice2", Email: "alice@example.com"},
+		},
+	}
+	if err := server.CreateUsers(stream); err != nil {
+		t.Fatalf("CreateUsers() error = %v", err)
+	}
+
+	if stream.resp.Created != 2 || stream.resp.Failed != 3 {
+		t.Errorf("created/failed = %d/%d, want 2/3", stream.resp.Created, stream.resp.Failed)
+	}
+	want := map[int32]string{
+		1: codes.InvalidArgument.String(),
+		2: codes.AlreadyExists.String(),
+		4: codes.AlreadyExists.String(),
+	}
+	got := make(map[int32]string)
+	for _, e := range stream.resp.Errors {
+		got[e.Index] = e.Code
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("errors by index = %v, want %v", got, want)
+	}
+}
+
+func TestCreateUsersRejectsDryRuns(t *testing.T) {
+	server := NewUserServiceServer(discardLogger())
+	stream := &fakeCreateUsersStream{
+		ctx: context.Background(),
+		end: io.EOF,
+		reqs: []*CreateUserRequest{
+			{Name: "alice", Email: "alice@example.com", DryRun: true},
+			{Name: "bob", Email: "bob@example.com"},
+		},
+	}
+	if err := server.CreateUsers(stream); err != nil {
+		t.Fatalf("CreateUsers() error = %v", err)
+	}
+
+	if stream.resp.Created != 1 || stream.resp.Failed != 1 {
+		t.Fatalf("created/failed = %d/%d, want 1/1", stream.resp.Created, stream.resp.Failed)
+	}
+	if e := stream.resp.Errors[0]; e.Index != 0 || e.Code != codes.InvalidArgument.String() {
+		t.Errorf("error = %+v, want InvalidArgument for index 0", e)
+	}
+	if _, err := server.repo.GetUserByEmail(context.Background(), "alice@example.com"); err == nil {
+		t.Error("dry-run item was stored")
+	}
+}
+
+func TestCreateUsersClientGoneKeepsCreated(t *testing.T) {
+	server := NewUserServiceServer(discardLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	stream := &fakeCreateUsersStream{
+		ctx:  ctx,
+		end:  context.Canceled,
+		reqs: []*CreateUserRequest{{Name: "alice", Email: "alice@example.com"}},
+	}
+	err := server.CreateUsers(stream)
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("CreateUsers() error = %v, want Canceled", err)
+	}
+	if stream.resp != nil {
+		t.Error("summary sent to a client that went away")
+	}
+}
+
+func TestFieldLimitRejectsBeforeHandler(t *testing.T) {
+	interceptor := fieldLimitUnaryInterceptor(map[string]FieldLimits{
+		methodCreateUser: {"name": 8, "email": 32},
+	})
+
+	tests := []struct {
+		name     string
+		method   string
+		req      *CreateUserRequest
+		wantCode codes.Code
+	}{
+		{"within limits", methodCreateUser, &CreateUserRequest{Name: "alice", Email: "alice@example.com"}, codes.OK},
+		{"long name", methodCreateUser, &CreateUserRequest{Name: strings.Repeat("a", 9), Email: "a@example.com"}, codes.InvalidArgument},
+		{"long email", methodCreateUser, &CreateUserRequest{Name: "a", Email: strings.Repeat("a", 33)}, codes.InvalidArgument},
+		{"unlimited method", methodGetUser, &CreateUserRequest{Name: strings.Repeat("a", 9)}, codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				called = true
+				return req, nil
+			}
+
+			_, err := interceptor(context.Background(), tt.req, unaryInfo(tt.method), handler)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %v, want %v (err %v)", code, tt.wantCode, err)
+			}
+			if called != (tt.wantCode == codes.OK) {
+				t.Errorf("handler called = %v, want %v", called, tt.wantCode == codes.OK)
+			}
+		})
+	}
+}
+
+func TestListUsersPageWalksAllUsers(t *testing.T) {
+	ctx := context.Background()
+	server := NewUserServiceServer(discardLogger())
+	const total = 11
+	for i := 0; i < total; i++ {
+		if _, err := server.CreateUser(ctx, &CreateUserRequest{
+			Name:  fmt.Sprintf("user%d", i),
+			Email: fmt.Sprintf("user%d@example.com", i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []int64
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > total {
+			t.Fatal("pagination did not terminate")
+		}
+		resp, err := server.ListUsersPage(ctx, &ListUsersPageRequest{PageSize: 4, PageToken: token})
+		if err != nil {
+			t.Fatalf("ListUsersPage() error = %v", err)
+		}
+		if resp.TotalSize != total {
+			t.Errorf("TotalSize = %d, want %d", resp.TotalSize, total)
+		}
+		for _, u := range resp.Users {
+			ids = append(ids, u.Id)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		token = resp.NextPageToken
+	}
+
+	if len(ids) != total {
+		t.Fatalf("walked %d users, want %d: %v", len(ids), total, ids)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("IDs not strictly increasing (duplicate or reorder): %v", ids)
+		}
+	}
+}
+
+func TestListUsersPageRejectsBadRequests(t *testing.T) {
+	server := NewUserServiceServer(discardLogger())
+	for _, req := range []*ListUsersPageRequest{
+		{PageSize: -1},
+		{PageToken: "not base64!"},
+	} {
+		_, err := server.ListUsersPage(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("ListUsersPage(%+v) error = %v, want InvalidArgument", req, err)
+		}
+	}
+}
+
+func TestCreateUserReportsAllFieldViolations(t *testing.T) {
+	server := NewUserServiceServer(discardLogger())
+
+	_, err := server.CreateUser(context.Background(), &CreateUserRequest{})
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Fatalf("code = %v, want InvalidArgument", st.Code())
+	}
+
+	var fields []string
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, violation := range badRequest.GetFieldViolations() {
+				fields = append(fields, violation.GetField())
+			}
+		}
+	}
+	if want := []string{"name", "email"}; !reflect.DeepEqual(fields, want) {
+		t.Errorf("field violations = %v, want %v", fields, want)
+	}
+}
+
+// spanRecorder collects finished spans
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *spanRecorder) export(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+func TestTraceparentContinuesAcrossCall(t *testing.T) {
+	const remote = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parent, _ := ParseTraceparent(remote)
+	recorder := &spanRecorder{}
+
+	// An inbound call carrying traceparent makes a child server span,
+	// and an outbound call from the handler carries that span on
+	var outbound string
+	backend := loopbackInvoker(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if values := md.Get(traceparentKey); len(values) > 0 {
+			outbound = values[0]
+		}
+		return nil, nil
+	}, nil)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, TracingClientInterceptor()(ctx, methodGetUser, nil, nil, nil, backend)
+	}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparentKey, remote))
+	if _, err := tracingUnaryInterceptor(NewTracer(recorder.export))(ctx, nil, unaryInfo(methodGetUser), handler); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(recorder.spans))
+	}
+	span := recorder.spans[0]
+	if span.Parent != parent {
+		t.Errorf("span parent = %+v, want %+v", span.Parent, parent)
+	}
+	if span.Context.TraceID != parent.TraceID || span.Context.SpanID == parent.SpanID {
+		t.Errorf("span context = %+v, want a new span in trace %s", span.Context, parent.TraceID)
+	}
+	if want := span.Context.Traceparent(); outbound != want {
+		t.Errorf("outbound traceparent = %q, want %q", outbound, want)
+	}
+}
+
+func TestToStatus(t *testing.T) {
+	server := NewUserServiceServer(discardLogger())
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"not found", newError(ErrNotFound, "user %s not found", "1"), codes.NotFound},
+		{"wrapped conflict", fmt.Errorf("creating: %w", newError(ErrConflict, "email taken")), codes.AlreadyExists},
+		{"validation", &ValidationError{Fields: []FieldError{{Field: "email", Message: "is required"}}}, codes.InvalidArgument},
+		{"plain validation", newError(ErrValidation, "bad page token"), codes.InvalidArgument},
+		{"canceled", context.Canceled, codes.Canceled},
+		{"existing status", status.Error(codes.Unavailable, "draining"), codes.Unavailable},
+		{"unexpected", errors.New("disk on fire"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(server.toStatus(tt.err)); got != tt.want {
+				t.Errorf("toStatus(%v) code = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// hangDesc is a bidirectional stream whose handler runs until its
+// connection is closed
+var hangDesc = grpc.ServiceDesc{
+	ServiceName: "test.Hang",
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Hang",
+		ClientStreams: true,
+		ServerStreams: true,
+		Handler: func(_ interface{}, stream grpc.ServerStream) error {
+			<-stream.Context().Done()
+			return stream.Context().Err()
+		},
+	}},
+}
+
+func TestStopForcesCloseAfterGrace(t *testing.T) {
+	srv, err := NewServer(0, discardLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.grpcServer.RegisterService(&hangDesc, struct{}{})
+	srv.ShutdownGrace = 100 * time.Millisecond
+	go srv.Start()
+
+	conn, err := grpc.NewClient(srv.listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	stream, err := conn.NewStream(context.Background(),
+		&grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, "/test.Hang/Hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.tracker.rpcs.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream never reached the server")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	srv.Stop()
+	elapsed := time.Since(start)
+
+	if elapsed < srv.ShutdownGrace || elapsed > srv.ShutdownGrace+2*time.Second {
+		t.Errorf("Stop took %v, want about the %v grace period", elapsed, srv.ShutdownGrace)
+	}
+	if err := stream.RecvMsg(new(struct{})); status.Code(err) != codes.Unavailable {
+		t.Errorf("RecvMsg() after forced stop = %v, want Unavailable", err)
+	}
+}
+
+func TestCreateUserGivesUpOnPersistentCollisions(t *testing.T) {
+	var calls int
+	ids := IDGeneratorFunc(func() int64 {
+		calls++
+		return 7
+	})
+	server := NewUserServiceServer(discardLogger(), WithIDGenerator(ids), WithCreateAttempts(3))
+	ctx := context.Background()
+
+	if _, err := server.CreateUser(ctx, &CreateUserRequest{Name: "first", Email: "first@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	_, err := server.CreateUser(ctx, &CreateUserRequest{Name: "second", Email: "second@example.com"})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("CreateUser() error = %v, want Internal once attempts run out", err)
+	}
+	if calls != 3 {
+		t.Errorf("tried %d IDs, want 3", calls)
+	}
+}
+
+func TestIsServerError(t *testing.T) {
+	tests := []struct {
+		code codes.Code
+		want bool
+	}{
+		{codes.OK, false},
+		{codes.InvalidArgument, false},
+		{codes.NotFound, false},
+		{codes.Unauthenticated, false},
+		{codes.Internal, true},
+		{codes.Unavailable, true},
+		{codes.DeadlineExceeded, true},
+	}
+	for _, tt := range tests {
+		if got := isServerError(tt.code); got != tt.want {
+			t.Errorf("isServerError(%v) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestPrometheusMetricsRecorder(t *testing.T) {
+	recorder, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	interceptor := metricsUnaryInterceptor(recorder)
+	for _, err := range []error{nil, status.Error(codes.NotFound, "missing"), errors.New("boom")} {
+		interceptor(context.Background(), nil, unaryInfo(methodGetUser), func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, err
+		})
+	}
+
+	for _, code := range []codes.Code{codes.OK, codes.NotFound, codes.Unknown} {
+		if got := testutil.ToFloat64(recorder.handled.WithLabelValues(methodGetUser, code.String())); got != 1 {
+			t.Errorf("handled{code=%v} = %v, want 1", code, got)
+		}
+	}
+	if got := testutil.ToFloat64(recorder.errors.WithLabelValues(methodGetUser)); got != 1 {
+		t.Errorf("errors = %v, want only the Unknown call counted", got)
+	}
+	if n := testutil.CollectAndCount(recorder.duration); n != 1 {
+		t.Errorf("duration series = %d, want 1", n)
+	}
+}
+
+func TestOTelMetricsRecorderRecordsStreams(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	recorder, err := NewOTelMetricsRecorder(provider.Meter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const method = "/user.UserService/CreateUsers"
+	stream := &fakeCreateUsersStream{ctx: context.Background()}
+	interceptor := metricsStreamInterceptor(recorder)
+	for _, err := range []error{nil, status.Error(codes.Internal, "boom")} {
+		interceptor(nil, stream, &grpc.StreamServerInfo{FullMethod: method}, func(srv interface{}, ss grpc.ServerStream) error {
+			return err
+		})
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]metricdata.Aggregation)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			got[m.Name] = m.Data
+		}
+	}
+
+	count := func(name string) int64 {
+		data, ok := got[name].(metricdata.Sum[int64])
+		if !ok {
+			t.Fatalf("%s = %T, want an int64 sum", name, got[name])
+		}
+		var total int64
+		for _, dp := range data.DataPoints {
+			if m, _ := dp.Attributes.Value(attribute.Key("rpc.method")); m.AsString() != method {
+				t.Errorf("%s rpc.method = %q, want %q", name, m.AsString(), method)
+			}
+			total += dp.Value
+		}
+		return total
+	}
+	if n := count("rpc.server.request.count"); n != 2 {
+		t.Errorf("request count = %d, want 2", n)
+	}
+	if n := count("rpc.server.request.errors"); n != 1 {
+		t.Errorf("error count = %d, want 1", n)
+	}
+	duration, ok := got["rpc.server.duration"].(metricdata.Histogram[float64])
+	if !ok || len(duration.DataPoints) != 1 || duration.DataPoints[0].Count != 2 {
+		t.Errorf("duration = %+v, want 2 observations", got["rpc.server.duration"])
+	}
+}
+
+func TestContextLoggerCarriesCallFields(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	service := NewUserServiceServer(discardLogger())
+	server := chainServer(
+		requestIDUnaryInterceptor(),
+		authUnaryInterceptor(map[string]string{"secret-a": "alice"}),
+		contextLoggerUnaryInterceptor(logger),
+	)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		authorizationKey, "Bearer secret-a",
+		requestIDMetadataKey, "edge-req-42",
+	))
+	_, err := server(ctx, &CreateUserRequest{Name: "jane", Email: "jane@example.com"}, unaryInfo(methodCreateUser),
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return service.CreateUser(ctx, req.(*CreateUserRequest))
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry isn't JSON: %v\n%s", err, logs.String())
+	}
+	want := map[string]interface{}{
+		"msg":        "user created",
+		"method":     methodCreateUser,
+		"actor":      "alice",
+		"request_id": "edge-req-42",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+}
+
+func TestWithFieldsExtendsContextLogger(t *testing.T) {
+	var logs bytes.Buffer
+	ctx := ContextWithLogger(context.Background(), slog.New(slog.NewJSONHandler(&logs, nil)).With("request_id", "r-1"))
+	FromContext(WithFields(ctx, "user_id", 7)).Info("loaded")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["request_id"] != "r-1" || entry["user_id"] != float64(7) {
+		t.Errorf("entry = %v, want request_id and user_id", entry)
+	}
+	if FromContext(context.Background()) != slog.Default() {
+		t.Error("FromContext without a logger should return slog.Default()")
+	}
+}
+
+func TestRoleAuthorizerGuardsCreate(t *testing.T) {
+	server := NewUserServiceServer(discardLogger(), WithAuthorizer(&RoleAuthorizer{
+		Roles:  map[string]string{"alice": "admin", "carol": "viewer"},
+		Grants: DefaultGrants,
+	}))
+	req := &CreateUserRequest{Name: "jane", Email: "jane@example.com"}
+
+	_, err := server.CreateUser(WithActor(context.Background(), "carol"), req)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("viewer create = %v, want PermissionDenied", err)
+	}
+	stream := &fakeCreateUsersStream{ctx: WithActor(context.Background(), "carol"), end: io.EOF, reqs: []*CreateUserRequest{req}}
+	if err := server.CreateUsers(stream); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("viewer import = %v, want PermissionDenied", err)
+	}
+	if _, err := server.CreateUser(WithActor(context.Background(), "alice"), req); err != nil {
+		t.Errorf("admin create = %v, want success", err)
+	}
+}
+
+func TestRoleAuthorizerDeniesDeleteToNonAdmins(t *testing.T) {
+	authorizer := &RoleAuthorizer{
+		Roles:  map[string]string{"alice": "admin", "bob": "editor"},
+		Grants: DefaultGrants,
+	}
+	if err := authorizer.Authorize(WithActor(context.Background(), "bob"), ActionDeleteUser, "users/1"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("editor delete = %v, want ErrForbidden", err)
+	}
+	if err := authorizer.Authorize(WithActor(context.Background(), "alice"), ActionDeleteUser, "users/1"); err != nil {
+		t.Errorf("admin delete = %v, want allowed", err)
+	}
+}
+
+// auditLines reads every JSON line from the audit log at path and its
+// backups, failing on any line that doesn't decode
+func auditLines(t *testing.T, path string) int {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var record AuditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%s: torn line %q: %v", name, line, err)
+			}
+			lines++
+		}
+	}
+	return lines
+}
+
+func TestJSONLAuditLoggerRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxSize: 1024}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				record := AuditRecord{Actor: "alice", Action: "user.update", TargetID: fmt.Sprintf("%d-%d", i, j)}
+				if err := l.Log(context.Background(), record); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) == 0 {
+		t.Fatal("no backups after writing past MaxSize")
+	}
+	for _, name := range append(backups, path) {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, want at most 1024", name, info.Size())
+		}
+	}
+	if n := auditLines(t, path); n != 200 {
+		t.Errorf("found %d records across files, want all 200", n)
+	}
+}
+
+func TestJSONLAuditLoggerPrunesOldBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxSize: 1, MaxBackups: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// MaxSize 1 rotates before every record after the first
+	for i := 0; i < 5; i++ {
+		if err := l.Log(context.Background(), AuditRecord{Action: "user.create", TargetID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want the newest 2", backups)
+	}
+	for i, name := range backups {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Records 0 through 2 were pruned; 3 is current
+		if want := fmt.Sprintf(`"target_id":"%d"`, i+2); !strings.Contains(string(data), want) {
+			t.Errorf("backup %d = %s, want record %d", i, data, i+2)
+		}
+	}
+}
+
+func TestJSONLAuditLoggerRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxAge: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.now = func() time.Time { return now }
+	l.opened = now
+
+	write := func() {
+		if err := l.Log(context.Background(), AuditRecord{Action: "user.create"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	now = now.Add(59 * time.Minute)
+	write()
+	if backups, _ := l.backups(); len(backups) != 0 {
+		t.Fatalf("rotated before MaxAge: %v", backups)
+	}
+	now = now.Add(time.Minute)
+	write()
+	if backups, _ := l.backups(); len(backups) != 1 {
+		t.Errorf("backups after MaxAge = %v, want 1", backups)
+	}
+}
+
+func TestJSONLAuditLoggerLogAfterClose(t *testing.T) {
+	l, err := NewJSONLAuditLogger(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close() = %v, want nil", err)
+	}
+	if err := l.Log(context.Background(), AuditRecord{}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Log() after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestCreateUserDryRun(t *testing.T) {
+	audit := &memoryAuditLogger{}
+	server := NewUserServiceServer(discardLogger(), WithAuditLogger(audit))
+	ctx := context.Background()
+
+	resp, err := server.CreateUser(ctx, &CreateUserRequest{Name: "jane", Email: "jane@example.com", DryRun: true})
+	if err != nil {
+		t.Fatalf("valid dry run = %v, want success", err)
+	}
+	if resp.User != nil {
+		t.Errorf("dry run returned user %+v, want none", resp.User)
+	}
+
+	_, err = server.CreateUser(ctx, &CreateUserRequest{Name: "jane", DryRun: true})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("invalid dry run = %v, want InvalidArgument", err)
+	}
+	var fields []string
+	for _, detail := range status.Convert(err).Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok {
+			for _, v := range badRequest.FieldViolations {
+				fields = append(fields, v.Field)
+			}
+		}
+	}
+	if !reflect.DeepEqual(fields, []string{"email"}) {
+		t.Errorf("field violations = %v, want [email]", fields)
+	}
+
+	page, err := server.ListUsersPage(ctx, &ListUsersPageRequest{PageSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.TotalSize != 0 {
+		t.Errorf("store holds %d users after dry runs, want 0", page.TotalSize)
+	}
+	if len(audit.records) != 0 {
+		t.Errorf("dry run audited %d records, want none", len(audit.records))
+	}
+}
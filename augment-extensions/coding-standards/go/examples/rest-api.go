@@ -3,268 +3,3909 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"golang.org/x/sync/singleflight"
 	"golang.org/x/time/rate"
 )
 
-// User represents a user entity
+// User represents a user entity. ID is assigned by the API's IDGenerator
+// and is a canonical lowercase UUID such as
+// "0b5f2c7e-8a1d-4e3b-9c6f-2d7a1e4b5c90" unless another generator is
+// configured. IDs are never reused, even after the user is deleted.
 type User struct {
-	ID        string    `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"created_at"`
+	XMLName   xml.Name  `json:"-" xml:"user"`
+	ID        string    `json:"id" xml:"id"`
+	FirstName string    `json:"first_name" xml:"first_name"`
+	LastName  string    `json:"last_name" xml:"last_name"`
+	Email     string    `json:"email" xml:"email"`
+	CreatedAt time.Time `json:"created_at" xml:"created_at"`
 }
 
-// ErrorResponse represents an API error
-type ErrorResponse struct {
-	Error   string `json:"error"`
-	Message string `json:"message"`
-	Code    string `json:"code,omitempty"`
+// emailPattern accepts the common subset of RFC 5322 addresses: a dot-atom
+// local part and a domain of at least two labels
+var emailPattern = regexp.MustCompile(
+	`^[A-Za-z0-9!#$%&'*+/=?^_{|}~-]+(\.[A-Za-z0-9!#$%&'*+/=?^_{|}~-]+)*` +
+		`@[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)+$`)
+
+// Validate checks that the user has both names and a well-formed email
+// address
+func (u *User) Validate() error {
+	var fields []FieldError
+	if strings.TrimSpace(u.FirstName) == "" {
+		fields = append(fields, FieldError{Field: "first_name", Message: "is required"})
+	}
+	if strings.TrimSpace(u.LastName) == "" {
+		fields = append(fields, FieldError{Field: "last_name", Message: "is required"})
+	}
+	switch {
+	case u.Email == "":
+		fields = append(fields, FieldError{Field: "email", Message: "is required"})
+	case !emailPattern.MatchString(u.Email):
+		fields = append(fields, FieldError{Field: "email", Message: "must be an email address"})
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// IDGenerator allocates IDs for new resources
+type IDGenerator interface {
+	NewID() string
+}
+
+// IDValidator reports whether a path ID is well formed. Handlers reject
+// malformed IDs with 400 before looking them up, so a typo isn't mistaken
+// for a missing user.
+type IDValidator interface {
+	ValidID(id string) bool
+}
+
+// IDValidatorFunc adapts a function to an IDValidator
+type IDValidatorFunc func(id string) bool
+
+// ValidID calls f(id)
+func (f IDValidatorFunc) ValidID(id string) bool { return f(id) }
+
+// UUIDGenerator issues random UUIDs. It is the production default.
+type UUIDGenerator struct{}
+
+// NewID returns a new random UUID
+func (UUIDGenerator) NewID() string { return uuid.NewString() }
+
+// ValidID reports whether id is a UUID in canonical lowercase form
+func (UUIDGenerator) ValidID(id string) bool { return canonicalUUID(id) }
+
+// canonicalUUID reports whether id is a UUID as uuid.NewString formats it
+func canonicalUUID(id string) bool {
+	parsed, err := uuid.Parse(id)
+	return err == nil && parsed.String() == id
+}
+
+// SequentialIDGenerator issues prefix-1, prefix-2, ... in order
+type SequentialIDGenerator struct {
+	prefix string
+	last   atomic.Int64
+}
+
+// NewSequentialIDGenerator creates a generator of sequential IDs with prefix
+func NewSequentialIDGenerator(prefix string) *SequentialIDGenerator {
+	return &SequentialIDGenerator{prefix: prefix}
+}
+
+// NewID returns the next ID in the sequence
+func (g *SequentialIDGenerator) NewID() string {
+	return fmt.Sprintf("%s-%d", g.prefix, g.last.Add(1))
+}
+
+// ValidID reports whether id is the prefix followed by a positive number
+func (g *SequentialIDGenerator) ValidID(id string) bool {
+	n, ok := strings.CutPrefix(id, g.prefix+"-")
+	if !ok || n == "" || n[0] == '0' {
+		return false
+	}
+	for _, c := range n {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// DeterministicIDGenerator issues UUID-shaped IDs derived from a seed and a
+// counter, so a test or replay with the same seed sees the same IDs in the
+// same order
+type DeterministicIDGenerator struct {
+	seed string
+	last atomic.Int64
+}
+
+// NewDeterministicIDGenerator creates a replayable generator for seed
+func NewDeterministicIDGenerator(seed string) *DeterministicIDGenerator {
+	return &DeterministicIDGenerator{seed: seed}
+}
+
+// NewID returns the next ID for the generator's seed
+func (g *DeterministicIDGenerator) NewID() string {
+	name := fmt.Sprintf("%s/%d", g.seed, g.last.Add(1))
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(name)).String()
+}
+
+// ValidID reports whether id is a UUID in canonical lowercase form
+func (g *DeterministicIDGenerator) ValidID(id string) bool { return canonicalUUID(id) }
+
+// Reset restarts the sequence so the same IDs are issued again
+func (g *DeterministicIDGenerator) Reset() {
+	g.last.Store(0)
+}
+
+// ErrIdempotencyInFlight is returned when an idempotency key is claimed by
+// a request that hasn't finished yet
+var ErrIdempotencyInFlight = errors.New("idempotent request in flight")
+
+// IdempotentResponse is a completed response saved for replay
+type IdempotentResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// IdempotencyStore dedupes retried requests by key. Claim reserves a key
+// for the caller for a lease of ttl, returning (nil, nil) if the caller now
+// owns it, the saved response if it already completed, or
+// ErrIdempotencyInFlight if another request holds it. The owner then calls
+// Complete to save its response, or Release to let a retry run again. A
+// claim whose owner dies expires with its lease.
+type IdempotencyStore interface {
+	Claim(ctx context.Context, key string, ttl time.Duration) (*IdempotentResponse, error)
+	Complete(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error
+	Release(ctx context.Context, key string) error
+}
+
+// idempotencySweepInterval is how often InMemoryIdempotencyStore drops
+// expired entries
+const idempotencySweepInterval = time.Minute
+
+// InMemoryIdempotencyStore is an IdempotencyStore for a single instance.
+// Expired entries are swept out during Claim, at most once per
+// idempotencySweepInterval.
+type InMemoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]idempotencyEntry
+	clock     Clock
+	nextSweep time.Time
+}
+
+type idempotencyEntry struct {
+	resp    *IdempotentResponse // nil while in flight
+	expires time.Time
+}
+
+// NewInMemoryIdempotencyStore creates an empty in-memory store
+func NewInMemoryIdempotencyStore(clock Clock) *InMemoryIdempotencyStore {
+	if clock == nil {
+		clock = RealClock{}
+	}
+	return &InMemoryIdempotencyStore{entries: make(map[string]idempotencyEntry), clock: clock}
+}
+
+// Claim reserves key unless it is already claimed or completed
+func (s *InMemoryIdempotencyStore) Claim(ctx context.Context, key string, ttl time.Duration) (*IdempotentResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+	if !now.Before(s.nextSweep) {
+		for k, entry := range s.entries {
+			if !now.Before(entry.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.nextSweep = now.Add(idempotencySweepInterval)
+	}
+
+	if entry, ok := s.entries[key]; ok && now.Before(entry.expires) {
+		if entry.resp == nil {
+			return nil, ErrIdempotencyInFlight
+		}
+		return entry.resp, nil
+	}
+
+	s.entries[key] = idempotencyEntry{expires: now.Add(ttl)}
+	return nil, nil
+}
+
+// Complete saves the response for key
+func (s *InMemoryIdempotencyStore) Complete(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = idempotencyEntry{resp: resp, expires: s.clock.Now().Add(ttl)}
+	return nil
+}
+
+// Release forgets key
+func (s *InMemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// idempotencyPending marks a claimed Redis key whose response isn't saved yet
+const idempotencyPending = "pending"
+
+// RedisIdempotencyStore shares idempotency keys across instances. Claims
+// use SET NX so exactly one instance wins a key.
+type RedisIdempotencyStore struct {
+	client *redis.Client
+}
+
+// NewRedisIdempotencyStore creates a store on client
+func NewRedisIdempotencyStore(client *redis.Client) *RedisIdempotencyStore {
+	return &RedisIdempotencyStore{client: client}
+}
+
+// Claim reserves key with SET NX, or reports its current state
+func (s *RedisIdempotencyStore) Claim(ctx context.Context, key string, ttl time.Duration) (*IdempotentResponse, error) {
+	claimed, err := s.client.SetNX(ctx, key, idempotencyPending, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if claimed {
+		return nil, nil
+	}
+
+	value, err := s.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		// Expired or released between SETNX and GET; let the client retry
+		return nil, ErrIdempotencyInFlight
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == idempotencyPending {
+		return nil, ErrIdempotencyInFlight
+	}
+
+	var resp IdempotentResponse
+	if err := json.Unmarshal([]byte(value), &resp); err != nil {
+		return nil, fmt.Errorf("corrupt idempotency record %s: %w", key, err)
+	}
+	return &resp, nil
+}
+
+// Complete saves the response for key
+func (s *RedisIdempotencyStore) Complete(ctx context.Context, key string, resp *IdempotentResponse, ttl time.Duration) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, key, data, ttl).Err()
+}
+
+// Release deletes key
+func (s *RedisIdempotencyStore) Release(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
+
+// Error kinds shared by the service layer. Handlers map them to status codes
+// with errors.Is and errors.As instead of matching messages.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("validation failed")
+	ErrForbidden  = errors.New("forbidden")
+)
+
+// kindError carries a client-facing message for one of the error kinds
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// newError returns an error with the formatted message that matches kind
+// with errors.Is
+func newError(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// ValidationError lists the invalid fields of a request. It matches
+// ErrValidation with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrValidation }
+
+// FieldMap returns the first message for each invalid field
+func (e *ValidationError) FieldMap() map[string]string {
+	fields := make(map[string]string, len(e.Fields))
+	for _, f := range e.Fields {
+		if _, ok := fields[f.Field]; !ok {
+			fields[f.Field] = f.Message
+		}
+	}
+	return fields
+}
+
+// errUserNotFound is returned when a user lookup finds nothing
+var errUserNotFound = newError(ErrNotFound, "user not found")
+
+// errUserDeleted is returned when a lookup hits a soft-deleted user
+var errUserDeleted = errors.New("user has been deleted")
+
+// UserStore persists users. Implementations must be safe for concurrent use.
+// Lookups of unknown IDs fail with an error matching ErrNotFound, and of
+// soft-deleted ones with errUserDeleted.
+type UserStore interface {
+	// List returns up to limit users, oldest first, starting at offset,
+	// along with the total number of users
+	List(ctx context.Context, offset, limit int) ([]*User, int, error)
+	Get(ctx context.Context, id string) (*User, error)
+	// Create stores a user under its ID, replacing a soft-deleted one. It
+	// fails with ErrConflict if a user with that ID exists.
+	Create(ctx context.Context, user *User) error
+	Update(ctx context.Context, id string, user *User) error
+	// Delete soft-deletes a user, leaving a tombstone so later lookups can
+	// tell it apart from an ID that never existed
+	Delete(ctx context.Context, id string) error
+}
+
+// AtomicUserStore is implemented by stores that can create a batch of users
+// all or nothing
+type AtomicUserStore interface {
+	// CreateAll creates users in order. If one fails, the users already
+	// created are removed again before it returns, leaving the store as it
+	// was, and the error is a *BatchError naming the failed user's index.
+	CreateAll(ctx context.Context, users []*User) error
+}
+
+// BatchError reports which item of a batch failed, and why
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string { return fmt.Sprintf("item %d: %v", e.Index, e.Err) }
+
+func (e *BatchError) Unwrap() error { return e.Err }
+
+// MemoryUserStore keeps users in memory. It is the default store and suits
+// demos and tests; its contents are lost on restart.
+type MemoryUserStore struct {
+	mu      sync.RWMutex
+	users   map[string]*User
+	deleted map[string]time.Time // Tombstones for soft-deleted users
+}
+
+// NewMemoryUserStore creates an empty in-memory store
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:   make(map[string]*User),
+		deleted: make(map[string]time.Time),
+	}
+}
+
+// List returns a page of users ordered by creation time, then ID
+func (s *MemoryUserStore) List(ctx context.Context, offset, limit int) ([]*User, int, error) {
+	s.mu.RLock()
+	users := make([]*User, 0, len(s.users))
+	for _, user := range s.users {
+		u := *user
+		users = append(users, &u)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		if !users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].CreatedAt.Before(users[j].CreatedAt)
+		}
+		return users[i].ID < users[j].ID
+	})
+
+	total := len(users)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return users[offset:end], total, nil
+}
+
+// Get returns a copy of the user with id
+func (s *MemoryUserStore) Get(ctx context.Context, id string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(id)
+}
+
+func (s *MemoryUserStore) get(id string) (*User, error) {
+	user, exists := s.users[id]
+	if !exists {
+		if _, gone := s.deleted[id]; gone {
+			return nil, errUserDeleted
+		}
+		return nil, errUserNotFound
+	}
+	u := *user
+	return &u, nil
+}
+
+// Create stores a copy of user
+func (s *MemoryUserStore) Create(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[user.ID]; exists {
+		return newError(ErrConflict, "user %s already exists", user.ID)
+	}
+	u := *user
+	s.users[user.ID] = &u
+	delete(s.deleted, user.ID)
+	return nil
+}
+
+// Update replaces the user with id by a copy of user
+func (s *MemoryUserStore) Update(ctx context.Context, id string, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.get(id); err != nil {
+		return err
+	}
+	u := *user
+	s.users[id] = &u
+	return nil
+}
+
+// Delete soft-deletes the user with id
+func (s *MemoryUserStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.get(id); err != nil {
+		return err
+	}
+	delete(s.users, id)
+	s.deleted[id] = time.Now()
+	return nil
+}
+
+// CreateAll stores copies of users, all or nothing. The batch holds the
+// store's lock throughout, so no reader sees part of it; on failure the
+// users already stored are removed and the tombstones they replaced are
+// restored.
+func (s *MemoryUserStore) CreateAll(ctx context.Context, users []*User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	created := make([]string, 0, len(users))
+	tombstones := make(map[string]time.Time)
+	rollback := func(index int, err error) error {
+		for _, id := range created {
+			delete(s.users, id)
+		}
+		for id, at := range tombstones {
+			s.deleted[id] = at
+		}
+		return &BatchError{Index: index, Err: err}
+	}
+
+	for i, user := range users {
+		if err := ctx.Err(); err != nil {
+			return rollback(i, err)
+		}
+		if _, exists := s.users[user.ID]; exists {
+			return rollback(i, newError(ErrConflict, "user %s already exists", user.ID))
+		}
+		if at, gone := s.deleted[user.ID]; gone {
+			tombstones[user.ID] = at
+		}
+		u := *user
+		s.users[user.ID] = &u
+		delete(s.deleted, user.ID)
+		created = append(created, user.ID)
+	}
+	return nil
+}
+
+// Reset removes every user and tombstone
+func (s *MemoryUserStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[string]*User)
+	s.deleted = make(map[string]time.Time)
+}
+
+// Problem is an RFC 7807 problem details document. Fields repeats Errors
+// keyed by field name, for clients that only need one message per field;
+// XML can't carry a map, so it's left out of XML problems.
+type Problem struct {
+	XMLName  xml.Name          `json:"-" xml:"urn:ietf:rfc:7807 problem"`
+	Type     string            `json:"type" xml:"type"`
+	Title    string            `json:"title" xml:"title"`
+	Status   int               `json:"status" xml:"status"`
+	Detail   string            `json:"detail,omitempty" xml:"detail,omitempty"`
+	Instance string            `json:"instance,omitempty" xml:"instance,omitempty"`
+	Code     string            `json:"code,omitempty" xml:"code,omitempty"`
+	Errors   []FieldError      `json:"errors,omitempty" xml:"errors>error,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty" xml:"-"`
+}
+
+// FieldError describes a validation failure on a single field
+type FieldError struct {
+	Field   string `json:"field" xml:"field"`
+	Message string `json:"message" xml:"message"`
+}
+
+// WriteProblem writes problem as application/problem+json, or
+// application/problem+xml if the client negotiated XML, defaulting the
+// type, title, and status from the HTTP status code
+func WriteProblem(w http.ResponseWriter, status int, problem Problem) {
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+		if slug, ok := problemTypes[status]; ok && typedProblems(w) {
+			problem.Type = problemTypeBase + slug
+		}
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(status)
+	}
+	problem.Status = status
+
+	encodeResponse(w, status, "application/problem+json", "application/problem+xml", problem)
+}
+
+// problemTypeBase prefixes the type URIs of v2 problem documents
+const problemTypeBase = "https://api.example.com/problems/"
+
+// problemTypes names the v2 problem type for each status. The names are
+// part of the v2 contract: clients may switch on them, so never change one.
+var problemTypes = map[int]string{
+	http.StatusBadRequest:            "bad-request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not-found",
+	http.StatusMethodNotAllowed:      "method-not-allowed",
+	http.StatusNotAcceptable:         "not-acceptable",
+	http.StatusConflict:              "conflict",
+	http.StatusGone:                  "gone",
+	http.StatusPreconditionFailed:    "precondition-failed",
+	http.StatusRequestEntityTooLarge: "payload-too-large",
+	http.StatusRequestURITooLong:     "uri-too-long",
+	http.StatusUnprocessableEntity:   "validation-error",
+	http.StatusTooManyRequests:       "rate-limited",
+	http.StatusInternalServerError:   "internal-error",
+	http.StatusNotImplemented:        "not-implemented",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// problemTypeWriter marks a response whose problems get typed URIs
+type problemTypeWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *problemTypeWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// typedProblems reports whether w, or a writer it wraps, is a
+// problemTypeWriter
+func typedProblems(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(*problemTypeWriter); ok {
+			return true
+		}
+		inner, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = inner.Unwrap()
+	}
+}
+
+// Response formats a client can negotiate with the Accept header
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+)
+
+// acceptableTypes maps the media types we can produce to their format, in
+// server preference order for ties. Wildcards come last so that an exact
+// type beats them at the same q.
+var acceptableTypes = []struct {
+	mediaType, format string
+}{
+	{"application/json", formatJSON},
+	{"application/problem+json", formatJSON},
+	{"application/xml", formatXML},
+	{"application/problem+xml", formatXML},
+	{"text/xml", formatXML},
+	{"application/*", formatJSON},
+	{"*/*", formatJSON},
+}
+
+// negotiateFormat picks the response format for an Accept header. A missing
+// header or a wildcard means JSON; ok is false if the client accepts
+// neither JSON nor XML.
+func negotiateFormat(header string) (format string, ok bool) {
+	if strings.TrimSpace(header) == "" {
+		return formatJSON, true
+	}
+	bestQ, bestRank := 0.0, len(acceptableTypes)
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		q := 1.0
+		for _, param := range params[1:] {
+			if v, found := strings.CutPrefix(strings.TrimSpace(param), "q="); found {
+				parsed, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					q = 0
+				} else {
+					q = parsed
+				}
+			}
+		}
+
+		for rank, acceptable := range acceptableTypes {
+			if acceptable.mediaType != mediaType || q <= 0 {
+				continue
+			}
+			if q > bestQ || (q == bestQ && rank < bestRank) {
+				format, bestQ, bestRank = acceptable.format, q, rank
+			}
+		}
+	}
+
+	return format, format != ""
+}
+
+// formatWriter carries the response format negotiated for a request
+type formatWriter struct {
+	http.ResponseWriter
+	format string
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *formatWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// responseFormat returns the format negotiated for w's request, or JSON if
+// none was
+func responseFormat(w http.ResponseWriter) string {
+	for {
+		if fw, ok := w.(*formatWriter); ok {
+			return fw.format
+		}
+		inner, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return formatJSON
+		}
+		w = inner.Unwrap()
+	}
+}
+
+// withResponseFormat wraps w with the format negotiated from r's Accept
+// header. ok is false if the client accepts none of our formats.
+func withResponseFormat(w http.ResponseWriter, r *http.Request) (_ http.ResponseWriter, ok bool) {
+	w.Header().Add("Vary", "Accept")
+	format, ok := negotiateFormat(r.Header.Get("Accept"))
+	if !ok {
+		return w, false
+	}
+	return &formatWriter{ResponseWriter: w, format: format}, true
+}
+
+// xmlList wraps a slice so that it marshals as a single XML document
+type xmlList struct {
+	XMLName xml.Name    `xml:"items"`
+	Items   interface{} `xml:"item"`
+}
+
+// encodeResponse writes status and data in the format negotiated for w,
+// labelled jsonType or xmlType
+func encodeResponse(w http.ResponseWriter, status int, jsonType, xmlType string, data interface{}) {
+	if responseFormat(w) != formatXML {
+		w.Header().Set("Content-Type", jsonType)
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	if v := reflect.ValueOf(data); v.Kind() == reflect.Slice {
+		data = xmlList{Items: data}
+	}
+	w.Header().Set("Content-Type", xmlType)
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(data)
+}
+
+// PaginatedResponse represents a paginated API response. In XML each item
+// of Data is an element inside <data>.
+type PaginatedResponse struct {
+	XMLName    xml.Name    `json:"-" xml:"collection"`
+	Data       interface{} `json:"data" xml:"data>item"`
+	Page       int         `json:"page" xml:"page"`
+	PageSize   int         `json:"page_size" xml:"page_size"`
+	TotalItems int         `json:"total_items" xml:"total_items"`
+	TotalPages int         `json:"total_pages" xml:"total_pages"`
+	HasNext    bool        `json:"has_next" xml:"has_next"`
+	HasPrev    bool        `json:"has_prev" xml:"has_prev"`
+	Links      Links       `json:"links" xml:"links"`
+}
+
+// Links are ready-made URLs for navigating a paginated collection. Links
+// that don't apply, like prev on the first page, are omitted.
+type Links struct {
+	Self  string `json:"self" xml:"self"`
+	First string `json:"first" xml:"first"`
+	Prev  string `json:"prev,omitempty" xml:"prev,omitempty"`
+	Next  string `json:"next,omitempty" xml:"next,omitempty"`
+	Last  string `json:"last" xml:"last"`
+}
+
+// paginate fills in the navigation fields of response for a request to u.
+// Links keep u's other query parameters and are relative to the host, so
+// they work behind proxies without trusting the Host header.
+func paginate(u *url.URL, response *PaginatedResponse) {
+	lastPage := response.TotalPages
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	pageURL := func(page int) string {
+		query := u.Query()
+		query.Set("page", strconv.Itoa(page))
+		query.Set("page_size", strconv.Itoa(response.PageSize))
+		return (&url.URL{Path: u.Path, RawQuery: query.Encode()}).String()
+	}
+
+	response.HasPrev = response.Page > 1
+	response.HasNext = response.Page < response.TotalPages
+	response.Links = Links{
+		Self:  pageURL(response.Page),
+		First: pageURL(1),
+		Last:  pageURL(lastPage),
+	}
+	if response.HasPrev {
+		// Past the end, prev leads back to the last real page
+		prev := response.Page - 1
+		if prev > lastPage {
+			prev = lastPage
+		}
+		response.Links.Prev = pageURL(prev)
+	}
+	if response.HasNext {
+		response.Links.Next = pageURL(response.Page + 1)
+	}
+}
+
+// Clock abstracts time so time-dependent behavior can be driven
+// deterministically in tests
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// RealClock is a Clock backed by the time package
+type RealClock struct{}
+
+// Now returns the current time
+func (RealClock) Now() time.Time { return time.Now() }
+
+// After waits for the duration to elapse and then sends the current time
+func (RealClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// Sleep pauses the current goroutine for at least the duration d
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// RateLimiter manages rate limiting. Limiters for keys not seen within the
+// idle TTL are evicted in the background so the map doesn't grow without
+// bound as client addresses churn.
+//
+// Every key has a limiter in the default bucket. Named buckets registered
+// with RegisterBucket give the same key a separate limiter with its own
+// rate, e.g. a stricter one for writes.
+type RateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*limiterEntry
+	rate     rate.Limit
+	burst    int
+	buckets  map[string]bucketLimits
+	clock    Clock
+	draining atomic.Bool
+
+	idleTTL  time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+
+	// Decision counters, set by WithRateLimiterMetrics
+	allowed *prometheus.CounterVec
+	denied  *prometheus.CounterVec
+}
+
+// limiterEntry is a key's token bucket and when the key was last seen
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// bucketLimits is the rate and burst of a named bucket
+type bucketLimits struct {
+	rate  rate.Limit
+	burst int
+}
+
+// bucketKeySeparator joins a key to its bucket name in the limiter map. It
+// follows the key so keyBucket still sees the key's kind.
+const bucketKeySeparator = "#"
+
+// RateLimiterOption configures a RateLimiter
+type RateLimiterOption func(*RateLimiter)
+
+// WithRateLimiterClock sets the clock used to refill token buckets
+func WithRateLimiterClock(clock Clock) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.clock = clock
+	}
+}
+
+// WithRateLimiterMetrics registers the limiter's metrics with reg:
+// ratelimit_allowed_total and ratelimit_denied_total, labeled by key bucket,
+// and ratelimit_tracked_limiters
+func WithRateLimiterMetrics(reg prometheus.Registerer) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.registerMetrics(reg)
+	}
+}
+
+// NewRateLimiter creates a rate limiter allowing r requests per second with
+// bursts of b per key. Keys idle for longer than idleTTL are evicted; zero
+// disables eviction. Call Stop to end the eviction loop.
+func NewRateLimiter(r rate.Limit, b int, idleTTL time.Duration, opts ...RateLimiterOption) *RateLimiter {
+	rl := &RateLimiter{
+		limiters: make(map[string]*limiterEntry),
+		rate:     r,
+		burst:    b,
+		buckets:  make(map[string]bucketLimits),
+		clock:    RealClock{},
+		idleTTL:  idleTTL,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(rl)
+	}
+
+	if idleTTL > 0 {
+		go rl.evictLoop()
+	} else {
+		close(rl.stopped)
+	}
+	return rl
+}
+
+// evictLoop drops idle limiters every half TTL until Stop is called, so no
+// key outlives its TTL by more than half again
+func (rl *RateLimiter) evictLoop() {
+	defer close(rl.stopped)
+	for {
+		select {
+		case <-rl.stop:
+			return
+		case now := <-rl.clock.After(rl.idleTTL / 2):
+			rl.evictIdle(now)
+		}
+	}
+}
+
+// evictIdle removes limiters whose keys haven't been seen since now minus
+// the idle TTL
+func (rl *RateLimiter) evictIdle(now time.Time) {
+	cutoff := now.Add(-rl.idleTTL)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for key, entry := range rl.limiters {
+		if entry.lastSeen.Before(cutoff) {
+			delete(rl.limiters, key)
+		}
+	}
+}
+
+// Stop ends the eviction loop and waits for it to exit. It is safe to call
+// more than once.
+func (rl *RateLimiter) Stop() {
+	rl.stopOnce.Do(func() { close(rl.stop) })
+	<-rl.stopped
+}
+
+// registerMetrics creates the limiter's metrics and registers them with reg
+func (rl *RateLimiter) registerMetrics(reg prometheus.Registerer) {
+	rl.allowed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_allowed_total",
+		Help: "Requests admitted by the rate limiter, by key bucket.",
+	}, []string{"bucket"})
+	rl.denied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ratelimit_denied_total",
+		Help: "Requests rejected by the rate limiter, by key bucket.",
+	}, []string{"bucket"})
+	tracked := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ratelimit_tracked_limiters",
+		Help: "Number of rate limit keys currently tracked.",
+	}, func() float64 { return float64(rl.Len()) })
+
+	reg.MustRegister(rl.allowed, rl.denied, tracked)
+}
+
+// keyBucket reduces a rate limit key to its kind, e.g. "user:alice" to
+// "user", so metric labels stay few no matter how many clients there are
+func keyBucket(key string) string {
+	if kind, _, ok := strings.Cut(key, ":"); ok && kind != "" {
+		return kind
+	}
+	return "other"
+}
+
+// RegisterBucket adds a named bucket allowing r requests per second with
+// bursts of b per key, or changes the limits of an existing one
+func (rl *RateLimiter) RegisterBucket(name string, r rate.Limit, b int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.buckets[name] = bucketLimits{rate: r, burst: b}
+	suffix := bucketKeySeparator + name
+	for key, entry := range rl.limiters {
+		if strings.HasSuffix(key, suffix) {
+			entry.limiter.SetLimit(r)
+			entry.limiter.SetBurst(b)
+		}
+	}
+}
+
+// Limits returns the rate and burst of bucket. Names that were never
+// registered, including "", get the default limits.
+func (rl *RateLimiter) Limits(bucket string) (rate.Limit, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	limits, _ := rl.limitsLocked(bucket)
+	return limits.rate, limits.burst
+}
+
+// limitsLocked returns the limits of bucket and whether it is a registered
+// named bucket
+func (rl *RateLimiter) limitsLocked(bucket string) (bucketLimits, bool) {
+	if limits, ok := rl.buckets[bucket]; ok && bucket != "" {
+		return limits, true
+	}
+	return bucketLimits{rate: rl.rate, burst: rl.burst}, false
+}
+
+// Len returns the number of keys with a limiter
+func (rl *RateLimiter) Len() int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return len(rl.limiters)
+}
+
+// GetLimiter returns a limiter for the given key and marks the key as seen.
+// It is safe for concurrent use.
+func (rl *RateLimiter) GetLimiter(key string) *rate.Limiter {
+	return rl.BucketLimiter("", key)
+}
+
+// BucketLimiter returns the limiter for key in the named bucket and marks
+// it as seen. Unregistered buckets share the default bucket's limiter.
+func (rl *RateLimiter) BucketLimiter(bucket, key string) *rate.Limiter {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	limits, named := rl.limitsLocked(bucket)
+	if named {
+		key += bucketKeySeparator + bucket
+	}
+	entry, exists := rl.limiters[key]
+	if !exists {
+		entry = &limiterEntry{limiter: rate.NewLimiter(limits.rate, limits.burst)}
+		rl.limiters[key] = entry
+	}
+	entry.lastSeen = rl.clock.Now()
+	return entry.limiter
+}
+
+// Allow reports whether a request for key may proceed at the limiter's clock time
+func (rl *RateLimiter) Allow(key string) bool {
+	return rl.AllowIn("", key)
+}
+
+// AllowIn reports whether a request for key may proceed in the named bucket
+func (rl *RateLimiter) AllowIn(bucket, key string) bool {
+	return rl.Take(bucket, key).Allowed
+}
+
+// RateLimitDecision is the outcome of taking a token from a bucket
+type RateLimitDecision struct {
+	Allowed bool
+	// Remaining is the whole tokens left after the decision
+	Remaining int
+	// Reset is when the bucket will be full again
+	Reset time.Time
+}
+
+// Take tries to take a token for key from the named bucket, reporting what
+// is left. The remaining count is read at the same clock time as the
+// decision.
+func (rl *RateLimiter) Take(bucket, key string) RateLimitDecision {
+	limiter := rl.BucketLimiter(bucket, key)
+	now := rl.clock.Now()
+	allowed := limiter.AllowN(now, 1)
+	tokens := limiter.TokensAt(now)
+
+	decision := RateLimitDecision{
+		Allowed:   allowed,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     now,
+	}
+	if missing := float64(limiter.Burst()) - tokens; missing > 0 && limiter.Limit() > 0 && limiter.Limit() != rate.Inf {
+		decision.Reset = now.Add(time.Duration(missing / float64(limiter.Limit()) * float64(time.Second)))
+	}
+	if rl.allowed != nil {
+		if allowed {
+			rl.allowed.WithLabelValues(keyBucket(key)).Inc()
+		} else {
+			rl.denied.WithLabelValues(keyBucket(key)).Inc()
+		}
+	}
+	return decision
+}
+
+// Drain stops the limiter admitting any further requests. It is used during
+// graceful shutdown and cannot be undone.
+func (rl *RateLimiter) Drain() {
+	rl.draining.Store(true)
+}
+
+// Draining reports whether Drain has been called
+func (rl *RateLimiter) Draining() bool {
+	return rl.draining.Load()
+}
+
+// Topic names a class of events on the EventBus
+type Topic string
+
+// Topics published by the user handlers
+const (
+	TopicUserCreated Topic = "user.created"
+	TopicUserUpdated Topic = "user.updated"
+	TopicUserDeleted Topic = "user.deleted"
+)
+
+// ErrBusClosed is returned when publishing to a drained EventBus
+var ErrBusClosed = errors.New("event bus closed")
+
+// BusEvent is a message delivered to EventBus subscribers
+type BusEvent struct {
+	Topic     Topic
+	Payload   interface{}
+	Timestamp time.Time
+}
+
+// EventHandler consumes events from the EventBus
+type EventHandler func(ctx context.Context, event BusEvent)
+
+type busSubscriber struct {
+	handler EventHandler
+	async   bool
+}
+
+type busDelivery struct {
+	ctx     context.Context
+	event   BusEvent
+	handler EventHandler
+}
+
+// EventBus is an in-process publish/subscribe bus that decouples write
+// handlers from side effects like cache invalidation and notifications.
+// Synchronous subscribers run inside Publish; asynchronous ones are queued
+// to a fixed pool of background workers.
+type EventBus struct {
+	mu     sync.RWMutex
+	subs   map[Topic][]busSubscriber
+	queue  chan busDelivery
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewEventBus creates a bus whose async deliveries are buffered up to buffer
+// and handled by workers goroutines
+func NewEventBus(buffer, workers int) *EventBus {
+	if workers < 1 {
+		workers = 1
+	}
+	b := &EventBus{
+		subs:  make(map[Topic][]busSubscriber),
+		queue: make(chan busDelivery, buffer),
+	}
+	for i := 0; i < workers; i++ {
+		b.wg.Add(1)
+		go b.work()
+	}
+	return b
+}
+
+func (b *EventBus) work() {
+	defer b.wg.Done()
+	for d := range b.queue {
+		d.handler(d.ctx, d.event)
+	}
+}
+
+// Subscribe registers a handler that runs synchronously inside Publish
+func (b *EventBus) Subscribe(topic Topic, handler EventHandler) {
+	b.subscribe(topic, busSubscriber{handler: handler})
+}
+
+// SubscribeAsync registers a handler that runs on a background worker
+func (b *EventBus) SubscribeAsync(topic Topic, handler EventHandler) {
+	b.subscribe(topic, busSubscriber{handler: handler, async: true})
+}
+
+func (b *EventBus) subscribe(topic Topic, sub busSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[topic] = append(b.subs[topic], sub)
+}
+
+// Publish delivers payload to every subscriber of topic. Async deliveries
+// block while the buffer is full until ctx is done. Async handlers get a
+// context detached from ctx's cancellation, since request contexts end as
+// soon as the response is written.
+func (b *EventBus) Publish(ctx context.Context, topic Topic, payload interface{}) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	event := BusEvent{Topic: topic, Payload: payload, Timestamp: time.Now()}
+	for _, sub := range b.subs[topic] {
+		if !sub.async {
+			sub.handler(ctx, event)
+			continue
+		}
+
+		select {
+		case b.queue <- busDelivery{ctx: context.WithoutCancel(ctx), event: event, handler: sub.handler}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Drain stops accepting new events and waits for queued async deliveries to
+// finish, or for ctx to be done
+func (b *EventBus) Drain(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AuditRecord describes a single mutating operation for the audit trail
+type AuditRecord struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Actor     string      `json:"actor"`
+	Action    string      `json:"action"`
+	TargetID  string      `json:"target_id"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+}
+
+// AuditLogger records who changed what
+type AuditLogger interface {
+	Log(ctx context.Context, record AuditRecord) error
+}
+
+// JSONLAuditLogger appends audit records to a file as JSON lines. With
+// rotation configured, the file is renamed to a timestamped backup once it
+// grows past a size or age, and a fresh one is started.
+type JSONLAuditLogger struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	opened   time.Time
+	rotation AuditRotation
+	now      func() time.Time
+}
+
+// AuditRotation configures when JSONLAuditLogger rotates its file. A zero
+// field disables that limit.
+type AuditRotation struct {
+	// MaxSize is the size in bytes a file may reach before rotating
+	MaxSize int64
+	// MaxAge is how long a file is written to before rotating
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files to keep; older ones are deleted
+	MaxBackups int
+}
+
+// AuditLoggerOption configures a JSONLAuditLogger
+type AuditLoggerOption func(*JSONLAuditLogger)
+
+// WithAuditRotation rotates the audit log by size and age
+func WithAuditRotation(rotation AuditRotation) AuditLoggerOption {
+	return func(l *JSONLAuditLogger) {
+		l.rotation = rotation
+	}
+}
+
+// AuditRotationFromEnv reads AUDIT_LOG_MAX_SIZE_MB, AUDIT_LOG_MAX_AGE (a
+// duration) and AUDIT_LOG_MAX_BACKUPS
+func AuditRotationFromEnv() (AuditRotation, error) {
+	var rotation AuditRotation
+	if v := os.Getenv("AUDIT_LOG_MAX_SIZE_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_SIZE_MB %q", v)
+		}
+		rotation.MaxSize = mb << 20
+	}
+	if v := os.Getenv("AUDIT_LOG_MAX_AGE"); v != "" {
+		age, err := time.ParseDuration(v)
+		if err != nil || age < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_AGE %q", v)
+		}
+		rotation.MaxAge = age
+	}
+	if v := os.Getenv("AUDIT_LOG_MAX_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_BACKUPS %q", v)
+		}
+		rotation.MaxBackups = n
+	}
+	return rotation, nil
+}
+
+// NewJSONLAuditLogger opens (or creates) path for appending audit records
+func NewJSONLAuditLogger(path string, opts ...AuditLoggerOption) (*JSONLAuditLogger, error) {
+	l := &JSONLAuditLogger{path: path, now: time.Now}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return l, nil
+}
+
+// open opens l.path for appending and notes its current size
+func (l *JSONLAuditLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	l.opened = l.now()
+	return nil
+}
+
+// Log writes record as a single JSON line, rotating first if the line
+// would take the file past its limits
+func (l *JSONLAuditLogger) Log(ctx context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if l.shouldRotate(int64(len(data))) {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// shouldRotate reports whether writing n more bytes needs a fresh file. A
+// record larger than MaxSize still goes to a file of its own.
+func (l *JSONLAuditLogger) shouldRotate(n int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if max := l.rotation.MaxSize; max > 0 && l.size+n > max {
+		return true
+	}
+	return l.rotation.MaxAge > 0 && l.now().Sub(l.opened) >= l.rotation.MaxAge
+}
+
+// rotate renames the current file to a timestamped backup, opens a fresh
+// one, and prunes backups beyond MaxBackups
+func (l *JSONLAuditLogger) rotate() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	// Keep appending to the current file if it can't be moved aside
+	renameErr := os.Rename(l.path, l.backupName())
+	if err := l.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	return l.prune()
+}
+
+// auditBackupTime formats backup timestamps so names sort by age
+const auditBackupTime = "20060102T150405.000000000"
+
+// backupName returns an unused backup path such as audit-<time>.jsonl
+func (l *JSONLAuditLogger) backupName() string {
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext)
+	at := l.now().UTC()
+	for {
+		name := base + "-" + at.Format(auditBackupTime) + ext
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		at = at.Add(time.Nanosecond)
+	}
+}
+
+// backups lists the rotated files for l.path, oldest first
+func (l *JSONLAuditLogger) backups() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	pattern := strings.TrimSuffix(l.path, ext) + "-*" + ext
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// prune deletes the oldest backups beyond MaxBackups
+func (l *JSONLAuditLogger) prune() error {
+	if l.rotation.MaxBackups <= 0 {
+		return nil
+	}
+	names, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for len(names) > l.rotation.MaxBackups {
+		if err := os.Remove(names[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Close flushes and closes the current file. Logging after Close fails with
+// os.ErrClosed; closing again is a no-op.
+func (l *JSONLAuditLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	syncErr := l.file.Sync()
+	closeErr := l.file.Close()
+	l.file = nil
+	if syncErr != nil {
+		return syncErr
+	}
+	return closeErr
+}
+
+// actorContextKey carries the authenticated identity in a request context
+type actorContextKey struct{}
+
+// WithActor returns a context carrying the authenticated actor identity
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the authenticated actor, or "anonymous"
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorContextKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// requestIDHeader carries the request ID on requests and responses
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds caller-supplied request IDs
+const maxRequestIDLength = 128
+
+// requestIDContextKey carries the request ID in a request context
+type requestIDContextKey struct{}
+
+// ContextWithRequestID returns a context carrying the request ID
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID, or "" outside a request
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether a caller-supplied ID is safe to adopt: non
+// empty, bounded, and printable ASCII without spaces, so it can't forge
+// extra fields or lines in logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// loggerContextKey carries the request-scoped logger in a request context
+type loggerContextKey struct{}
+
+// ContextWithLogger returns a context carrying logger for FromContext
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// FromContext returns the request-scoped logger, or slog.Default() outside
+// a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Actions checked by an Authorizer. They match the audit record actions.
+const (
+	ActionCreateUser = "user.create"
+	ActionUpdateUser = "user.update"
+	ActionDeleteUser = "user.delete"
+)
+
+// Authorizer decides whether the actor in ctx may perform action on
+// resource, returning an ErrForbidden error if not
+type Authorizer interface {
+	Authorize(ctx context.Context, action, resource string) error
+}
+
+// RoleAuthorizer grants actions by the role of the actor in the context.
+// Actors without a role, including anonymous callers, may do nothing.
+type RoleAuthorizer struct {
+	Roles  map[string]string   // actor -> role
+	Grants map[string][]string // role -> permitted actions; "*" permits all
+}
+
+// DefaultGrants lets admins do anything and editors create and update users
+// but not delete them
+var DefaultGrants = map[string][]string{
+	"admin":  {"*"},
+	"editor": {ActionCreateUser, ActionUpdateUser},
+}
+
+// Authorize implements Authorizer
+func (a *RoleAuthorizer) Authorize(ctx context.Context, action, resource string) error {
+	actor := ActorFromContext(ctx)
+	for _, granted := range a.Grants[a.Roles[actor]] {
+		if granted == "*" || granted == action {
+			return nil
+		}
+	}
+	return newError(ErrForbidden, "%s is not allowed to %s %s", actor, action, resource)
+}
+
+// ParseRoles parses a comma-separated list of actor=role pairs, as in the
+// API_ROLES environment variable
+func ParseRoles(v string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		actor, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || actor == "" || role == "" {
+			return nil, fmt.Errorf("invalid API_ROLES entry %q: want actor=role", pair)
+		}
+		roles[actor] = role
+	}
+	return roles, nil
+}
+
+// FeatureFlags toggles experimental route groups without a redeploy of
+// code paths. All flags default to off.
+type FeatureFlags struct {
+	// V2API serves /api/v2, whose problem documents carry stable type URIs
+	V2API          bool
+	BulkOperations bool
+
+	// TestAdmin exposes endpoints that wipe and seed the store for
+	// integration test suites. Never enable it in production.
+	TestAdmin bool
+}
+
+// FeatureFlagsFromEnv reads flags from FEATURE_* environment variables
+func FeatureFlagsFromEnv() FeatureFlags {
+	enabled := func(name string) bool {
+		v, _ := strconv.ParseBool(os.Getenv(name))
+		return v
+	}
+	return FeatureFlags{
+		V2API:          enabled("FEATURE_V2_API"),
+		BulkOperations: enabled("FEATURE_BULK_OPERATIONS"),
+		TestAdmin:      enabled("FEATURE_TEST_ADMIN"),
+	}
+}
+
+// defaultMaxHeaderBytes bounds request headers, well below net/http's 1 MB
+// default
+const defaultMaxHeaderBytes = 64 << 10
+
+// API represents the REST API server
+type API struct {
+	router      *mux.Router
+	rateLimiter *RateLimiter
+	features    FeatureFlags
+	ids         IDGenerator
+	idValidator IDValidator
+	store       UserStore
+	userReads   singleflight.Group
+	// routeTiers maps each route to the rate limit tier setupRoutes gave it
+	routeTiers map[*mux.Route]string
+
+	// MaxURLLength and MaxQueryLength bound the raw request URI and query
+	// string; longer requests are rejected with 414. Zero disables a check.
+	MaxURLLength   int
+	MaxQueryLength int
+
+	// MaxBodyBytes bounds request bodies. Requests declaring a larger
+	// Content-Length are rejected with 413 before the body is read, and
+	// bodies without a declared length are cut off at the limit. Zero
+	// disables the check.
+	MaxBodyBytes int64
+
+	// Idempotency, when set, dedupes POSTs carrying an Idempotency-Key
+	// header: retries replay the first response instead of running again.
+	// Completed responses are remembered for IdempotencyTTL. A request in
+	// progress holds its key for IdempotencyLease, so a crashed instance
+	// doesn't block retries for the full TTL.
+	Idempotency      IdempotencyStore
+	IdempotencyTTL   time.Duration
+	IdempotencyLease time.Duration
+
+	// ImportMaxInFlight bounds how many NDJSON lines a streaming import
+	// reads ahead of processing. When it is reached, reading pauses and
+	// TCP flow control pushes back on the client.
+	ImportMaxInFlight int
+
+	// CompressionMinSize is the smallest response body worth compressing
+	CompressionMinSize int
+
+	// AuditLogger, when set, records every create, update, and delete
+	AuditLogger AuditLogger
+
+	// AuthTokens maps bearer tokens to the actor identity recorded for
+	// their requests. Requests without a token run as anonymous; requests
+	// with an unknown one are rejected with 401.
+	AuthTokens map[string]string
+
+	// Authorizer, when set, is consulted before every create, update, and
+	// delete; denied requests are rejected with 403. Nil permits everything.
+	Authorizer Authorizer
+
+	// Events, when set, receives a user.* event after every create, update,
+	// and delete
+	Events *EventBus
+
+	// RateLimitKey derives the rate-limit bucket for a request. Defaults to
+	// IdentityOrIPKey.
+	RateLimitKey func(*http.Request) string
+
+	// RateLimitRoutes overrides the rate limit tier setupRoutes assigned a
+	// route; the first matching entry wins. Requests matching neither use
+	// the default bucket.
+	RateLimitRoutes []RateLimitRoute
+
+	// SlowRequestThreshold logs a warning for requests that take longer.
+	// Zero disables slow-request reporting.
+	SlowRequestThreshold time.Duration
+
+	// OnSlowRequest, when set, is also called for every slow request, e.g.
+	// to increment a metric or raise an alert
+	OnSlowRequest func(SlowRequest)
+
+	// LogSampler, when set, limits request logging to errors, slow
+	// requests, and a sample of the rest. Nil logs every request.
+	LogSampler *LogSampler
+
+	// Logger receives request logs. Every record logged while serving a
+	// request carries its request_id. Defaults to slog.Default().
+	Logger *slog.Logger
+
+	// Metrics, when set, records the count, latency, and errors of every
+	// request
+	Metrics MetricsRecorder
+}
+
+// SlowRequest describes a request that exceeded SlowRequestThreshold
+type SlowRequest struct {
+	Method   string
+	Route    string
+	Status   int
+	Duration time.Duration
+}
+
+// APIOption configures an API before its routes are registered
+type APIOption func(*API)
+
+// WithRateLimitMetrics registers the rate limiter's metrics with reg
+func WithRateLimitMetrics(reg prometheus.Registerer) APIOption {
+	return func(api *API) {
+		api.rateLimiter.registerMetrics(reg)
+	}
+}
+
+// WithRateLimitBucket registers a named rate limit bucket, or changes the
+// limits of an existing one such as "write". Map requests to it through
+// RateLimitRoutes.
+func WithRateLimitBucket(name string, r rate.Limit, b int) APIOption {
+	return func(api *API) {
+		api.rateLimiter.RegisterBucket(name, r, b)
+	}
+}
+
+// WithRateLimitTiers sets the limits of the given tiers, leaving any others
+// at their defaults
+func WithRateLimitTiers(tiers RateLimitTiers) APIOption {
+	return func(api *API) {
+		for name, tier := range tiers {
+			api.rateLimiter.RegisterBucket(name, tier.Rate, tier.Burst)
+		}
+	}
+}
+
+// WithFeatureFlags enables the experimental route groups set in flags
+func WithFeatureFlags(flags FeatureFlags) APIOption {
+	return func(api *API) {
+		api.features = flags
+	}
+}
+
+// WithUserStore sets where users are persisted. Defaults to a
+// MemoryUserStore.
+func WithUserStore(store UserStore) APIOption {
+	return func(api *API) {
+		api.store = store
+	}
+}
+
+// WithIDGenerator sets how new user IDs are allocated. Defaults to UUIDs.
+func WithIDGenerator(ids IDGenerator) APIOption {
+	return func(api *API) {
+		api.ids = ids
+	}
+}
+
+// WithIDValidator sets how user IDs in request paths are checked. Defaults
+// to the ID generator's own check if it implements IDValidator; otherwise
+// any ID is looked up.
+func WithIDValidator(v IDValidator) APIOption {
+	return func(api *API) {
+		api.idValidator = v
+	}
+}
+
+// Rate limit tiers setupRoutes assigns routes to
+const (
+	readTier  = "read"
+	writeTier = "write"
+)
+
+// RateLimitTier is the limit of one rate limit tier
+type RateLimitTier struct {
+	Rate  rate.Limit
+	Burst int
+}
+
+// RateLimitTiers maps tier names to their limits
+type RateLimitTiers map[string]RateLimitTier
+
+// DefaultRateLimitTiers returns the tiers NewAPI registers. Writes cost
+// more than reads, so they get a much smaller allowance.
+func DefaultRateLimitTiers() RateLimitTiers {
+	return RateLimitTiers{
+		readTier:  {Rate: rate.Limit(20), Burst: 40},
+		writeTier: {Rate: rate.Limit(2), Burst: 10},
+	}
+}
+
+// NewAPI creates a new API instance
+func NewAPI(opts ...APIOption) *API {
+	api := &API{
+		router:             mux.NewRouter(),
+		rateLimiter:        NewRateLimiter(rate.Limit(10), 20, 10*time.Minute),
+		ids:                UUIDGenerator{},
+		store:              NewMemoryUserStore(),
+		MaxURLLength:       8192,
+		MaxQueryLength:     4096,
+		MaxBodyBytes:       1 << 20,
+		IdempotencyTTL:     24 * time.Hour,
+		IdempotencyLease:   time.Minute,
+		ImportMaxInFlight:  64,
+		CompressionMinSize: 1024,
+		RateLimitKey:       IdentityOrIPKey,
+		Logger:             slog.Default(),
+		routeTiers:         make(map[*mux.Route]string),
+	}
+	for name, tier := range DefaultRateLimitTiers() {
+		api.rateLimiter.RegisterBucket(name, tier.Rate, tier.Burst)
+	}
+	for _, opt := range opts {
+		opt(api)
+	}
+	if v, ok := api.ids.(IDValidator); ok && api.idValidator == nil {
+		api.idValidator = v
+	}
+
+	api.setupRoutes()
+	return api
+}
+
+// Drain rejects new requests with 503 while letting in-flight ones finish.
+// Call it before http.Server.Shutdown so requests arriving on kept-alive
+// connections are turned away too.
+func (api *API) Drain() {
+	api.rateLimiter.Drain()
+}
+
+// Close stops the API's background work, such as rate limiter eviction. Call
+// it once the server has shut down. It is safe to call more than once.
+func (api *API) Close() {
+	api.rateLimiter.Stop()
+}
+
+// setupRoutes configures API routes. Experimental route groups are only
+// registered when enabled in api.features, so they 404 when switched off.
+func (api *API) setupRoutes() {
+	// Answer unmatched requests with problem details like every other error
+	api.router.NotFoundHandler = http.HandlerFunc(api.unmatched)
+	api.router.MethodNotAllowedHandler = http.HandlerFunc(api.unmatched)
+
+	// Apply middleware
+	api.router.Use(api.requestIDMiddleware)
+	api.router.Use(api.slowRequestMiddleware)
+	api.router.Use(api.metricsMiddleware)
+	api.router.Use(api.problemTypesMiddleware)
+	api.router.Use(api.negotiationMiddleware)
+	api.router.Use(api.uriLengthMiddleware)
+	api.router.Use(api.bodyLimitMiddleware)
+	api.router.Use(api.authMiddleware)
+	api.router.Use(api.rateLimitMiddleware)
+	api.router.Use(api.loggingMiddleware)
+	api.router.Use(api.idValidationMiddleware)
+	api.router.Use(api.compressionMiddleware)
+	api.router.Use(api.idempotencyMiddleware)
+
+	// V1 routes
+	v1 := api.router.PathPrefix("/api/v1").Subrouter()
+	api.tier(readTier,
+		v1.HandleFunc("/users", api.listUsersV1).Methods("GET"),
+		v1.HandleFunc("/users/{id}", api.getUserV1).Methods("GET"),
+	)
+	api.tier(writeTier,
+		v1.HandleFunc("/users", api.authorized(ActionCreateUser, Handle(api.createUserV1))).Methods("POST"),
+		v1.HandleFunc("/users/{id}", api.authorized(ActionUpdateUser, api.updateUserV1)).Methods("PUT"),
+		v1.HandleFunc("/users/{id}", api.authorized(ActionUpdateUser, api.patchUserV1)).Methods("PATCH"),
+		v1.HandleFunc("/users/{id}", api.authorized(ActionDeleteUser, api.deleteUserV1)).Methods("DELETE"),
+	)
+
+	// V2 serves the same resources; only its problem types differ
+	if api.features.V2API {
+		v2 := api.router.PathPrefix("/api/v2").Subrouter()
+		api.tier(readTier,
+			v2.HandleFunc("/users", api.listUsersV1).Methods("GET"),
+			v2.HandleFunc("/users/{id}", api.getUserV1).Methods("GET"),
+		)
+		api.tier(writeTier,
+			v2.HandleFunc("/users", api.authorized(ActionCreateUser, Handle(api.createUserV1))).Methods("POST"),
+			v2.HandleFunc("/users/{id}", api.authorized(ActionUpdateUser, api.updateUserV1)).Methods("PUT"),
+			v2.HandleFunc("/users/{id}", api.authorized(ActionUpdateUser, api.patchUserV1)).Methods("PATCH"),
+			v2.HandleFunc("/users/{id}", api.authorized(ActionDeleteUser, api.deleteUserV1)).Methods("DELETE"),
+		)
+	}
+
+	if api.features.BulkOperations {
+		api.tier(writeTier,
+			v1.HandleFunc("/users", api.authorized(ActionDeleteUser, api.bulkDeleteUsersV1)).Methods("DELETE"),
+			v1.HandleFunc("/users/bulk", api.authorized(ActionCreateUser, api.bulkCreateUsersV1)).Methods("POST"),
+			v1.HandleFunc("/users/import/stream", api.authorized(ActionCreateUser, api.importUsersStreamV1)).Methods("POST").Name(routeImportStream),
+		)
+	}
+
+	if api.features.TestAdmin {
+		log.Println("WARNING: test admin endpoints are enabled; never run this in production")
+		api.tier(writeTier,
+			v1.HandleFunc("/admin/reset", api.adminResetV1).Methods("POST"),
+			v1.HandleFunc("/admin/seed", api.adminSeedV1).Methods("POST"),
+		)
+	}
+}
+
+// tier assigns routes to a rate limit tier
+func (api *API) tier(name string, routes ...*mux.Route) {
+	for _, route := range routes {
+		api.routeTiers[route] = name
+	}
+}
+
+// authorized runs h only if the Authorizer permits action on the user the
+// route addresses, or on the users collection for routes without an ID
+func (api *API) authorized(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.Authorizer != nil {
+			resource := "users"
+			if id := mux.Vars(r)["id"]; id != "" {
+				resource += "/" + id
+			}
+			if err := api.Authorizer.Authorize(r.Context(), action, resource); err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// withProblemTypes wraps w so that problems written for a v2 request carry
+// typed URIs instead of about:blank
+func (api *API) withProblemTypes(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if api.features.V2API && strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		return &problemTypeWriter{ResponseWriter: w}
+	}
+	return w
+}
+
+// problemTypesMiddleware applies withProblemTypes. It runs before any
+// middleware that can reject a request.
+func (api *API) problemTypesMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(api.withProblemTypes(w, r), r)
+	})
+}
+
+// negotiationMiddleware picks the response format from the Accept header,
+// answering 406 if the client accepts none we produce. It runs right after
+// problemTypesMiddleware so every later problem is in the chosen format.
+func (api *API) negotiationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fw, ok := withResponseFormat(w, r)
+		if !ok {
+			api.writeError(w, r, http.StatusNotAcceptable, "Supported response types are application/json and application/xml")
+			return
+		}
+		next.ServeHTTP(fw, r)
+	})
+}
+
+// uriLengthMiddleware rejects abusively long URLs and query strings before
+// any further work (including rate limiting) is done for them
+func (api *API) uriLengthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.MaxURLLength > 0 && len(r.RequestURI) > api.MaxURLLength {
+			api.writeError(w, r, http.StatusRequestURITooLong, "Request URL too long")
+			return
+		}
+		if api.MaxQueryLength > 0 && len(r.URL.RawQuery) > api.MaxQueryLength {
+			api.writeError(w, r, http.StatusRequestURITooLong, "Query string too long")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// bodyLimitMiddleware enforces MaxBodyBytes. Checking the declared
+// Content-Length first turns away oversized uploads without buffering
+// anything; MaxBytesReader catches chunked bodies and lying headers.
+func (api *API) bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.MaxBodyBytes <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Streaming imports are unbounded by design and read incrementally
+		if isStreamingRoute(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > api.MaxBodyBytes {
+			w.Header().Set("Connection", "close")
+			api.writeError(w, r, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Request body exceeds %d bytes", api.MaxBodyBytes))
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, api.MaxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// responseCapture tees a response so it can be saved for replay
+type responseCapture struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *responseCapture) Unwrap() http.ResponseWriter { return c.ResponseWriter }
+
+func (c *responseCapture) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *responseCapture) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	c.body.Write(p)
+	return c.ResponseWriter.Write(p)
+}
+
+// isStreamingRoute reports whether r is for the streaming import, whose
+// body and response are unbounded and must not be buffered
+func isStreamingRoute(r *http.Request) bool {
+	route := mux.CurrentRoute(r)
+	return route != nil && route.GetName() == routeImportStream
+}
+
+// idempotencyMiddleware replays the saved response for a repeated
+// Idempotency-Key and answers 409 while the first request is still running.
+// Keys are scoped to the caller, by identity or else client IP, and route.
+// Server errors aren't saved, so the client can retry them. Streaming
+// responses are never captured. It runs inside compression so saved bodies
+// are stored uncompressed and re-encoded per client.
+func (api *API) idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idemKey := r.Header.Get("Idempotency-Key")
+		// A validate-only response mustn't be replayed for the real request
+		if api.Idempotency == nil || r.Method != http.MethodPost || idemKey == "" || isStreamingRoute(r) || validateOnly(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		key := fmt.Sprintf("idempotency:%s:%s:%s", IdentityOrIPKey(r), r.URL.Path, idemKey)
+
+		saved, err := api.Idempotency.Claim(ctx, key, api.IdempotencyLease)
+		switch {
+		case errors.Is(err, ErrIdempotencyInFlight):
+			w.Header().Set("Retry-After", "1")
+			api.writeError(w, r, http.StatusConflict, "A request with this Idempotency-Key is still in progress")
+			return
+		case err != nil:
+			// Fail open: a store outage shouldn't take writes down with it
+			FromContext(ctx).Warn("idempotency store unavailable", "error", err)
+			next.ServeHTTP(w, r)
+			return
+		case saved != nil:
+			for name, values := range saved.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(saved.Status)
+			w.Write(saved.Body)
+			return
+		}
+
+		capture := &responseCapture{ResponseWriter: w}
+		next.ServeHTTP(capture, r)
+
+		// The request context may be canceled once the handler returns
+		storeCtx := context.WithoutCancel(ctx)
+		if capture.status >= 500 || capture.status == 0 {
+			if err := api.Idempotency.Release(storeCtx, key); err != nil {
+				FromContext(ctx).Error("failed to release idempotency key", "error", err)
+			}
+			return
+		}
+
+		// The body was captured before encoding, so drop encoding headers
+		// the compression layer may already have added
+		header := w.Header().Clone()
+		header.Del("Content-Encoding")
+		header.Del("Content-Length")
+
+		resp := &IdempotentResponse{
+			Status: capture.status,
+			Header: header,
+			Body:   capture.body.Bytes(),
+		}
+		if err := api.Idempotency.Complete(storeCtx, key, resp, api.IdempotencyTTL); err != nil {
+			FromContext(ctx).Error("failed to save idempotent response", "error", err)
+		}
+	})
+}
+
+// authMiddleware records the actor for a request's bearer token in its
+// context. It runs before rate limiting so limits apply per identity.
+func (api *API) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		actor, known := api.actorForToken(token)
+		if !ok || !known {
+			// Rate limiting runs after auth, so charge failed attempts to
+			// the unauthenticated client here; otherwise token guessing
+			// would never be throttled
+			if !api.rateLimiter.Take(api.rateLimitBucket(r), api.RateLimitKey(r)).Allowed {
+				w.Header().Set("Retry-After", "60")
+				api.writeError(w, r, http.StatusTooManyRequests, "Rate limit exceeded")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			api.writeError(w, r, http.StatusUnauthorized, "Invalid bearer token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithActor(r.Context(), actor)))
+	})
+}
+
+// actorForToken looks up the actor for a bearer token. Every token is
+// compared in constant time so response timing doesn't leak a prefix match.
+func (api *API) actorForToken(token string) (string, bool) {
+	var actor string
+	for candidate, a := range api.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			actor = a
+		}
+	}
+	return actor, actor != "" && token != ""
+}
+
+// ParseAPITokens parses a comma-separated list of token=actor pairs, as in
+// the API_TOKENS environment variable
+func ParseAPITokens(v string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		token, actor, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || token == "" || actor == "" {
+			return nil, fmt.Errorf("invalid API_TOKENS entry %q: want token=actor", pair)
+		}
+		tokens[token] = actor
+	}
+	return tokens, nil
+}
+
+// IdentityOrIPKey buckets authenticated requests by actor identity, so users
+// behind a shared NAT don't share a limit, and anonymous requests by client IP.
+// The actor is set by authMiddleware, which runs before rate limiting.
+func IdentityOrIPKey(r *http.Request) string {
+	if actor := ActorFromContext(r.Context()); actor != "anonymous" {
+		return "user:" + actor
+	}
+	return "ip:" + clientIP(r)
+}
+
+// clientIP returns the remote address without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// RateLimitRoute sends matching requests to a named rate limit bucket
+type RateLimitRoute struct {
+	// Methods the route matches; empty matches every method
+	Methods []string
+	// PathPrefix the request path must start with
+	PathPrefix string
+	// Bucket is the RateLimiter bucket the requests count against
+	Bucket string
+}
+
+// matches reports whether r falls under the route
+func (rt RateLimitRoute) matches(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if len(rt.Methods) == 0 {
+		return true
+	}
+	for _, method := range rt.Methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimitBucket returns the bucket of the first RateLimitRoutes entry
+// matching r, else the tier of the route r matched, else "" for the default
+// bucket
+func (api *API) rateLimitBucket(r *http.Request) string {
+	for _, route := range api.RateLimitRoutes {
+		if route.matches(r) {
+			return route.Bucket
+		}
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		return api.routeTiers[route]
+	}
+	return ""
+}
+
+// unixCeil returns t as Unix seconds, rounded up
+func unixCeil(t time.Time) int64 {
+	sec := t.Unix()
+	if t.Nanosecond() > 0 {
+		sec++
+	}
+	return sec
+}
+
+// rateLimitMiddleware implements rate limiting
+func (api *API) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.rateLimiter.Draining() {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", "5")
+			api.writeError(w, r, http.StatusServiceUnavailable, "Server is shutting down")
+			return
+		}
+
+		key := api.RateLimitKey(r)
+		bucket := api.rateLimitBucket(r)
+		_, burst := api.rateLimiter.Limits(bucket)
+
+		decision := api.rateLimiter.Take(bucket, key)
+		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		// Round up so clients that wait until Reset find the bucket full
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(unixCeil(decision.Reset), 10))
+
+		if !decision.Allowed {
+			w.Header().Set("Retry-After", "60")
+			api.writeError(w, r, http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// LogSampler decides which completed requests get logged. Errors and slow
+// requests are always logged; other requests are logged at the sample rate.
+// The rate can be changed while serving.
+type LogSampler struct {
+	rate atomic.Uint64 // math.Float64bits of the sample rate
+	slow time.Duration
+}
+
+// NewLogSampler creates a sampler logging fraction rate (0 to 1) of normal
+// requests, plus every error and every request slower than slow
+func NewLogSampler(rate float64, slow time.Duration) *LogSampler {
+	ls := &LogSampler{slow: slow}
+	ls.SetRate(rate)
+	return ls
+}
+
+// SetRate changes the fraction of normal requests that are logged
+func (ls *LogSampler) SetRate(rate float64) {
+	rate = math.Max(0, math.Min(1, rate))
+	ls.rate.Store(math.Float64bits(rate))
+}
+
+// Rate returns the current sample rate
+func (ls *LogSampler) Rate() float64 {
+	return math.Float64frombits(ls.rate.Load())
+}
+
+// ShouldLog reports whether a request that finished with status after
+// elapsed should be logged
+func (ls *LogSampler) ShouldLog(status int, elapsed time.Duration) bool {
+	if status >= 400 || (ls.slow > 0 && elapsed >= ls.slow) {
+		return true
+	}
+	return rand.Float64() < ls.Rate()
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter { return rec.ResponseWriter }
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// MetricsRecorder records request metrics to a monitoring backend, such as
+// Prometheus or an OpenTelemetry collector
+type MetricsRecorder interface {
+	// RecordRequest records a finished request. route is the route
+	// template, not the raw path, so metric cardinality stays bounded.
+	RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration)
+}
+
+// PrometheusMetricsRecorder records http_requests_total,
+// http_request_errors_total (5xx responses), and
+// http_request_duration_seconds
+type PrometheusMetricsRecorder struct {
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+}
+
+// NewPrometheusMetricsRecorder creates the request metrics and registers them
+// with reg
+func NewPrometheusMetricsRecorder(reg prometheus.Registerer) (*PrometheusMetricsRecorder, error) {
+	m := &PrometheusMetricsRecorder{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests handled, by method, route, and status.",
+		}, []string{"method", "route", "status"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_request_errors_total",
+			Help: "HTTP requests that failed with a 5xx status, by method and route.",
+		}, []string{"method", "route"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency, by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.errors, m.duration} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// RecordRequest implements MetricsRecorder
+func (m *PrometheusMetricsRecorder) RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration) {
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	if status >= 500 {
+		m.errors.WithLabelValues(method, route).Inc()
+	}
+	m.duration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// OTelMetricsRecorder records the OpenTelemetry HTTP server metrics
+// http.server.request.count, http.server.request.errors (5xx responses), and
+// http.server.request.duration in seconds
+type OTelMetricsRecorder struct {
+	requests otelmetric.Int64Counter
+	errors   otelmetric.Int64Counter
+	duration otelmetric.Float64Histogram
+}
+
+// NewOTelMetricsRecorder creates the request instruments from meter
+func NewOTelMetricsRecorder(meter otelmetric.Meter) (*OTelMetricsRecorder, error) {
+	requests, err := meter.Int64Counter("http.server.request.count",
+		otelmetric.WithDescription("HTTP requests handled."))
+	if err != nil {
+		return nil, err
+	}
+	errs, err := meter.Int64Counter("http.server.request.errors",
+		otelmetric.WithDescription("HTTP requests that failed with a 5xx status."))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram("http.server.request.duration",
+		otelmetric.WithDescription("HTTP request latency."),
+		otelmetric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	return &OTelMetricsRecorder{requests: requests, errors: errs, duration: duration}, nil
+}
+
+// RecordRequest implements MetricsRecorder
+func (m *OTelMetricsRecorder) RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration) {
+	attrs := otelmetric.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("http.route", route),
+	)
+	m.requests.Add(ctx, 1, attrs, otelmetric.WithAttributes(attribute.Int("http.response.status_code", status)))
+	if status >= 500 {
+		m.errors.Add(ctx, 1, attrs)
+	}
+	m.duration.Record(ctx, duration.Seconds(), attrs)
+}
+
+// newOTLPMeterProvider exports metrics over OTLP/gRPC to the collector named
+// by the standard OTEL_EXPORTER_OTLP_* environment variables
+func newOTLPMeterProvider(ctx context.Context) (*sdkmetric.MeterProvider, error) {
+	exporter, err := otlpmetricgrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter))), nil
+}
+
+// routeTemplate returns the template of the route r matched, or "" if it
+// matched none. Reporting templates rather than raw paths groups metrics and
+// alerts by endpoint instead of by ID.
+func routeTemplate(r *http.Request) string {
+	if current := mux.CurrentRoute(r); current != nil {
+		if tmpl, err := current.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return ""
+}
+
+// metricsMiddleware records every request with the Metrics recorder
+func (api *API) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.Metrics == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+
+		// Unmatched requests share one label rather than echoing
+		// arbitrary paths into the metric
+		route := routeTemplate(r)
+		if route == "" {
+			route = "unmatched"
+		}
+		api.Metrics.RecordRequest(r.Context(), r.Method, route, rec.status, time.Since(start))
+	})
+}
+
+// requestIDMiddleware adopts the caller's X-Request-Id or generates a UUID,
+// echoes it in the response, and stores it in the request context along
+// with a logger that tags every record with it. It runs outermost so even
+// rejected requests can be traced.
+func (api *API) requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := ContextWithRequestID(r.Context(), id)
+		ctx = ContextWithLogger(ctx, api.Logger.With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// slowRequestMiddleware reports requests slower than SlowRequestThreshold.
+// It runs outermost so the measured duration covers the whole chain.
+func (api *API) slowRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if api.SlowRequestThreshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		if elapsed <= api.SlowRequestThreshold {
+			return
+		}
+
+		route := routeTemplate(r)
+		if route == "" {
+			route = r.URL.Path
+		}
+		slow := SlowRequest{Method: r.Method, Route: route, Status: rec.status, Duration: elapsed}
+		FromContext(r.Context()).Warn("slow request",
+			"method", slow.Method,
+			"route", slow.Route,
+			"status", slow.Status,
+			"duration", slow.Duration,
+			"threshold", api.SlowRequestThreshold,
+		)
+		if api.OnSlowRequest != nil {
+			api.OnSlowRequest(slow)
+		}
+	})
+}
+
+// loggingMiddleware logs one structured record per completed request,
+// subject to LogSampler
+func (api *API) loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+
+		if api.LogSampler != nil && !api.LogSampler.ShouldLog(rec.status, elapsed) {
+			return
+		}
+		FromContext(r.Context()).Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", elapsed,
+		)
+	})
+}
+
+// idValidationMiddleware rejects routes whose {id} is malformed with 400, so
+// only well-formed IDs reach the store and a 404 always means the user
+// doesn't exist
+func (api *API) idValidationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := mux.Vars(r)["id"]; ok && api.idValidator != nil && !api.idValidator.ValidID(id) {
+			WriteProblem(w, http.StatusBadRequest, Problem{
+				Detail:   "Malformed user ID",
+				Instance: r.URL.Path,
+				Errors:   []FieldError{{Field: "id", Message: "is not a valid user ID"}},
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Supported response encodings, in server preference order for ties
+var supportedEncodings = []string{"br", "gzip", "deflate"}
+
+// negotiateEncoding picks the client's highest-q supported encoding from an
+// Accept-Encoding header, or "" if none is acceptable
+func negotiateEncoding(header string) string {
+	best, bestQ, bestRank := "", 0.0, len(supportedEncodings)
+
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "*" {
+			name = "gzip"
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		rank := -1
+		for i, enc := range supportedEncodings {
+			if enc == name {
+				rank = i
+				break
+			}
+		}
+		if rank < 0 || q <= 0 {
+			continue
+		}
+
+		if q > bestQ || (q == bestQ && rank < bestRank) {
+			best, bestQ, bestRank = name, q, rank
+		}
+	}
+
+	return best
+}
+
+// newEncoder wraps w with a compressor for the given content coding
+func newEncoder(w io.Writer, encoding string) io.WriteCloser {
+	switch encoding {
+	case "br":
+		return brotli.NewWriter(w)
+	case "deflate":
+		// HTTP "deflate" is the zlib format (RFC 9110 section 8.4.1.2)
+		return zlib.NewWriter(w)
+	default:
+		return gzip.NewWriter(w)
+	}
+}
+
+// isCompressedType reports whether a content type is already compressed
+func isCompressedType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip", "application/x-gzip"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter buffers the start of a response so it can skip compressing
+// small bodies, then streams the remainder through the chosen encoder
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buf      []byte
+	enc      io.WriteCloser
+	started  bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.started {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start commits the headers, choosing whether to compress, and flushes the
+// buffered prefix of the body
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	h := cw.Header()
+	if compress && h.Get("Content-Encoding") == "" && !isCompressedType(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		cw.enc = newEncoder(cw.ResponseWriter, cw.encoding)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buffered := cw.buf
+	cw.buf = nil
+	if len(buffered) == 0 {
+		return nil
+	}
+	if cw.enc != nil {
+		_, err := cw.enc.Write(buffered)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buffered)
+	return err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+// FlushError commits the headers and pushes everything written so far,
+// including data held in the encoder, to the client. Streaming handlers
+// flush through this via http.ResponseController.
+func (cw *compressWriter) FlushError() error {
+	if !cw.started {
+		if err := cw.start(true); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := cw.enc.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+	return http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close flushes any buffered body uncompressed if it never reached the
+// minimum size, and finishes the compressed stream otherwise
+func (cw *compressWriter) Close() error {
+	if !cw.started {
+		if err := cw.start(false); err != nil {
+			return err
+		}
+	}
+	if cw.enc != nil {
+		return cw.enc.Close()
+	}
+	return nil
+}
+
+// compressionMiddleware negotiates br, gzip, or deflate from Accept-Encoding
+func (api *API) compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        api.CompressionMinSize,
+		}
+		defer func() {
+			if err := cw.Close(); err != nil {
+				FromContext(r.Context()).Error("failed to finish compressed response", "encoding", encoding, "error", err)
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// listUsersV1 handles GET /api/v1/users
+func (api *API) listUsersV1(w http.ResponseWriter, r *http.Request) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	users, total, err := api.store.List(r.Context(), (page-1)*pageSize, pageSize)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	response := PaginatedResponse{
+		Data:       users,
+		Page:       page,
+		PageSize:   pageSize,
+		TotalItems: total,
+		TotalPages: (total + pageSize - 1) / pageSize,
+	}
+	paginate(r.URL, &response)
+
+	writeResponse(w, http.StatusOK, response)
+}
+
+// createUserV1 handles POST /api/v1/users
+func (api *API) createUserV1(ctx context.Context, user User) (User, int, error) {
+	if err := api.insertUser(ctx, &user); err != nil {
+		return User{}, 0, err
+	}
+	return user, http.StatusCreated, nil
+}
+
+// insertUser assigns a new user its ID and creation time, stores it, and
+// records the side effects of a create
+func (api *API) insertUser(ctx context.Context, user *User) error {
+	user.ID = api.ids.NewID()
+	user.CreatedAt = time.Now()
+
+	if err := api.store.Create(ctx, user); err != nil {
+		return err
+	}
+	api.audit(ctx, "user.create", user.ID, nil, *user)
+	api.publish(ctx, TopicUserCreated, *user)
+	return nil
+}
+
+// getUserV1 handles GET /api/v1/users/{id}. Soft-deleted users answer 410
+// Gone so clients can tell them apart from IDs that never existed.
+func (api *API) getUserV1(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	user, err := api.fetchUser(r.Context(), id)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	etag := userETag(user)
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeResponse(w, http.StatusOK, user)
+}
+
+// userETag returns a strong ETag for user: a hash of its JSON form, so it
+// changes whenever any field does
+func userETag(user *User) string {
+	data, _ := json.Marshal(user)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists
+// etag or is "*". If-None-Match uses weak comparison, which ignores a W/
+// prefix; If-Match must compare strongly.
+func etagMatches(header, etag string, weak bool) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// userReadTimeout bounds a coalesced store read, which no longer ends with
+// the request that started it
+const userReadTimeout = 5 * time.Second
+
+// fetchUser loads a user, coalescing concurrent lookups for the same ID into
+// a single store read. The read is shared, so it runs detached from the
+// first caller's cancellation under its own timeout; a caller that goes away
+// only stops waiting. Errors are never cached, and each caller receives its
+// own copy so one request can't mutate another's result.
+func (api *API) fetchUser(ctx context.Context, id string) (*User, error) {
+	results := api.userReads.DoChan(id, func() (interface{}, error) {
+		readCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), userReadTimeout)
+		defer cancel()
+		return api.store.Get(readCtx, id)
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-results:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if res.Err != nil {
+		return nil, res.Err
+	}
+
+	user := *res.Val.(*User)
+	return &user, nil
+}
+
+// updateUserV1 handles PUT /api/v1/users/{id}. With "If-None-Match: *" the
+// request becomes a conditional create that only succeeds if the user does
+// not exist yet, so clients creating by a known ID can't clobber a record.
+// With If-Match the update only applies if the user still has one of the
+// listed ETags, so clients can't overwrite changes they haven't seen.
+func (api *API) updateUserV1(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	createOnly := r.Header.Get("If-None-Match") == "*"
+
+	// A conditional create may reuse a soft-deleted ID
+	before, err := api.store.Get(r.Context(), id)
+	if createOnly && err == nil {
+		api.writeError(w, r, http.StatusPreconditionFailed, "User already exists")
+		return
+	}
+	if err != nil && !(createOnly && (errors.Is(err, ErrNotFound) || errors.Is(err, errUserDeleted))) {
+		writeServiceError(w, r, err)
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); !createOnly && ifMatch != "" && !etagMatches(ifMatch, userETag(before), false) {
+		api.writeError(w, r, http.StatusPreconditionFailed, "User has changed since it was read")
+		return
+	}
+
+	var user User
+	if !decodeBody(w, r, &user) {
+		return
+	}
+	if err := user.Validate(); err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	user.ID = id
+	status := http.StatusOK
+	if createOnly {
+		user.CreatedAt = time.Now()
+		status = http.StatusCreated
+		err = api.store.Create(r.Context(), &user)
+	} else {
+		err = api.store.Update(r.Context(), id, &user)
+	}
+	if errors.Is(err, ErrConflict) {
+		// Created concurrently since the check above
+		api.writeError(w, r, http.StatusPreconditionFailed, "User already exists")
+		return
+	}
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	if createOnly {
+		api.audit(r.Context(), "user.create", id, nil, user)
+		api.publish(r.Context(), TopicUserCreated, user)
+	} else {
+		api.audit(r.Context(), "user.update", id, before, user)
+		api.publish(r.Context(), TopicUserUpdated, user)
+	}
+
+	w.Header().Set("ETag", userETag(&user))
+	writeResponse(w, status, user)
+}
+
+// UserPatch is a partial update to a user. Nil fields are left unchanged;
+// a JSON null counts as omitted.
+type UserPatch struct {
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+}
+
+// apply sets the fields present in p on user
+func (p *UserPatch) apply(user *User) {
+	if p.FirstName != nil {
+		user.FirstName = *p.FirstName
+	}
+	if p.LastName != nil {
+		user.LastName = *p.LastName
+	}
+	if p.Email != nil {
+		user.Email = *p.Email
+	}
+}
+
+// patchUserV1 handles PATCH /api/v1/users/{id}. Only the fields in the body
+// change; the merged user is validated as a whole before it's saved. Like
+// PUT, If-Match makes the update conditional on the user's ETag.
+func (api *API) patchUserV1(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	before, err := api.store.Get(r.Context(), id)
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagMatches(ifMatch, userETag(before), false) {
+		api.writeError(w, r, http.StatusPreconditionFailed, "User has changed since it was read")
+		return
+	}
+
+	var patch UserPatch
+	if !decodeBody(w, r, &patch) {
+		return
+	}
+	user := *before
+	patch.apply(&user)
+	if err := user.Validate(); err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	if err := api.store.Update(r.Context(), id, &user); err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+	api.audit(r.Context(), "user.update", id, before, user)
+	api.publish(r.Context(), TopicUserUpdated, user)
+
+	w.Header().Set("ETag", userETag(&user))
+	writeResponse(w, http.StatusOK, user)
 }
 
-// PaginatedResponse represents a paginated API response
-type PaginatedResponse struct {
-	Data       interface{} `json:"data"`
-	Page       int         `json:"page"`
-	PageSize   int         `json:"page_size"`
-	TotalItems int         `json:"total_items"`
-	TotalPages int         `json:"total_pages"`
+// deleteUserV1 handles DELETE /api/v1/users/{id}. Deletes are soft and
+// idempotent: deleting an already-deleted user succeeds again with 204, so
+// retries are safe. Only IDs that never existed return 404.
+func (api *API) deleteUserV1(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	before, err := api.store.Get(r.Context(), id)
+	if err == nil {
+		err = api.store.Delete(r.Context(), id)
+	}
+	if errors.Is(err, errUserDeleted) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err != nil {
+		writeServiceError(w, r, err)
+		return
+	}
+
+	api.audit(r.Context(), "user.delete", id, before, nil)
+	api.publish(r.Context(), TopicUserDeleted, *before)
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// RateLimiter manages rate limiting
-type RateLimiter struct {
-	limiters map[string]*rate.Limiter
-	rate     rate.Limit
-	burst    int
+// routeImportStream names the streaming import route so middleware can
+// recognize it
+const routeImportStream = "users.import.stream"
+
+// maxImportLineBytes bounds a single NDJSON line
+const maxImportLineBytes = 1 << 20
+
+// ImportLineResult reports the outcome of one NDJSON import line
+type ImportLineResult struct {
+	Line   int          `json:"line"`
+	Status int          `json:"status"`
+	ID     string       `json:"id,omitempty"`
+	Error  string       `json:"error,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
 }
 
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter(r rate.Limit, b int) *RateLimiter {
-	return &RateLimiter{
-		limiters: make(map[string]*rate.Limiter),
-		rate:     r,
-		burst:    b,
+type importLine struct {
+	number int
+	data   []byte
+}
+
+// importUsersStreamV1 handles POST /api/v1/users/import/stream. It reads
+// newline-delimited JSON users incrementally and streams back one
+// ImportLineResult per line as it goes, so arbitrarily large imports never
+// sit in memory. Blank lines are skipped. The import stops when the client
+// disconnects; users created up to that point are kept.
+func (api *API) importUsersStreamV1(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+
+	// Large imports outlive the server's per-request deadlines; rely on the
+	// client connection instead. Results are written while the body is
+	// still being read, which HTTP/1.1 only allows in full-duplex mode.
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+	rc.EnableFullDuplex()
+
+	maxInFlight := api.ImportMaxInFlight
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	lines := make(chan importLine, maxInFlight)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64<<10), maxImportLineBytes)
+		for number := 1; scanner.Scan(); number++ {
+			data := bytes.TrimSpace(scanner.Bytes())
+			if len(data) == 0 {
+				continue
+			}
+			select {
+			case lines <- importLine{number: number, data: append([]byte(nil), data...)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		readErr <- scanner.Err()
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+
+	for {
+		select {
+		case <-ctx.Done():
+			FromContext(ctx).Info("streaming import canceled", "error", ctx.Err())
+			return
+		case line, ok := <-lines:
+			if !ok {
+				if err := <-readErr; err != nil {
+					enc.Encode(ImportLineResult{Status: http.StatusBadRequest, Error: err.Error()})
+				}
+				rc.Flush()
+				return
+			}
+
+			result := api.importUser(r, line)
+			if err := enc.Encode(result); err != nil {
+				return
+			}
+			// Flush once the read-ahead drains so results keep flowing
+			// without a syscall per line
+			if len(lines) == 0 {
+				rc.Flush()
+			}
+		}
 	}
 }
 
-// GetLimiter returns a limiter for the given key
-func (rl *RateLimiter) GetLimiter(key string) *rate.Limiter {
-	limiter, exists := rl.limiters[key]
-	if !exists {
-		limiter = rate.NewLimiter(rl.rate, rl.burst)
-		rl.limiters[key] = limiter
+// importUser creates the user on one import line
+func (api *API) importUser(r *http.Request, line importLine) ImportLineResult {
+	var user User
+	violations, err := decodeStrict(bytes.NewReader(line.data), &user)
+	if err != nil {
+		return ImportLineResult{Line: line.number, Status: http.StatusBadRequest, Error: "invalid JSON: " + err.Error()}
+	}
+	if len(violations) > 0 {
+		return ImportLineResult{Line: line.number, Status: http.StatusBadRequest, Error: "unknown fields or fields of the wrong type", Errors: violations}
+	}
+	var validation *ValidationError
+	if errors.As(user.Validate(), &validation) {
+		return ImportLineResult{Line: line.number, Status: http.StatusUnprocessableEntity, Error: validation.Error(), Errors: validation.Fields}
+	}
+
+	if err := api.insertUser(r.Context(), &user); err != nil {
+		status := statusForError(err)
+		if status == http.StatusInternalServerError {
+			FromContext(r.Context()).Error("import line failed", "line", line.number, "error", err)
+			return ImportLineResult{Line: line.number, Status: status, Error: "Internal server error"}
+		}
+		return ImportLineResult{Line: line.number, Status: status, Error: err.Error()}
 	}
-	return limiter
+	return ImportLineResult{Line: line.number, Status: http.StatusCreated, ID: user.ID}
 }
 
-// API represents the REST API server
-type API struct {
-	router      *mux.Router
-	rateLimiter *RateLimiter
-	users       map[string]*User // In-memory store for demo
+// bulkListPageSize is how many users a bulk delete reads from the store at a
+// time while looking for matches
+const bulkListPageSize = 500
+
+// BulkDeleteResponse reports how many users a bulk delete removed
+type BulkDeleteResponse struct {
+	XMLName xml.Name `json:"-" xml:"bulk_delete"`
+	Deleted int      `json:"deleted" xml:"deleted"`
 }
 
-// NewAPI creates a new API instance
-func NewAPI() *API {
-	api := &API{
-		router:      mux.NewRouter(),
-		rateLimiter: NewRateLimiter(rate.Limit(10), 20),
-		users:       make(map[string]*User),
+// BulkCreateResult reports the outcome of one user in a non-atomic bulk
+// create
+type BulkCreateResult struct {
+	XMLName xml.Name     `json:"-" xml:"result"`
+	Index   int          `json:"index" xml:"index"`
+	Status  int          `json:"status" xml:"status"`
+	ID      string       `json:"id,omitempty" xml:"id,omitempty"`
+	Error   string       `json:"error,omitempty" xml:"error,omitempty"`
+	Errors  []FieldError `json:"errors,omitempty" xml:"errors>error,omitempty"`
+}
+
+// bulkCreateUsersV1 handles POST /api/v1/users/bulk, creating a JSON array
+// of users. By default each user stands alone and the response lists a
+// BulkCreateResult per item. With atomic=true the batch is all or nothing:
+// an invalid item fails the request before anything is stored, and a store
+// failure rolls back the users already created. Errors name the failing
+// item by index, as in "[2].email".
+func (api *API) bulkCreateUsersV1(w http.ResponseWriter, r *http.Request) {
+	var users []User
+	raw, err := io.ReadAll(r.Body)
+	if err == nil {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err = locateJSONError(raw, dec.Decode(&users))
+	}
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
 	}
 
-	api.setupRoutes()
-	return api
+	allOrNothing, _ := strconv.ParseBool(r.URL.Query().Get("atomic"))
+	if !allOrNothing {
+		api.createEach(w, r, users)
+		return
+	}
+
+	var invalid []FieldError
+	for i := range users {
+		var validation *ValidationError
+		if errors.As(users[i].Validate(), &validation) {
+			for _, f := range validation.Fields {
+				invalid = append(invalid, FieldError{Field: fmt.Sprintf("[%d].%s", i, f.Field), Message: f.Message})
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		writeServiceError(w, r, &ValidationError{Fields: invalid})
+		return
+	}
+
+	store, ok := api.store.(AtomicUserStore)
+	if !ok {
+		api.writeError(w, r, http.StatusNotImplemented, "The user store can't create users atomically")
+		return
+	}
+
+	now := time.Now()
+	batch := make([]*User, len(users))
+	for i := range users {
+		users[i].ID = api.ids.NewID()
+		users[i].CreatedAt = now
+		batch[i] = &users[i]
+	}
+	if err := store.CreateAll(r.Context(), batch); err != nil {
+		var batchErr *BatchError
+		status := statusForError(err)
+		if !errors.As(err, &batchErr) || status == http.StatusInternalServerError {
+			writeServiceError(w, r, err)
+			return
+		}
+		WriteProblem(w, status, Problem{
+			Detail:   fmt.Sprintf("Item %d failed, so no users were created", batchErr.Index),
+			Instance: r.URL.Path,
+			Errors:   []FieldError{{Field: fmt.Sprintf("[%d]", batchErr.Index), Message: batchErr.Err.Error()}},
+		})
+		return
+	}
+
+	for _, user := range users {
+		api.audit(r.Context(), "user.create", user.ID, nil, user)
+		api.publish(r.Context(), TopicUserCreated, user)
+	}
+	writeResponse(w, http.StatusCreated, users)
 }
 
-// setupRoutes configures API routes
-func (api *API) setupRoutes() {
-	// Apply middleware
-	api.router.Use(api.rateLimitMiddleware)
-	api.router.Use(api.loggingMiddleware)
+// createEach creates users one at a time for a non-atomic bulk create,
+// reporting each outcome
+func (api *API) createEach(w http.ResponseWriter, r *http.Request, users []User) {
+	results := make([]BulkCreateResult, len(users))
+	for i := range users {
+		result := BulkCreateResult{Index: i, Status: http.StatusCreated}
+		err := users[i].Validate()
+		if err == nil {
+			err = api.insertUser(r.Context(), &users[i])
+		}
 
-	// V1 routes
-	v1 := api.router.PathPrefix("/api/v1").Subrouter()
-	v1.HandleFunc("/users", api.listUsersV1).Methods("GET")
-	v1.HandleFunc("/users", api.createUserV1).Methods("POST")
-	v1.HandleFunc("/users/{id}", api.getUserV1).Methods("GET")
-	v1.HandleFunc("/users/{id}", api.updateUserV1).Methods("PUT")
-	v1.HandleFunc("/users/{id}", api.deleteUserV1).Methods("DELETE")
+		var validation *ValidationError
+		switch {
+		case err == nil:
+			result.ID = users[i].ID
+		case errors.As(err, &validation):
+			result.Status = http.StatusUnprocessableEntity
+			result.Errors = validation.Fields
+		default:
+			result.Status = statusForError(err)
+			result.Error = err.Error()
+			if result.Status == http.StatusInternalServerError {
+				FromContext(r.Context()).Error("bulk create item failed", "index", i, "error", err)
+				result.Error = "Internal server error"
+			}
+		}
+		results[i] = result
+	}
+	writeResponse(w, http.StatusOK, results)
 }
 
-// rateLimitMiddleware implements rate limiting
-func (api *API) rateLimitMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := r.RemoteAddr
-		limiter := api.rateLimiter.GetLimiter(key)
+// bulkDeleteUsersV1 handles DELETE /api/v1/users?email_contains=...&confirm=true.
+// It soft-deletes every user matching the filter. Both a filter and an
+// explicit confirm=true are required so a stray request can't wipe the
+// whole store.
+func (api *API) bulkDeleteUsersV1(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
 
-		if !limiter.Allow() {
-			w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", api.rateLimiter.burst))
-			w.Header().Set("X-RateLimit-Remaining", "0")
-			w.Header().Set("Retry-After", "60")
+	if query.Get("confirm") != "true" {
+		WriteProblem(w, http.StatusBadRequest, Problem{
+			Detail:   "Bulk delete requires confirm=true",
+			Instance: r.URL.Path,
+			Errors:   []FieldError{{Field: "confirm", Message: "must be true"}},
+		})
+		return
+	}
+
+	emailContains := query.Get("email_contains")
+	if emailContains == "" {
+		WriteProblem(w, http.StatusBadRequest, Problem{
+			Detail:   "Bulk delete requires a filter",
+			Instance: r.URL.Path,
+			Errors:   []FieldError{{Field: "email_contains", Message: "is required"}},
+		})
+		return
+	}
+
+	// Collect the matches first: deleting while paging would shift the
+	// pages still to come
+	var matches []*User
+	for offset := 0; ; offset += bulkListPageSize {
+		users, total, err := api.store.List(r.Context(), offset, bulkListPageSize)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		for _, user := range users {
+			if strings.Contains(user.Email, emailContains) {
+				matches = append(matches, user)
+			}
+		}
+		if offset+bulkListPageSize >= total {
+			break
+		}
+	}
 
-			api.writeError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+	deleted := 0
+	for _, user := range matches {
+		if err := api.store.Delete(r.Context(), user.ID); err != nil {
+			if errors.Is(err, ErrNotFound) || errors.Is(err, errUserDeleted) {
+				continue // Deleted concurrently
+			}
+			writeServiceError(w, r, err)
 			return
 		}
+		api.audit(r.Context(), "user.delete", user.ID, user, nil)
+		api.publish(r.Context(), TopicUserDeleted, *user)
+		deleted++
+	}
 
-		w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", api.rateLimiter.burst))
-		next.ServeHTTP(w, r)
-	})
+	writeResponse(w, http.StatusOK, BulkDeleteResponse{Deleted: deleted})
 }
 
-// loggingMiddleware logs requests
-func (api *API) loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Printf("%s %s", r.Method, r.URL.Path)
-		next.ServeHTTP(w, r)
-		log.Printf("Completed in %v", time.Since(start))
-	})
+// adminResetV1 handles POST /api/v1/admin/reset, removing every user and
+// tombstone. A deterministic ID generator is rewound too, so each test run
+// sees the same IDs. Stores that can't be wiped answer 501.
+func (api *API) adminResetV1(w http.ResponseWriter, r *http.Request) {
+	store, ok := api.store.(interface{ Reset() })
+	if !ok {
+		api.writeError(w, r, http.StatusNotImplemented, "The user store does not support reset")
+		return
+	}
+	store.Reset()
+	if resetter, ok := api.ids.(interface{ Reset() }); ok {
+		resetter.Reset()
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
-// listUsersV1 handles GET /api/v1/users
-func (api *API) listUsersV1(w http.ResponseWriter, r *http.Request) {
-	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
-	if page < 1 {
-		page = 1
+// adminSeedV1 handles POST /api/v1/admin/seed, preloading a JSON array of
+// users. Fixtures may fix their IDs; the rest are generated. Seeding is
+// setup, not user activity, so it isn't audited or published.
+func (api *API) adminSeedV1(w http.ResponseWriter, r *http.Request) {
+	raw, err := io.ReadAll(r.Body)
+	var users []User
+	if err == nil {
+		err = locateJSONError(raw, json.Unmarshal(raw, &users))
+	}
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
 	}
 
-	pageSize, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
-	if pageSize < 1 || pageSize > 100 {
-		pageSize = 20
+	// Seed all or nothing: report every invalid user before storing any
+	var invalid []FieldError
+	for i := range users {
+		var validation *ValidationError
+		if errors.As(users[i].Validate(), &validation) {
+			for _, f := range validation.Fields {
+				invalid = append(invalid, FieldError{Field: fmt.Sprintf("[%d].%s", i, f.Field), Message: f.Message})
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		writeServiceError(w, r, &ValidationError{Fields: invalid})
+		return
+	}
+
+	now := time.Now()
+	for i := range users {
+		user := users[i]
+		if user.ID == "" {
+			user.ID = api.ids.NewID()
+		}
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = now
+		}
+		err := api.store.Create(r.Context(), &user)
+		if errors.Is(err, ErrConflict) {
+			err = api.store.Update(r.Context(), user.ID, &user)
+		}
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		users[i] = user
 	}
 
-	// Convert map to slice
-	users := make([]*User, 0, len(api.users))
-	for _, user := range api.users {
-		users = append(users, user)
+	writeResponse(w, http.StatusCreated, users)
+}
+
+// audit records a mutating operation if an AuditLogger is configured.
+// Audit failures are logged but never fail the request.
+func (api *API) audit(ctx context.Context, action, targetID string, before, after interface{}) {
+	if api.AuditLogger == nil {
+		return
 	}
 
-	// Simple pagination
-	start := (page - 1) * pageSize
-	end := start + pageSize
-	if start > len(users) {
-		start = len(users)
+	record := AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Actor:     ActorFromContext(ctx),
+		Action:    action,
+		TargetID:  targetID,
+		Before:    before,
+		After:     after,
 	}
-	if end > len(users) {
-		end = len(users)
+	if err := api.AuditLogger.Log(ctx, record); err != nil {
+		FromContext(ctx).Error("failed to write audit record", "action", action, "target_id", targetID, "error", err)
 	}
+}
 
-	response := PaginatedResponse{
-		Data:       users[start:end],
-		Page:       page,
-		PageSize:   pageSize,
-		TotalItems: len(users),
-		TotalPages: (len(users) + pageSize - 1) / pageSize,
+// publish sends an event to the bus if one is configured. Like auditing,
+// publish failures are logged but never fail the request.
+func (api *API) publish(ctx context.Context, topic Topic, payload interface{}) {
+	if api.Events == nil {
+		return
 	}
+	if err := api.Events.Publish(ctx, topic, payload); err != nil {
+		FromContext(ctx).Error("failed to publish event", "topic", topic, "error", err)
+	}
+}
 
-	api.writeJSON(w, http.StatusOK, response)
+// decodeBody strictly decodes the request body into dst, writing a 400
+// problem that says where the JSON is malformed or names any mistyped fields.
+// It reports whether decoding succeeded.
+func decodeBody(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	violations, err := decodeStrict(r.Body, dst)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return false
+	}
+	if len(violations) > 0 {
+		WriteProblem(w, http.StatusBadRequest, Problem{
+			Detail:   "Request body has unknown fields or fields of the wrong type",
+			Instance: r.URL.Path,
+			Errors:   violations,
+		})
+		return false
+	}
+	return true
 }
 
-// createUserV1 handles POST /api/v1/users
-func (api *API) createUserV1(w http.ResponseWriter, r *http.Request) {
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		api.writeError(w, http.StatusBadRequest, "Invalid request body")
+// writeBodyError writes the problem for a request body that couldn't be
+// read or decoded
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	var bodyErr *BodyError
+	problem := Problem{Detail: "Invalid request body", Instance: r.URL.Path}
+	switch {
+	case errors.As(err, &tooLarge):
+		problem.Detail = fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit)
+		WriteProblem(w, http.StatusRequestEntityTooLarge, problem)
 		return
+	case errors.As(err, &bodyErr):
+		problem.Detail = "Invalid request body: " + bodyErr.Error()
+		if bodyErr.Field != "" {
+			problem.Errors = []FieldError{{Field: bodyErr.Field, Message: bodyErr.Message}}
+		}
+	case errors.Is(err, io.EOF):
+		problem.Detail = "Request body is empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		problem.Detail = "Request body ends before the JSON value is complete"
 	}
+	WriteProblem(w, http.StatusBadRequest, problem)
+}
 
-	user.ID = fmt.Sprintf("user-%d", len(api.users)+1)
-	user.CreatedAt = time.Now()
-
-	api.users[user.ID] = &user
+// BodyError locates a JSON decoding failure in a request body
+type BodyError struct {
+	Line    int
+	Column  int
+	Offset  int64
+	Field   string
+	Message string
+	Err     error
+}
 
-	api.writeJSON(w, http.StatusCreated, user)
+func (e *BodyError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("field %q %s at line %d, column %d", e.Field, e.Message, e.Line, e.Column)
+	}
+	return fmt.Sprintf("%s at line %d, column %d", e.Message, e.Line, e.Column)
 }
 
-// getUserV1 handles GET /api/v1/users/{id}
-func (api *API) getUserV1(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+func (e *BodyError) Unwrap() error { return e.Err }
 
-	user, exists := api.users[id]
-	if !exists {
-		api.writeError(w, http.StatusNotFound, "User not found")
-		return
+// locateJSONError wraps a syntax or type error from decoding raw in a
+// BodyError that says where it happened. Other errors are returned as is.
+func locateJSONError(raw []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, column := jsonPosition(raw, syntaxErr.Offset)
+		return &BodyError{Line: line, Column: column, Offset: syntaxErr.Offset, Message: syntaxErr.Error(), Err: err}
+	case errors.As(err, &typeErr):
+		line, column := jsonPosition(raw, typeErr.Offset)
+		message := fmt.Sprintf("must be %s, got %s", typeErr.Type, typeErr.Value)
+		if typeErr.Field == "" {
+			message = "body must be a JSON object, got " + typeErr.Value
+		}
+		return &BodyError{Line: line, Column: column, Offset: typeErr.Offset, Field: typeErr.Field, Message: message, Err: err}
 	}
+	return err
+}
 
-	api.writeJSON(w, http.StatusOK, user)
+// jsonPosition converts a byte offset reported by encoding/json into a
+// 1-based line and column. The decoder reports the offset just past the
+// offending byte, which makes it that byte's column.
+func jsonPosition(raw []byte, offset int64) (line, column int) {
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	prefix := raw[:offset]
+	line = 1 + bytes.Count(prefix, []byte("\n"))
+	column = len(prefix) - (bytes.LastIndexByte(prefix, '\n') + 1)
+	return line, column
 }
 
-// updateUserV1 handles PUT /api/v1/users/{id}
-func (api *API) updateUserV1(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+// decodeStrict decodes a JSON object into the struct dst points to,
+// reporting every unknown field and every field whose JSON type doesn't
+// match the Go type instead of failing on the first. Numbers are kept as
+// json.Number so that "5", 5 and 5.5 can be told apart for integer fields.
+func decodeStrict(body io.Reader, dst interface{}) ([]FieldError, error) {
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
 
-	if _, exists := api.users[id]; !exists {
-		api.writeError(w, http.StatusNotFound, "User not found")
-		return
+	var fields map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&fields); err != nil {
+		return nil, locateJSONError(raw, err)
 	}
 
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		api.writeError(w, http.StatusBadRequest, "Invalid request body")
-		return
+	var violations []FieldError
+	known := make(map[string]bool)
+	t := reflect.TypeOf(dst).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" || !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		known[name] = true
+
+		value, ok := fields[name]
+		if !ok || value == nil {
+			continue
+		}
+		if expected, ok := matchesJSONType(field.Type, value); !ok {
+			violations = append(violations, FieldError{Field: name, Message: "must be " + expected})
+		}
 	}
 
-	user.ID = id
-	api.users[id] = &user
+	// Typos in keys would otherwise be silently dropped
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		violations = append(violations, FieldError{Field: name, Message: "is not a known field"})
+	}
+	if len(violations) > 0 {
+		return violations, nil
+	}
 
-	api.writeJSON(w, http.StatusOK, user)
+	// DisallowUnknownFields also catches unknown keys in nested objects
+	dec = json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return nil, locateJSONError(raw, dec.Decode(dst))
 }
 
-// deleteUserV1 handles DELETE /api/v1/users/{id}
-func (api *API) deleteUserV1(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+// matchesJSONType reports whether a decoded JSON value fits Go type t, and
+// describes the JSON type t expects
+func matchesJSONType(t reflect.Type, value interface{}) (string, bool) {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		_, ok := value.(string)
+		return "an RFC 3339 timestamp string", ok
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		_, ok := value.(string)
+		return "a string", ok
+	case reflect.Bool:
+		_, ok := value.(bool)
+		return "a boolean", ok
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := value.(json.Number)
+		if ok {
+			_, err := strconv.ParseInt(n.String(), 10, t.Bits())
+			ok = err == nil
+		}
+		return "an integer", ok
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := value.(json.Number)
+		if ok {
+			_, err := strconv.ParseUint(n.String(), 10, t.Bits())
+			ok = err == nil
+		}
+		return "a non-negative integer", ok
+	case reflect.Float32, reflect.Float64:
+		_, ok := value.(json.Number)
+		return "a number", ok
+	}
+	return "", true
+}
+
+// writeResponse writes data as JSON, or as XML if the client negotiated it
+func writeResponse(w http.ResponseWriter, status int, data interface{}) {
+	encodeResponse(w, status, "application/json", "application/xml", data)
+}
+
+// writeError writes a problem details error response for the request
+func (api *API) writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	WriteProblem(w, status, Problem{
+		Detail:   message,
+		Instance: r.URL.Path,
+	})
+}
+
+// routeMethods are the methods probed when building an Allow header
+var routeMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions,
+}
+
+// unmatched answers requests no route serves. If the path is served under
+// other methods the answer is 405 with those methods in Allow, otherwise
+// 404. It backs both of the router's fallback handlers because mux's own
+// method-mismatch detection misses paths registered in a subrouter with
+// more routes after them.
+func (api *API) unmatched(w http.ResponseWriter, r *http.Request) {
+	// The router's middleware doesn't run for unmatched requests
+	w = api.withProblemTypes(w, r)
+	w, _ = withResponseFormat(w, r)
+
+	var allowed []string
+	for _, method := range routeMethods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		var match mux.RouteMatch
+		if api.router.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
 
-	if _, exists := api.users[id]; !exists {
-		api.writeError(w, http.StatusNotFound, "User not found")
+	if len(allowed) == 0 {
+		api.writeError(w, r, http.StatusNotFound, "No resource at this path")
 		return
 	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	api.writeError(w, r, http.StatusMethodNotAllowed,
+		fmt.Sprintf("Method %s is not allowed here; use %s", r.Method, strings.Join(allowed, ", ")))
+}
 
-	delete(api.users, id)
-	w.WriteHeader(http.StatusNoContent)
+// Validator is implemented by request types that check their own fields.
+// Validate should return a *ValidationError listing every invalid field.
+type Validator interface {
+	Validate() error
 }
 
-// writeJSON writes a JSON response
-func (api *API) writeJSON(w http.ResponseWriter, status int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(data)
+// ValidationResult is the response to a request made with validate_only
+type ValidationResult struct {
+	XMLName xml.Name `json:"-" xml:"validation"`
+	Valid   bool     `json:"valid" xml:"valid"`
+}
+
+// validateOnly reports whether the client asked, with ?validate_only=true,
+// for its request to be checked but not carried out
+func validateOnly(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("validate_only"))
+	return v
+}
+
+// Handle adapts a typed handler to http.HandlerFunc. The request body is
+// strictly decoded into Req and validated if Req implements Validator; fn's
+// result is written as JSON or XML with the status it returns (200 if zero, and no
+// body for 204). Errors from decoding, validation, or fn become problem
+// responses with the status statusForError maps them to. With
+// ?validate_only=true, fn isn't called: a request that passes validation
+// gets 200 and a ValidationResult.
+func Handle[Req, Resp any](fn func(ctx context.Context, req Req) (Resp, int, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if !decodeBody(w, r, &req) {
+			return
+		}
+		if v, ok := any(&req).(Validator); ok {
+			if err := v.Validate(); err != nil {
+				writeServiceError(w, r, err)
+				return
+			}
+		}
+		if validateOnly(r) {
+			writeResponse(w, http.StatusOK, ValidationResult{Valid: true})
+			return
+		}
+
+		resp, status, err := fn(r.Context(), req)
+		if err != nil {
+			writeServiceError(w, r, err)
+			return
+		}
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		writeResponse(w, status, resp)
+	}
+}
+
+// statusForError maps a service error to its HTTP status
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, errUserDeleted):
+		return http.StatusGone
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrValidation):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
-// writeError writes an error response
-func (api *API) writeError(w http.ResponseWriter, status int, message string) {
-	response := ErrorResponse{
-		Error:   http.StatusText(status),
-		Message: message,
+// writeServiceError writes err as a problem with the status it maps to.
+// Validation errors list their fields; unexpected errors are logged and
+// hidden from the client.
+func writeServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	status := statusForError(err)
+	if status == http.StatusInternalServerError {
+		FromContext(r.Context()).Error("unexpected error", "method", r.Method, "path", r.URL.Path, "error", err)
+		WriteProblem(w, status, Problem{Detail: "Internal server error", Instance: r.URL.Path})
+		return
+	}
+
+	problem := Problem{Detail: err.Error(), Instance: r.URL.Path}
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		problem.Errors = validation.Fields
+		problem.Fields = validation.FieldMap()
 	}
-	api.writeJSON(w, status, response)
+	WriteProblem(w, status, problem)
 }
 
 func main() {
-	api := NewAPI()
+	api := NewAPI(
+		WithFeatureFlags(FeatureFlagsFromEnv()),
+		WithRateLimitMetrics(prometheus.DefaultRegisterer),
+	)
+	api.router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// METRICS_BACKEND=otlp pushes request metrics to an OpenTelemetry
+	// collector instead of exposing them to Prometheus
+	switch backend := os.Getenv("METRICS_BACKEND"); backend {
+	case "", "prometheus":
+		metrics, err := NewPrometheusMetricsRecorder(prometheus.DefaultRegisterer)
+		if err != nil {
+			log.Fatalf("Failed to register metrics: %v", err)
+		}
+		api.Metrics = metrics
+	case "otlp":
+		provider, err := newOTLPMeterProvider(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to create OTLP exporter: %v", err)
+		}
+		defer provider.Shutdown(context.Background())
+		metrics, err := NewOTelMetricsRecorder(provider.Meter("rest-api"))
+		if err != nil {
+			log.Fatalf("Failed to create metrics: %v", err)
+		}
+		api.Metrics = metrics
+	default:
+		log.Fatalf("Invalid METRICS_BACKEND %q: want prometheus or otlp", backend)
+	}
+
+	if path := os.Getenv("AUDIT_LOG_PATH"); path != "" {
+		rotation, err := AuditRotationFromEnv()
+		if err != nil {
+			log.Fatal(err)
+		}
+		auditLogger, err := NewJSONLAuditLogger(path, WithAuditRotation(rotation))
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		defer auditLogger.Close()
+		api.AuditLogger = auditLogger
+	}
+
+	if v := os.Getenv("API_TOKENS"); v != "" {
+		tokens, err := ParseAPITokens(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.AuthTokens = tokens
+	}
+
+	if v := os.Getenv("API_ROLES"); v != "" {
+		roles, err := ParseRoles(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.Authorizer = &RoleAuthorizer{Roles: roles, Grants: DefaultGrants}
+	}
 
+	if v := os.Getenv("LOG_SAMPLE_RATE"); v != "" {
+		sampleRate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("Invalid LOG_SAMPLE_RATE %q", v)
+		}
+		api.LogSampler = NewLogSampler(sampleRate, time.Second)
+	}
+
+	// Share idempotency keys across instances when Redis is available
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		api.Idempotency = NewRedisIdempotencyStore(redis.NewClient(&redis.Options{Addr: addr}))
+	} else {
+		api.Idempotency = NewInMemoryIdempotencyStore(nil)
+	}
+
+	// Side effects of user writes run off the request path
+	api.Events = NewEventBus(256, 4)
+	for _, topic := range []Topic{TopicUserCreated, TopicUserUpdated, TopicUserDeleted} {
+		api.Events.SubscribeAsync(topic, func(ctx context.Context, event BusEvent) {
+			log.Printf("Event %s at %s", event.Topic, event.Timestamp.Format(time.RFC3339))
+		})
+	}
+
+	maxHeaderBytes := defaultMaxHeaderBytes
+	if v := os.Getenv("MAX_HEADER_BYTES"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("Invalid MAX_HEADER_BYTES %q", v)
+		}
+		maxHeaderBytes = n
+	}
+
+	// ReadHeaderTimeout cuts off clients that dribble headers (slowloris)
 	server := &http.Server{
-		Addr:         ":8080",
-		Handler:      api.router,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		Addr:              ":8080",
+		Handler:           api.router,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      15 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    maxHeaderBytes,
 	}
 
-	log.Println("Starting REST API server on :8080")
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	go func() {
+		log.Println("Starting REST API server on :8080")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Println("Shutting down server...")
+	api.Drain()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Server forced to shutdown: %v", err)
+	}
+	if err := api.Events.Drain(ctx); err != nil {
+		log.Printf("Event bus drain incomplete: %v", err)
 	}
+	api.Close()
 }
 
@@ -0,0 +1,2962 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/andybalholm/brotli"
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"golang.org/x/time/rate"
+)
+
+// newTestAPI creates an API and stops its background work when the test ends
+func newTestAPI(t *testing.T, opts ...APIOption) *API {
+	t.Helper()
+	api := NewAPI(opts...)
+	t.Cleanup(api.Close)
+	return api
+}
+
+// serve runs a request through api's router
+func serve(api *API, method, target, body string, header http.Header) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// absentUserID is a well-formed UUID that no test creates
+const absentUserID = "00000000-0000-4000-8000-000000000000"
+
+// memoryStore returns api's default in-memory user store
+func memoryStore(api *API) *MemoryUserStore {
+	return api.store.(*MemoryUserStore)
+}
+
+// bearer returns an Authorization header for token
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// memoryAuditLogger keeps audit records in memory
+type memoryAuditLogger struct {
+	mu      sync.Mutex
+	records []AuditRecord
+}
+
+func (l *memoryAuditLogger) Log(ctx context.Context, record AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record)
+	return nil
+}
+
+func TestAuditRecordsCreateAndDelete(t *testing.T) {
+	api := newTestAPI(t)
+	audit := &memoryAuditLogger{}
+	api.AuditLogger = audit
+	api.AuthTokens = map[string]string{"secret-a": "alice"}
+
+	rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, bearer("secret-a"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	var created User
+	json.NewDecoder(rec.Body).Decode(&created)
+
+	rec = serve(api, "DELETE", "/api/v1/users/"+created.ID, "", bearer("secret-a"))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", rec.Code, rec.Body)
+	}
+
+	if len(audit.records) != 2 {
+		t.Fatalf("got %d audit records, want 2", len(audit.records))
+	}
+	for i, action := range []string{"user.create", "user.delete"} {
+		got := audit.records[i]
+		if got.Action != action || got.Actor != "alice" || got.TargetID != created.ID {
+			t.Errorf("record %d = %+v, want %s of %s by alice", i, got, action, created.ID)
+		}
+	}
+	if audit.records[0].After == nil || audit.records[1].Before == nil {
+		t.Error("audit records are missing their before/after summaries")
+	}
+}
+
+func TestUnknownBearerTokenRejected(t *testing.T) {
+	api := newTestAPI(t)
+	api.AuthTokens = map[string]string{"secret-a": "alice"}
+
+	rec := serve(api, "GET", "/api/v1/users", "", bearer("guess"))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", rec.Code)
+	}
+	if rec.Header().Get("WWW-Authenticate") == "" {
+		t.Error("missing WWW-Authenticate header")
+	}
+
+	// No token at all is anonymous, not an error
+	if rec := serve(api, "GET", "/api/v1/users", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("anonymous status = %d, want 200", rec.Code)
+	}
+}
+
+func TestBadTokensAreRateLimited(t *testing.T) {
+	api := newTestAPI(t)
+	api.AuthTokens = map[string]string{"secret-a": "alice"}
+
+	_, burst := api.rateLimiter.Limits(readTier)
+	var unauthorized, throttled int
+	for i := 0; i < 500; i++ {
+		switch rec := serve(api, "GET", "/api/v1/users", "", bearer(fmt.Sprintf("guess-%d", i))); rec.Code {
+		case http.StatusUnauthorized:
+			unauthorized++
+		case http.StatusTooManyRequests:
+			throttled++
+		default:
+			t.Fatalf("guess %d = %d, want 401 or 429", i, rec.Code)
+		}
+	}
+	if unauthorized > burst || throttled == 0 {
+		t.Errorf("%d guesses rejected with 401 and %d throttled, want at most %d before throttling", unauthorized, throttled, burst)
+	}
+
+	// The guesses used up the client's allowance for anonymous requests too
+	if rec := serve(api, "GET", "/api/v1/users", "", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("anonymous request after guessing = %d, want 429", rec.Code)
+	}
+}
+
+func TestRateLimitPerIdentity(t *testing.T) {
+	api := newTestAPI(t)
+	api.rateLimiter.Stop()
+	api.rateLimiter = NewRateLimiter(rate.Every(1<<62), 1, 0)
+	api.AuthTokens = map[string]string{"secret-a": "alice", "secret-b": "bob"}
+
+	// httptest requests all come from the same address
+	if rec := serve(api, "GET", "/api/v1/users", "", bearer("secret-a")); rec.Code != http.StatusOK {
+		t.Fatalf("alice first request = %d, want 200", rec.Code)
+	}
+	if rec := serve(api, "GET", "/api/v1/users", "", bearer("secret-a")); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("alice second request = %d, want 429", rec.Code)
+	}
+	if rec := serve(api, "GET", "/api/v1/users", "", bearer("secret-b")); rec.Code != http.StatusOK {
+		t.Errorf("bob first request = %d, want 200; identities share a bucket", rec.Code)
+	}
+	if rec := serve(api, "GET", "/api/v1/users", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("anonymous first request = %d, want 200", rec.Code)
+	}
+}
+
+func TestIdentityOrIPKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.7:51234"
+	if got := IdentityOrIPKey(req); got != "ip:203.0.113.7" {
+		t.Errorf("anonymous key = %q, want ip:203.0.113.7", got)
+	}
+
+	req = req.WithContext(WithActor(req.Context(), "alice"))
+	if got := IdentityOrIPKey(req); got != "user:alice" {
+		t.Errorf("authenticated key = %q, want user:alice", got)
+	}
+}
+
+func TestRateLimitKeyIsPluggable(t *testing.T) {
+	api := newTestAPI(t)
+	api.rateLimiter.Stop()
+	api.rateLimiter = NewRateLimiter(rate.Every(1<<62), 1, 0)
+	api.RateLimitKey = func(r *http.Request) string { return "tenant:" + r.Header.Get("X-Tenant") }
+
+	for _, tt := range []struct {
+		tenant string
+		want   int
+	}{
+		{"acme", http.StatusOK},
+		{"acme", http.StatusTooManyRequests},
+		{"globex", http.StatusOK},
+	} {
+		rec := serve(api, "GET", "/api/v1/users", "", http.Header{"X-Tenant": {tt.tenant}})
+		if rec.Code != tt.want {
+			t.Errorf("tenant %s request = %d, want %d", tt.tenant, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestFeatureFlagsGateRoutes(t *testing.T) {
+	routes := []struct {
+		method, path, body string
+		enable             func(*FeatureFlags)
+	}{
+		{"POST", "/api/v1/admin/reset", "", func(f *FeatureFlags) { f.TestAdmin = true }},
+		{"POST", "/api/v1/users/import/stream", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, func(f *FeatureFlags) { f.BulkOperations = true }},
+	}
+	for _, route := range routes {
+		off := newTestAPI(t)
+		if rec := serve(off, route.method, route.path, route.body, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s with flag off = %d, want 404", route.method, route.path, rec.Code)
+		}
+
+		var flags FeatureFlags
+		route.enable(&flags)
+		on := newTestAPI(t, WithFeatureFlags(flags))
+		if rec := serve(on, route.method, route.path, route.body, nil); rec.Code == http.StatusNotFound {
+			t.Errorf("%s %s with flag on = 404", route.method, route.path)
+		}
+	}
+}
+
+func TestDecodeStrictTypeMismatches(t *testing.T) {
+	type order struct {
+		ID       int64     `json:"id"`
+		Quantity uint      `json:"quantity"`
+		Price    float64   `json:"price"`
+		Note     string    `json:"note"`
+		Gift     bool      `json:"gift"`
+		PlacedAt time.Time `json:"placed_at"`
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want []FieldError
+	}{
+		{
+			name: "well typed",
+			body: `{"id": 5, "quantity": 2, "price": 9.5, "note": "hi", "gift": true, "placed_at": "2024-01-01T00:00:00Z"}`,
+		},
+		{
+			name: "string for integer",
+			body: `{"id": "5"}`,
+			want: []FieldError{{Field: "id", Message: "must be an integer"}},
+		},
+		{
+			name: "float for integer",
+			body: `{"id": 5.5}`,
+			want: []FieldError{{Field: "id", Message: "must be an integer"}},
+		},
+		{
+			name: "negative for unsigned",
+			body: `{"quantity": -1}`,
+			want: []FieldError{{Field: "quantity", Message: "must be a non-negative integer"}},
+		},
+		{
+			name: "string for float",
+			body: `{"price": "9.5"}`,
+			want: []FieldError{{Field: "price", Message: "must be a number"}},
+		},
+		{
+			name: "number for string",
+			body: `{"note": 7}`,
+			want: []FieldError{{Field: "note", Message: "must be a string"}},
+		},
+		{
+			name: "every mismatch reported",
+			body: `{"id": "5", "note": 7, "gift": "yes", "placed_at": 0}`,
+			want: []FieldError{
+				{Field: "id", Message: "must be an integer"},
+				{Field: "note", Message: "must be a string"},
+				{Field: "gift", Message: "must be a boolean"},
+				{Field: "placed_at", Message: "must be an RFC 3339 timestamp string"},
+			},
+		},
+		{
+			name: "unknown fields",
+			body: `{"id": 5, "qty": 2, "emial": "x"}`,
+			want: []FieldError{
+				{Field: "emial", Message: "is not a known field"},
+				{Field: "qty", Message: "is not a known field"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got order
+			violations, err := decodeStrict(strings.NewReader(tt.body), &got)
+			if err != nil {
+				t.Fatalf("decodeStrict() error = %v", err)
+			}
+			if !reflect.DeepEqual(violations, tt.want) {
+				t.Errorf("violations = %v, want %v", violations, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		user User
+		want map[string]string
+	}{
+		{
+			name: "valid",
+			user: User{FirstName: "Jane", LastName: "Doe", Email: "jane.doe+work@mail.example.com"},
+		},
+		{
+			name: "missing email",
+			user: User{FirstName: "Jane", LastName: "Doe"},
+			want: map[string]string{"email": "is required"},
+		},
+		{
+			name: "bad email format",
+			user: User{FirstName: "Jane", LastName: "Doe", Email: "jane@localhost"},
+			want: map[string]string{"email": "must be an email address"},
+		},
+		{
+			name: "email with spaces",
+			user: User{FirstName: "Jane", LastName: "Doe", Email: "jane doe@example.com"},
+			want: map[string]string{"email": "must be an email address"},
+		},
+		{
+			name: "empty names",
+			user: User{FirstName: " ", Email: "jane@example.com"},
+			want: map[string]string{"first_name": "is required", "last_name": "is required"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.user.Validate()
+			var validation *ValidationError
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if !errors.As(err, &validation) {
+				t.Fatalf("Validate() = %v, want a *ValidationError", err)
+			}
+			if got := validation.FieldMap(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateUserInvalidFieldsAre422(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := serve(api, "POST", "/api/v1/users", `{"first_name":"","last_name":"Doe","email":"not-an-email"}`, nil)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"first_name": "is required", "email": "must be an email address"}
+	if !reflect.DeepEqual(problem.Fields, want) {
+		t.Errorf("fields = %v, want %v", problem.Fields, want)
+	}
+	if len(memoryStore(api).users) != 0 {
+		t.Error("invalid user was stored")
+	}
+}
+
+func TestCreateUserRejectsNumberForString(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := serve(api, "POST", "/api/v1/users", `{"email": 42}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	want := []FieldError{{Field: "email", Message: "must be a string"}}
+	if !reflect.DeepEqual(problem.Errors, want) {
+		t.Errorf("errors = %v, want %v", problem.Errors, want)
+	}
+}
+
+func TestDeterministicIDGeneratorOrder(t *testing.T) {
+	want := []string{
+		"3ce95ab7-20ef-5192-9972-ff808c3b18b2",
+		"63b72490-1d5c-59f0-b7e5-471e4ded5045",
+		"759fc5fa-eddc-5b2d-80aa-ef015feb455e",
+	}
+	ids := NewDeterministicIDGenerator("test")
+	api := newTestAPI(t, WithIDGenerator(ids))
+
+	for i, id := range want {
+		body := fmt.Sprintf(`{"first_name":"Jane","last_name":"Doe","email":"user%d@example.com"}`, i)
+		rec := serve(api, "POST", "/api/v1/users", body, nil)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+		}
+		var created User
+		json.NewDecoder(rec.Body).Decode(&created)
+		if created.ID != id {
+			t.Errorf("user %d ID = %q, want %q", i, created.ID, id)
+		}
+	}
+
+	ids.Reset()
+	if got := ids.NewID(); got != want[0] {
+		t.Errorf("after Reset NewID() = %q, want %q", got, want[0])
+	}
+}
+
+func TestSequentialIDGenerator(t *testing.T) {
+	ids := NewSequentialIDGenerator("user")
+	for _, want := range []string{"user-1", "user-2", "user-3"} {
+		if got := ids.NewID(); got != want {
+			t.Errorf("NewID() = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestUserIDsNeverCollide(t *testing.T) {
+	api := newTestAPI(t, WithRateLimitTiers(RateLimitTiers{
+		readTier:  {Rate: rate.Inf},
+		writeTier: {Rate: rate.Inf},
+	}))
+	create := func(email string) string {
+		t.Helper()
+		rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"`+email+`"}`, nil)
+		if rec.Code != http.StatusCreated {
+			t.Errorf("create %s = %d: %s", email, rec.Code, rec.Body)
+			return ""
+		}
+		var created User
+		if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := uuid.Parse(created.ID); err != nil {
+			t.Errorf("ID %q is not a UUID: %v", created.ID, err)
+		}
+		return created.ID
+	}
+
+	first := create("a@example.com")
+	second := create("b@example.com")
+	if rec := serve(api, "DELETE", "/api/v1/users/"+first, "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("delete = %d: %s", rec.Code, rec.Body)
+	}
+	ids := []string{first, second, create("c@example.com"), create("d@example.com")}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := create(fmt.Sprintf("user%d@example.com", i))
+			mu.Lock()
+			ids = append(ids, id)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			t.Errorf("ID %q issued twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestMalformedIDsAreRejectedBeforeLookup(t *testing.T) {
+	tests := []struct {
+		name   string
+		ids    IDGenerator
+		target string
+		want   int
+	}{
+		{"uuid absent", UUIDGenerator{}, "/api/v1/users/" + absentUserID, http.StatusNotFound},
+		{"uuid garbage", UUIDGenerator{}, "/api/v1/users/not-a-uuid", http.StatusBadRequest},
+		{"uuid uppercase", UUIDGenerator{}, "/api/v1/users/" + strings.ToUpper(uuid.NewString()), http.StatusBadRequest},
+		{"uuid urn form", UUIDGenerator{}, "/api/v1/users/urn:uuid:" + absentUserID, http.StatusBadRequest},
+		{"sequential absent", NewSequentialIDGenerator("user"), "/api/v1/users/user-42", http.StatusNotFound},
+		{"sequential wrong prefix", NewSequentialIDGenerator("user"), "/api/v1/users/account-42", http.StatusBadRequest},
+		{"sequential leading zero", NewSequentialIDGenerator("user"), "/api/v1/users/user-042", http.StatusBadRequest},
+		{"sequential uuid", NewSequentialIDGenerator("user"), "/api/v1/users/" + absentUserID, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := getFuncStore{UserStore: NewMemoryUserStore(), get: func(id string) (*User, error) {
+				t.Errorf("looked up %q", id)
+				return nil, errUserNotFound
+			}}
+			api := newTestAPI(t, WithIDGenerator(tt.ids))
+			for _, method := range []string{"GET", "PUT", "PATCH", "DELETE"} {
+				body := ""
+				if method == "PUT" || method == "PATCH" {
+					body = `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`
+				}
+				rec := serve(api, method, tt.target, body, nil)
+				if rec.Code != tt.want {
+					t.Errorf("%s = %d, want %d: %s", method, rec.Code, tt.want, rec.Body)
+				}
+			}
+
+			if tt.want == http.StatusBadRequest {
+				api := newTestAPI(t, WithIDGenerator(tt.ids), WithUserStore(store))
+				if rec := serve(api, "GET", tt.target, "", nil); rec.Code != http.StatusBadRequest {
+					t.Errorf("GET with a fake store = %d, want 400", rec.Code)
+				}
+			}
+		})
+	}
+}
+
+// manualClock is a Clock that only moves when advanced. After channels
+// fire once Advance reaches their deadline.
+type manualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []clockWaiter
+}
+
+type clockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newManualClock() *manualClock {
+	return &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if c.now.Before(w.at) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// Waiters returns how many After channels haven't fired yet
+func (c *manualClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, clockWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *manualClock) Sleep(d time.Duration) { c.Advance(d) }
+
+// postWithKey POSTs body from remoteAddr with an Idempotency-Key
+func postWithKey(api *API, target, body, key, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", target, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	req.RemoteAddr = remoteAddr
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyReplaysForSameClient(t *testing.T) {
+	api := newTestAPI(t)
+	api.Idempotency = NewInMemoryIdempotencyStore(nil)
+
+	first := postWithKey(api, "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, "k1", "198.51.100.1:1000")
+	second := postWithKey(api, "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, "k1", "198.51.100.1:2000")
+	if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+		t.Fatalf("statuses = %d, %d; want 201, 201", first.Code, second.Code)
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("retry wasn't replayed")
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("replayed body = %s, want %s", second.Body, first.Body)
+	}
+}
+
+func TestIdempotencyKeysScopedByClient(t *testing.T) {
+	api := newTestAPI(t)
+	api.Idempotency = NewInMemoryIdempotencyStore(nil)
+	api.AuthTokens = map[string]string{"secret-a": "alice", "secret-b": "bob"}
+
+	// Anonymous clients on different addresses don't share a key
+	a := postWithKey(api, "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"a@example.com"}`, "same", "198.51.100.1:1000")
+	b := postWithKey(api, "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"b@example.com"}`, "same", "198.51.100.2:1000")
+	if b.Header().Get("Idempotent-Replayed") != "" || a.Body.String() == b.Body.String() {
+		t.Errorf("second anonymous client got the first one's response: %s", b.Body)
+	}
+
+	// Nor do different identities behind one address
+	req := func(token, email string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"first_name":"Jane","last_name":"Doe","email":"`+email+`"}`))
+		r.Header.Set("Idempotency-Key", "shared")
+		r.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		api.router.ServeHTTP(rec, r)
+		return rec
+	}
+	alice := req("secret-a", "alice@example.com")
+	bob := req("secret-b", "bob@example.com")
+	if bob.Header().Get("Idempotent-Replayed") != "" || alice.Body.String() == bob.Body.String() {
+		t.Errorf("bob got alice's response: %s", bob.Body)
+	}
+}
+
+func TestInMemoryIdempotencyLeaseExpires(t *testing.T) {
+	ctx := context.Background()
+	clock := newManualClock()
+	store := NewInMemoryIdempotencyStore(clock)
+
+	if _, err := store.Claim(ctx, "k", time.Minute); err != nil {
+		t.Fatalf("Claim() error = %v", err)
+	}
+	if _, err := store.Claim(ctx, "k", time.Minute); !errors.Is(err, ErrIdempotencyInFlight) {
+		t.Fatalf("second Claim() error = %v, want ErrIdempotencyInFlight", err)
+	}
+
+	// The owner died without completing; its lease runs out
+	clock.Advance(time.Minute)
+	if resp, err := store.Claim(ctx, "k", time.Minute); resp != nil || err != nil {
+		t.Fatalf("Claim() after lease = %v, %v; want a fresh claim", resp, err)
+	}
+}
+
+func TestInMemoryIdempotencyEvictsExpired(t *testing.T) {
+	ctx := context.Background()
+	clock := newManualClock()
+	store := NewInMemoryIdempotencyStore(clock)
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		store.Claim(ctx, key, time.Minute)
+		store.Complete(ctx, key, &IdempotentResponse{Status: http.StatusCreated}, time.Hour)
+	}
+	clock.Advance(time.Hour)
+	store.Claim(ctx, "fresh", time.Minute)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.entries) != 1 {
+		t.Errorf("store holds %d entries after expiry, want 1", len(store.entries))
+	}
+}
+
+func TestIdempotencySkipsStreamingImport(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}))
+	store := NewInMemoryIdempotencyStore(nil)
+	api.Idempotency = store
+
+	for i := 0; i < 2; i++ {
+		rec := postWithKey(api, "/api/v1/users/import/stream", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`+"\n", "k1", "198.51.100.1:1000")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("import %d status = %d: %s", i, rec.Code, rec.Body)
+		}
+		if rec.Header().Get("Idempotent-Replayed") != "" {
+			t.Fatalf("import %d was replayed from a buffered response", i)
+		}
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.entries) != 0 {
+		t.Errorf("streaming import was captured: %d entries", len(store.entries))
+	}
+}
+
+func TestRedisIdempotencyStore(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	store := NewRedisIdempotencyStore(redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+
+	if resp, err := store.Claim(ctx, "k", time.Minute); resp != nil || err != nil {
+		t.Fatalf("Claim() = %v, %v; want ownership", resp, err)
+	}
+	if _, err := store.Claim(ctx, "k", time.Minute); !errors.Is(err, ErrIdempotencyInFlight) {
+		t.Fatalf("second Claim() error = %v, want ErrIdempotencyInFlight", err)
+	}
+
+	// An abandoned claim expires with its lease
+	mr.FastForward(time.Minute)
+	if resp, err := store.Claim(ctx, "k", time.Minute); resp != nil || err != nil {
+		t.Fatalf("Claim() after lease = %v, %v; want ownership", resp, err)
+	}
+
+	want := &IdempotentResponse{Status: http.StatusCreated, Header: http.Header{"Content-Type": {"application/json"}}, Body: []byte(`{"id":"1"}`)}
+	if err := store.Complete(ctx, "k", want, time.Hour); err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	got, err := store.Claim(ctx, "k", time.Minute)
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("Claim() after Complete = %+v, %v; want %+v", got, err, want)
+	}
+	if ttl := mr.TTL("k"); ttl != time.Hour {
+		t.Errorf("completed key TTL = %v, want %v", ttl, time.Hour)
+	}
+
+	if err := store.Release(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("k") {
+		t.Error("Release() left the key behind")
+	}
+}
+
+func TestCloseStopsRateLimiterEviction(t *testing.T) {
+	api := NewAPI()
+	api.Close()
+	api.Close()
+
+	select {
+	case <-api.rateLimiter.stopped:
+	default:
+		t.Fatal("eviction loop still running after Close")
+	}
+}
+
+func TestUserValidatedOnEveryWritePath(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true, TestAdmin: true}))
+
+	rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, nil)
+	var jane User
+	json.NewDecoder(rec.Body).Decode(&jane)
+
+	tests := []struct {
+		name, method, target, body string
+		wantField                  string
+	}{
+		{"create", "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"nope"}`, "email"},
+		{"update", "PUT", "/api/v1/users/" + jane.ID, `{"first_name":"Jane","last_name":"Doe","email":""}`, "email"},
+		{"seed", "POST", "/api/v1/admin/seed", `[{"first_name":"Jane","last_name":"Doe","email":"ok@example.com"},{"first_name":"Jane","last_name":"Doe","email":"nope"}]`, "[1].email"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(api, tt.method, tt.target, tt.body, nil)
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want 422: %s", rec.Code, rec.Body)
+			}
+			var problem Problem
+			json.NewDecoder(rec.Body).Decode(&problem)
+			if len(problem.Errors) != 1 || problem.Errors[0].Field != tt.wantField {
+				t.Errorf("errors = %v, want one for %s", problem.Errors, tt.wantField)
+			}
+		})
+	}
+
+	t.Run("import", func(t *testing.T) {
+		rec := serve(api, "POST", "/api/v1/users/import/stream", `{"first_name":"Jane","last_name":"Doe","email":"nope"}`+"\n", nil)
+		var result ImportLineResult
+		if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Status != http.StatusUnprocessableEntity || len(result.Errors) != 1 || result.Errors[0].Field != "email" {
+			t.Errorf("import result = %+v, want a 422 for email", result)
+		}
+	})
+
+	// Nothing invalid was stored, and the seed stored nothing at all
+	if got := memoryStore(api).users[jane.ID]; got.Email != "jane@example.com" {
+		t.Errorf("update stored invalid email %q", got.Email)
+	}
+	if len(memoryStore(api).users) != 1 {
+		t.Errorf("store holds %d users, want only jane", len(memoryStore(api).users))
+	}
+}
+
+func TestConditionalCreate(t *testing.T) {
+	api := newTestAPI(t, WithIDGenerator(NewSequentialIDGenerator("user")))
+	ifNoneMatch := http.Header{"If-None-Match": {"*"}}
+
+	rec := serve(api, "PUT", "/api/v1/users/user-7", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, ifNoneMatch)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create-if-absent status = %d, want 201: %s", rec.Code, rec.Body)
+	}
+	var created User
+	json.NewDecoder(rec.Body).Decode(&created)
+	if created.ID != "user-7" || created.CreatedAt.IsZero() {
+		t.Errorf("created = %+v, want ID user-7 with a creation time", created)
+	}
+
+	rec = serve(api, "PUT", "/api/v1/users/user-7", `{"first_name":"Jane","last_name":"Doe","email":"other@example.com"}`, ifNoneMatch)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("create over existing status = %d, want 412: %s", rec.Code, rec.Body)
+	}
+	if got := memoryStore(api).users["user-7"].Email; got != "jane@example.com" {
+		t.Errorf("412 overwrote the user: email = %q", got)
+	}
+
+	// Without the header, PUT still only updates existing users
+	if rec := serve(api, "PUT", "/api/v1/users/user-8", `{"first_name":"Jane","last_name":"Doe","email":"x@example.com"}`, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("plain PUT of a missing user = %d, want 404", rec.Code)
+	}
+}
+
+func TestRateLimiterFollowsClock(t *testing.T) {
+	clock := newManualClock()
+	rl := NewRateLimiter(rate.Every(time.Second), 1, 0, WithRateLimiterClock(clock))
+	defer rl.Stop()
+
+	if !rl.Allow("ip:a") {
+		t.Fatal("first request denied")
+	}
+	if rl.Allow("ip:a") {
+		t.Fatal("second request allowed before the bucket refilled")
+	}
+	clock.Advance(time.Second)
+	if !rl.Allow("ip:a") {
+		t.Fatal("request denied after the bucket refilled")
+	}
+}
+
+func TestRateLimiterEvictsIdleKeysOnClock(t *testing.T) {
+	clock := newManualClock()
+	rl := NewRateLimiter(rate.Limit(1), 1, 10*time.Minute, WithRateLimiterClock(clock))
+	defer rl.Stop()
+
+	rl.Allow("ip:idle")
+	clock.Advance(6 * time.Minute)
+	rl.Allow("ip:active")
+
+	// Step in half-TTL ticks, waiting for the eviction loop to rearm
+	for i := 0; i < 2; i++ {
+		waitFor(t, func() bool { return clock.Waiters() == 1 })
+		clock.Advance(5 * time.Minute)
+	}
+	waitFor(t, func() bool { return rl.Len() == 1 })
+
+	if _, ok := rl.limiters["ip:active"]; !ok {
+		t.Error("active key was evicted")
+	}
+}
+
+// waitFor polls cond until it holds or a second passes
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestURILengthLimits(t *testing.T) {
+	api := newTestAPI(t)
+	api.MaxURLLength = 200
+	api.MaxQueryLength = 100
+
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"normal query", "/api/v1/users?page=1&page_size=10", http.StatusOK},
+		{"long query", "/api/v1/users?sort=" + strings.Repeat("a", 100), http.StatusRequestURITooLong},
+		{"long path", "/api/v1/users/" + strings.Repeat("u", 200), http.StatusRequestURITooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(api, "GET", tt.target, "", nil); rec.Code != tt.want {
+				t.Errorf("GET status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestErrorsAreProblemDetails(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := serve(api, "GET", "/api/v1/users/"+absentUserID, "", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+
+	var problem map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"type", "title", "status", "detail", "instance"} {
+		if _, ok := problem[field]; !ok {
+			t.Errorf("problem %v is missing %q", problem, field)
+		}
+	}
+	if problem["status"] != float64(http.StatusNotFound) || problem["instance"] != "/api/v1/users/"+absentUserID {
+		t.Errorf("problem = %v, want status 404 for /api/v1/users/missing", problem)
+	}
+}
+
+// getFuncStore answers Get with get, passing the rest to UserStore
+type getFuncStore struct {
+	UserStore
+	get func(id string) (*User, error)
+}
+
+func (s getFuncStore) Get(ctx context.Context, id string) (*User, error) {
+	return s.get(id)
+}
+
+func TestConcurrentGetsShareOneFetch(t *testing.T) {
+	api := newTestAPI(t)
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	api.store = getFuncStore{UserStore: api.store, get: func(id string) (*User, error) {
+		loads.Add(1)
+		<-release
+		return &User{ID: id, Email: "jane@example.com"}, nil
+	}}
+
+	const callers = 50
+	var wg sync.WaitGroup
+	results := make([]*User, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := api.fetchUser(context.Background(), "user-1")
+			if err != nil {
+				t.Errorf("fetchUser() error = %v", err)
+				return
+			}
+			results[i] = user
+		}(i)
+	}
+
+	// Let every caller join the in-flight fetch before it completes
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Errorf("backend loads = %d, want 1", n)
+	}
+	results[0].Email = "changed@example.com"
+	if results[1].Email != "jane@example.com" {
+		t.Error("callers share one User value")
+	}
+}
+
+// ctxGetStore answers Get with get, which sees the read's context
+type ctxGetStore struct {
+	UserStore
+	get func(ctx context.Context, id string) (*User, error)
+}
+
+func (s ctxGetStore) Get(ctx context.Context, id string) (*User, error) {
+	return s.get(ctx, id)
+}
+
+func TestCancelledCallerDoesNotFailSharedFetch(t *testing.T) {
+	api := newTestAPI(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	api.store = ctxGetStore{UserStore: api.store, get: func(ctx context.Context, id string) (*User, error) {
+		close(started)
+		select {
+		case <-release:
+			return &User{ID: id, Email: "jane@example.com"}, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}}
+
+	first, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := api.fetchUser(first, "user-1")
+		firstErr <- err
+	}()
+	<-started
+
+	second := make(chan error, 1)
+	go func() {
+		user, err := api.fetchUser(context.Background(), "user-1")
+		if err == nil && user.Email != "jane@example.com" {
+			err = fmt.Errorf("got %+v", user)
+		}
+		second <- err
+	}()
+	// Let the second caller join the in-flight fetch
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller error = %v, want context.Canceled", err)
+	}
+	close(release)
+	if err := <-second; err != nil {
+		t.Errorf("waiting caller error = %v, want the user", err)
+	}
+}
+
+func TestFetchUserDoesNotCacheErrors(t *testing.T) {
+	api := newTestAPI(t)
+
+	var loads int
+	api.store = getFuncStore{UserStore: api.store, get: func(id string) (*User, error) {
+		loads++
+		if loads == 1 {
+			return nil, errors.New("backend unavailable")
+		}
+		return &User{ID: id}, nil
+	}}
+
+	if _, err := api.fetchUser(context.Background(), "user-1"); err == nil {
+		t.Fatal("first fetchUser() succeeded, want the backend error")
+	}
+	if _, err := api.fetchUser(context.Background(), "user-1"); err != nil {
+		t.Fatalf("second fetchUser() error = %v, want a fresh fetch", err)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"deflate, gzip;q=0.8", "deflate"},
+		{"br;q=0, gzip;q=0", ""},
+		{"*", "gzip"},
+		{"GZIP;q=0.3", "gzip"},
+	}
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.header); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+		ok     bool
+	}{
+		{"", formatJSON, true},
+		{"application/json", formatJSON, true},
+		{"application/xml", formatXML, true},
+		{"text/xml; charset=utf-8", formatXML, true},
+		{"*/*", formatJSON, true},
+		{"application/xml, */*", formatXML, true},
+		{"application/json;q=0.5, application/xml", formatXML, true},
+		{"application/json, application/xml", formatJSON, true},
+		{"APPLICATION/XML", formatXML, true},
+		{"text/csv", "", false},
+		{"application/json;q=0", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := negotiateFormat(tt.header)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("negotiateFormat(%q) = %q, %v, want %q, %v", tt.header, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestXMLResponses(t *testing.T) {
+	api := newTestAPI(t)
+	acceptXML := http.Header{"Accept": {"application/xml"}}
+
+	rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, acceptXML)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Type") != "application/xml" {
+		t.Fatalf("create = %d %q, want 201 application/xml: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	var created User
+	if err := xml.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Email != "jane@example.com" {
+		t.Errorf("created = %+v, want Jane with an ID", created)
+	}
+
+	rec = serve(api, "GET", "/api/v1/users", "", acceptXML)
+	var page struct {
+		XMLName    xml.Name `xml:"collection"`
+		Users      []User   `xml:"data>user"`
+		TotalItems int      `xml:"total_items"`
+		Self       string   `xml:"links>self"`
+	}
+	if err := xml.NewDecoder(rec.Body).Decode(&page); err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(page.Users) != 1 || page.Users[0].ID != created.ID || page.TotalItems != 1 || page.Self == "" {
+		t.Errorf("page = %+v, want the one created user", page)
+	}
+
+	rec = serve(api, "POST", "/api/v1/users", `{"email":"nope"}`, acceptXML)
+	if rec.Code != http.StatusUnprocessableEntity || rec.Header().Get("Content-Type") != "application/problem+xml" {
+		t.Fatalf("invalid create = %d %q, want 422 application/problem+xml", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var problem Problem
+	if err := xml.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.XMLName.Space != "urn:ietf:rfc:7807" || problem.Status != http.StatusUnprocessableEntity || len(problem.Errors) == 0 {
+		t.Errorf("problem = %+v, want an RFC 7807 problem listing field errors", problem)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		name       string
+		accept     string
+		wantStatus int
+		wantType   string
+	}{
+		{"no accept", "", http.StatusOK, "application/json"},
+		{"json", "application/json", http.StatusOK, "application/json"},
+		{"xml", "application/xml", http.StatusOK, "application/xml"},
+		{"xml preferred", "application/json;q=0.1, application/xml", http.StatusOK, "application/xml"},
+		{"unsupported", "text/csv", http.StatusNotAcceptable, "application/problem+json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header http.Header
+			if tt.accept != "" {
+				header = http.Header{"Accept": {tt.accept}}
+			}
+			rec := serve(api, "GET", "/api/v1/users", "", header)
+			if rec.Code != tt.wantStatus || rec.Header().Get("Content-Type") != tt.wantType {
+				t.Errorf("GET with Accept %q = %d %q, want %d %q", tt.accept, rec.Code, rec.Header().Get("Content-Type"), tt.wantStatus, tt.wantType)
+			}
+			if vary := rec.Header().Values("Vary"); !slices.Contains(vary, "Accept") {
+				t.Errorf("Vary = %v, want it to include Accept", vary)
+			}
+		})
+	}
+}
+
+// decoders undo each supported content coding
+var decoders = map[string]func(io.Reader) (io.Reader, error){
+	"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+	"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	"br":      func(r io.Reader) (io.Reader, error) { return brotli.NewReader(r), nil },
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	api := newTestAPI(t)
+	body := strings.Repeat(`{"name":"jane"}`, 200)
+	handler := api.compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+
+	for encoding, decode := range decoders {
+		t.Run(encoding, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", encoding)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, encoding)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+
+			r, err := decode(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != body {
+				t.Errorf("decoded body differs from the original (%d vs %d bytes)", len(decoded), len(body))
+			}
+		})
+	}
+}
+
+func TestCompressionSkipsSmallAndCompressedBodies(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"small body", "application/json", `{"ok":true}`},
+		{"already compressed", "image/png", strings.Repeat("x", 4096)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := api.compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				io.WriteString(w, tt.body)
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got := rec.Header().Get("Content-Encoding"); got != "" {
+				t.Errorf("Content-Encoding = %q, want none", got)
+			}
+			if rec.Body.String() != tt.body {
+				t.Error("body was altered")
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+		})
+	}
+}
+
+func TestDeleteIsIdempotentAndGone(t *testing.T) {
+	api := newTestAPI(t)
+	rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	var created User
+	json.NewDecoder(rec.Body).Decode(&created)
+	userPath := "/api/v1/users/" + created.ID
+
+	steps := []struct {
+		method string
+		target string
+		want   int
+	}{
+		{"GET", userPath, http.StatusOK},
+		{"DELETE", userPath, http.StatusNoContent},
+		{"GET", userPath, http.StatusGone},
+		{"DELETE", userPath, http.StatusNoContent},
+		{"GET", "/api/v1/users/" + absentUserID, http.StatusNotFound},
+		{"DELETE", "/api/v1/users/" + absentUserID, http.StatusNotFound},
+	}
+	for _, step := range steps {
+		if rec := serve(api, step.method, step.target, "", nil); rec.Code != step.want {
+			t.Errorf("%s %s = %d, want %d: %s", step.method, step.target, rec.Code, step.want, rec.Body)
+		}
+	}
+}
+
+func TestSlowRequestReportedAboveThreshold(t *testing.T) {
+	api := newTestAPI(t)
+	api.SlowRequestThreshold = 20 * time.Millisecond
+	var reported []SlowRequest
+	api.OnSlowRequest = func(slow SlowRequest) { reported = append(reported, slow) }
+
+	handler := api.slowRequestMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(40 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	for _, path := range []string{"/fast", "/slow"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if len(reported) != 1 {
+		t.Fatalf("reported %d slow requests, want 1: %+v", len(reported), reported)
+	}
+	got := reported[0]
+	if got.Route != "/slow" || got.Status != http.StatusAccepted || got.Duration < 40*time.Millisecond {
+		t.Errorf("reported %+v, want /slow with 202 and >= 40ms", got)
+	}
+}
+
+func TestDrainRejectsNewRequestsOnly(t *testing.T) {
+	api := newTestAPI(t)
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := api.rateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(entered)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(inFlight, httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	<-entered
+
+	api.Drain()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/fast", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("request after Drain = %d (Retry-After %q), want 503 with Retry-After",
+			rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(release)
+	<-done
+	if inFlight.Code != http.StatusOK {
+		t.Errorf("in-flight request = %d, want 200", inFlight.Code)
+	}
+}
+
+func TestEventBusDeliversToEverySubscriber(t *testing.T) {
+	bus := NewEventBus(8, 2)
+	var mu sync.Mutex
+	var got []string
+	record := func(name string) EventHandler {
+		return func(ctx context.Context, event BusEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			got = append(got, fmt.Sprintf("%s:%s:%v", name, event.Topic, event.Payload))
+		}
+	}
+	bus.Subscribe(TopicUserCreated, record("sync"))
+	bus.SubscribeAsync(TopicUserCreated, record("async"))
+	bus.Subscribe(TopicUserDeleted, record("other"))
+
+	if err := bus.Publish(context.Background(), TopicUserCreated, "user-1"); err != nil {
+		t.Fatalf("Publish() error = %v", err)
+	}
+	if err := bus.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+
+	sort.Strings(got)
+	if want := []string{"async:user.created:user-1", "sync:user.created:user-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deliveries = %v, want %v", got, want)
+	}
+}
+
+func TestEventBusDrainWaitsForQueued(t *testing.T) {
+	bus := NewEventBus(16, 1)
+	var handled atomic.Int32
+	bus.SubscribeAsync(TopicUserUpdated, func(ctx context.Context, event BusEvent) {
+		time.Sleep(time.Millisecond)
+		handled.Add(1)
+	})
+
+	for i := 0; i < 10; i++ {
+		if err := bus.Publish(context.Background(), TopicUserUpdated, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := bus.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if n := handled.Load(); n != 10 {
+		t.Errorf("handled %d events before Drain returned, want 10", n)
+	}
+
+	if err := bus.Publish(context.Background(), TopicUserUpdated, 11); !errors.Is(err, ErrBusClosed) {
+		t.Errorf("Publish() after Drain error = %v, want ErrBusClosed", err)
+	}
+	if err := bus.Drain(context.Background()); err != nil {
+		t.Errorf("second Drain() error = %v", err)
+	}
+}
+
+func TestUserWritesPublishEvents(t *testing.T) {
+	api := newTestAPI(t)
+	api.Events = NewEventBus(8, 1)
+	var topics []Topic
+	for _, topic := range []Topic{TopicUserCreated, TopicUserUpdated, TopicUserDeleted} {
+		api.Events.Subscribe(topic, func(ctx context.Context, event BusEvent) {
+			topics = append(topics, event.Topic)
+		})
+	}
+
+	rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, nil)
+	var created User
+	json.NewDecoder(rec.Body).Decode(&created)
+	serve(api, "PUT", "/api/v1/users/"+created.ID, `{"first_name":"Jane","last_name":"Doe","email":"janet@example.com"}`, nil)
+	serve(api, "DELETE", "/api/v1/users/"+created.ID, "", nil)
+
+	if want := []Topic{TopicUserCreated, TopicUserUpdated, TopicUserDeleted}; !reflect.DeepEqual(topics, want) {
+		t.Errorf("published %v, want %v", topics, want)
+	}
+}
+
+func TestLogSamplerKeepsErrorsAndSamplesTheRest(t *testing.T) {
+	sampler := NewLogSampler(0.1, 500*time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		if !sampler.ShouldLog(http.StatusInternalServerError, time.Millisecond) {
+			t.Fatal("5xx request not logged")
+		}
+		if !sampler.ShouldLog(http.StatusNotFound, time.Millisecond) {
+			t.Fatal("4xx request not logged")
+		}
+		if !sampler.ShouldLog(http.StatusOK, time.Second) {
+			t.Fatal("slow request not logged")
+		}
+	}
+
+	const n = 20000
+	logged := 0
+	for i := 0; i < n; i++ {
+		if sampler.ShouldLog(http.StatusOK, time.Millisecond) {
+			logged++
+		}
+	}
+	if got := float64(logged) / n; got < 0.08 || got > 0.12 {
+		t.Errorf("sampled %.3f of normal requests, want about 0.1", got)
+	}
+
+	sampler.SetRate(0)
+	for i := 0; i < 1000; i++ {
+		if sampler.ShouldLog(http.StatusOK, time.Millisecond) {
+			t.Fatal("normal request logged after SetRate(0)")
+		}
+	}
+	sampler.SetRate(7)
+	if got := sampler.Rate(); got != 1 {
+		t.Errorf("Rate() after SetRate(7) = %v, want it clamped to 1", got)
+	}
+}
+
+// logRecords decodes the JSON lines slog wrote to buf
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var record map[string]interface{}
+		if err := dec.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestLogsCarryRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	api := newTestAPI(t)
+	api.Logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	api.SlowRequestThreshold = time.Nanosecond
+
+	rec := serve(api, "GET", "/api/v1/users", "", nil)
+	id := rec.Header().Get(requestIDHeader)
+	if _, err := uuid.Parse(id); err != nil {
+		t.Fatalf("%s = %q, want a generated UUID", requestIDHeader, id)
+	}
+
+	records := logRecords(t, &buf)
+	if len(records) != 2 {
+		t.Fatalf("logged %d records, want the completion and the slow request warning: %v", len(records), records)
+	}
+	for _, record := range records {
+		if record["request_id"] != id {
+			t.Errorf("%q logged request_id %v, want %s", record["msg"], record["request_id"], id)
+		}
+	}
+	completed := records[0]
+	if completed["msg"] != "request completed" || completed["method"] != "GET" ||
+		completed["path"] != "/api/v1/users" || completed["status"] != float64(http.StatusOK) {
+		t.Errorf("completion record = %v", completed)
+	}
+	if _, ok := completed["duration"].(float64); !ok {
+		t.Errorf("completion record has no numeric duration: %v", completed)
+	}
+}
+
+func TestRequestIDAdoptsValidCallerIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		adopt  bool
+	}{
+		{"valid", "req-123", true},
+		{"spaces", "req 123", false},
+		{"newline", "req\n{\"admin\":true}", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			api.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+			var seen string
+			handler := api.requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = RequestIDFromContext(r.Context())
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set(requestIDHeader, tt.header)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			got := rec.Header().Get(requestIDHeader)
+			if got != seen {
+				t.Errorf("response ID %q != context ID %q", got, seen)
+			}
+			if adopted := got == tt.header; adopted != tt.adopt {
+				t.Errorf("request ID = %q for header %q, want adopted = %v", got, tt.header, tt.adopt)
+			}
+		})
+	}
+}
+
+func TestBulkDeleteByEmailFilter(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}))
+	for _, email := range []string{"a@spam.example", "b@spam.example", "c@example.com"} {
+		if rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"`+email+`"}`, nil); rec.Code != http.StatusCreated {
+			t.Fatalf("create %s = %d: %s", email, rec.Code, rec.Body)
+		}
+	}
+
+	for _, target := range []string{
+		"/api/v1/users?email_contains=spam.example",
+		"/api/v1/users?email_contains=spam.example&confirm=false",
+		"/api/v1/users?confirm=true",
+	} {
+		if rec := serve(api, "DELETE", target, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("DELETE %s = %d, want 400", target, rec.Code)
+		}
+	}
+	if len(memoryStore(api).users) != 3 {
+		t.Fatalf("%d users left after rejected deletes, want 3", len(memoryStore(api).users))
+	}
+
+	rec := serve(api, "DELETE", "/api/v1/users?email_contains=spam.example&confirm=true", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("bulk delete = %d: %s", rec.Code, rec.Body)
+	}
+	var resp BulkDeleteResponse
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp.Deleted != 2 {
+		t.Errorf("deleted = %d, want 2", resp.Deleted)
+	}
+	if len(memoryStore(api).users) != 1 || len(memoryStore(api).deleted) != 2 {
+		t.Errorf("users/tombstones = %d/%d, want 1/2 (soft-deleted)", len(memoryStore(api).users), len(memoryStore(api).deleted))
+	}
+}
+
+// storeSnapshot copies a MemoryUserStore's users and tombstones
+func storeSnapshot(store *MemoryUserStore) (map[string]User, map[string]time.Time) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	users := make(map[string]User, len(store.users))
+	for id, user := range store.users {
+		users[id] = *user
+	}
+	deleted := make(map[string]time.Time, len(store.deleted))
+	for id, at := range store.deleted {
+		deleted[id] = at
+	}
+	return users, deleted
+}
+
+func TestAtomicBulkCreateRollsBackOnStoreFailure(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}), WithIDGenerator(NewSequentialIDGenerator("user")))
+	store := memoryStore(api)
+	ctx := context.Background()
+	// The batch will be given user-1, user-2, and user-3: user-2 is a
+	// tombstone it may replace and user-3 is taken, so the third item fails
+	for _, user := range []*User{
+		{ID: "user-2", FirstName: "Gone", LastName: "User", Email: "gone@example.com"},
+		{ID: "user-3", FirstName: "Taken", LastName: "User", Email: "taken@example.com"},
+	} {
+		if err := store.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Delete(ctx, "user-2")
+	beforeUsers, beforeDeleted := storeSnapshot(store)
+
+	body := `[
+		{"first_name":"Ann","last_name":"Lee","email":"ann@example.com"},
+		{"first_name":"Bob","last_name":"Lee","email":"bob@example.com"},
+		{"first_name":"Cat","last_name":"Lee","email":"cat@example.com"}
+	]`
+	rec := serve(api, "POST", "/api/v1/users/bulk?atomic=true", body, nil)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	json.NewDecoder(rec.Body).Decode(&problem)
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "[2]" {
+		t.Errorf("errors = %+v, want the failure at [2]", problem.Errors)
+	}
+
+	afterUsers, afterDeleted := storeSnapshot(store)
+	if !reflect.DeepEqual(afterUsers, beforeUsers) || !reflect.DeepEqual(afterDeleted, beforeDeleted) {
+		t.Errorf("store after rollback = %v / %v, want %v / %v", afterUsers, afterDeleted, beforeUsers, beforeDeleted)
+	}
+}
+
+func TestAtomicBulkCreateRejectsInvalidItems(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}))
+
+	body := `[
+		{"first_name":"Ann","last_name":"Lee","email":"ann@example.com"},
+		{"first_name":"Bob","last_name":"Lee","email":"nope"}
+	]`
+	rec := serve(api, "POST", "/api/v1/users/bulk?atomic=true", body, nil)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	json.NewDecoder(rec.Body).Decode(&problem)
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "[1].email" {
+		t.Errorf("errors = %+v, want one for [1].email", problem.Errors)
+	}
+	if n := len(memoryStore(api).users); n != 0 {
+		t.Errorf("%d users stored, want none", n)
+	}
+
+	rec = serve(api, "POST", "/api/v1/users/bulk?atomic=true", `[{"first_name":"Ann","last_name":"Lee","email":"ann@example.com"}]`, nil)
+	if rec.Code != http.StatusCreated || len(memoryStore(api).users) != 1 {
+		t.Errorf("valid batch = %d with %d users stored, want 201 and 1", rec.Code, len(memoryStore(api).users))
+	}
+}
+
+func TestAtomicBulkCreateIsInvisibleUntilDone(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}), WithIDGenerator(NewSequentialIDGenerator("user")))
+	store := memoryStore(api)
+	// Every batch ends on the taken user-100, so every batch fails
+	if err := store.Create(context.Background(), &User{ID: "user-100", FirstName: "Taken", LastName: "User", Email: "taken@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	items := make([]string, 100)
+	for i := range items {
+		items[i] = fmt.Sprintf(`{"first_name":"U","last_name":"%d","email":"u%d@example.com"}`, i, i)
+	}
+	body := "[" + strings.Join(items, ",") + "]"
+
+	done := make(chan struct{})
+	var partial atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, total, _ := store.List(context.Background(), 0, 1); total != 1 {
+				partial.Add(1)
+			}
+		}
+	}()
+
+	rec := serve(api, "POST", "/api/v1/users/bulk?atomic=true", body, nil)
+	close(done)
+	wg.Wait()
+
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409: %s", rec.Code, rec.Body)
+	}
+	if n := partial.Load(); n != 0 {
+		t.Errorf("readers saw a partial batch %d times", n)
+	}
+}
+
+func TestBulkCreateReportsEachItem(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}))
+
+	body := `[
+		{"first_name":"Ann","last_name":"Lee","email":"ann@example.com"},
+		{"first_name":"Bob","last_name":"Lee","email":"nope"},
+		{"first_name":"Cat","last_name":"Lee","email":"cat@example.com"}
+	]`
+	rec := serve(api, "POST", "/api/v1/users/bulk", body, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var results []BulkCreateResult
+	if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	var statuses []int
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	if !reflect.DeepEqual(statuses, []int{http.StatusCreated, http.StatusUnprocessableEntity, http.StatusCreated}) {
+		t.Errorf("statuses = %v, want 201, 422, 201", statuses)
+	}
+	if n := len(memoryStore(api).users); n != 2 {
+		t.Errorf("%d users stored, want the 2 valid ones", n)
+	}
+}
+
+func TestInflatedContentLengthRejected(t *testing.T) {
+	api := newTestAPI(t)
+	api.MaxBodyBytes = 1024
+
+	req := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = 1 << 30
+	rec := httptest.NewRecorder()
+	api.router.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+	if rec.Header().Get("Connection") != "close" {
+		t.Error("connection not closed after rejecting the body")
+	}
+	if len(memoryStore(api).users) != 0 {
+		t.Error("handler ran despite the oversized Content-Length")
+	}
+
+	if rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, nil); rec.Code != http.StatusCreated {
+		t.Errorf("small body = %d, want 201: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestOversizedStreamedBodyRejected(t *testing.T) {
+	api := newTestAPI(t, WithIDGenerator(NewSequentialIDGenerator("user")))
+	api.MaxBodyBytes = 1024
+	if err := api.store.Create(context.Background(), &User{ID: "user-1", Email: "jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","first_name":"` + strings.Repeat("a", 2048) + `"}`
+
+	for _, tt := range []struct{ method, target string }{
+		{"POST", "/api/v1/users"},
+		{"PUT", "/api/v1/users/user-1"},
+	} {
+		// Without a declared length the limit is hit while decoding
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+		api.router.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s status = %d, want 413: %s", tt.method, rec.Code, rec.Body)
+			continue
+		}
+		var problem Problem
+		if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+			t.Fatal(err)
+		}
+		if problem.Status != http.StatusRequestEntityTooLarge || !strings.Contains(problem.Detail, "1024 bytes") {
+			t.Errorf("%s problem = %+v, want a 413 naming the limit", tt.method, problem)
+		}
+	}
+	if n := len(memoryStore(api).users); n != 1 {
+		t.Errorf("users = %d, want only the seeded one", n)
+	}
+	if user, _ := api.store.Get(context.Background(), "user-1"); user.FirstName != "" {
+		t.Error("oversized update was applied")
+	}
+}
+
+func TestCreateUserRejectsUnknownFields(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","frist_name":"Jane"}`, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	want := []FieldError{{Field: "frist_name", Message: "is not a known field"}}
+	if !reflect.DeepEqual(problem.Errors, want) {
+		t.Errorf("errors = %v, want %v", problem.Errors, want)
+	}
+}
+
+func TestStreamingImportReportsEveryLine(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}))
+	api.ImportMaxInFlight = 8
+
+	const lines = 3000
+	var body strings.Builder
+	wantStatus := make(map[int]int, lines)
+	for n := 1; n <= lines; n++ {
+		switch {
+		case n%100 == 0:
+			body.WriteString("{not json\n")
+			wantStatus[n] = http.StatusBadRequest
+		case n%150 == 0:
+			body.WriteString(`{"first_name":"Jane","last_name":"Doe","email":""}` + "\n")
+			wantStatus[n] = http.StatusUnprocessableEntity
+		default:
+			fmt.Fprintf(&body, `{"first_name":"Jane","last_name":"Doe","email":"user%d@example.com"}`+"\n", n)
+			wantStatus[n] = http.StatusCreated
+		}
+	}
+
+	rec := serve(api, "POST", "/api/v1/users/import/stream", body.String(), nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+
+	dec := json.NewDecoder(rec.Body)
+	seen := 0
+	for {
+		var result ImportLineResult
+		if err := dec.Decode(&result); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		seen++
+		if result.Line != seen {
+			t.Fatalf("result %d is for line %d, want results in line order", seen, result.Line)
+		}
+		if result.Status != wantStatus[result.Line] {
+			t.Errorf("line %d status = %d, want %d (%s)", result.Line, result.Status, wantStatus[result.Line], result.Error)
+		}
+	}
+	if seen != lines {
+		t.Errorf("got %d results, want %d", seen, lines)
+	}
+
+	created := 0
+	for _, status := range wantStatus {
+		if status == http.StatusCreated {
+			created++
+		}
+	}
+	if len(memoryStore(api).users) != created {
+		t.Errorf("stored %d users, want %d", len(memoryStore(api).users), created)
+	}
+}
+
+func TestStreamingImportStopsOnCancel(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{BulkOperations: true}))
+	body, writer := io.Pipe()
+	defer writer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("POST", "/api/v1/users/import/stream", body).WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	done := make(chan struct{})
+	go func() {
+		api.router.ServeHTTP(httptest.NewRecorder(), req)
+		close(done)
+	}()
+
+	// The body never ends; only cancellation can stop the import
+	fmt.Fprintln(writer, `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("import kept running after the request was canceled")
+	}
+}
+
+func TestSyntaxErrorNamesItsPosition(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := serve(api, "POST", "/api/v1/users", "{\n  \"email\": \"jane@example.com\",\n}", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	json.NewDecoder(rec.Body).Decode(&problem)
+	if !strings.Contains(problem.Detail, "at line 3, column 1") {
+		t.Errorf("detail = %q, want the trailing comma located at line 3, column 1", problem.Detail)
+	}
+}
+
+func TestPaginateLinks(t *testing.T) {
+	link := func(page int) string {
+		return fmt.Sprintf("/api/v1/users?page=%d&page_size=2&sort=name", page)
+	}
+	tests := []struct {
+		name               string
+		page               int
+		wantPrev, wantNext bool
+		want               Links
+	}{
+		{"first", 1, false, true, Links{Self: link(1), First: link(1), Next: link(2), Last: link(3)}},
+		{"middle", 2, true, true, Links{Self: link(2), First: link(1), Prev: link(1), Next: link(3), Last: link(3)}},
+		{"last", 3, true, false, Links{Self: link(3), First: link(1), Prev: link(2), Last: link(3)}},
+		{"past the end", 7, true, false, Links{Self: link(7), First: link(1), Prev: link(3), Last: link(3)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, _ := url.Parse(fmt.Sprintf("http://example.com/api/v1/users?sort=name&page=%d", tt.page))
+			response := PaginatedResponse{Page: tt.page, PageSize: 2, TotalItems: 5, TotalPages: 3}
+			paginate(u, &response)
+
+			if response.HasPrev != tt.wantPrev || response.HasNext != tt.wantNext {
+				t.Errorf("has_prev, has_next = %v, %v; want %v, %v", response.HasPrev, response.HasNext, tt.wantPrev, tt.wantNext)
+			}
+			if response.Links != tt.want {
+				t.Errorf("links = %+v, want %+v", response.Links, tt.want)
+			}
+		})
+	}
+}
+
+func TestListUsersOmitsInapplicableLinks(t *testing.T) {
+	api := newTestAPI(t)
+	rec := serve(api, http.MethodGet, "/api/v1/users", "", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	var body struct {
+		HasNext bool                   `json:"has_next"`
+		HasPrev bool                   `json:"has_prev"`
+		Links   map[string]interface{} `json:"links"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.HasNext || body.HasPrev {
+		t.Errorf("has_next, has_prev = %v, %v; want false for a single page", body.HasNext, body.HasPrev)
+	}
+	for _, rel := range []string{"prev", "next"} {
+		if _, ok := body.Links[rel]; ok {
+			t.Errorf("links include %q on the only page", rel)
+		}
+	}
+	if body.Links["first"] != "/api/v1/users?page=1&page_size=20" {
+		t.Errorf("first link = %v", body.Links["first"])
+	}
+}
+
+func TestAdminSeedAndReset(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{TestAdmin: true}))
+	const fixed = "6f1c8a2e-4b7d-4e19-9a3c-5d2e8f0b1a47"
+
+	rec := serve(api, "POST", "/api/v1/admin/seed", `[{"id":"`+fixed+`","first_name":"Ann","last_name":"Lee","email":"a@example.com"},{"first_name":"Jane","last_name":"Doe","email":"b@example.com"}]`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("seed = %d: %s", rec.Code, rec.Body)
+	}
+	var seeded []User
+	json.NewDecoder(rec.Body).Decode(&seeded)
+	if len(seeded) != 2 || seeded[0].ID != fixed || seeded[1].ID == "" {
+		t.Errorf("seeded = %+v, want the fixed ID kept and the other generated", seeded)
+	}
+	for _, user := range seeded {
+		if rec := serve(api, "GET", "/api/v1/users/"+user.ID, "", nil); rec.Code != http.StatusOK {
+			t.Errorf("GET seeded %s = %d", user.ID, rec.Code)
+		}
+	}
+
+	if rec := serve(api, "POST", "/api/v1/admin/reset", "", nil); rec.Code != http.StatusNoContent {
+		t.Fatalf("reset = %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(api, "GET", "/api/v1/users", "", nil)
+	var list PaginatedResponse
+	json.NewDecoder(rec.Body).Decode(&list)
+	if list.TotalItems != 0 {
+		t.Errorf("%d users after reset, want 0", list.TotalItems)
+	}
+	if rec := serve(api, "GET", "/api/v1/users/"+fixed, "", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("GET reset user = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminEndpointsAbsentByDefault(t *testing.T) {
+	api := newTestAPI(t)
+	for _, target := range []string{"/api/v1/admin/reset", "/api/v1/admin/seed"} {
+		if rec := serve(api, "POST", target, "[]", nil); rec.Code != http.StatusNotFound {
+			t.Errorf("POST %s = %d, want 404", target, rec.Code)
+		}
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", newError(ErrNotFound, "user %s not found", "1"), http.StatusNotFound},
+		{"wrapped not found", fmt.Errorf("loading: %w", newError(ErrNotFound, "gone")), http.StatusNotFound},
+		{"deleted", errUserDeleted, http.StatusGone},
+		{"conflict", newError(ErrConflict, "email taken"), http.StatusConflict},
+		{"validation", &ValidationError{Fields: []FieldError{{Field: "email", Message: "is required"}}}, http.StatusUnprocessableEntity},
+		{"unexpected", errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusForError(tt.err); got != tt.want {
+				t.Errorf("statusForError(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmatchedRequestsAreProblems(t *testing.T) {
+	api := newTestAPI(t)
+
+	tests := []struct {
+		name, method, target string
+		wantStatus           int
+		wantAllow            []string
+	}{
+		{"unknown path", "GET", "/api/v1/nothing-here", http.StatusNotFound, nil},
+		{"wrong method on collection", "DELETE", "/api/v1/users", http.StatusMethodNotAllowed, []string{"GET", "POST"}},
+		{"wrong method on item", "POST", "/api/v1/users/123", http.StatusMethodNotAllowed, []string{"GET", "PUT", "DELETE"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(api, tt.method, tt.target, "", nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+			var problem Problem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil || problem.Status != tt.wantStatus {
+				t.Errorf("problem = %+v, %v; want status %d", problem, err, tt.wantStatus)
+			}
+
+			allow := rec.Header().Get("Allow")
+			if tt.wantAllow == nil {
+				if allow != "" {
+					t.Errorf("Allow = %q on a 404", allow)
+				}
+				return
+			}
+			for _, method := range tt.wantAllow {
+				if !strings.Contains(allow, method) {
+					t.Errorf("Allow = %q, missing %s", allow, method)
+				}
+			}
+			if strings.Contains(allow, tt.method) {
+				t.Errorf("Allow = %q includes the rejected %s", allow, tt.method)
+			}
+		})
+	}
+}
+
+func TestRateLimiterConcurrentKeys(t *testing.T) {
+	rl := NewRateLimiter(rate.Limit(1000), 1000, time.Millisecond)
+	defer rl.Stop()
+
+	// Run under -race: many goroutines create, read, and evict keys at once
+	var wg sync.WaitGroup
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				rl.Allow(fmt.Sprintf("ip:%d", (g*200+i)%50))
+				rl.Len()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if n := rl.Len(); n > 50 {
+		t.Errorf("tracking %d keys, want at most 50", n)
+	}
+}
+
+func TestRateLimiterStop(t *testing.T) {
+	rl := NewRateLimiter(rate.Limit(1), 1, time.Hour)
+	rl.Stop()
+	rl.Stop()
+	select {
+	case <-rl.stopped:
+	default:
+		t.Fatal("eviction loop still running after Stop")
+	}
+
+	// Without eviction there is no loop, and Stop returns at once
+	NewRateLimiter(rate.Limit(1), 1, 0).Stop()
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"c", "a", "b"} {
+		if err := store.Create(ctx, &User{ID: id, Email: id + "@example.com", CreatedAt: base.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Create(ctx, &User{ID: "a"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate Create() error = %v, want ErrConflict", err)
+	}
+
+	page, total, err := store.List(ctx, 1, 5)
+	if err != nil || total != 3 || len(page) != 2 || page[0].ID != "a" || page[1].ID != "b" {
+		t.Errorf("List(1, 5) = %v, %d, %v; want [a b] of 3 in creation order", page, total, err)
+	}
+	if page, total, _ := store.List(ctx, 10, 5); len(page) != 0 || total != 3 {
+		t.Errorf("List past the end = %v of %d, want none of 3", page, total)
+	}
+
+	got, _ := store.Get(ctx, "a")
+	got.Email = "changed@example.com"
+	if again, _ := store.Get(ctx, "a"); again.Email != "a@example.com" {
+		t.Error("Get returned the stored value, not a copy")
+	}
+
+	if err := store.Update(ctx, "missing", &User{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update(missing) error = %v, want ErrNotFound", err)
+	}
+	if err := store.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{
+		"Get":    func() error { _, err := store.Get(ctx, "a"); return err }(),
+		"Update": store.Update(ctx, "a", &User{ID: "a"}),
+		"Delete": store.Delete(ctx, "a"),
+	} {
+		if !errors.Is(err, errUserDeleted) {
+			t.Errorf("%s of a deleted user error = %v, want errUserDeleted", name, err)
+		}
+	}
+	if err := store.Create(ctx, &User{ID: "a", Email: "new@example.com"}); err != nil {
+		t.Errorf("Create over a tombstone error = %v", err)
+	}
+}
+
+func TestAPIUsesInjectedStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+	if err := store.Create(ctx, &User{ID: "user-100", Email: "jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	api := newTestAPI(t, WithUserStore(store), WithIDGenerator(NewSequentialIDGenerator("user")))
+
+	if rec := serve(api, "GET", "/api/v1/users/user-100", "", nil); rec.Code != http.StatusOK {
+		t.Errorf("GET of a pre-stored user = %d, want 200", rec.Code)
+	}
+	if rec := serve(api, "POST", "/api/v1/users", `{"first_name":"Jane","last_name":"Doe","email":"bob@example.com"}`, nil); rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	if user, err := store.Get(ctx, "user-1"); err != nil || user.Email != "bob@example.com" {
+		t.Errorf("store has %+v, %v; want the created user", user, err)
+	}
+}
+
+func TestAdminResetNeedsResettableStore(t *testing.T) {
+	// Embedding hides MemoryUserStore's Reset
+	store := struct{ UserStore }{NewMemoryUserStore()}
+	api := newTestAPI(t, WithUserStore(store), WithFeatureFlags(FeatureFlags{TestAdmin: true}))
+
+	if rec := serve(api, "POST", "/api/v1/admin/reset", "", nil); rec.Code != http.StatusNotImplemented {
+		t.Errorf("reset = %d, want 501", rec.Code)
+	}
+}
+
+// metricsTestAPI serves one found, one missing, and one failing user lookup
+func metricsTestAPI(t *testing.T, recorder MetricsRecorder) *API {
+	t.Helper()
+	store := getFuncStore{UserStore: NewMemoryUserStore(), get: func(id string) (*User, error) {
+		switch id {
+		case "found":
+			return &User{ID: id, Email: "jane@example.com"}, nil
+		case "failing":
+			return nil, errors.New("backend unavailable")
+		}
+		return nil, errUserNotFound
+	}}
+	// The fake store answers by name, not by UUID
+	api := newTestAPI(t, WithUserStore(store), WithIDValidator(IDValidatorFunc(func(string) bool { return true })))
+	api.Metrics = recorder
+	for _, id := range []string{"found", "missing", "failing"} {
+		serve(api, "GET", "/api/v1/users/"+id, "", nil)
+	}
+	return api
+}
+
+func TestPrometheusMetricsRecorder(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	recorder, err := NewPrometheusMetricsRecorder(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsTestAPI(t, recorder)
+
+	const route = "/api/v1/users/{id}"
+	for status, want := range map[string]float64{"200": 1, "404": 1, "500": 1} {
+		if got := testutil.ToFloat64(recorder.requests.WithLabelValues("GET", route, status)); got != want {
+			t.Errorf("requests{status=%s} = %v, want %v", status, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(recorder.errors.WithLabelValues("GET", route)); got != 1 {
+		t.Errorf("errors = %v, want only the 500 counted", got)
+	}
+	if n := testutil.CollectAndCount(recorder.duration); n != 1 {
+		t.Errorf("duration series = %d, want 1", n)
+	}
+}
+
+func TestOTelMetricsRecorder(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	recorder, err := NewOTelMetricsRecorder(provider.Meter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsTestAPI(t, recorder)
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]metricdata.Aggregation)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			got[m.Name] = m.Data
+		}
+	}
+
+	sum := func(name string) int64 {
+		data, ok := got[name].(metricdata.Sum[int64])
+		if !ok {
+			t.Fatalf("%s = %T, want an int64 sum", name, got[name])
+		}
+		var total int64
+		for _, dp := range data.DataPoints {
+			if route, _ := dp.Attributes.Value(attribute.Key("http.route")); route.AsString() != "/api/v1/users/{id}" {
+				t.Errorf("%s route = %q, want the template", name, route.AsString())
+			}
+			total += dp.Value
+		}
+		return total
+	}
+	if n := sum("http.server.request.count"); n != 3 {
+		t.Errorf("request count = %d, want 3", n)
+	}
+	if n := sum("http.server.request.errors"); n != 1 {
+		t.Errorf("error count = %d, want 1", n)
+	}
+	duration, ok := got["http.server.request.duration"].(metricdata.Histogram[float64])
+	if !ok || len(duration.DataPoints) != 1 || duration.DataPoints[0].Count != 3 {
+		t.Errorf("duration = %+v, want 3 observations", got["http.server.request.duration"])
+	}
+}
+
+func TestV2ProblemsHaveStableTypes(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{V2API: true}))
+
+	tests := []struct {
+		name, method, target, body string
+		wantStatus                 int
+		wantType                   string
+	}{
+		{"missing user", "GET", "/api/v2/users/" + absentUserID, "", http.StatusNotFound, problemTypeBase + "not-found"},
+		{"invalid user", "POST", "/api/v2/users", `{"email":"nope"}`, http.StatusUnprocessableEntity, problemTypeBase + "validation-error"},
+		{"unmatched path", "GET", "/api/v2/nothing", "", http.StatusNotFound, problemTypeBase + "not-found"},
+		{"wrong method", "PATCH", "/api/v2/users", "", http.StatusMethodNotAllowed, problemTypeBase + "method-not-allowed"},
+		{"v1 unchanged", "GET", "/api/v1/users/" + absentUserID, "", http.StatusNotFound, "about:blank"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(api, tt.method, tt.target, tt.body, nil)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+			var problem Problem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Type != tt.wantType || problem.Status != tt.wantStatus || problem.Title == "" || problem.Instance != tt.target {
+				t.Errorf("problem = %+v, want type %s for %s", problem, tt.wantType, tt.target)
+			}
+		})
+	}
+}
+
+func TestV2ServesUsers(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{V2API: true}))
+
+	rec := serve(api, "POST", "/api/v2/users", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`, nil)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+	}
+	var created User
+	json.NewDecoder(rec.Body).Decode(&created)
+	if rec := serve(api, "GET", "/api/v2/users/"+created.ID, "", nil); rec.Code != http.StatusOK {
+		t.Errorf("get = %d, want 200", rec.Code)
+	}
+}
+
+func TestV2AbsentByDefault(t *testing.T) {
+	api := newTestAPI(t)
+
+	rec := serve(api, "GET", "/api/v2/users/missing", "", nil)
+	var problem Problem
+	json.NewDecoder(rec.Body).Decode(&problem)
+	if rec.Code != http.StatusNotFound || problem.Type != "about:blank" {
+		t.Errorf("v2 without the flag = %d %q, want an untyped 404", rec.Code, problem.Type)
+	}
+}
+
+func TestGetUserConditionalOnETag(t *testing.T) {
+	api := newTestAPI(t, WithIDGenerator(NewSequentialIDGenerator("user")))
+	if err := api.store.Create(context.Background(), &User{ID: "user-1", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(api, "GET", "/api/v1/users/user-1", "", nil)
+	etag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || etag == "" {
+		t.Fatalf("GET = %d with ETag %q, want 200 with an ETag", rec.Code, etag)
+	}
+
+	for _, header := range []string{etag, "W/" + etag, `"other", ` + etag} {
+		rec := serve(api, "GET", "/api/v1/users/user-1", "", http.Header{"If-None-Match": {header}})
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s = %d with %d body bytes, want an empty 304", header, rec.Code, rec.Body.Len())
+		}
+		if rec.Header().Get("ETag") != etag {
+			t.Errorf("304 ETag = %q, want %q", rec.Header().Get("ETag"), etag)
+		}
+	}
+
+	rec = serve(api, "GET", "/api/v1/users/user-1", "", http.Header{"If-None-Match": {`"stale"`}})
+	if rec.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match = %d, want 200", rec.Code)
+	}
+}
+
+func TestUpdateUserHonorsIfMatch(t *testing.T) {
+	api := newTestAPI(t, WithIDGenerator(NewSequentialIDGenerator("user")))
+	if err := api.store.Create(context.Background(), &User{ID: "user-1", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	etag := serve(api, "GET", "/api/v1/users/user-1", "", nil).Header().Get("ETag")
+
+	// The first writer wins and gets the new ETag back
+	rec := serve(api, "PUT", "/api/v1/users/user-1", `{"first_name":"Jane","last_name":"Doe","email":"janet@example.com"}`, http.Header{"If-Match": {etag}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT with current ETag = %d: %s", rec.Code, rec.Body)
+	}
+	newETag := rec.Header().Get("ETag")
+	if newETag == "" || newETag == etag {
+		t.Errorf("ETag after update = %q, want a new one", newETag)
+	}
+	if got := serve(api, "GET", "/api/v1/users/user-1", "", nil).Header().Get("ETag"); got != newETag {
+		t.Errorf("GET ETag = %q, want the one the update returned", got)
+	}
+
+	// A second writer holding the old ETag is turned away
+	rec = serve(api, "PUT", "/api/v1/users/user-1", `{"first_name":"Jane","last_name":"Doe","email":"jd@example.com"}`, http.Header{"If-Match": {etag}})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Fatalf("PUT with stale ETag = %d, want 412: %s", rec.Code, rec.Body)
+	}
+	if user, _ := api.store.Get(context.Background(), "user-1"); user.Email != "janet@example.com" {
+		t.Errorf("email = %q, want the stale update rejected", user.Email)
+	}
+
+	// Weak ETags never satisfy If-Match
+	rec = serve(api, "PUT", "/api/v1/users/user-1", `{"first_name":"Jane","last_name":"Doe","email":"jd@example.com"}`, http.Header{"If-Match": {"W/" + newETag}})
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with weak ETag = %d, want 412", rec.Code)
+	}
+}
+
+func TestPatchUserChangesOnlyGivenFields(t *testing.T) {
+	api := newTestAPI(t, WithIDGenerator(NewSequentialIDGenerator("user")))
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := api.store.Create(context.Background(), &User{ID: "user-1", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", CreatedAt: createdAt}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(api, "PATCH", "/api/v1/users/user-1", `{"email":"janet@example.com"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PATCH = %d: %s", rec.Code, rec.Body)
+	}
+	var patched User
+	if err := json.NewDecoder(rec.Body).Decode(&patched); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := api.store.Get(context.Background(), "user-1")
+	for _, user := range []*User{&patched, stored} {
+		if user.Email != "janet@example.com" || user.FirstName != "Jane" || user.LastName != "Doe" || !user.CreatedAt.Equal(createdAt) {
+			t.Errorf("user = %+v, want only the email changed", user)
+		}
+	}
+	if etag := rec.Header().Get("ETag"); etag != userETag(stored) {
+		t.Errorf("ETag = %q, want the patched user's %q", etag, userETag(stored))
+	}
+}
+
+func TestPatchUserRejectsBadPatches(t *testing.T) {
+	api := newTestAPI(t, WithIDGenerator(NewSequentialIDGenerator("user")))
+	if err := api.store.Create(context.Background(), &User{ID: "user-1", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	etag := serve(api, "GET", "/api/v1/users/user-1", "", nil).Header().Get("ETag")
+
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		header     http.Header
+		wantStatus int
+		wantField  string
+	}{
+		{"unknown field", "/api/v1/users/user-1", `{"nickname":"JD"}`, nil, http.StatusBadRequest, "nickname"},
+		{"read-only field", "/api/v1/users/user-1", `{"id":"user-2"}`, nil, http.StatusBadRequest, "id"},
+		{"wrong type", "/api/v1/users/user-1", `{"email":42}`, nil, http.StatusBadRequest, "email"},
+		{"invalid email", "/api/v1/users/user-1", `{"email":"nope"}`, nil, http.StatusUnprocessableEntity, "email"},
+		{"emptied name", "/api/v1/users/user-1", `{"first_name":""}`, nil, http.StatusUnprocessableEntity, "first_name"},
+		{"missing user", "/api/v1/users/user-999", `{"email":"janet@example.com"}`, nil, http.StatusNotFound, ""},
+		{"stale etag", "/api/v1/users/user-1", `{"email":"janet@example.com"}`, http.Header{"If-Match": {`"stale"`}}, http.StatusPreconditionFailed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(api, "PATCH", tt.target, tt.body, tt.header)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			var problem Problem
+			json.NewDecoder(rec.Body).Decode(&problem)
+			if tt.wantField != "" && (len(problem.Errors) != 1 || problem.Errors[0].Field != tt.wantField) {
+				t.Errorf("errors = %+v, want one for %s", problem.Errors, tt.wantField)
+			}
+		})
+	}
+
+	if user, _ := api.store.Get(context.Background(), "user-1"); user.FirstName != "Jane" || user.Email != "jane@example.com" {
+		t.Errorf("user = %+v, want it untouched by rejected patches", user)
+	}
+	if rec := serve(api, "PATCH", "/api/v1/users/user-1", `{"last_name":"Roe"}`, http.Header{"If-Match": {etag}}); rec.Code != http.StatusOK {
+		t.Errorf("PATCH with current ETag = %d, want 200: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRoleAuthorizerGuardsWrites(t *testing.T) {
+	api := newTestAPI(t, WithIDGenerator(NewSequentialIDGenerator("user")))
+	api.AuthTokens = map[string]string{"admin-token": "alice", "editor-token": "bob"}
+	api.Authorizer = &RoleAuthorizer{
+		Roles:  map[string]string{"alice": "admin", "bob": "editor"},
+		Grants: DefaultGrants,
+	}
+	if err := api.store.Create(context.Background(), &User{ID: "user-1", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(api, "DELETE", "/api/v1/users/user-1", "", bearer("editor-token"))
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("editor delete = %d, want 403: %s", rec.Code, rec.Body)
+	}
+	if _, err := api.store.Get(context.Background(), "user-1"); err != nil {
+		t.Fatalf("user gone after a denied delete: %v", err)
+	}
+
+	body := `{"first_name":"Jane","last_name":"Doe","email":"janet@example.com"}`
+	if rec := serve(api, "PUT", "/api/v1/users/user-1", body, bearer("editor-token")); rec.Code != http.StatusOK {
+		t.Errorf("editor update = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if rec := serve(api, "POST", "/api/v1/users", body, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("anonymous create = %d, want 403", rec.Code)
+	}
+	if rec := serve(api, "DELETE", "/api/v1/users/user-1", "", bearer("admin-token")); rec.Code != http.StatusNoContent {
+		t.Errorf("admin delete = %d, want 204: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestParseRoles(t *testing.T) {
+	roles, err := ParseRoles("alice=admin, bob=editor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"alice": "admin", "bob": "editor"}; !reflect.DeepEqual(roles, want) {
+		t.Errorf("roles = %v, want %v", roles, want)
+	}
+	for _, bad := range []string{"alice", "=admin", "alice="} {
+		if _, err := ParseRoles(bad); err == nil {
+			t.Errorf("ParseRoles(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+// auditLines reads every JSON line from the audit log at path and its
+// backups, failing on any line that doesn't decode
+func auditLines(t *testing.T, path string) int {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var record AuditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%s: torn line %q: %v", name, line, err)
+			}
+			lines++
+		}
+	}
+	return lines
+}
+
+func TestJSONLAuditLoggerRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxSize: 1024}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				record := AuditRecord{Actor: "alice", Action: "user.update", TargetID: fmt.Sprintf("%d-%d", i, j)}
+				if err := l.Log(context.Background(), record); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) == 0 {
+		t.Fatal("no backups after writing past MaxSize")
+	}
+	for _, name := range append(backups, path) {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, want at most 1024", name, info.Size())
+		}
+	}
+	if n := auditLines(t, path); n != 200 {
+		t.Errorf("found %d records across files, want all 200", n)
+	}
+}
+
+func TestJSONLAuditLoggerPrunesOldBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxSize: 1, MaxBackups: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// MaxSize 1 rotates before every record after the first
+	for i := 0; i < 5; i++ {
+		if err := l.Log(context.Background(), AuditRecord{Action: "user.create", TargetID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want the newest 2", backups)
+	}
+	for i, name := range backups {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Records 0 through 2 were pruned; 3 is current
+		if want := fmt.Sprintf(`"target_id":"%d"`, i+2); !strings.Contains(string(data), want) {
+			t.Errorf("backup %d = %s, want record %d", i, data, i+2)
+		}
+	}
+}
+
+func TestJSONLAuditLoggerRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxAge: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.now = func() time.Time { return now }
+	l.opened = now
+
+	write := func() {
+		if err := l.Log(context.Background(), AuditRecord{Action: "user.create"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	now = now.Add(59 * time.Minute)
+	write()
+	if backups, _ := l.backups(); len(backups) != 0 {
+		t.Fatalf("rotated before MaxAge: %v", backups)
+	}
+	now = now.Add(time.Minute)
+	write()
+	if backups, _ := l.backups(); len(backups) != 1 {
+		t.Errorf("backups after MaxAge = %v, want 1", backups)
+	}
+}
+
+func TestJSONLAuditLoggerLogAfterClose(t *testing.T) {
+	l, err := NewJSONLAuditLogger(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close() = %v, want nil", err)
+	}
+	if err := l.Log(context.Background(), AuditRecord{}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Log() after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestWriteBurstThrottledBeforeReads(t *testing.T) {
+	api := newTestAPI(t, WithRateLimitBucket(writeTier, rate.Every(1<<62), 3))
+
+	var throttledAt int
+	for i := 1; i <= 10; i++ {
+		body := fmt.Sprintf(`{"first_name":"Jane","last_name":"Doe","email":"jane%d@example.com"}`, i)
+		rec := serve(api, "POST", "/api/v1/users", body, nil)
+		if rec.Code == http.StatusTooManyRequests {
+			throttledAt = i
+			if got := rec.Header().Get("X-RateLimit-Limit"); got != "3" {
+				t.Errorf("X-RateLimit-Limit = %q, want the writes burst 3", got)
+			}
+			break
+		}
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("POST %d = %d, want 201: %s", i, rec.Code, rec.Body)
+		}
+	}
+	if throttledAt != 4 {
+		t.Fatalf("POSTs throttled at request %d, want 4", throttledAt)
+	}
+
+	// Reads from the same client draw on the read tier
+	for i := 1; i <= 10; i++ {
+		rec := serve(api, "GET", "/api/v1/users", "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %d after the POST burst = %d, want 200", i, rec.Code)
+		}
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != "40" {
+			t.Errorf("X-RateLimit-Limit = %q, want the read burst 40", got)
+		}
+	}
+}
+
+func TestWriteTierThrottlesBeforeReadTier(t *testing.T) {
+	never := rate.Every(1 << 62)
+	api := newTestAPI(t, WithRateLimitTiers(RateLimitTiers{
+		readTier:  {Rate: never, Burst: 8},
+		writeTier: {Rate: never, Burst: 2},
+	}))
+	api.store.Create(context.Background(), &User{ID: "u1", FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"})
+
+	// The same load against each route: count requests until the first 429
+	load := func(method, target, body string) int {
+		for i := 1; i <= 20; i++ {
+			if serve(api, method, target, body, nil).Code == http.StatusTooManyRequests {
+				return i - 1
+			}
+		}
+		return 20
+	}
+	writes := load("PUT", "/api/v1/users/u1", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`)
+	reads := load("GET", "/api/v1/users/u1", "")
+
+	if writes != 2 || reads != 8 {
+		t.Errorf("allowed %d writes and %d reads before throttling, want 2 and 8", writes, reads)
+	}
+}
+
+func TestEveryRouteHasARateLimitTier(t *testing.T) {
+	api := newTestAPI(t, WithFeatureFlags(FeatureFlags{V2API: true, BulkOperations: true, TestAdmin: true}))
+
+	err := api.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil // a subrouter prefix, not an endpoint
+		}
+		path, _ := route.GetPathTemplate()
+		methods, _ := route.GetMethods()
+		tier := api.routeTiers[route]
+		want := writeTier
+		if len(methods) == 1 && methods[0] == "GET" {
+			want = readTier
+		}
+		if tier != want {
+			t.Errorf("%v %s is in tier %q, want %q", methods, path, tier, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimitRoutesPickBucket(t *testing.T) {
+	api := newTestAPI(t)
+	api.RateLimitRoutes = []RateLimitRoute{
+		{Methods: []string{"DELETE"}, PathPrefix: "/api/", Bucket: "deletes"},
+		{PathPrefix: "/api/v1/users/import", Bucket: "imports"},
+		{Methods: []string{"POST"}, PathPrefix: "/api/", Bucket: "writes"},
+	}
+
+	for _, tt := range []struct {
+		method, path, want string
+	}{
+		{"DELETE", "/api/v1/users/1", "deletes"},
+		{"POST", "/api/v1/users/import", "imports"},
+		{"GET", "/api/v1/users/import", "imports"},
+		{"POST", "/api/v1/users", "writes"},
+		{"GET", "/api/v1/users", ""},
+		{"POST", "/health", ""},
+	} {
+		if got := api.rateLimitBucket(httptest.NewRequest(tt.method, tt.path, nil)); got != tt.want {
+			t.Errorf("%s %s bucket = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestRegisterBucketUpdatesLiveLimiters(t *testing.T) {
+	rl := NewRateLimiter(rate.Every(1<<62), 1, 0)
+	rl.RegisterBucket("writes", rate.Every(1<<62), 1)
+
+	if !rl.AllowIn("writes", "ip:a") || rl.AllowIn("writes", "ip:a") {
+		t.Fatal("writes bucket should allow exactly one request")
+	}
+	if !rl.Allow("ip:a") {
+		t.Error("default bucket shares tokens with the writes bucket")
+	}
+	if !rl.AllowIn("unregistered", "ip:b") || rl.Allow("ip:b") {
+		t.Error("unregistered bucket should share the default limiter")
+	}
+
+	rl.RegisterBucket("writes", rate.Inf, 1)
+	if !rl.AllowIn("writes", "ip:a") {
+		t.Error("raised writes limit not applied to the existing limiter")
+	}
+}
+
+func TestCreateUserValidateOnly(t *testing.T) {
+	api := newTestAPI(t)
+	api.Idempotency = NewInMemoryIdempotencyStore(nil)
+	key := http.Header{"Idempotency-Key": {"form-1"}}
+
+	valid := `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com"}`
+	rec := serve(api, "POST", "/api/v1/users?validate_only=true", valid, key)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid dry run = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var result ValidationResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil || !result.Valid {
+		t.Errorf("result = %+v (%v), want valid", result, err)
+	}
+
+	rec = serve(api, "POST", "/api/v1/users?validate_only=true", `{"first_name":"Jane","email":"not-an-email"}`, nil)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("invalid dry run = %d, want 422: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Fields["last_name"] == "" || problem.Fields["email"] == "" {
+		t.Errorf("fields = %v, want last_name and email errors", problem.Fields)
+	}
+
+	if n := len(memoryStore(api).users); n != 0 {
+		t.Fatalf("store holds %d users after dry runs, want 0", n)
+	}
+
+	// The dry run's idempotency key is still free for the real create
+	if rec := serve(api, "POST", "/api/v1/users", valid, key); rec.Code != http.StatusCreated {
+		t.Errorf("create after dry run = %d, want 201: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRateLimitRemainingDecrements(t *testing.T) {
+	clock := newManualClock()
+	api := newTestAPI(t)
+	api.rateLimiter.Stop()
+	api.rateLimiter = NewRateLimiter(rate.Every(time.Second), 3, 0, WithRateLimiterClock(clock))
+	start := clock.Now()
+
+	for i, want := range []string{"2", "1", "0"} {
+		rec := serve(api, "GET", "/api/v1/users", "", nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d = %d, want 200", i+1, rec.Code)
+		}
+		if got := rec.Header().Get("X-RateLimit-Remaining"); got != want {
+			t.Errorf("request %d X-RateLimit-Remaining = %q, want %s", i+1, got, want)
+		}
+	}
+
+	rec := serve(api, "GET", "/api/v1/users", "", nil)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("throttled X-RateLimit-Remaining = %q, want 0", got)
+	}
+	// Three tokens at one per second refill three seconds from now
+	if got, want := rec.Header().Get("X-RateLimit-Reset"), strconv.FormatInt(unixCeil(start.Add(3*time.Second)), 10); got != want {
+		t.Errorf("X-RateLimit-Reset = %s, want %s", got, want)
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	rec = serve(api, "GET", "/api/v1/users", "", nil)
+	if got := rec.Header().Get("X-RateLimit-Remaining"); rec.Code != http.StatusOK || got != "0" {
+		t.Errorf("after refilling 1.5 tokens = %d with remaining %q, want 200 with 0", rec.Code, got)
+	}
+}
+
+// greetRequest is a minimal typed request for exercising Handle
+type greetRequest struct {
+	Name string `json:"name"`
+}
+
+func (r *greetRequest) Validate() error {
+	if r.Name == "" {
+		return &ValidationError{Fields: []FieldError{{Field: "name", Message: "is required"}}}
+	}
+	return nil
+}
+
+type greetResponse struct {
+	Greeting string `json:"greeting"`
+}
+
+// greet fails for a few reserved names and greets everyone else
+func greet(ctx context.Context, req greetRequest) (greetResponse, int, error) {
+	switch req.Name {
+	case "nobody":
+		return greetResponse{}, 0, fmt.Errorf("no greeting for %s: %w", req.Name, ErrNotFound)
+	case "twin":
+		return greetResponse{}, 0, fmt.Errorf("%s is already greeted: %w", req.Name, ErrConflict)
+	case "crash":
+		return greetResponse{}, 0, errors.New("greeting store unreachable")
+	}
+	return greetResponse{Greeting: "Hello, " + req.Name}, http.StatusCreated, nil
+}
+
+func TestHandleAdapter(t *testing.T) {
+	handler := Handle(greet)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantDetail string
+		wantFields []FieldError
+	}{
+		{"success", `{"name":"Jane"}`, http.StatusCreated, "", nil},
+		{"validation failure", `{}`, http.StatusUnprocessableEntity, "name is required", []FieldError{{Field: "name", Message: "is required"}}},
+		{"unknown field", `{"name":"Jane","age":3}`, http.StatusBadRequest, "Request body has unknown fields or fields of the wrong type", []FieldError{{Field: "age", Message: "is not a known field"}}},
+		{"not found", `{"name":"nobody"}`, http.StatusNotFound, "no greeting for nobody: not found", nil},
+		{"conflict", `{"name":"twin"}`, http.StatusConflict, "twin is already greeted: conflict", nil},
+		{"unexpected error", `{"name":"crash"}`, http.StatusInternalServerError, "Internal server error", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/greetings", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusCreated {
+				var resp greetResponse
+				if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || resp.Greeting != "Hello, Jane" {
+					t.Errorf("response = %+v (%v), want a greeting for Jane", resp, err)
+				}
+				return
+			}
+
+			if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+			var problem Problem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Status != tt.wantStatus || problem.Detail != tt.wantDetail || problem.Instance != "/greetings" {
+				t.Errorf("problem = %+v, want status %d and detail %q", problem, tt.wantStatus, tt.wantDetail)
+			}
+			if !reflect.DeepEqual(problem.Errors, tt.wantFields) {
+				t.Errorf("errors = %+v, want %+v", problem.Errors, tt.wantFields)
+			}
+		})
+	}
+}
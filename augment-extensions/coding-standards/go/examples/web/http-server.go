@@ -2,19 +2,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
 	"log/slog"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelmetric "go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
 )
 
 // User represents a user in the system
@@ -25,94 +45,1669 @@ type User struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// Problem is an RFC 7807 problem details document
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes a validation failure on a single field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error kinds shared by the service layer. Handlers map them to status codes
+// with errors.Is and errors.As instead of matching messages.
+var (
+	ErrNotFound   = errors.New("not found")
+	ErrConflict   = errors.New("conflict")
+	ErrValidation = errors.New("validation failed")
+	ErrForbidden  = errors.New("forbidden")
+)
+
+// kindError carries a client-facing message for one of the error kinds
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// newError returns an error with the formatted message that matches kind
+// with errors.Is
+func newError(kind error, format string, args ...interface{}) error {
+	return &kindError{kind: kind, msg: fmt.Sprintf(format, args...)}
+}
+
+// ValidationError lists the invalid fields of a request. It matches
+// ErrValidation with errors.Is.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		messages[i] = f.Field + " " + f.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool { return target == ErrValidation }
+
+// WriteProblem writes problem as application/problem+json, defaulting the
+// type, title, and status from the HTTP status code
+func WriteProblem(w http.ResponseWriter, status int, problem Problem) {
+	if problem.Type == "" {
+		problem.Type = "about:blank"
+	}
+	if problem.Title == "" {
+		problem.Title = http.StatusText(status)
+	}
+	problem.Status = status
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// IDGenerator allocates IDs for new users. User IDs are int64 on this
+// service's wire format, so the default is a sequence rather than UUIDs.
+type IDGenerator interface {
+	NewID() int64
+}
+
+// IDGeneratorFunc adapts a function to an IDGenerator
+type IDGeneratorFunc func() int64
+
+// NewID calls f
+func (f IDGeneratorFunc) NewID() int64 { return f() }
+
+// SequentialIDGenerator issues 1, 2, 3, ... in order. It is the default.
+type SequentialIDGenerator struct {
+	last atomic.Int64
+}
+
+// NewID returns the next ID in the sequence
+func (g *SequentialIDGenerator) NewID() int64 {
+	return g.last.Add(1)
+}
+
+// DeterministicIDGenerator issues positive IDs derived from a seed and a
+// counter, so a test or replay with the same seed sees the same IDs in the
+// same order
+type DeterministicIDGenerator struct {
+	seed string
+	last atomic.Int64
+}
+
+// NewDeterministicIDGenerator creates a replayable generator for seed
+func NewDeterministicIDGenerator(seed string) *DeterministicIDGenerator {
+	return &DeterministicIDGenerator{seed: seed}
+}
+
+// NewID returns the next ID for the generator's seed
+func (g *DeterministicIDGenerator) NewID() int64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s/%d", g.seed, g.last.Add(1))
+	return int64(h.Sum64() >> 1)
+}
+
+// Reset restarts the sequence so the same IDs are issued again
+func (g *DeterministicIDGenerator) Reset() {
+	g.last.Store(0)
+}
+
 // UserService handles user operations
 type UserService struct {
 	logger *slog.Logger
-	users  map[int64]*User // In-memory store for demo
-	nextID int64
+	ids    IDGenerator
+
+	mu    sync.RWMutex
+	users map[int64]*User // In-memory store for demo
+}
+
+// NewUserService creates a new user service that allocates IDs with ids,
+// or sequentially if ids is nil
+func NewUserService(logger *slog.Logger, ids IDGenerator) *UserService {
+	if ids == nil {
+		ids = &SequentialIDGenerator{}
+	}
+	return &UserService{
+		logger: logger,
+		ids:    ids,
+		users:  make(map[int64]*User),
+	}
+}
+
+// GetUser retrieves a user by ID
+func (s *UserService) GetUser(ctx context.Context, id int64) (*User, error) {
+	s.mu.RLock()
+	user, ok := s.users[id]
+	s.mu.RUnlock()
+	if !ok {
+		return nil, newError(ErrNotFound, "user %d not found", id)
+	}
+	return user, nil
+}
+
+// CreateUser creates a new user. Emails are unique; reusing one returns
+// an ErrConflict error.
+func (s *UserService) CreateUser(ctx context.Context, name, email string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.Email == email {
+			return nil, newError(ErrConflict, "email %s is already registered", email)
+		}
+	}
+
+	user := &User{
+		ID:        s.ids.NewID(),
+		Name:      name,
+		Email:     email,
+		CreatedAt: time.Now(),
+	}
+	s.users[user.ID] = user
+	return user, nil
+}
+
+// Topic names a class of events on the EventBus
+type Topic string
+
+// Topics published by the user handlers
+const (
+	TopicUserCreated Topic = "user.created"
+	TopicUserUpdated Topic = "user.updated"
+	TopicUserDeleted Topic = "user.deleted"
+)
+
+// ErrBusClosed is returned when publishing to a drained EventBus
+var ErrBusClosed = errors.New("event bus closed")
+
+// BusEvent is a message delivered to EventBus subscribers
+type BusEvent struct {
+	Topic     Topic
+	Payload   interface{}
+	Timestamp time.Time
+}
+
+// EventHandler consumes events from the EventBus
+type EventHandler func(ctx context.Context, event BusEvent)
+
+type busSubscriber struct {
+	id      uint64
+	handler EventHandler
+	async   bool
+}
+
+type busDelivery struct {
+	ctx     context.Context
+	event   BusEvent
+	handler EventHandler
+}
+
+// EventBus is an in-process publish/subscribe bus that decouples write
+// handlers from side effects like cache invalidation and notifications.
+// Synchronous subscribers run inside Publish; asynchronous ones are queued
+// to a fixed pool of background workers.
+type EventBus struct {
+	mu     sync.RWMutex
+	subs   map[Topic][]busSubscriber
+	nextID uint64
+	queue  chan busDelivery
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewEventBus creates a bus whose async deliveries are buffered up to buffer
+// and handled by workers goroutines
+func NewEventBus(buffer, workers int) *EventBus {
+	if workers < 1 {
+		workers = 1
+	}
+	b := &EventBus{
+		subs:  make(map[Topic][]busSubscriber),
+		queue: make(chan busDelivery, buffer),
+	}
+	for i := 0; i < workers; i++ {
+		b.wg.Add(1)
+		go b.work()
+	}
+	return b
+}
+
+func (b *EventBus) work() {
+	defer b.wg.Done()
+	for d := range b.queue {
+		d.handler(d.ctx, d.event)
+	}
+}
+
+// Subscribe registers a handler that runs synchronously inside Publish
+func (b *EventBus) Subscribe(topic Topic, handler EventHandler) {
+	b.subscribe(topic, busSubscriber{handler: handler})
+}
+
+// SubscribeAsync registers a handler that runs on a background worker
+func (b *EventBus) SubscribeAsync(topic Topic, handler EventHandler) {
+	b.subscribe(topic, busSubscriber{handler: handler, async: true})
+}
+
+// Listen registers a synchronous handler for each of topics until the
+// returned unsubscribe func is called. It suits short-lived consumers like
+// open client streams; handler must not block.
+func (b *EventBus) Listen(handler EventHandler, topics ...Topic) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	id := b.nextID
+	for _, topic := range topics {
+		b.subs[topic] = append(b.subs[topic], busSubscriber{id: id, handler: handler})
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for _, topic := range topics {
+				subs := b.subs[topic]
+				for i, sub := range subs {
+					if sub.id == id {
+						b.subs[topic] = append(subs[:i:i], subs[i+1:]...)
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func (b *EventBus) subscribe(topic Topic, sub busSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[topic] = append(b.subs[topic], sub)
+}
+
+// Publish delivers payload to every subscriber of topic. Async deliveries
+// block while the buffer is full until ctx is done. Async handlers get a
+// context detached from ctx's cancellation, since request contexts end as
+// soon as the response is written.
+func (b *EventBus) Publish(ctx context.Context, topic Topic, payload interface{}) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrBusClosed
+	}
+
+	event := BusEvent{Topic: topic, Payload: payload, Timestamp: time.Now()}
+	for _, sub := range b.subs[topic] {
+		if !sub.async {
+			sub.handler(ctx, event)
+			continue
+		}
+
+		select {
+		case b.queue <- busDelivery{ctx: context.WithoutCancel(ctx), event: event, handler: sub.handler}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Drain stops accepting new events and waits for queued async deliveries to
+// finish, or for ctx to be done
+func (b *EventBus) Drain(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AuditRecord describes a single mutating operation for the audit trail
+type AuditRecord struct {
+	Timestamp time.Time   `json:"timestamp"`
+	Actor     string      `json:"actor"`
+	Action    string      `json:"action"`
+	TargetID  string      `json:"target_id"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+}
+
+// AuditLogger records who changed what
+type AuditLogger interface {
+	Log(ctx context.Context, record AuditRecord) error
+}
+
+// JSONLAuditLogger appends audit records to a file as JSON lines. With
+// rotation configured, the file is renamed to a timestamped backup once it
+// grows past a size or age, and a fresh one is started.
+type JSONLAuditLogger struct {
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	size     int64
+	opened   time.Time
+	rotation AuditRotation
+	now      func() time.Time
+}
+
+// AuditRotation configures when JSONLAuditLogger rotates its file. A zero
+// field disables that limit.
+type AuditRotation struct {
+	// MaxSize is the size in bytes a file may reach before rotating
+	MaxSize int64
+	// MaxAge is how long a file is written to before rotating
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files to keep; older ones are deleted
+	MaxBackups int
+}
+
+// AuditLoggerOption configures a JSONLAuditLogger
+type AuditLoggerOption func(*JSONLAuditLogger)
+
+// WithAuditRotation rotates the audit log by size and age
+func WithAuditRotation(rotation AuditRotation) AuditLoggerOption {
+	return func(l *JSONLAuditLogger) {
+		l.rotation = rotation
+	}
+}
+
+// AuditRotationFromEnv reads AUDIT_LOG_MAX_SIZE_MB, AUDIT_LOG_MAX_AGE (a
+// duration) and AUDIT_LOG_MAX_BACKUPS
+func AuditRotationFromEnv() (AuditRotation, error) {
+	var rotation AuditRotation
+	if v := os.Getenv("AUDIT_LOG_MAX_SIZE_MB"); v != "" {
+		mb, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || mb < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_SIZE_MB %q", v)
+		}
+		rotation.MaxSize = mb << 20
+	}
+	if v := os.Getenv("AUDIT_LOG_MAX_AGE"); v != "" {
+		age, err := time.ParseDuration(v)
+		if err != nil || age < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_AGE %q", v)
+		}
+		rotation.MaxAge = age
+	}
+	if v := os.Getenv("AUDIT_LOG_MAX_BACKUPS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return rotation, fmt.Errorf("invalid AUDIT_LOG_MAX_BACKUPS %q", v)
+		}
+		rotation.MaxBackups = n
+	}
+	return rotation, nil
+}
+
+// NewJSONLAuditLogger opens (or creates) path for appending audit records
+func NewJSONLAuditLogger(path string, opts ...AuditLoggerOption) (*JSONLAuditLogger, error) {
+	l := &JSONLAuditLogger{path: path, now: time.Now}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if err := l.open(); err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return l, nil
+}
+
+// open opens l.path for appending and notes its current size
+func (l *JSONLAuditLogger) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	l.opened = l.now()
+	return nil
+}
+
+// Log writes record as a single JSON line, rotating first if the line
+// would take the file past its limits
+func (l *JSONLAuditLogger) Log(ctx context.Context, record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if l.shouldRotate(int64(len(data))) {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// shouldRotate reports whether writing n more bytes needs a fresh file. A
+// record larger than MaxSize still goes to a file of its own.
+func (l *JSONLAuditLogger) shouldRotate(n int64) bool {
+	if l.size == 0 {
+		return false
+	}
+	if max := l.rotation.MaxSize; max > 0 && l.size+n > max {
+		return true
+	}
+	return l.rotation.MaxAge > 0 && l.now().Sub(l.opened) >= l.rotation.MaxAge
+}
+
+// rotate renames the current file to a timestamped backup, opens a fresh
+// one, and prunes backups beyond MaxBackups
+func (l *JSONLAuditLogger) rotate() error {
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	// Keep appending to the current file if it can't be moved aside
+	renameErr := os.Rename(l.path, l.backupName())
+	if err := l.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	return l.prune()
+}
+
+// auditBackupTime formats backup timestamps so names sort by age
+const auditBackupTime = "20060102T150405.000000000"
+
+// backupName returns an unused backup path such as audit-<time>.jsonl
+func (l *JSONLAuditLogger) backupName() string {
+	ext := filepath.Ext(l.path)
+	base := strings.TrimSuffix(l.path, ext)
+	at := l.now().UTC()
+	for {
+		name := base + "-" + at.Format(auditBackupTime) + ext
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			return name
+		}
+		at = at.Add(time.Nanosecond)
+	}
+}
+
+// backups lists the rotated files for l.path, oldest first
+func (l *JSONLAuditLogger) backups() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	pattern := strings.TrimSuffix(l.path, ext) + "-*" + ext
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// prune deletes the oldest backups beyond MaxBackups
+func (l *JSONLAuditLogger) prune() error {
+	if l.rotation.MaxBackups <= 0 {
+		return nil
+	}
+	names, err := l.backups()
+	if err != nil {
+		return err
+	}
+	for len(names) > l.rotation.MaxBackups {
+		if err := os.Remove(names[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// Close flushes and closes the current file. Logging after Close fails with
+// os.ErrClosed; closing again is a no-op.
+func (l *JSONLAuditLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	syncErr := l.file.Sync()
+	closeErr := l.file.Close()
+	l.file = nil
+	if syncErr != nil {
+		return syncErr
+	}
+	return closeErr
+}
+
+// actorContextKey carries the authenticated identity in a request context
+type actorContextKey struct{}
+
+// WithActor returns a context carrying the authenticated actor identity
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorContextKey{}, actor)
+}
+
+// ActorFromContext returns the authenticated actor, or "anonymous"
+func ActorFromContext(ctx context.Context) string {
+	if actor, ok := ctx.Value(actorContextKey{}).(string); ok && actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
+
+// Actions checked by an Authorizer. They match the audit record actions.
+const (
+	ActionCreateUser = "user.create"
+	ActionUpdateUser = "user.update"
+	ActionDeleteUser = "user.delete"
+)
+
+// Authorizer decides whether the actor in ctx may perform action on
+// resource, returning an ErrForbidden error if not
+type Authorizer interface {
+	Authorize(ctx context.Context, action, resource string) error
+}
+
+// RoleAuthorizer grants actions by the role of the actor in the context.
+// Actors without a role, including anonymous callers, may do nothing.
+type RoleAuthorizer struct {
+	Roles  map[string]string   // actor -> role
+	Grants map[string][]string // role -> permitted actions; "*" permits all
+}
+
+// DefaultGrants lets admins do anything and editors create and update users
+// but not delete them
+var DefaultGrants = map[string][]string{
+	"admin":  {"*"},
+	"editor": {ActionCreateUser, ActionUpdateUser},
+}
+
+// Authorize implements Authorizer
+func (a *RoleAuthorizer) Authorize(ctx context.Context, action, resource string) error {
+	actor := ActorFromContext(ctx)
+	for _, granted := range a.Grants[a.Roles[actor]] {
+		if granted == "*" || granted == action {
+			return nil
+		}
+	}
+	return newError(ErrForbidden, "%s is not allowed to %s %s", actor, action, resource)
+}
+
+// ParseRoles parses a comma-separated list of actor=role pairs, as in the
+// API_ROLES environment variable
+func ParseRoles(v string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		actor, role, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || actor == "" || role == "" {
+			return nil, fmt.Errorf("invalid API_ROLES entry %q: want actor=role", pair)
+		}
+		roles[actor] = role
+	}
+	return roles, nil
+}
+
+// loggerContextKey carries the request-scoped logger in a request context
+type loggerContextKey struct{}
+
+// ContextWithLogger returns a context carrying logger for FromContext
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// WithFields returns a context whose logger adds args, as slog key-value
+// pairs, to every record
+func WithFields(ctx context.Context, args ...interface{}) context.Context {
+	return ContextWithLogger(ctx, FromContext(ctx).With(args...))
+}
+
+// FromContext returns the request-scoped logger, or slog.Default() outside
+// a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// MiddlewareConfig selects the optional middleware installed by routes.
+// Anything that widens exposure, like trusting forwarded headers or
+// answering cross-origin requests, is off unless asked for.
+type MiddlewareConfig struct {
+	// RealIP takes the client address from X-Forwarded-For and X-Real-IP.
+	// Only enable it behind a proxy that sets those headers.
+	RealIP bool
+	// Logger logs every request, or a sample if a LogSampler is set
+	Logger bool
+	// Compress gzips compressible responses
+	Compress bool
+	// CORS answers cross-origin requests from CORSOrigins ("*" for any)
+	CORS        bool
+	CORSOrigins []string
+	// Auth requires a bearer token from AuthTokens on /api routes. Each
+	// token maps to the actor recorded for its requests.
+	Auth       bool
+	AuthTokens map[string]string
+}
+
+// DefaultMiddlewareConfig logs and compresses but trusts no forwarded
+// headers and allows no cross-origin requests
+func DefaultMiddlewareConfig() MiddlewareConfig {
+	return MiddlewareConfig{Logger: true, Compress: true}
+}
+
+// MiddlewareConfigFromEnv reads MIDDLEWARE_* environment variables, keeping
+// the default for any that are unset. CORS_ORIGINS is a comma-separated
+// list and API_TOKENS a comma-separated list of token=actor pairs.
+func MiddlewareConfigFromEnv() (MiddlewareConfig, error) {
+	cfg := DefaultMiddlewareConfig()
+	toggles := []struct {
+		name string
+		dst  *bool
+	}{
+		{"MIDDLEWARE_REAL_IP", &cfg.RealIP},
+		{"MIDDLEWARE_LOGGER", &cfg.Logger},
+		{"MIDDLEWARE_COMPRESS", &cfg.Compress},
+		{"MIDDLEWARE_CORS", &cfg.CORS},
+		{"MIDDLEWARE_AUTH", &cfg.Auth},
+	}
+	for _, t := range toggles {
+		v := os.Getenv(t.name)
+		if v == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %s %q: %w", t.name, v, err)
+		}
+		*t.dst = enabled
+	}
+
+	if v := os.Getenv("CORS_ORIGINS"); v != "" {
+		for _, origin := range strings.Split(v, ",") {
+			cfg.CORSOrigins = append(cfg.CORSOrigins, strings.TrimSpace(origin))
+		}
+	}
+	if v := os.Getenv("API_TOKENS"); v != "" {
+		cfg.AuthTokens = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			token, actor, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if !ok || token == "" || actor == "" {
+				return cfg, fmt.Errorf("invalid API_TOKENS entry %q: want token=actor", pair)
+			}
+			cfg.AuthTokens[token] = actor
+		}
+	}
+	return cfg, nil
+}
+
+// Server represents the HTTP server
+type Server struct {
+	http        *http.Server
+	userService *UserService
+	ids         IDGenerator
+	logger      *slog.Logger
+	audit       AuditLogger
+	authorizer  Authorizer
+	middleware  MiddlewareConfig
+	events      *EventBus
+
+	maxHeaderBytes int
+	maxBodyBytes   int64
+	writeTimeout   time.Duration
+
+	slowThreshold time.Duration
+	onSlow        func(SlowRequest)
+	sampler       *LogSampler
+	tracer        Tracer
+	metrics       MetricsRecorder
+
+	// Event streams send a comment every heartbeat to keep proxies from
+	// timing out idle connections, and end when closing is closed
+	heartbeat time.Duration
+	closing   chan struct{}
+	stream    StreamConfig
+
+	// envelope wraps successful JSON responses in {data, meta}
+	envelope bool
+}
+
+// SlowRequest describes a request that exceeded the slow-request threshold
+type SlowRequest struct {
+	Method   string
+	Route    string
+	Status   int
+	Duration time.Duration
+}
+
+// ServerOption configures a Server
+type ServerOption func(*Server)
+
+// WithAuditLogger records create, update, and delete operations to audit
+func WithAuditLogger(audit AuditLogger) ServerOption {
+	return func(s *Server) {
+		s.audit = audit
+	}
+}
+
+// WithAuthorizer consults authorizer before every write, rejecting denied
+// requests with 403
+func WithAuthorizer(authorizer Authorizer) ServerOption {
+	return func(s *Server) {
+		s.authorizer = authorizer
+	}
+}
+
+// WithEventBus publishes user.* events to bus after every write. The bus is
+// drained when the server shuts down.
+func WithEventBus(bus *EventBus) ServerOption {
+	return func(s *Server) {
+		s.events = bus
+	}
+}
+
+// WithLogSampler replaces the default request logger with one that logs
+// errors, slow requests, and only a sample of the rest. Adjust the rate
+// while serving with sampler.SetRate.
+func WithLogSampler(sampler *LogSampler) ServerOption {
+	return func(s *Server) {
+		s.sampler = sampler
+	}
+}
+
+// WithMetrics records the count, latency, and errors of every request with
+// recorder. A PrometheusMetricsRecorder also serves the default registry at
+// /metrics.
+func WithMetrics(recorder MetricsRecorder) ServerOption {
+	return func(s *Server) {
+		s.metrics = recorder
+	}
+}
+
+// WithTracer enables tracing, continuing inbound W3C traceparent headers
+func WithTracer(tracer Tracer) ServerOption {
+	return func(s *Server) {
+		s.tracer = tracer
+	}
+}
+
+// WithMaxHeaderBytes overrides the maximum size of request headers
+func WithMaxHeaderBytes(n int) ServerOption {
+	return func(s *Server) {
+		s.maxHeaderBytes = n
+	}
+}
+
+// WithMaxBodyBytes overrides the maximum request body size. Zero disables
+// the limit.
+func WithMaxBodyBytes(n int64) ServerOption {
+	return func(s *Server) {
+		s.maxBodyBytes = n
+	}
+}
+
+// WithWriteTimeout overrides the server's WriteTimeout. The request timeout
+// is derived from it, so handlers that overrun still get their 504.
+func WithWriteTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.writeTimeout = timeout
+	}
+}
+
+// requestTimeout is how long handlers get before TimeoutJSON answers 504. It
+// stops short of writeTimeout: once the write deadline passes, the
+// connection is dropped and the client never sees the 504.
+func requestTimeout(writeTimeout time.Duration) time.Duration {
+	return writeTimeout - min(writeTimeout/10, time.Second)
+}
+
+// WithStreamHeartbeat overrides how often idle event streams send a
+// keep-alive comment
+func WithStreamHeartbeat(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.heartbeat = interval
+	}
+}
+
+// WithStreamConfig overrides how far event stream clients may fall behind,
+// and what happens when they do
+func WithStreamConfig(cfg StreamConfig) ServerOption {
+	return func(s *Server) {
+		s.stream = cfg
+	}
+}
+
+// WithMiddlewareConfig replaces the default middleware selection
+func WithMiddlewareConfig(cfg MiddlewareConfig) ServerOption {
+	return func(s *Server) {
+		s.middleware = cfg
+	}
+}
+
+// WithSlowRequestThreshold logs a warning for requests slower than
+// threshold. onSlow, if non-nil, is also called for each one, e.g. to feed
+// a metric or alert.
+func WithSlowRequestThreshold(threshold time.Duration, onSlow func(SlowRequest)) ServerOption {
+	return func(s *Server) {
+		s.slowThreshold = threshold
+		s.onSlow = onSlow
+	}
+}
+
+// WithIDGenerator sets how new user IDs are allocated. Defaults to a
+// sequence.
+func WithIDGenerator(ids IDGenerator) ServerOption {
+	return func(s *Server) {
+		s.ids = ids
+	}
+}
+
+// WithResponseEnvelope wraps successful API responses in an Envelope
+// instead of writing the resource itself. Problem responses and the health
+// check are never wrapped. Defaults to off.
+func WithResponseEnvelope(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.envelope = enabled
+	}
+}
+
+// NewServer creates a new HTTP server
+func NewServer(addr string, logger *slog.Logger, opts ...ServerOption) *Server {
+	s := &Server{
+		logger:         logger,
+		middleware:     DefaultMiddlewareConfig(),
+		maxHeaderBytes: 64 << 10,
+		maxBodyBytes:   1 << 20,
+		writeTimeout:   15 * time.Second,
+		heartbeat:      15 * time.Second,
+		closing:        make(chan struct{}),
+		stream:         DefaultStreamConfig(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	s.userService = NewUserService(logger, s.ids)
+	
+	// ReadHeaderTimeout cuts off clients that dribble headers (slowloris)
+	s.http = &http.Server{
+		Addr:              addr,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       60 * time.Second,
+		MaxHeaderBytes:    s.maxHeaderBytes,
+	}
+	// Shutdown waits for active connections, so open streams must end
+	s.http.RegisterOnShutdown(func() { close(s.closing) })
+	
+	return s
+}
+
+// routes sets up the HTTP routes. Optional middleware is installed as
+// selected in s.middleware.
+func (s *Server) routes() http.Handler {
+	r := chi.NewRouter()
+	
+	// Middleware
+	r.Use(RequestID)
+	if s.middleware.RealIP {
+		r.Use(middleware.RealIP)
+	}
+	r.Use(s.contextLogger)
+	if s.tracer != nil {
+		r.Use(s.tracing)
+	}
+	if s.metrics != nil {
+		r.Use(s.recordMetrics)
+	}
+	if s.middleware.Logger {
+		if s.sampler != nil {
+			r.Use(s.sampledLogger)
+		} else {
+			r.Use(middleware.Logger)
+		}
+	}
+	if s.slowThreshold > 0 {
+		r.Use(s.slowRequests)
+	}
+	r.Use(middleware.Recoverer)
+	if s.maxBodyBytes > 0 {
+		r.Use(s.limitBody)
+	}
+	if s.middleware.Compress {
+		r.Use(middleware.Compress(5))
+	}
+	if s.middleware.CORS {
+		r.Use(s.cors)
+	}
+	
+	// Streams hold their connection open, so they bypass the request
+	// timeout, which buffers the whole response
+	if s.events != nil {
+		r.With(s.apiMiddleware()...).Get("/api/v1/users/events", s.handleUserEvents)
+	}
+	
+	r.Group(func(r chi.Router) {
+		r.Use(TimeoutJSON(requestTimeout(s.writeTimeout)))
+
+		// Health check
+		r.Get("/health", s.handleHealth)
+
+		if _, ok := s.metrics.(*PrometheusMetricsRecorder); ok {
+			r.Handle("/metrics", promhttp.Handler())
+		}
+
+		// API routes
+		r.Route("/api/v1", func(r chi.Router) {
+			r.Use(s.apiMiddleware()...)
+			r.Route("/users", func(r chi.Router) {
+				r.Get("/{id}", s.handleGetUser)
+				r.Post("/", s.authorized(ActionCreateUser, s.handleCreateUser))
+			})
+		})
+	})
+	
+	return r
+}
+
+// apiMiddleware returns the middleware for /api routes
+func (s *Server) apiMiddleware() []func(http.Handler) http.Handler {
+	var mws []func(http.Handler) http.Handler
+	if s.middleware.Auth {
+		mws = append(mws, s.authenticate)
+	}
+	return mws
+}
+
+// cors allows cross-origin requests from the configured origins and answers
+// their preflight requests
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !s.allowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+requestIDHeader)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedOrigin reports whether origin may make cross-origin requests
+func (s *Server) allowedOrigin(origin string) bool {
+	for _, allowed := range s.middleware.CORSOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate rejects requests without a known bearer token with 401 and
+// records the token's actor in the request context
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		actor, known := s.actorForToken(token)
+		if !ok || !known {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			WriteProblem(w, http.StatusUnauthorized, Problem{
+				Detail:   "A valid bearer token is required",
+				Instance: r.URL.Path,
+			})
+			return
+		}
+		ctx := WithFields(WithActor(r.Context(), actor), "actor", actor)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authorized runs h only if the server's Authorizer permits action on the
+// user the route addresses, or on the users collection for routes without
+// an ID
+func (s *Server) authorized(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.authorizer != nil {
+			resource := "users"
+			if id := chi.URLParam(r, "id"); id != "" {
+				resource += "/" + id
+			}
+			if err := s.authorizer.Authorize(r.Context(), action, resource); err != nil {
+				s.writeServiceError(w, r, err)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// contextLogger stores the server's logger in the request context, tagged
+// with the request ID, method, and path, so handlers log through
+// FromContext and get correlated records
+func (s *Server) contextLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := s.logger.With(
+			"request_id", RequestIDFromContext(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+		)
+		next.ServeHTTP(w, r.WithContext(ContextWithLogger(r.Context(), logger)))
+	})
+}
+
+// actorForToken looks up the actor for a bearer token. Every token is
+// compared in constant time so response timing doesn't leak a prefix match.
+func (s *Server) actorForToken(token string) (string, bool) {
+	var actor string
+	for candidate, a := range s.middleware.AuthTokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			actor = a
+		}
+	}
+	return actor, actor != "" && token != ""
+}
+
+// sampledLogger logs completed requests the sampler selects
+func (s *Server) sampledLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+		elapsed := time.Since(start)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if !s.sampler.ShouldLog(status, elapsed) {
+			return
+		}
+
+		s.logger.Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"duration", elapsed,
+			"request_id", RequestIDFromContext(r.Context()),
+		)
+	})
+}
+
+// limitBody rejects requests whose declared Content-Length exceeds the
+// limit with 413 before reading anything, and caps undeclared bodies with
+// MaxBytesReader
+func (s *Server) limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > s.maxBodyBytes {
+			w.Header().Set("Connection", "close")
+			WriteProblem(w, http.StatusRequestEntityTooLarge, Problem{
+				Detail:   fmt.Sprintf("Request body exceeds %d bytes", s.maxBodyBytes),
+				Instance: r.URL.Path,
+			})
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MetricsRecorder records request metrics to a monitoring backend, such as
+// Prometheus or an OpenTelemetry collector
+type MetricsRecorder interface {
+	// RecordRequest records a finished request. route is the route
+	// pattern, not the raw path, so metric cardinality stays bounded.
+	RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration)
+	// RecordSlowConsumer records an event stream client overflowing its
+	// buffer, and so losing an event or being cut off under policy
+	RecordSlowConsumer(ctx context.Context, policy SlowConsumerPolicy)
+}
+
+// PrometheusMetricsRecorder records http_requests_total,
+// http_request_errors_total (5xx responses), http_request_duration_seconds,
+// and event_stream_slow_consumers_total
+type PrometheusMetricsRecorder struct {
+	requests      *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	slowConsumers *prometheus.CounterVec
+}
+
+// NewPrometheusMetricsRecorder creates the request metrics and registers them
+// with reg
+func NewPrometheusMetricsRecorder(reg prometheus.Registerer) (*PrometheusMetricsRecorder, error) {
+	m := &PrometheusMetricsRecorder{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests handled, by method, route, and status.",
+		}, []string{"method", "route", "status"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_request_errors_total",
+			Help: "HTTP requests that failed with a 5xx status, by method and route.",
+		}, []string{"method", "route"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency, by method and route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		slowConsumers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "event_stream_slow_consumers_total",
+			Help: "Times an event stream client overflowed its buffer, by the slow consumer policy applied.",
+		}, []string{"policy"}),
+	}
+	for _, c := range []prometheus.Collector{m.requests, m.errors, m.duration, m.slowConsumers} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// RecordRequest implements MetricsRecorder
+func (m *PrometheusMetricsRecorder) RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration) {
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+	if status >= 500 {
+		m.errors.WithLabelValues(method, route).Inc()
+	}
+	m.duration.WithLabelValues(method, route).Observe(duration.Seconds())
+}
+
+// RecordSlowConsumer implements MetricsRecorder
+func (m *PrometheusMetricsRecorder) RecordSlowConsumer(ctx context.Context, policy SlowConsumerPolicy) {
+	m.slowConsumers.WithLabelValues(string(policy)).Inc()
+}
+
+// OTelMetricsRecorder records the OpenTelemetry HTTP server metrics
+// http.server.request.count, http.server.request.errors (5xx responses), and
+// http.server.request.duration in seconds, plus event.stream.slow_consumers
+type OTelMetricsRecorder struct {
+	requests      otelmetric.Int64Counter
+	errors        otelmetric.Int64Counter
+	duration      otelmetric.Float64Histogram
+	slowConsumers otelmetric.Int64Counter
+}
+
+// NewOTelMetricsRecorder creates the request instruments from meter
+func NewOTelMetricsRecorder(meter otelmetric.Meter) (*OTelMetricsRecorder, error) {
+	requests, err := meter.Int64Counter("http.server.request.count",
+		otelmetric.WithDescription("HTTP requests handled."))
+	if err != nil {
+		return nil, err
+	}
+	errs, err := meter.Int64Counter("http.server.request.errors",
+		otelmetric.WithDescription("HTTP requests that failed with a 5xx status."))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram("http.server.request.duration",
+		otelmetric.WithDescription("HTTP request latency."),
+		otelmetric.WithUnit("s"))
+	if err != nil {
+		return nil, err
+	}
+	slowConsumers, err := meter.Int64Counter("event.stream.slow_consumers",
+		otelmetric.WithDescription("Times an event stream client overflowed its buffer."))
+	if err != nil {
+		return nil, err
+	}
+	return &OTelMetricsRecorder{requests: requests, errors: errs, duration: duration, slowConsumers: slowConsumers}, nil
+}
+
+// RecordRequest implements MetricsRecorder
+func (m *OTelMetricsRecorder) RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration) {
+	attrs := otelmetric.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("http.route", route),
+	)
+	m.requests.Add(ctx, 1, attrs, otelmetric.WithAttributes(attribute.Int("http.response.status_code", status)))
+	if status >= 500 {
+		m.errors.Add(ctx, 1, attrs)
+	}
+	m.duration.Record(ctx, duration.Seconds(), attrs)
+}
+
+// RecordSlowConsumer implements MetricsRecorder
+func (m *OTelMetricsRecorder) RecordSlowConsumer(ctx context.Context, policy SlowConsumerPolicy) {
+	m.slowConsumers.Add(ctx, 1, otelmetric.WithAttributes(attribute.String("policy", string(policy))))
+}
+
+// newOTLPMeterProvider exports metrics over OTLP/gRPC to the collector named
+// by the standard OTEL_EXPORTER_OTLP_* environment variables
+func newOTLPMeterProvider(ctx context.Context) (*sdkmetric.MeterProvider, error) {
+	exporter, err := otlpmetricgrpc.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter))), nil
+}
+
+// recordMetrics records every request with the server's MetricsRecorder
+func (s *Server) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+
+		// The route pattern is only complete once routing has finished.
+		// Unmatched requests share one label rather than echoing
+		// arbitrary paths into the metric.
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		s.metrics.RecordRequest(r.Context(), r.Method, route, status, time.Since(start))
+	})
+}
+
+// slowRequests reports requests slower than the configured threshold
+func (s *Server) slowRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+		elapsed := time.Since(start)
+		if elapsed <= s.slowThreshold {
+			return
+		}
+
+		// The route pattern is only complete once routing has finished
+		route := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		slow := SlowRequest{Method: r.Method, Route: route, Status: status, Duration: elapsed}
+		s.logger.Warn("slow request",
+			"method", slow.Method,
+			"route", slow.Route,
+			"status", slow.Status,
+			"duration", slow.Duration,
+			"threshold", s.slowThreshold,
+		)
+		if s.onSlow != nil {
+			s.onSlow(slow)
+		}
+	})
+}
+
+// LogSampler decides which completed requests get logged. Errors and slow
+// requests are always logged; other requests are logged at the sample rate.
+// The rate can be changed while serving.
+type LogSampler struct {
+	rate atomic.Uint64 // math.Float64bits of the sample rate
+	slow time.Duration
+}
+
+// NewLogSampler creates a sampler logging fraction rate (0 to 1) of normal
+// requests, plus every error and every request slower than slow
+func NewLogSampler(rate float64, slow time.Duration) *LogSampler {
+	ls := &LogSampler{slow: slow}
+	ls.SetRate(rate)
+	return ls
+}
+
+// SetRate changes the fraction of normal requests that are logged
+func (ls *LogSampler) SetRate(rate float64) {
+	rate = math.Max(0, math.Min(1, rate))
+	ls.rate.Store(math.Float64bits(rate))
+}
+
+// Rate returns the current sample rate
+func (ls *LogSampler) Rate() float64 {
+	return math.Float64frombits(ls.rate.Load())
 }
 
-// NewUserService creates a new user service
-func NewUserService(logger *slog.Logger) *UserService {
-	return &UserService{
-		logger: logger,
-		users:  make(map[int64]*User),
-		nextID: 1,
+// ShouldLog reports whether a request that finished with status after
+// elapsed should be logged
+func (ls *LogSampler) ShouldLog(status int, elapsed time.Duration) bool {
+	if status >= 400 || (ls.slow > 0 && elapsed >= ls.slow) {
+		return true
 	}
+	return rand.Float64() < ls.Rate()
 }
 
-// GetUser retrieves a user by ID
-func (s *UserService) GetUser(ctx context.Context, id int64) (*User, error) {
-	user, ok := s.users[id]
-	if !ok {
-		return nil, errors.New("user not found")
+// SpanContext identifies a span within a W3C trace
+type SpanContext struct {
+	TraceID string // 32 lowercase hex digits
+	SpanID  string // 16 lowercase hex digits
+	Sampled bool
+}
+
+// IsValid reports whether sc carries usable trace and span IDs
+func (sc SpanContext) IsValid() bool {
+	return isLowerHex(sc.TraceID, 32) && isLowerHex(sc.SpanID, 16) &&
+		strings.Trim(sc.TraceID, "0") != "" && strings.Trim(sc.SpanID, "0") != ""
+}
+
+// Traceparent formats sc as a W3C traceparent header value
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
 	}
-	return user, nil
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-" + flags
 }
 
-// CreateUser creates a new user
-func (s *UserService) CreateUser(ctx context.Context, name, email string) (*User, error) {
-	user := &User{
-		ID:        s.nextID,
-		Name:      name,
-		Email:     email,
-		CreatedAt: time.Now(),
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || !isLowerHex(parts[0], 2) || parts[0] == "ff" || !isLowerHex(parts[3], 2) {
+		return SpanContext{}, false
 	}
-	s.users[s.nextID] = user
-	s.nextID++
-	return user, nil
+	// Version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	sc := SpanContext{TraceID: parts[1], SpanID: parts[2], Sampled: flags&0x01 == 1}
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return sc, true
 }
 
-// Server represents the HTTP server
-type Server struct {
-	http        *http.Server
-	userService *UserService
-	logger      *slog.Logger
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
 }
 
-// NewServer creates a new HTTP server
-func NewServer(addr string, logger *slog.Logger) *Server {
-	userService := NewUserService(logger)
-	
-	s := &Server{
-		userService: userService,
-		logger:      logger,
+// Span is a timed operation within a trace
+type Span struct {
+	Name    string
+	Context SpanContext
+	Parent  SpanContext // zero for root spans
+	Start   time.Time
+	EndTime time.Time
+
+	export func(*Span)
+}
+
+// End finishes the span and hands it to the tracer's exporter
+func (s *Span) End() {
+	s.EndTime = time.Now()
+	if s.export != nil {
+		s.export(s)
 	}
-	
-	s.http = &http.Server{
-		Addr:         addr,
-		Handler:      s.routes(),
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
-		IdleTimeout:  60 * time.Second,
+}
+
+// Tracer starts spans. Inject a custom Tracer to capture spans in tests.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, *Span)
+}
+
+// spanContextKey carries the current SpanContext, whether it belongs to a
+// local span or a remote parent read from an inbound request
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns ctx carrying sc as the current span
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the current span context, if any
+func SpanContextFromContext(ctx context.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok && sc.IsValid()
+}
+
+// simpleTracer creates spans with random IDs and passes finished spans to
+// export
+type simpleTracer struct {
+	export func(*Span)
+}
+
+// NewTracer creates a Tracer that calls export with every finished span
+func NewTracer(export func(*Span)) Tracer {
+	return &simpleTracer{export: export}
+}
+
+// Start begins a span that is a child of the span in ctx, or a new root
+func (t *simpleTracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{Name: name, Start: time.Now(), export: t.export}
+	if parent, ok := SpanContextFromContext(ctx); ok {
+		span.Parent = parent
+		span.Context = SpanContext{TraceID: parent.TraceID, SpanID: randomHex(8), Sampled: parent.Sampled}
+	} else {
+		span.Context = SpanContext{TraceID: randomHex(16), SpanID: randomHex(8), Sampled: true}
 	}
-	
-	return s
+	return ContextWithSpanContext(ctx, span.Context), span
 }
 
-// routes sets up the HTTP routes
-func (s *Server) routes() http.Handler {
-	r := chi.NewRouter()
-	
-	// Middleware
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(30 * time.Second))
-	
-	// Health check
-	r.Get("/health", s.handleHealth)
-	
-	// API routes
-	r.Route("/api/v1", func(r chi.Router) {
-		r.Route("/users", func(r chi.Router) {
-			r.Get("/{id}", s.handleGetUser)
-			r.Post("/", s.handleCreateUser)
-		})
+func randomHex(n int) string {
+	b := make([]byte, n)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDHeader carries the request ID on HTTP requests and responses.
+// gRPC metadata uses the same name, lowercased.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds caller-supplied request IDs
+const maxRequestIDLength = 128
+
+// validRequestID reports whether a caller-supplied ID is safe to adopt: non
+// empty, bounded, and printable ASCII without spaces, so it can't forge
+// extra fields or lines in logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID generates a random request ID
+func newRequestID() string {
+	return randomHex(16)
+}
+
+// RequestID adopts the caller's X-Request-Id or generates one, stores it in
+// the request context, and echoes it in the response. It uses chi's context
+// key, so chi's logger and middleware.GetReqID see the same ID.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		ctx := context.WithValue(r.Context(), middleware.RequestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-	
-	return r
+}
+
+// RequestIDFromContext returns the request ID stored by RequestID, if any
+func RequestIDFromContext(ctx context.Context) string {
+	return middleware.GetReqID(ctx)
+}
+
+// InjectTraceparent propagates the current span in ctx to an outbound HTTP
+// request's headers
+func InjectTraceparent(ctx context.Context, header http.Header) {
+	if sc, ok := SpanContextFromContext(ctx); ok {
+		header.Set("traceparent", sc.Traceparent())
+	}
+}
+
+// tracing starts a server span for each request, continuing the caller's
+// trace when a valid traceparent header is present
+func (s *Server) tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if remote, ok := ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = ContextWithSpanContext(ctx, remote)
+		}
+
+		ctx, span := s.tracer.Start(ctx, r.Method+" "+r.URL.Path)
+		defer span.End()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// timeoutWriter buffers a handler's response so it can be discarded if the
+// handler overruns its deadline
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.header }
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.body.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+// TimeoutJSON cancels the request context after timeout and answers with a
+// 504 problem document instead of chi's plain-text 503. Handlers observe
+// the deadline through r.Context(); anything they write afterwards is
+// dropped. Panics are re-raised on the serving goroutine so Recoverer still
+// sees them.
+func TimeoutJSON(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+
+			tw := &timeoutWriter{header: make(http.Header)}
+			done := make(chan struct{})
+			panicked := make(chan interface{}, 1)
+			go func() {
+				defer func() {
+					if p := recover(); p != nil {
+						panicked <- p
+					}
+				}()
+				next.ServeHTTP(tw, r)
+				close(done)
+			}()
+
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				for key, values := range tw.header {
+					w.Header()[key] = values
+				}
+				if tw.status == 0 {
+					tw.status = http.StatusOK
+				}
+				w.WriteHeader(tw.status)
+				w.Write(tw.body.Bytes())
+			case <-ctx.Done():
+				tw.mu.Lock()
+				tw.timedOut = true
+				tw.mu.Unlock()
+				if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					return // client went away; nobody to answer
+				}
+				WriteProblem(w, http.StatusGatewayTimeout, Problem{
+					Detail:   fmt.Sprintf("Request did not complete within %v", timeout),
+					Instance: r.URL.Path,
+					Code:     "request_timeout",
+				})
+			}
+		})
+	}
 }
 
 // handleHealth handles health check requests
@@ -121,6 +1716,224 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 }
 
+// streamEvents names the server-sent event sent for each bus topic
+var streamEvents = map[Topic]string{
+	TopicUserCreated: "created",
+	TopicUserUpdated: "updated",
+	TopicUserDeleted: "deleted",
+}
+
+// SlowConsumerPolicy decides what an event stream does with a client that
+// has fallen a full buffer behind
+type SlowConsumerPolicy string
+
+const (
+	// DropOldest discards the client's oldest buffered event to make room
+	DropOldest SlowConsumerPolicy = "drop_oldest"
+	// Disconnect ends the client's stream; it can reconnect and refetch
+	Disconnect SlowConsumerPolicy = "disconnect"
+	// BlockWithTimeout holds the publishing request for up to BlockTimeout
+	// waiting for room, then disconnects the client. Writes slow to the
+	// pace of the slowest client, so keep the timeout short.
+	BlockWithTimeout SlowConsumerPolicy = "block_with_timeout"
+)
+
+// ParseSlowConsumerPolicy parses a policy name
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(name); policy {
+	case DropOldest, Disconnect, BlockWithTimeout:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown slow consumer policy %q: want drop_oldest, disconnect, or block_with_timeout", name)
+}
+
+// StreamConfig bounds the events buffered for each event stream client
+type StreamConfig struct {
+	// Buffer is how many events a client may fall behind
+	Buffer int
+	// Policy applies once a client's buffer is full
+	Policy SlowConsumerPolicy
+	// BlockTimeout is how long BlockWithTimeout waits for room
+	BlockTimeout time.Duration
+}
+
+// DefaultStreamConfig buffers 64 events per client and drops the oldest
+// beyond that
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{Buffer: 64, Policy: DropOldest, BlockTimeout: time.Second}
+}
+
+// StreamConfigFromEnv reads STREAM_BUFFER, STREAM_SLOW_CONSUMER_POLICY, and
+// STREAM_BLOCK_TIMEOUT (a duration) over the defaults
+func StreamConfigFromEnv() (StreamConfig, error) {
+	cfg := DefaultStreamConfig()
+	if v := os.Getenv("STREAM_BUFFER"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid STREAM_BUFFER %q", v)
+		}
+		cfg.Buffer = n
+	}
+	if v := os.Getenv("STREAM_SLOW_CONSUMER_POLICY"); v != "" {
+		policy, err := ParseSlowConsumerPolicy(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.Policy = policy
+	}
+	if v := os.Getenv("STREAM_BLOCK_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return cfg, fmt.Errorf("invalid STREAM_BLOCK_TIMEOUT %q", v)
+		}
+		cfg.BlockTimeout = timeout
+	}
+	return cfg, nil
+}
+
+// streamQueue buffers the events bound for one stream client. push is
+// called by publishers, the stream reads events, and done closes once the
+// client is cut off or its stream ends.
+type streamQueue struct {
+	cfg    StreamConfig
+	events chan BusEvent
+	// dropMu serializes DropOldest's make-room-then-send between
+	// concurrent publishers
+	dropMu sync.Mutex
+	done   chan struct{}
+	stop   sync.Once
+}
+
+func newStreamQueue(cfg StreamConfig) *streamQueue {
+	return &streamQueue{
+		cfg:    cfg,
+		events: make(chan BusEvent, cfg.Buffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// close marks the queue done, releasing any publisher blocked in push
+func (q *streamQueue) close() {
+	q.stop.Do(func() { close(q.done) })
+}
+
+// push queues event, applying the policy if the buffer is full. It reports
+// whether the client overflowed: an event was dropped or the client cut off.
+func (q *streamQueue) push(event BusEvent) (overflowed bool) {
+	select {
+	case <-q.done:
+		return false
+	case q.events <- event:
+		return false
+	default:
+	}
+
+	switch q.cfg.Policy {
+	case DropOldest:
+		q.dropMu.Lock()
+		defer q.dropMu.Unlock()
+		for {
+			select {
+			case q.events <- event:
+				return true
+			default:
+			}
+			select {
+			case <-q.events:
+			default:
+			}
+		}
+	case BlockWithTimeout:
+		timer := time.NewTimer(q.cfg.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case q.events <- event:
+			return false
+		case <-q.done:
+			return false
+		case <-timer.C:
+		}
+	}
+	q.close()
+	return true
+}
+
+// handleUserEvents handles GET /api/v1/users/events, streaming user changes
+// as server-sent events until the client disconnects, the server shuts
+// down, or the stream's slow consumer policy cuts the client off
+func (s *Server) handleUserEvents(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's WriteTimeout
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		FromContext(r.Context()).Error("Failed to clear stream write deadline", "error", err)
+	}
+
+	queue := newStreamQueue(s.stream)
+	topics := make([]Topic, 0, len(streamEvents))
+	for topic := range streamEvents {
+		topics = append(topics, topic)
+	}
+	unsubscribe := s.events.Listen(func(ctx context.Context, event BusEvent) {
+		if !queue.push(event) {
+			return
+		}
+		FromContext(r.Context()).Warn("Slow stream client overflowed its buffer",
+			"policy", s.stream.Policy, "topic", event.Topic)
+		if s.metrics != nil {
+			s.metrics.RecordSlowConsumer(ctx, s.stream.Policy)
+		}
+	}, topics...)
+	// Release blocked publishers before unsubscribing, which waits for them
+	defer unsubscribe()
+	defer queue.close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		FromContext(r.Context()).Error("Event stream cannot be flushed", "error", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(s.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		// Once cut off, stop even though buffered events remain
+		select {
+		case <-queue.done:
+			return
+		default:
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		case <-queue.done:
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event := <-queue.events:
+			data, err := json.Marshal(event.Payload)
+			if err != nil {
+				FromContext(r.Context()).Error("Failed to encode stream event", "topic", event.Topic, "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", streamEvents[event.Topic], data); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
 // handleGetUser handles GET /api/v1/users/{id}
 func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
@@ -129,20 +1942,45 @@ func (s *Server) handleGetUser(w http.ResponseWriter, r *http.Request) {
 	idStr := chi.URLParam(r, "id")
 	id, err := strconv.ParseInt(idStr, 10, 64)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		WriteProblem(w, http.StatusBadRequest, Problem{
+			Detail:   "Invalid user ID",
+			Instance: r.URL.Path,
+			Errors:   []FieldError{{Field: "id", Message: "must be an integer"}},
+		})
 		return
 	}
 	
 	// Get user
 	user, err := s.userService.GetUser(ctx, id)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		s.writeServiceError(w, r, err)
 		return
 	}
 	
 	// Return user
+	s.writeJSON(w, r, http.StatusOK, user)
+}
+
+// Envelope is the response shape when WithResponseEnvelope is on
+type Envelope struct {
+	Data interface{}  `json:"data"`
+	Meta EnvelopeMeta `json:"meta"`
+}
+
+// EnvelopeMeta describes the request an enveloped response answers
+type EnvelopeMeta struct {
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeJSON writes v as a JSON response with status, wrapped in an
+// Envelope if the server is configured to use one
+func (s *Server) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	if s.envelope {
+		v = Envelope{Data: v, Meta: EnvelopeMeta{RequestID: RequestIDFromContext(r.Context())}}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
 
 // CreateUserRequest represents the request body for creating a user
@@ -151,48 +1989,338 @@ type CreateUserRequest struct {
 	Email string `json:"email"`
 }
 
+// ValidationResult is the response to a request made with validate_only
+type ValidationResult struct {
+	Valid bool `json:"valid"`
+}
+
+// validateOnly reports whether the client asked, with ?validate_only=true,
+// for its request to be checked but not carried out
+func validateOnly(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("validate_only"))
+	return v
+}
+
 // handleCreateUser handles POST /api/v1/users
 func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	
 	// Parse request body
 	var req CreateUserRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if !decodeBody(w, r, &req) {
 		return
 	}
 	
 	// Validate input
-	if req.Name == "" || req.Email == "" {
-		http.Error(w, "Name and email are required", http.StatusBadRequest)
+	var violations []FieldError
+	if req.Name == "" {
+		violations = append(violations, FieldError{Field: "name", Message: "is required"})
+	}
+	if req.Email == "" {
+		violations = append(violations, FieldError{Field: "email", Message: "is required"})
+	}
+	if len(violations) > 0 {
+		WriteProblem(w, http.StatusBadRequest, Problem{
+			Detail:   "Name and email are required",
+			Instance: r.URL.Path,
+			Errors:   violations,
+		})
+		return
+	}
+
+	// ?validate_only=true checks the request without creating anything
+	if validateOnly(r) {
+		s.writeJSON(w, r, http.StatusOK, ValidationResult{Valid: true})
 		return
 	}
 	
 	// Create user
 	user, err := s.userService.CreateUser(ctx, req.Name, req.Email)
 	if err != nil {
-		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		s.writeServiceError(w, r, err)
 		return
 	}
+
+	s.recordAudit(ctx, "user.create", user.ID, nil, user)
+	s.publish(ctx, TopicUserCreated, user)
 	
 	// Return created user
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	s.writeJSON(w, r, http.StatusCreated, user)
+}
+
+// statusForError maps a service error to its HTTP status
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, ErrValidation):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrForbidden):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeServiceError writes err as a problem with the status it maps to.
+// Validation errors list their fields; unexpected errors are logged and
+// hidden from the client.
+func (s *Server) writeServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	status := statusForError(err)
+	if status == http.StatusInternalServerError {
+		FromContext(r.Context()).Error("Unexpected error", "error", err)
+		WriteProblem(w, status, Problem{Detail: "Internal server error", Instance: r.URL.Path})
+		return
+	}
+
+	problem := Problem{Detail: err.Error(), Instance: r.URL.Path}
+	var validation *ValidationError
+	if errors.As(err, &validation) {
+		problem.Errors = validation.Fields
+	}
+	WriteProblem(w, status, problem)
+}
+
+// decodeBody decodes the JSON request body into dst, writing a 400 problem
+// that says where the JSON is malformed or which field has the wrong type.
+// It reports whether decoding succeeded.
+func decodeBody(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+	raw, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = locateJSONError(raw, json.Unmarshal(raw, dst))
+	}
+	if err == nil {
+		return true
+	}
+
+	var tooLarge *http.MaxBytesError
+	var bodyErr *BodyError
+	problem := Problem{Detail: "Invalid request body", Instance: r.URL.Path}
+	switch {
+	case errors.As(err, &tooLarge):
+		problem.Detail = fmt.Sprintf("Request body exceeds %d bytes", tooLarge.Limit)
+		WriteProblem(w, http.StatusRequestEntityTooLarge, problem)
+		return false
+	case len(bytes.TrimSpace(raw)) == 0:
+		problem.Detail = "Request body is empty"
+	case errors.As(err, &bodyErr):
+		problem.Detail = "Invalid request body: " + bodyErr.Error()
+		if bodyErr.Field != "" {
+			problem.Errors = []FieldError{{Field: bodyErr.Field, Message: bodyErr.Message}}
+		}
+	}
+	WriteProblem(w, http.StatusBadRequest, problem)
+	return false
+}
+
+// BodyError locates a JSON decoding failure in a request body
+type BodyError struct {
+	Line    int
+	Column  int
+	Offset  int64
+	Field   string
+	Message string
+	Err     error
+}
+
+func (e *BodyError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("field %q %s at line %d, column %d", e.Field, e.Message, e.Line, e.Column)
+	}
+	return fmt.Sprintf("%s at line %d, column %d", e.Message, e.Line, e.Column)
+}
+
+func (e *BodyError) Unwrap() error { return e.Err }
+
+// locateJSONError wraps a syntax or type error from decoding raw in a
+// BodyError that says where it happened. Other errors are returned as is.
+func locateJSONError(raw []byte, err error) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		line, column := jsonPosition(raw, syntaxErr.Offset)
+		return &BodyError{Line: line, Column: column, Offset: syntaxErr.Offset, Message: syntaxErr.Error(), Err: err}
+	case errors.As(err, &typeErr):
+		line, column := jsonPosition(raw, typeErr.Offset)
+		message := fmt.Sprintf("must be %s, got %s", typeErr.Type, typeErr.Value)
+		if typeErr.Field == "" {
+			message = "body must be a JSON object, got " + typeErr.Value
+		}
+		return &BodyError{Line: line, Column: column, Offset: typeErr.Offset, Field: typeErr.Field, Message: message, Err: err}
+	}
+	return err
+}
+
+// jsonPosition converts a byte offset reported by encoding/json into a
+// 1-based line and column. The decoder reports the offset just past the
+// offending byte, which makes it that byte's column.
+func jsonPosition(raw []byte, offset int64) (line, column int) {
+	if offset > int64(len(raw)) {
+		offset = int64(len(raw))
+	}
+	prefix := raw[:offset]
+	line = 1 + bytes.Count(prefix, []byte("\n"))
+	column = len(prefix) - (bytes.LastIndexByte(prefix, '\n') + 1)
+	return line, column
+}
+
+// recordAudit writes an audit record if an AuditLogger is configured.
+// Audit failures are logged but never fail the request.
+func (s *Server) recordAudit(ctx context.Context, action string, targetID int64, before, after interface{}) {
+	if s.audit == nil {
+		return
+	}
+
+	record := AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Actor:     ActorFromContext(ctx),
+		Action:    action,
+		TargetID:  strconv.FormatInt(targetID, 10),
+		Before:    before,
+		After:     after,
+	}
+	if err := s.audit.Log(ctx, record); err != nil {
+		FromContext(ctx).Error("Failed to write audit record", "action", action, "target_id", targetID, "error", err)
+	}
+}
+
+// publish sends an event to the bus if one is configured. Publish failures
+// are logged but never fail the request.
+func (s *Server) publish(ctx context.Context, topic Topic, payload interface{}) {
+	if s.events == nil {
+		return
+	}
+	if err := s.events.Publish(ctx, topic, payload); err != nil {
+		FromContext(ctx).Error("Failed to publish event", "topic", topic, "error", err)
+	}
 }
 
-// Shutdown gracefully shuts down the server
+// Shutdown gracefully shuts down the server, then drains the event bus so
+// events published by the last requests are still handled
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Info("Starting graceful shutdown")
-	return s.http.Shutdown(ctx)
+	if err := s.http.Shutdown(ctx); err != nil {
+		return err
+	}
+	if s.events != nil {
+		return s.events.Drain(ctx)
+	}
+	return nil
 }
 
 func main() {
 	// Create logger
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	// FromContext falls back to the default outside requests
+	slog.SetDefault(logger)
 	
 	// Create server
-	srv := NewServer(":8080", logger)
+	middlewareConfig, err := MiddlewareConfigFromEnv()
+	if err != nil {
+		logger.Error("Invalid middleware configuration", "error", err)
+		os.Exit(1)
+	}
+	opts := []ServerOption{
+		WithMiddlewareConfig(middlewareConfig),
+	}
+	if path := os.Getenv("AUDIT_LOG_PATH"); path != "" {
+		rotation, err := AuditRotationFromEnv()
+		if err != nil {
+			logger.Error("Invalid audit log rotation", "error", err)
+			os.Exit(1)
+		}
+		auditLogger, err := NewJSONLAuditLogger(path, WithAuditRotation(rotation))
+		if err != nil {
+			logger.Error("Failed to open audit log", "error", err)
+			os.Exit(1)
+		}
+		defer auditLogger.Close()
+		opts = append(opts, WithAuditLogger(auditLogger))
+	}
+
+	if v := os.Getenv("API_ROLES"); v != "" {
+		roles, err := ParseRoles(v)
+		if err != nil {
+			logger.Error("Invalid API_ROLES", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, WithAuthorizer(&RoleAuthorizer{Roles: roles, Grants: DefaultGrants}))
+	}
+
+	streamConfig, err := StreamConfigFromEnv()
+	if err != nil {
+		logger.Error("Invalid event stream configuration", "error", err)
+		os.Exit(1)
+	}
+	opts = append(opts, WithStreamConfig(streamConfig))
+
+	if v := os.Getenv("RESPONSE_ENVELOPE"); v != "" {
+		envelope, err := strconv.ParseBool(v)
+		if err != nil {
+			logger.Error("Invalid RESPONSE_ENVELOPE", "value", v)
+			os.Exit(1)
+		}
+		opts = append(opts, WithResponseEnvelope(envelope))
+	}
+
+	if v := os.Getenv("LOG_SAMPLE_RATE"); v != "" {
+		sampleRate, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Error("Invalid LOG_SAMPLE_RATE", "value", v)
+			os.Exit(1)
+		}
+		opts = append(opts, WithLogSampler(NewLogSampler(sampleRate, time.Second)))
+	}
+
+	// Side effects of user writes run off the request path
+	events := NewEventBus(256, 4)
+	events.SubscribeAsync(TopicUserCreated, func(ctx context.Context, event BusEvent) {
+		logger.Info("User created event", "topic", event.Topic, "timestamp", event.Timestamp)
+	})
+	opts = append(opts, WithEventBus(events))
+
+	opts = append(opts, WithTracer(NewTracer(func(span *Span) {
+		logger.Debug("span finished",
+			"name", span.Name,
+			"trace_id", span.Context.TraceID,
+			"span_id", span.Context.SpanID,
+			"parent_span_id", span.Parent.SpanID,
+			"duration", span.EndTime.Sub(span.Start),
+		)
+	})))
+
+	// METRICS_BACKEND=otlp pushes request metrics to an OpenTelemetry
+	// collector instead of exposing them to Prometheus
+	switch backend := os.Getenv("METRICS_BACKEND"); backend {
+	case "", "prometheus":
+		metrics, err := NewPrometheusMetricsRecorder(prometheus.DefaultRegisterer)
+		if err != nil {
+			logger.Error("Failed to register metrics", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, WithMetrics(metrics))
+	case "otlp":
+		provider, err := newOTLPMeterProvider(context.Background())
+		if err != nil {
+			logger.Error("Failed to create OTLP exporter", "error", err)
+			os.Exit(1)
+		}
+		defer provider.Shutdown(context.Background())
+		metrics, err := NewOTelMetricsRecorder(provider.Meter("http-server"))
+		if err != nil {
+			logger.Error("Failed to create metrics", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, WithMetrics(metrics))
+	default:
+		logger.Error("Invalid METRICS_BACKEND, want prometheus or otlp", "value", backend)
+		os.Exit(1)
+	}
+
+	srv := NewServer(":8080", logger, opts...)
 	
 	// Start server in goroutine
 	go func() {
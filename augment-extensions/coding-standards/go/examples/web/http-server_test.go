@@ -0,0 +1,1158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// newTestServer creates a server whose logs are discarded
+func newTestServer(t *testing.T, opts ...ServerOption) *Server {
+	t.Helper()
+	return NewServer(":0", slog.New(slog.NewTextHandler(io.Discard, nil)), opts...)
+}
+
+// serve runs a request through the server's handler
+func serve(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if body != "" {
+		req = httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+	rec := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestDeterministicIDGeneratorOrder(t *testing.T) {
+	want := []int64{5075978916318951774, 5075977267051509458, 5075977816807323563}
+	ids := NewDeterministicIDGenerator("test")
+	s := newTestServer(t, WithIDGenerator(ids))
+
+	for i, id := range want {
+		body := fmt.Sprintf(`{"name":"user%d","email":"user%d@example.com"}`, i, i)
+		rec := serve(s, "POST", "/api/v1/users", body)
+		if rec.Code != http.StatusCreated {
+			t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+		}
+		var created User
+		json.NewDecoder(rec.Body).Decode(&created)
+		if created.ID != id {
+			t.Errorf("user %d ID = %d, want %d", i, created.ID, id)
+		}
+	}
+
+	ids.Reset()
+	if got := ids.NewID(); got != want[0] {
+		t.Errorf("after Reset NewID() = %d, want %d", got, want[0])
+	}
+}
+
+func TestDefaultIDsAreSequential(t *testing.T) {
+	s := newTestServer(t)
+	for i, want := range []int64{1, 2} {
+		body := fmt.Sprintf(`{"name":"user%d","email":"user%d@example.com"}`, i, i)
+		rec := serve(s, "POST", "/api/v1/users", body)
+		var created User
+		json.NewDecoder(rec.Body).Decode(&created)
+		if created.ID != want {
+			t.Errorf("user %d ID = %d, want %d", i, created.ID, want)
+		}
+	}
+}
+
+func TestRequestIDAdoptedOrGenerated(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "edge-req-42")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if seen != "edge-req-42" || rec.Header().Get(requestIDHeader) != "edge-req-42" {
+		t.Errorf("inbound ID: context %q, response header %q; want edge-req-42", seen, rec.Header().Get(requestIDHeader))
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "bad id\n")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if seen == "" || seen == "bad id\n" || rec.Header().Get(requestIDHeader) != seen {
+		t.Errorf("invalid inbound ID: context %q, response header %q; want a fresh matching ID", seen, rec.Header().Get(requestIDHeader))
+	}
+}
+
+func TestErrorsAreProblemDetails(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantFields []string
+	}{
+		{"missing user", "GET", "/api/v1/users/42", "", http.StatusNotFound, nil},
+		{"bad id", "GET", "/api/v1/users/abc", "", http.StatusBadRequest, []string{"id"}},
+		{"missing fields", "POST", "/api/v1/users", `{}`, http.StatusBadRequest, []string{"name", "email"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(s, tt.method, tt.target, tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", ct)
+			}
+
+			var problem Problem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Type != "about:blank" || problem.Title != http.StatusText(tt.wantStatus) ||
+				problem.Status != tt.wantStatus || problem.Detail == "" || problem.Instance != tt.target {
+				t.Errorf("problem = %+v, missing required fields", problem)
+			}
+
+			var fields []string
+			for _, f := range problem.Errors {
+				fields = append(fields, f.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.wantFields) {
+				t.Errorf("error fields = %v, want %v", fields, tt.wantFields)
+			}
+		})
+	}
+}
+
+func TestSlowRequestReportedAboveThreshold(t *testing.T) {
+	var reported []SlowRequest
+	s := newTestServer(t, WithSlowRequestThreshold(20*time.Millisecond, func(slow SlowRequest) {
+		reported = append(reported, slow)
+	}))
+
+	handler := s.slowRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(40 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	for _, path := range []string{"/fast", "/slow"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	if len(reported) != 1 {
+		t.Fatalf("reported %d slow requests, want 1: %+v", len(reported), reported)
+	}
+	got := reported[0]
+	if got.Route != "/slow" || got.Status != http.StatusAccepted || got.Duration < 40*time.Millisecond {
+		t.Errorf("reported %+v, want /slow with 202 and >= 40ms", got)
+	}
+}
+
+func TestCreatePublishesUserCreated(t *testing.T) {
+	bus := NewEventBus(8, 1)
+	var events []BusEvent
+	bus.Subscribe(TopicUserCreated, func(ctx context.Context, event BusEvent) {
+		events = append(events, event)
+	})
+	s := newTestServer(t, WithEventBus(bus))
+
+	rec := serve(s, "POST", "/api/v1/users", `{"name":"jane","email":"jane@example.com"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("published %d events, want 1", len(events))
+	}
+	if user, ok := events[0].Payload.(*User); !ok || user.Email != "jane@example.com" {
+		t.Errorf("payload = %#v, want the created user", events[0].Payload)
+	}
+	if err := bus.Drain(context.Background()); err != nil {
+		t.Errorf("Drain() error = %v", err)
+	}
+}
+
+func TestConcurrentCreatesGetUniqueIDs(t *testing.T) {
+	service := NewUserService(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	const n = 200
+
+	var wg sync.WaitGroup
+	ids := make([]int64, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, err := service.CreateUser(context.Background(), "user", fmt.Sprintf("user%d@example.com", i))
+			if err != nil {
+				t.Errorf("CreateUser() error = %v", err)
+				return
+			}
+			ids[i] = user.ID
+		}(i)
+	}
+	wg.Wait()
+
+	// Sequential IDs under concurrency must be exactly 1..n
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("sorted IDs[%d] = %d, want %d (duplicate or gap)", i, id, i+1)
+		}
+	}
+}
+
+func TestTimeoutJSONAnswers504(t *testing.T) {
+	cancelled := make(chan struct{})
+	handler := TimeoutJSON(20 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+		w.Write([]byte("too late"))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/slow", nil))
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+	var problem Problem
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	if problem.Code != "request_timeout" || problem.Status != http.StatusGatewayTimeout {
+		t.Errorf("problem = %+v, want request_timeout with status 504", problem)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("handler context was not cancelled")
+	}
+}
+
+// stallingAuthorizer holds every request until its context ends
+type stallingAuthorizer struct{}
+
+func (stallingAuthorizer) Authorize(ctx context.Context, action, resource string) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRequestTimeoutBeatsWriteTimeout(t *testing.T) {
+	s := newTestServer(t, WithWriteTimeout(300*time.Millisecond), WithAuthorizer(stallingAuthorizer{}))
+	ts := httptest.NewUnstartedServer(s.http.Handler)
+	ts.Config = s.http
+	ts.Start()
+	defer ts.Close()
+
+	resp, err := http.Post(ts.URL+"/api/v1/users", "application/json", strings.NewReader(`{"name":"Jane","email":"jane@example.com"}`))
+	if err != nil {
+		t.Fatalf("request failed before the 504 arrived: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var problem Problem
+	if err := json.NewDecoder(resp.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusGatewayTimeout || problem.Code != "request_timeout" {
+		t.Errorf("got %d %+v, want a 504 request_timeout problem", resp.StatusCode, problem)
+	}
+}
+
+func TestTimeoutJSONPassesFastResponses(t *testing.T) {
+	handler := TimeoutJSON(time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Handled", "yes")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/", nil))
+	if rec.Code != http.StatusCreated || rec.Body.String() != "done" || rec.Header().Get("X-Handled") != "yes" {
+		t.Errorf("response = %d %q (X-Handled %q), want the handler's own", rec.Code, rec.Body, rec.Header().Get("X-Handled"))
+	}
+}
+
+func TestSampledLoggerAlwaysLogsErrors(t *testing.T) {
+	var logs bytes.Buffer
+	sampler := NewLogSampler(0, 0)
+	s := NewServer(":0", slog.New(slog.NewTextHandler(&logs, nil)), WithLogSampler(sampler))
+
+	serve(s, "GET", "/health", "")
+	if strings.Contains(logs.String(), "request completed") {
+		t.Errorf("2xx request logged at sample rate 0:\n%s", logs.String())
+	}
+
+	serve(s, "GET", "/api/v1/users/404", "")
+	if !strings.Contains(logs.String(), "status=404") {
+		t.Errorf("404 request not logged:\n%s", logs.String())
+	}
+
+	// The rate applies to requests served after the change
+	sampler.SetRate(1)
+	logs.Reset()
+	serve(s, "GET", "/health", "")
+	if !strings.Contains(logs.String(), "status=200") {
+		t.Errorf("2xx request not logged at sample rate 1:\n%s", logs.String())
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		sc, ok := ParseTraceparent(tt.value)
+		if ok != tt.ok {
+			t.Errorf("ParseTraceparent(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+		}
+		if ok && tt.value[:2] == "00" && sc.Traceparent() != tt.value {
+			t.Errorf("Traceparent() = %q, want round trip of %q", sc.Traceparent(), tt.value)
+		}
+	}
+}
+
+func TestInboundTraceparentMakesChildSpan(t *testing.T) {
+	const remote = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	parent, _ := ParseTraceparent(remote)
+	var spans []*Span
+	s := newTestServer(t, WithTracer(NewTracer(func(span *Span) { spans = append(spans, span) })))
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("traceparent", remote)
+	s.http.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	if spans[0].Parent != parent {
+		t.Errorf("span parent = %+v, want %+v", spans[0].Parent, parent)
+	}
+	if spans[0].Context.TraceID != parent.TraceID || spans[0].Context.SpanID == parent.SpanID {
+		t.Errorf("span context = %+v, want a new span in trace %s", spans[0].Context, parent.TraceID)
+	}
+}
+
+func TestInflatedContentLengthRejected(t *testing.T) {
+	s := newTestServer(t, WithMaxBodyBytes(1024))
+
+	req := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"name":"jane","email":"jane@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = 1 << 30
+	rec := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+
+	if rec := serve(s, "POST", "/api/v1/users", `{"name":"jane","email":"jane@example.com"}`); rec.Code != http.StatusCreated {
+		t.Errorf("small body = %d, want 201: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestBodyErrorsNameTheirPosition(t *testing.T) {
+	s := newTestServer(t)
+
+	tests := []struct {
+		name       string
+		body       string
+		wantDetail string
+		wantField  string
+	}{
+		{
+			"trailing comma",
+			"{\n  \"name\": \"jane\",\n  \"email\": \"jane@example.com\",\n}",
+			"at line 4, column 1",
+			"",
+		},
+		{
+			"type mismatch",
+			"{\n  \"name\": 42,\n  \"email\": \"jane@example.com\"\n}",
+			`field "name" must be string, got number at line 2, column 12`,
+			"name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(s, "POST", "/api/v1/users", tt.body)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", rec.Code)
+			}
+			var problem Problem
+			json.NewDecoder(rec.Body).Decode(&problem)
+			if !strings.Contains(problem.Detail, tt.wantDetail) {
+				t.Errorf("detail = %q, want it to contain %q", problem.Detail, tt.wantDetail)
+			}
+			if tt.wantField != "" && (len(problem.Errors) != 1 || problem.Errors[0].Field != tt.wantField) {
+				t.Errorf("errors = %v, want one for %s", problem.Errors, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"not found", newError(ErrNotFound, "user %s not found", "1"), http.StatusNotFound},
+		{"wrapped conflict", fmt.Errorf("creating: %w", newError(ErrConflict, "email taken")), http.StatusConflict},
+		{"validation", &ValidationError{Fields: []FieldError{{Field: "email", Message: "is required"}}}, http.StatusBadRequest},
+		{"unexpected", errors.New("disk on fire"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statusForError(tt.err); got != tt.want {
+				t.Errorf("statusForError(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddlewareConfigSelectsMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        MiddlewareConfig
+		wantGzip   bool
+		wantCORS   bool
+		wantStatus int
+	}{
+		{"defaults", DefaultMiddlewareConfig(), true, false, http.StatusCreated},
+		{"all off", MiddlewareConfig{}, false, false, http.StatusCreated},
+		{"cors", MiddlewareConfig{CORS: true, CORSOrigins: []string{"https://app.example"}}, false, true, http.StatusCreated},
+		{"auth", MiddlewareConfig{Auth: true, AuthTokens: map[string]string{"secret": "ci"}}, false, false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, WithMiddlewareConfig(tt.cfg))
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/users", strings.NewReader(`{"name":"Jane","email":"jane@example.com"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept-Encoding", "gzip")
+			req.Header.Set("Origin", "https://app.example")
+			rec := httptest.NewRecorder()
+			s.http.Handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Errorf("gzipped = %v, want %v", got, tt.wantGzip)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin") != ""; got != tt.wantCORS {
+				t.Errorf("CORS allowed = %v, want %v", got, tt.wantCORS)
+			}
+		})
+	}
+}
+
+func TestMiddlewareConfigFromEnv(t *testing.T) {
+	t.Setenv("MIDDLEWARE_COMPRESS", "false")
+	t.Setenv("MIDDLEWARE_CORS", "true")
+	t.Setenv("CORS_ORIGINS", "https://a.example, https://b.example")
+	t.Setenv("API_TOKENS", "t1=alice")
+
+	cfg, err := MiddlewareConfigFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MiddlewareConfig{
+		Logger:      true,
+		CORS:        true,
+		CORSOrigins: []string{"https://a.example", "https://b.example"},
+		AuthTokens:  map[string]string{"t1": "alice"},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config = %+v, want %+v", cfg, want)
+	}
+
+	t.Setenv("MIDDLEWARE_AUTH", "maybe")
+	if _, err := MiddlewareConfigFromEnv(); err == nil {
+		t.Error("invalid MIDDLEWARE_AUTH accepted")
+	}
+}
+
+// listeners counts the bus subscribers for topic
+func listeners(bus *EventBus, topic Topic) int {
+	bus.mu.RLock()
+	defer bus.mu.RUnlock()
+	return len(bus.subs[topic])
+}
+
+func TestUserEventsStream(t *testing.T) {
+	bus := NewEventBus(8, 1)
+	s := newTestServer(t, WithEventBus(bus), WithStreamHeartbeat(20*time.Millisecond))
+	ts := httptest.NewServer(s.http.Handler)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/v1/users/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	next := func(want string) {
+		t.Helper()
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					t.Fatalf("stream ended before %q", want)
+				}
+				if strings.HasPrefix(line, want) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no %q line in time", want)
+			}
+		}
+	}
+
+	// Headers are sent after the stream subscribes, so the create is seen
+	create, err := http.Post(ts.URL+"/api/v1/users", "application/json",
+		strings.NewReader(`{"name":"jane","email":"jane@example.com"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	create.Body.Close()
+	next("event: created")
+	next(`data: {"id":`)
+	next(": heartbeat")
+
+	resp.Body.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for listeners(bus, TopicUserCreated) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream still subscribed after the client disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for range lines {
+	}
+}
+
+func TestStreamQueuePolicies(t *testing.T) {
+	tests := []struct {
+		policy         SlowConsumerPolicy
+		wantOverflowed []bool
+		wantQueued     []int
+		wantCutOff     bool
+	}{
+		{DropOldest, []bool{false, false, true, true}, []int{3, 4}, false},
+		{Disconnect, []bool{false, false, true, false}, []int{1, 2}, true},
+		{BlockWithTimeout, []bool{false, false, true, false}, []int{1, 2}, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			// Nobody reads: the slowest possible consumer
+			q := newStreamQueue(StreamConfig{Buffer: 2, Policy: tt.policy, BlockTimeout: 10 * time.Millisecond})
+			var overflowed []bool
+			for i := 1; i <= 4; i++ {
+				overflowed = append(overflowed, q.push(BusEvent{Payload: i}))
+			}
+			if !reflect.DeepEqual(overflowed, tt.wantOverflowed) {
+				t.Errorf("overflowed = %v, want %v", overflowed, tt.wantOverflowed)
+			}
+
+			var queued []int
+			for len(q.events) > 0 {
+				queued = append(queued, (<-q.events).Payload.(int))
+			}
+			if !reflect.DeepEqual(queued, tt.wantQueued) {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+			select {
+			case <-q.done:
+				if !tt.wantCutOff {
+					t.Error("client cut off, want it kept")
+				}
+			default:
+				if tt.wantCutOff {
+					t.Error("client kept, want it cut off")
+				}
+			}
+		})
+	}
+}
+
+func TestBlockWithTimeoutWaitsForSlowReader(t *testing.T) {
+	q := newStreamQueue(StreamConfig{Buffer: 1, Policy: BlockWithTimeout, BlockTimeout: 2 * time.Second})
+	q.push(BusEvent{Payload: 1})
+
+	// A reader that catches up within the timeout keeps its stream
+	time.AfterFunc(20*time.Millisecond, func() { <-q.events })
+	start := time.Now()
+	if q.push(BusEvent{Payload: 2}) {
+		t.Fatal("push overflowed, want it to wait for the reader")
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Errorf("push returned after %v, want it to block until the read", waited)
+	}
+
+	// Ending the stream releases a blocked publisher at once
+	time.AfterFunc(20*time.Millisecond, q.close)
+	start = time.Now()
+	q.push(BusEvent{Payload: 3})
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("push blocked %v after the stream ended", waited)
+	}
+}
+
+// stalledWriter is a stream client that stops reading: writes block until
+// release is closed
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestSlowStreamClientIsCutOff(t *testing.T) {
+	recorder, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewEventBus(8, 1)
+	s := newTestServer(t, WithEventBus(bus), WithMetrics(recorder),
+		WithStreamConfig(StreamConfig{Buffer: 2, Policy: Disconnect}))
+
+	w := &stalledWriter{ResponseRecorder: httptest.NewRecorder(), release: make(chan struct{})}
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		s.http.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/users/events", nil))
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for listeners(bus, TopicUserCreated) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream never subscribed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// One event stalls in the write, two fill the buffer, and the rest
+	// overflow it
+	for i := 0; i < 5; i++ {
+		bus.Publish(context.Background(), TopicUserCreated, map[string]int{"id": i})
+	}
+	close(w.release)
+
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Fatal("slow stream still open, want it cut off")
+	}
+	if got := testutil.ToFloat64(recorder.slowConsumers.WithLabelValues(string(Disconnect))); got != 1 {
+		t.Errorf("slow consumers{disconnect} = %v, want 1", got)
+	}
+	if n := listeners(bus, TopicUserCreated); n != 0 {
+		t.Errorf("%d listeners after the cut-off, want 0", n)
+	}
+}
+
+func TestStreamConfigFromEnv(t *testing.T) {
+	t.Setenv("STREAM_BUFFER", "8")
+	t.Setenv("STREAM_SLOW_CONSUMER_POLICY", "block_with_timeout")
+	t.Setenv("STREAM_BLOCK_TIMEOUT", "250ms")
+	cfg, err := StreamConfigFromEnv()
+	want := StreamConfig{Buffer: 8, Policy: BlockWithTimeout, BlockTimeout: 250 * time.Millisecond}
+	if err != nil || cfg != want {
+		t.Errorf("StreamConfigFromEnv() = %+v, %v, want %+v", cfg, err, want)
+	}
+
+	t.Setenv("STREAM_SLOW_CONSUMER_POLICY", "drop_newest")
+	if _, err := StreamConfigFromEnv(); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestPrometheusMetricsRecorder(t *testing.T) {
+	recorder, err := NewPrometheusMetricsRecorder(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithMetrics(recorder))
+
+	if rec := serve(s, "POST", "/api/v1/users", `{"name":"jane","email":"jane@example.com"}`); rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+	serve(s, "GET", "/api/v1/users/1", "")
+	serve(s, "GET", "/api/v1/users/2", "")
+	serve(s, "GET", "/no/such/path", "")
+
+	tests := []struct {
+		method, route, status string
+	}{
+		{"POST", "/api/v1/users", "201"},
+		{"GET", "/api/v1/users/{id}", "200"},
+		{"GET", "/api/v1/users/{id}", "404"},
+		{"GET", "unmatched", "404"},
+	}
+	for _, tt := range tests {
+		if got := testutil.ToFloat64(recorder.requests.WithLabelValues(tt.method, tt.route, tt.status)); got != 1 {
+			t.Errorf("requests{%s %s %s} = %v, want 1", tt.method, tt.route, tt.status, got)
+		}
+	}
+	if n := testutil.CollectAndCount(recorder.errors); n != 0 {
+		t.Errorf("error series = %d, want client errors not counted", n)
+	}
+	if rec := serve(s, "GET", "/metrics", ""); rec.Code != http.StatusOK {
+		t.Errorf("GET /metrics = %d, want 200", rec.Code)
+	}
+}
+
+func TestOTelMetricsRecorderCountsServerErrors(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	recorder, err := NewOTelMetricsRecorder(provider.Meter("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, WithMetrics(recorder))
+
+	r := chi.NewRouter()
+	r.Use(s.recordMetrics)
+	r.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "id") == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	for _, target := range []string{"/items/1", "/items/broken"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]metricdata.Aggregation)
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			got[m.Name] = m.Data
+		}
+	}
+
+	count := func(name string) int64 {
+		data, ok := got[name].(metricdata.Sum[int64])
+		if !ok {
+			t.Fatalf("%s = %T, want an int64 sum", name, got[name])
+		}
+		var total int64
+		for _, dp := range data.DataPoints {
+			if route, _ := dp.Attributes.Value(attribute.Key("http.route")); route.AsString() != "/items/{id}" {
+				t.Errorf("%s route = %q, want the pattern", name, route.AsString())
+			}
+			total += dp.Value
+		}
+		return total
+	}
+	if n := count("http.server.request.count"); n != 2 {
+		t.Errorf("request count = %d, want 2", n)
+	}
+	if n := count("http.server.request.errors"); n != 1 {
+		t.Errorf("error count = %d, want 1", n)
+	}
+	if _, ok := got["http.server.request.duration"].(metricdata.Histogram[float64]); !ok {
+		t.Errorf("duration = %T, want a float64 histogram", got["http.server.request.duration"])
+	}
+}
+
+// failingAuditLogger rejects every record
+type failingAuditLogger struct{}
+
+func (failingAuditLogger) Log(ctx context.Context, record AuditRecord) error {
+	return errors.New("audit store unavailable")
+}
+
+func TestContextLoggerCarriesRequestFields(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	s := NewServer(":0", logger,
+		WithAuditLogger(failingAuditLogger{}),
+		WithMiddlewareConfig(MiddlewareConfig{Auth: true, AuthTokens: map[string]string{"secret": "alice"}}),
+	)
+
+	req := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"name":"jane","email":"jane@example.com"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set(requestIDHeader, "edge-req-42")
+	rec := httptest.NewRecorder()
+	s.http.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry isn't JSON: %v\n%s", err, logs.String())
+	}
+	want := map[string]interface{}{
+		"msg":        "Failed to write audit record",
+		"request_id": "edge-req-42",
+		"method":     "POST",
+		"path":       "/api/v1/users",
+		"actor":      "alice",
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s = %v, want %v", key, entry[key], value)
+		}
+	}
+}
+
+func TestRoleAuthorizerGuardsCreate(t *testing.T) {
+	s := newTestServer(t,
+		WithMiddlewareConfig(MiddlewareConfig{Auth: true, AuthTokens: map[string]string{"editor-token": "bob", "viewer-token": "carol"}}),
+		WithAuthorizer(&RoleAuthorizer{
+			Roles:  map[string]string{"bob": "editor", "carol": "viewer"},
+			Grants: DefaultGrants,
+		}),
+	)
+
+	create := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(`{"name":"jane","email":"jane@example.com"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := create("viewer-token"); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer create = %d, want 403: %s", rec.Code, rec.Body)
+	}
+	if rec := create("editor-token"); rec.Code != http.StatusCreated {
+		t.Errorf("editor create = %d, want 201: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRoleAuthorizerDeniesDeleteToNonAdmins(t *testing.T) {
+	authorizer := &RoleAuthorizer{
+		Roles:  map[string]string{"alice": "admin", "bob": "editor"},
+		Grants: DefaultGrants,
+	}
+	if err := authorizer.Authorize(WithActor(context.Background(), "bob"), ActionDeleteUser, "users/1"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("editor delete = %v, want ErrForbidden", err)
+	}
+	if err := authorizer.Authorize(WithActor(context.Background(), "alice"), ActionDeleteUser, "users/1"); err != nil {
+		t.Errorf("admin delete = %v, want allowed", err)
+	}
+}
+
+// auditLines reads every JSON line from the audit log at path and its
+// backups, failing on any line that doesn't decode
+func auditLines(t *testing.T, path string) int {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(filepath.Dir(path), "*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines int
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if line == "" {
+				continue
+			}
+			var record AuditRecord
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("%s: torn line %q: %v", name, line, err)
+			}
+			lines++
+		}
+	}
+	return lines
+}
+
+func TestJSONLAuditLoggerRotatesBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxSize: 1024}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				record := AuditRecord{Actor: "alice", Action: "user.update", TargetID: fmt.Sprintf("%d-%d", i, j)}
+				if err := l.Log(context.Background(), record); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) == 0 {
+		t.Fatal("no backups after writing past MaxSize")
+	}
+	for _, name := range append(backups, path) {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 1024 {
+			t.Errorf("%s is %d bytes, want at most 1024", name, info.Size())
+		}
+	}
+	if n := auditLines(t, path); n != 200 {
+		t.Errorf("found %d records across files, want all 200", n)
+	}
+}
+
+func TestJSONLAuditLoggerPrunesOldBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxSize: 1, MaxBackups: 2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// MaxSize 1 rotates before every record after the first
+	for i := 0; i < 5; i++ {
+		if err := l.Log(context.Background(), AuditRecord{Action: "user.create", TargetID: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backups, err := l.backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("backups = %v, want the newest 2", backups)
+	}
+	for i, name := range backups {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Records 0 through 2 were pruned; 3 is current
+		if want := fmt.Sprintf(`"target_id":"%d"`, i+2); !strings.Contains(string(data), want) {
+			t.Errorf("backup %d = %s, want record %d", i, data, i+2)
+		}
+	}
+}
+
+func TestJSONLAuditLoggerRotatesByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l, err := NewJSONLAuditLogger(path, WithAuditRotation(AuditRotation{MaxAge: time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.now = func() time.Time { return now }
+	l.opened = now
+
+	write := func() {
+		if err := l.Log(context.Background(), AuditRecord{Action: "user.create"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	now = now.Add(59 * time.Minute)
+	write()
+	if backups, _ := l.backups(); len(backups) != 0 {
+		t.Fatalf("rotated before MaxAge: %v", backups)
+	}
+	now = now.Add(time.Minute)
+	write()
+	if backups, _ := l.backups(); len(backups) != 1 {
+		t.Errorf("backups after MaxAge = %v, want 1", backups)
+	}
+}
+
+func TestJSONLAuditLoggerLogAfterClose(t *testing.T) {
+	l, err := NewJSONLAuditLogger(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("second Close() = %v, want nil", err)
+	}
+	if err := l.Log(context.Background(), AuditRecord{}); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Log() after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestCreateUserValidateOnly(t *testing.T) {
+	s := newTestServer(t)
+
+	rec := serve(s, "POST", "/api/v1/users?validate_only=true", `{"name":"jane","email":"jane@example.com"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid dry run = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var result ValidationResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil || !result.Valid {
+		t.Errorf("result = %+v (%v), want valid", result, err)
+	}
+
+	rec = serve(s, "POST", "/api/v1/users?validate_only=true", `{"name":"jane"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid dry run = %d, want 400: %s", rec.Code, rec.Body)
+	}
+	var problem Problem
+	if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+		t.Fatal(err)
+	}
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "email" {
+		t.Errorf("errors = %+v, want one for email", problem.Errors)
+	}
+
+	s.userService.mu.RLock()
+	n := len(s.userService.users)
+	s.userService.mu.RUnlock()
+	if n != 0 {
+		t.Errorf("store holds %d users after dry runs, want 0", n)
+	}
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	// getUser creates Jane on a fresh server and fetches her back
+	getUser := func(t *testing.T, opts ...ServerOption) []byte {
+		t.Helper()
+		opts = append(opts, WithIDGenerator(NewDeterministicIDGenerator("test")))
+		s := newTestServer(t, opts...)
+		if rec := serve(s, "POST", "/api/v1/users", `{"name":"Jane","email":"jane@example.com"}`); rec.Code != http.StatusCreated {
+			t.Fatalf("create = %d: %s", rec.Code, rec.Body)
+		}
+
+		req := httptest.NewRequest("GET", "/api/v1/users/5075978916318951774", nil)
+		req.Header.Set(requestIDHeader, "req-123")
+		rec := httptest.NewRecorder()
+		s.http.Handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("get = %d: %s", rec.Code, rec.Body)
+		}
+		return rec.Body.Bytes()
+	}
+
+	raw := getUser(t)
+	enveloped := getUser(t, WithResponseEnvelope(true))
+
+	want := map[string][]string{
+		"raw":       {"created_at", "email", "id", "name"},
+		"enveloped": {"data", "meta"},
+	}
+	for name, body := range map[string][]byte{"raw": raw, "enveloped": enveloped} {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(body, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if got := fieldNames(fields); !reflect.DeepEqual(got, want[name]) {
+			t.Errorf("%s response has fields %v, want %v", name, got, want[name])
+		}
+	}
+
+	var rawUser User
+	var envelope struct {
+		Data User
+		Meta EnvelopeMeta
+	}
+	json.Unmarshal(raw, &rawUser)
+	json.Unmarshal(enveloped, &envelope)
+	if rawUser.ID == 0 || rawUser.ID != envelope.Data.ID || rawUser.Name != envelope.Data.Name || rawUser.Email != envelope.Data.Email {
+		t.Errorf("enveloped user = %+v, want the raw user %+v", envelope.Data, rawUser)
+	}
+	if envelope.Meta.RequestID != "req-123" {
+		t.Errorf("meta = %+v, want the request ID", envelope.Meta)
+	}
+}
+
+func TestEnvelopeLeavesProblemsBare(t *testing.T) {
+	s := newTestServer(t, WithResponseEnvelope(true))
+	rec := serve(s, "GET", "/api/v1/users/999", "")
+	var problem Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &problem); err != nil || problem.Status != http.StatusNotFound {
+		t.Errorf("problem = %s (%v), want a bare 404 problem", rec.Body, err)
+	}
+}
+
+// fieldNames returns the sorted top-level field names of a JSON object
+func fieldNames(object map[string]json.RawMessage) []string {
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
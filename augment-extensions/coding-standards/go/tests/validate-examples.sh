@@ -56,14 +56,48 @@ echo "--------------------------------"
 
 cd "$EXAMPLES_DIR"
 
-# Find all .go files
-GO_FILES=$(find . -name "*.go" -type f)
+# Group the examples into packages. A directory holding one program is
+# built as a whole, so an example may span several files. A directory of
+# standalone programs (several files with their own main) is built file by
+# file.
+PACKAGES=()
+for dir in $(find . -name "*.go" -type f ! -name "*_test.go" -exec dirname {} \; | sort -u); do
+    mains=$(grep -l "^func main()" "$dir"/*.go | grep -vc "_test\.go$" || true)
+    if [ "$mains" -le 1 ]; then
+        PACKAGES+=("$dir")
+    else
+        for file in "$dir"/*.go; do
+            case "$file" in
+                *_test.go) ;;
+                *) PACKAGES+=("$file") ;;
+            esac
+        done
+    fi
+done
 
-if [ -z "$GO_FILES" ]; then
+# package_sources lists the non-test files of a package
+package_sources() {
+    if [ -d "$1" ]; then
+        ls "$1"/*.go | grep -v "_test\.go$" | tr '\n' ' '
+    else
+        echo "$1"
+    fi
+}
+
+# package_tests lists the test files of a package
+package_tests() {
+    if [ -d "$1" ]; then
+        ls "$1"/*_test.go 2>/dev/null | tr '\n' ' '
+    elif [ -f "${1%.go}_test.go" ]; then
+        echo "${1%.go}_test.go"
+    fi
+}
+
+if [ ${#PACKAGES[@]} -eq 0 ]; then
     echo -e "${YELLOW}Warning: No .go files found in examples directory${NC}"
 else
-    for file in $GO_FILES; do
-        run_test "Compile $file" "go build -o /dev/null $file"
+    for pkg in "${PACKAGES[@]}"; do
+        run_test "Compile $pkg" "go build -o /dev/null $(package_sources "$pkg")"
     done
 fi
 
@@ -102,14 +136,27 @@ echo ""
 echo "🔧 GOL.4.3.4: Running go vet"
 echo "----------------------------"
 
-for file in $GO_FILES; do
-    run_test "go vet $file" "go vet $file"
+for pkg in "${PACKAGES[@]}"; do
+    run_test "go vet $pkg" "go vet $(package_sources "$pkg")"
+done
+
+echo ""
+
+# GOL.4.3.5: Run example tests
+echo "🧪 GOL.4.3.5: Running Example Tests"
+echo "-----------------------------------"
+
+for pkg in "${PACKAGES[@]}"; do
+    tests=$(package_tests "$pkg")
+    if [ -n "$tests" ]; then
+        run_test "go test $pkg" "go test $(package_sources "$pkg") $tests"
+    fi
 done
 
 echo ""
 
-# GOL.4.3.5: Manual review checklist
-echo "📋 GOL.4.3.5: Manual Review Checklist"
+# GOL.4.3.6: Manual review checklist
+echo "📋 GOL.4.3.6: Manual Review Checklist"
 echo "-------------------------------------"
 echo "  ✓ Examples demonstrate best practices"
 echo "  ✓ Examples include error handling"